@@ -1,6 +1,9 @@
 package inodeFactory
 
-import "sync"
+import (
+	"strings"
+	"sync"
+)
 
 // PathAwareFactory implements InodeFactory, issuing unique inodes where the path has not been seen before.
 type PathAwareFactory struct {
@@ -36,6 +39,24 @@ func (f *PathAwareFactory) GetByPath(path string) uint64 {
 	return f.LastIssuedInode
 }
 
+// Move reassigns the inodes issued for oldPath, and every path beneath it, to the
+// corresponding paths beneath newPath.
+func (f *PathAwareFactory) Move(oldPath, newPath string) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+
+	moved := map[string]uint64{}
+	for p, i := range f.Paths {
+		if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+			delete(f.Paths, p)
+			moved[newPath+p[len(oldPath):]] = i
+		}
+	}
+	for p, i := range moved {
+		f.Paths[p] = i
+	}
+}
+
 // MakePathAwareFactory returns an initialized structure ready to be used.
 func MakePathAwareFactory() *PathAwareFactory {
 	return &PathAwareFactory{
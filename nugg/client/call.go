@@ -3,12 +3,18 @@ package client
 import (
 	"crypto/rand"
 	"encoding/binary"
+
+	"github.com/twitchyliquid64/nugget/packet"
 )
 
 // Call represents an in-flight RPC.
 type Call struct {
 	id           uint64
 	responseChan chan interface{}
+
+	// set for calls which stream data: the credit for data sent, and the data received
+	window *packet.Window
+	buffer *packet.StreamBuffer
 }
 
 func (c *RemoteSource) dispatchCallResponse(id uint64, data interface{}) {
@@ -18,8 +24,13 @@ func (c *RemoteSource) dispatchCallResponse(id uint64, data interface{}) {
 	call, ok := c.pending[id]
 	if !ok {
 		c.logger.Warning("rpc-response", "Could not match RPC response ", id, " with tracked request")
-	} else {
-		call.responseChan <- data
+		return
+	}
+	select {
+	case call.responseChan <- data:
+	default:
+		// a response is already waiting, as the request was sent again after reconnecting
+		c.logger.Warning("rpc-response", "Dropping duplicate RPC response ", id)
 	}
 }
 
@@ -32,6 +43,37 @@ func (c *RemoteSource) registerRPC(ch chan interface{}) *Call {
 	return call
 }
 
+// registerStream tracks a call which streams data, so the StreamData and StreamAck packets for it can be
+// routed to it. ch should be buffered, as responses may arrive while the caller is sending data.
+func (c *RemoteSource) registerStream(ch chan interface{}, window *packet.Window, buffer *packet.StreamBuffer) *Call {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	id := getRandInt()
+	call := &Call{id: id, responseChan: ch, window: window, buffer: buffer}
+	c.pending[id] = call
+	return call
+}
+
+func (c *RemoteSource) findCall(id uint64) *Call {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	return c.pending[id]
+}
+
+// closeStreams ends the streams of every call with err, as the connection has failed.
+func (c *RemoteSource) closeStreams(err error) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	for _, call := range c.pending {
+		if call.window != nil {
+			call.window.Close()
+		}
+		if call.buffer != nil {
+			call.buffer.Close(err)
+		}
+	}
+}
+
 func (c *RemoteSource) unregisterRPC(call *Call) {
 	c.pendingLock.Lock()
 	defer c.pendingLock.Unlock()
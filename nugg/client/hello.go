@@ -0,0 +1,113 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// handshakeTimeout bounds the Hello exchange made when connecting.
+const handshakeTimeout = time.Second * 4
+
+// messageOverhead is the room left in each packet for fields other than file data, when data is split
+// to fit the largest message the server accepts.
+const messageOverhead = 4096
+
+var errNotHelloResp = errors.New("Expected a HelloResp in answer to Hello")
+
+// clientPackets are the request packet types a RemoteSource may send.
+var clientPackets = []packet.PktType{
+	packet.PktHello, packet.PktPing, packet.PktLookup, packet.PktReadMeta, packet.PktList, packet.PktListPage,
+	packet.PktFetch, packet.PktStore, packet.PktMkdir, packet.PktDelete, packet.PktRemoveAll, packet.PktWrite,
+	packet.PktRead, packet.PktCreate, packet.PktSetattr, packet.PktRename, packet.PktSymlink, packet.PktReadlink,
+	packet.PktLink, packet.PktGetxattr, packet.PktListxattr, packet.PktSetxattr, packet.PktRemovexattr,
+	packet.PktStatfs, packet.PktFetchStream, packet.PktStoreStream, packet.PktStreamData, packet.PktStreamAck,
+}
+
+// handshake exchanges Hello packets with the server, recording the protocol version, packet types and
+// limits it reports. It must complete before the read routine is started.
+func (s *session) handshake() error {
+	s.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer s.conn.SetDeadline(time.Time{})
+
+	err := s.transiever.WriteHello(&packet.Hello{Version: packet.ProtocolVersion, Packets: clientPackets})
+	if err != nil {
+		return err
+	}
+	pktType, err := s.transiever.Decode()
+	if err != nil {
+		return err
+	}
+	if pktType != packet.PktHelloResp {
+		return errNotHelloResp
+	}
+	var helloResp packet.HelloResp
+	if err = s.transiever.GetHelloResp(&helloResp); err != nil {
+		return err
+	}
+
+	s.version = helloResp.Version
+	s.maxMessageSize = helloResp.MaxMessageSize
+	s.maxListPageSize = helloResp.MaxListPageSize
+	s.packets = map[packet.PktType]bool{}
+	for _, pktType := range helloResp.Packets {
+		s.packets[pktType] = true
+	}
+	if s.version >= packet.FramedVersion {
+		s.transiever.UseFrames(s.maxMessageSize)
+	}
+	return nil
+}
+
+// rejectedHello returns true if err, from the Hello exchange, is how a server which predates it responds:
+// by dropping the connection, or answering with a packet other than HelloResp. Other errors, such as
+// timeouts, are not taken to mean the server is a legacy one.
+func rejectedHello(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, errNotHelloResp:
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNRESET || sysErr.Err == syscall.EPIPE
+		}
+	}
+	return false
+}
+
+// useLegacyProtocol assumes the server predates the Hello exchange, and so only handles the packet
+// types of the original protocol.
+func (s *session) useLegacyProtocol() {
+	s.version = 0
+	s.maxMessageSize = packet.DefaultMaxMessageSize
+	s.maxListPageSize = packet.MaxListPageSize
+	s.packets = map[packet.PktType]bool{}
+	for _, pktType := range packet.LegacyPackets {
+		s.packets[pktType] = true
+	}
+}
+
+// Supports returns true if the server handles requests of the given packet type.
+func (c *RemoteSource) Supports(pktType packet.PktType) bool {
+	return c.session().packets[pktType]
+}
+
+// ProtocolVersion returns the protocol version agreed with the server, or zero if the server predates
+// the Hello exchange.
+func (c *RemoteSource) ProtocolVersion() uint32 {
+	return c.session().version
+}
+
+// maxDataSize returns the most file data which may be sent in a single packet.
+func (c *RemoteSource) maxDataSize() int {
+	maxMessageSize := c.session().maxMessageSize
+	if maxMessageSize <= 2*messageOverhead {
+		return messageOverhead
+	}
+	return int(maxMessageSize - messageOverhead)
+}
@@ -9,42 +9,59 @@ import (
 	"github.com/twitchyliquid64/nugget/packet"
 )
 
+// keepAliveInterval is how often the server is pinged.
+const keepAliveInterval = time.Second * 2
+
+// deadConnectionTimeout is how long the server may go without answering a ping before the connection
+// is presumed dead and dropped, so that it is re-established.
+const deadConnectionTimeout = time.Second * 15
+
 // RemoteSource represents a nuggFS endpoint over
-// an authenticated network connection.
+// an authenticated network connection. If the connection
+// is lost, it is re-established in the background.
 type RemoteSource struct {
-	conn       *tls.Conn
-	transiever *packet.Transiever
-	logger     *logger.Logger
+	addr        string
+	certPemPath string
+	keyPemPath  string
+	caCertPath  string
+	logger      *logger.Logger
 
-	shouldRun bool           //set to true if routines should run
-	wg        sync.WaitGroup //tracks all routines
+	wg sync.WaitGroup //tracks all routines
 
-	onFatalChan chan error //if non-nil, fatal errors will be sent down it
-	fatal       error      //set if there was a fatal error on this RemoteSource
-
-	latency time.Duration //current latency - updated periodically by keepAliveRoutine
+	failFast bool //set if calls fail while disconnected, rather than waiting to reconnect
 
 	pendingLock sync.Mutex
 	pending     map[uint64]*Call
+
+	sessionLock sync.Mutex
+	current     *session      // the latest connection, which is down while reconnecting
+	reconnected chan struct{} // closed and replaced each time a connection is established
+	closed      bool          // set once Close is called, after which no connection is made
+	stop        chan struct{} // closed by Close, waking the routines so they exit
 }
 
 // Open starts a connection to the given nuggFS remote source using the
-// certificate paths provided.
-func Open(addr, certPemPath, keyPemPath, caCertPath string, l *logger.Logger, fatalErr chan error) (*RemoteSource, error) {
-	conn, err := connect(addr, certPemPath, keyPemPath, caCertPath)
-	if err != nil {
-		return nil, err
-	}
-
+// certificate paths provided. The protocol version, packet types and limits of the server are
+// negotiated with a Hello exchange; servers which predate it are spoken to with the original protocol.
+// Only the first connection must succeed: if it is later lost, it is re-established with backoff.
+func Open(addr, certPemPath, keyPemPath, caCertPath string, l *logger.Logger) (*RemoteSource, error) {
 	rs := &RemoteSource{
-		conn:        conn,
-		shouldRun:   true,
-		transiever:  packet.MakeTransiever(conn, conn),
+		addr:        addr,
+		certPemPath: certPemPath,
+		keyPemPath:  keyPemPath,
+		caCertPath:  caCertPath,
 		logger:      l,
-		onFatalChan: fatalErr,
 		pending:     map[uint64]*Call{},
+		reconnected: make(chan struct{}),
+		stop:        make(chan struct{}),
 	}
-	go rs.readServiceRoutine()
+	s, err := rs.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	rs.start(s)
+	rs.wg.Add(1)
 	go rs.keepAliveRoutine()
 	return rs, nil
 }
@@ -58,24 +75,36 @@ func connect(addr, certPemPath, keyPemPath, caCertPath string) (*tls.Conn, error
 	return conn, err
 }
 
+// SetFailFast sets whether calls made while the connection is down fail immediately with ErrDisconnected,
+// rather than waiting for it to be re-established. Calls wait by default.
+func (c *RemoteSource) SetFailFast(failFast bool) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	c.failFast = failFast
+}
+
 func (c *RemoteSource) keepAliveRoutine() {
-	c.wg.Add(1)
 	defer c.wg.Done()
-	for c.shouldRun {
-		c.ping()
-		time.Sleep(time.Second * 2)
+	for c.running() {
+		if s := c.session(); !s.isDown() {
+			if time.Since(s.lastPong()) > deadConnectionTimeout {
+				c.logger.Warning("net-keepalive", "No pong for ", deadConnectionTimeout, ", dropping the connection")
+				s.close()
+			} else if err := c.ping(s); err != nil {
+				s.close()
+			}
+		}
+		c.sleep(keepAliveInterval)
 	}
 }
 
-func (c *RemoteSource) readServiceRoutine() {
-	c.wg.Add(1)
+func (c *RemoteSource) readServiceRoutine(s *session) {
 	defer c.wg.Done()
 
-	for c.shouldRun {
-		pktType, err := c.transiever.Decode()
+	for c.running() {
+		pktType, err := s.transiever.Decode()
 		if err != nil {
-			c.logger.Error("net-read", err)
-			c.fatalInternalError(err)
+			c.connectionLost(s, err)
 			return
 		}
 
@@ -83,48 +112,107 @@ func (c *RemoteSource) readServiceRoutine() {
 		switch pktType {
 		case packet.PktPong:
 			var pong packet.PingPong
-			processingError = c.transiever.GetPing(&pong)
-			c.latency = time.Now().Sub(pong.Sent)
+			processingError = s.transiever.GetPing(&pong)
+			s.ponged(pong.Sent)
 
 		case packet.PktLookupResp:
-			processingError = c.processLookupResponse()
+			processingError = c.processLookupResponse(s.transiever)
 
 		case packet.PktReadMetaResp:
-			processingError = c.processReadMetaResponse()
+			processingError = c.processReadMetaResponse(s.transiever)
 
 		case packet.PktListResp:
-			processingError = c.processListResponse()
+			processingError = c.processListResponse(s.transiever)
+
+		case packet.PktListPageResp:
+			processingError = c.processListPageResponse(s.transiever)
+
+		case packet.PktSymlinkResp:
+			processingError = c.processSymlinkResponse(s.transiever)
+
+		case packet.PktReadlinkResp:
+			processingError = c.processReadlinkResponse(s.transiever)
+
+		case packet.PktLinkResp:
+			processingError = c.processLinkResponse(s.transiever)
+
+		case packet.PktGetxattrResp:
+			processingError = c.processGetxattrResponse(s.transiever)
+
+		case packet.PktListxattrResp:
+			processingError = c.processListxattrResponse(s.transiever)
+
+		case packet.PktSetxattrResp:
+			processingError = c.processSetxattrResponse(s.transiever)
+
+		case packet.PktRemovexattrResp:
+			processingError = c.processRemovexattrResponse(s.transiever)
 
 		case packet.PktFetchResp:
-			processingError = c.processFetchResponse()
+			processingError = c.processFetchResponse(s.transiever)
 
 		case packet.PktStoreResp:
-			processingError = c.processStoreResponse()
+			processingError = c.processStoreResponse(s.transiever)
 
 		case packet.PktMkdirResp:
-			processingError = c.processMkdirResponse()
+			processingError = c.processMkdirResponse(s.transiever)
 
 		case packet.PktDeleteResp:
-			processingError = c.processDeleteResponse()
+			processingError = c.processDeleteResponse(s.transiever)
+
+		case packet.PktRemoveAllResp:
+			processingError = c.processRemoveAllResponse(s.transiever)
+
+		case packet.PktStatfsResp:
+			processingError = c.processStatfsResponse(s.transiever)
 
 		case packet.PktWriteResp:
-			processingError = c.processWriteResponse()
+			processingError = c.processWriteResponse(s.transiever)
 
 		case packet.PktReadResp:
-			processingError = c.processReadResponse()
+			processingError = c.processReadResponse(s.transiever)
+
+		case packet.PktCreateResp:
+			processingError = c.processCreateResponse(s.transiever)
+
+		case packet.PktSetattrResp:
+			processingError = c.processSetattrResponse(s.transiever)
+
+		case packet.PktRenameResp:
+			processingError = c.processRenameResponse(s.transiever)
+
+		case packet.PktFetchStreamResp:
+			processingError = c.processFetchStreamResponse(s.transiever)
+
+		case packet.PktStoreStreamResp:
+			processingError = c.processStoreStreamResponse(s.transiever)
+
+		case packet.PktStreamData:
+			processingError = c.processStreamData(s.transiever)
+
+		case packet.PktStreamAck:
+			processingError = c.processStreamAck(s.transiever)
+
+		default:
+			c.logger.Warning("net-read", "Discarding packet of unknown type ", pktType)
+			processingError = s.transiever.Discard()
 		}
 
+		// a packet which could not be decoded from its frame is dropped, leaving the connection usable
+		if frameErr, ok := processingError.(*packet.FrameError); ok {
+			c.logger.Warning("net-read", frameErr)
+			continue
+		}
 		if processingError != nil {
-			c.logger.Error("net-process", processingError)
-			c.fatalInternalError(err)
+			c.connectionLost(s, processingError)
 			return
 		}
 	}
 }
 
-func (c *RemoteSource) processReadResponse() error {
+func (c *RemoteSource) processReadResponse(t *packet.Transiever) error {
 	var readResp packet.ReadResp
-	err := c.transiever.GetReadResp(&readResp)
+	err := t.GetReadResp(&readResp)
 	if err != nil {
 		return err
 	}
@@ -133,9 +221,42 @@ func (c *RemoteSource) processReadResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processWriteResponse() error {
+func (c *RemoteSource) processRenameResponse(t *packet.Transiever) error {
+	var renameResp packet.RenameResp
+	err := t.GetRenameResp(&renameResp)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(renameResp.ID, renameResp)
+	return nil
+}
+
+func (c *RemoteSource) processSetattrResponse(t *packet.Transiever) error {
+	var setattrResp packet.SetattrResp
+	err := t.GetSetattrResp(&setattrResp)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(setattrResp.ID, setattrResp)
+	return nil
+}
+
+func (c *RemoteSource) processCreateResponse(t *packet.Transiever) error {
+	var createResp packet.CreateResp
+	err := t.GetCreateResp(&createResp)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(createResp.ID, createResp)
+	return nil
+}
+
+func (c *RemoteSource) processWriteResponse(t *packet.Transiever) error {
 	var writeResp packet.WriteResp
-	err := c.transiever.GetWriteResp(&writeResp)
+	err := t.GetWriteResp(&writeResp)
 	if err != nil {
 		return err
 	}
@@ -144,9 +265,9 @@ func (c *RemoteSource) processWriteResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processDeleteResponse() error {
+func (c *RemoteSource) processDeleteResponse(t *packet.Transiever) error {
 	var deleteResp packet.DeleteResp
-	err := c.transiever.GetDeleteResp(&deleteResp)
+	err := t.GetDeleteResp(&deleteResp)
 	if err != nil {
 		return err
 	}
@@ -155,9 +276,9 @@ func (c *RemoteSource) processDeleteResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processMkdirResponse() error {
+func (c *RemoteSource) processMkdirResponse(t *packet.Transiever) error {
 	var mkdirResp packet.MkdirResp
-	err := c.transiever.GetMkdirResp(&mkdirResp)
+	err := t.GetMkdirResp(&mkdirResp)
 	if err != nil {
 		return err
 	}
@@ -166,9 +287,9 @@ func (c *RemoteSource) processMkdirResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processStoreResponse() error {
+func (c *RemoteSource) processStoreResponse(t *packet.Transiever) error {
 	var storeResp packet.StoreResp
-	err := c.transiever.GetStoreResp(&storeResp)
+	err := t.GetStoreResp(&storeResp)
 	if err != nil {
 		return err
 	}
@@ -177,9 +298,9 @@ func (c *RemoteSource) processStoreResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processFetchResponse() error {
+func (c *RemoteSource) processFetchResponse(t *packet.Transiever) error {
 	var fetchResponse packet.FetchResp
-	err := c.transiever.GetFetchResp(&fetchResponse)
+	err := t.GetFetchResp(&fetchResponse)
 	if err != nil {
 		return err
 	}
@@ -188,9 +309,9 @@ func (c *RemoteSource) processFetchResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processListResponse() error {
+func (c *RemoteSource) processListResponse(t *packet.Transiever) error {
 	var listResponse packet.ListResp
-	err := c.transiever.GetListResp(&listResponse)
+	err := t.GetListResp(&listResponse)
 	if err != nil {
 		return err
 	}
@@ -199,50 +320,147 @@ func (c *RemoteSource) processListResponse() error {
 	return nil
 }
 
-func (c *RemoteSource) processReadMetaResponse() error {
-	var readMetaResponse packet.ReadMetaResp
-	err := c.transiever.GetReadMetaResp(&readMetaResponse)
+func (c *RemoteSource) processSymlinkResponse(t *packet.Transiever) error {
+	var symlinkResponse packet.SymlinkResp
+	err := t.GetSymlinkResp(&symlinkResponse)
 	if err != nil {
 		return err
 	}
 
-	c.dispatchCallResponse(readMetaResponse.ID, readMetaResponse)
+	c.dispatchCallResponse(symlinkResponse.ID, symlinkResponse)
 	return nil
 }
 
-func (c *RemoteSource) processLookupResponse() error {
-	var lookupResponse packet.LookupResp
-	err := c.transiever.GetLookupResp(&lookupResponse)
+func (c *RemoteSource) processReadlinkResponse(t *packet.Transiever) error {
+	var readlinkResponse packet.ReadlinkResp
+	err := t.GetReadlinkResp(&readlinkResponse)
 	if err != nil {
 		return err
 	}
 
-	c.dispatchCallResponse(lookupResponse.ID, lookupResponse)
+	c.dispatchCallResponse(readlinkResponse.ID, readlinkResponse)
+	return nil
+}
+
+func (c *RemoteSource) processLinkResponse(t *packet.Transiever) error {
+	var linkResponse packet.LinkResp
+	err := t.GetLinkResp(&linkResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(linkResponse.ID, linkResponse)
+	return nil
+}
+
+func (c *RemoteSource) processGetxattrResponse(t *packet.Transiever) error {
+	var getxattrResponse packet.GetxattrResp
+	err := t.GetGetxattrResp(&getxattrResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(getxattrResponse.ID, getxattrResponse)
+	return nil
+}
+
+func (c *RemoteSource) processListxattrResponse(t *packet.Transiever) error {
+	var listxattrResponse packet.ListxattrResp
+	err := t.GetListxattrResp(&listxattrResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(listxattrResponse.ID, listxattrResponse)
+	return nil
+}
+
+func (c *RemoteSource) processSetxattrResponse(t *packet.Transiever) error {
+	var setxattrResponse packet.SetxattrResp
+	err := t.GetSetxattrResp(&setxattrResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(setxattrResponse.ID, setxattrResponse)
+	return nil
+}
+
+func (c *RemoteSource) processRemovexattrResponse(t *packet.Transiever) error {
+	var removexattrResponse packet.RemovexattrResp
+	err := t.GetRemovexattrResp(&removexattrResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(removexattrResponse.ID, removexattrResponse)
+	return nil
+}
+
+func (c *RemoteSource) processRemoveAllResponse(t *packet.Transiever) error {
+	var removeAllResponse packet.RemoveAllResp
+	err := t.GetRemoveAllResp(&removeAllResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(removeAllResponse.ID, removeAllResponse)
+	return nil
+}
+
+func (c *RemoteSource) processStatfsResponse(t *packet.Transiever) error {
+	var statfsResponse packet.StatfsResp
+	err := t.GetStatfsResp(&statfsResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(statfsResponse.ID, statfsResponse)
+	return nil
+}
+
+func (c *RemoteSource) processListPageResponse(t *packet.Transiever) error {
+	var listPageResponse packet.ListPageResp
+	err := t.GetListPageResp(&listPageResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(listPageResponse.ID, listPageResponse)
 	return nil
 }
 
-func (c *RemoteSource) fatalInternalError(err error) {
-	c.shouldRun = false
-	c.conn.Close()
-	c.fatal = err
-	if c.onFatalChan != nil {
-		c.onFatalChan <- err
+func (c *RemoteSource) processReadMetaResponse(t *packet.Transiever) error {
+	var readMetaResponse packet.ReadMetaResp
+	err := t.GetReadMetaResp(&readMetaResponse)
+	if err != nil {
+		return err
 	}
+
+	c.dispatchCallResponse(readMetaResponse.ID, readMetaResponse)
+	return nil
 }
 
-// Ready returns true if the connection is healthy and ready for RPCs.
-func (c *RemoteSource) Ready() bool {
-	return c.shouldRun && c.fatal == nil
+func (c *RemoteSource) processLookupResponse(t *packet.Transiever) error {
+	var lookupResponse packet.LookupResp
+	err := t.GetLookupResp(&lookupResponse)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(lookupResponse.ID, lookupResponse)
+	return nil
 }
 
-func (c *RemoteSource) ping() error {
+func (c *RemoteSource) ping(s *session) error {
 	var ping packet.PingPong
 	ping.Sent = time.Now()
 
-	return c.transiever.WritePing(&ping)
+	return s.transiever.WritePing(&ping)
 }
 
-// Latency returns the latency of the connection in nanoseconds.
+// Latency returns the latency of the current connection in nanoseconds, as measured by the last ping
+// answered on it.
 func (c *RemoteSource) Latency() int64 {
-	return c.latency.Nanoseconds()
+	return c.session().lastLatency().Nanoseconds()
 }
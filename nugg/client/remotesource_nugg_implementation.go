@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/nuggdb"
 	"github.com/twitchyliquid64/nugget/packet"
 )
 
@@ -16,78 +17,122 @@ var ErrNotImplemented = errors.New("Not implemented")
 
 const defaultTimeout = time.Second * 4
 
+// removeAllTimeout is longer than defaultTimeout, as a RemoveAll may remove a large subtree.
+const removeAllTimeout = time.Minute
+
 // Lookup implements nugget.DataSource
 func (c *RemoteSource) Lookup(path string) (nugget.EntryID, error) {
-	responseChan := make(chan interface{})
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
 	var lookupRequest packet.LookupReq
 	lookupRequest.ID = call.id
 	lookupRequest.Path = path
-	c.transiever.WriteLookupReq(&lookupRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return nugget.EntryID{}, ErrTimeout
-	case r := <-responseChan:
-		lookupResp := r.(packet.LookupResp)
-		if lookupResp.ErrorCode != packet.ErrNoError {
-			return nugget.EntryID{}, packet.ErrorCodeToErr(lookupResp.ErrorCode)
-		}
-		return lookupResp.EntryID, nil
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteLookupReq(&lookupRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, err
 	}
+	lookupResp := r.(packet.LookupResp)
+	if lookupResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, packet.ErrorCodeToErr(lookupResp.ErrorCode)
+	}
+	return lookupResp.EntryID, nil
 }
 
 // ReadMeta implements nugget.DataSource
 func (c *RemoteSource) ReadMeta(entry nugget.EntryID) (nugget.NodeMetadata, error) {
-	responseChan := make(chan interface{})
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
 	var readMetaRequest packet.ReadMetaReq
 	readMetaRequest.ID = call.id
 	readMetaRequest.EntryID = entry
-	c.transiever.WriteReadMetaReq(&readMetaRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return nil, ErrTimeout
-	case r := <-responseChan:
-		readMetaResp := r.(packet.ReadMetaResp)
-		if readMetaResp.ErrorCode != packet.ErrNoError {
-			return nil, packet.ErrorCodeToErr(readMetaResp.ErrorCode)
-		}
-		return &readMetaResp.Meta, nil
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteReadMetaReq(&readMetaRequest)
+	})
+	if err != nil {
+		return nil, err
 	}
+	readMetaResp := r.(packet.ReadMetaResp)
+	if readMetaResp.ErrorCode != packet.ErrNoError {
+		return nil, packet.ErrorCodeToErr(readMetaResp.ErrorCode)
+	}
+	return &readMetaResp.Meta, nil
 }
 
 // List implements nugget.DataSource
 func (c *RemoteSource) List(path string) ([]nugget.DirEntry, error) {
-	responseChan := make(chan interface{})
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
 	var listRequest packet.ListReq
 	listRequest.ID = call.id
 	listRequest.Path = path
-	c.transiever.WriteListReq(&listRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return nil, ErrTimeout
-	case r := <-responseChan:
-		listResp := r.(packet.ListResp)
-		if listResp.ErrorCode != packet.ErrNoError {
-			return nil, packet.ErrorCodeToErr(listResp.ErrorCode)
-		}
 
-		b := make([]nugget.DirEntry, len(listResp.Entries))
-		for i := range listResp.Entries {
-			b[i] = &listResp.Entries[i]
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteListReq(&listRequest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	listResp := r.(packet.ListResp)
+	if listResp.ErrorCode != packet.ErrNoError {
+		return nil, packet.ErrorCodeToErr(listResp.ErrorCode)
+	}
+
+	b := make([]nugget.DirEntry, len(listResp.Entries))
+	for i := range listResp.Entries {
+		b[i] = &listResp.Entries[i]
+	}
+	return b, nil
+}
+
+// ListPage implements nugget.PagedDataSource. Servers without paged listings return the whole
+// listing as a single page.
+func (c *RemoteSource) ListPage(path string, cursor string, limit int) ([]nugget.DirEntry, string, error) {
+	if !c.Supports(packet.PktListPage) {
+		if cursor != "" {
+			return nil, "", nuggdb.ErrInvalidCursor
 		}
-		return b, nil
+		entries, err := c.List(path)
+		return entries, "", err
+	}
+	if max := c.session().maxListPageSize; limit > max {
+		limit = max
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var listPageRequest packet.ListPageReq
+	listPageRequest.ID = call.id
+	listPageRequest.Path = path
+	listPageRequest.Cursor = cursor
+	listPageRequest.Limit = limit
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteListPageReq(&listPageRequest)
+	})
+	if err != nil {
+		return nil, "", err
 	}
+	listPageResp := r.(packet.ListPageResp)
+	if listPageResp.ErrorCode != packet.ErrNoError {
+		return nil, "", packet.ErrorCodeToErr(listPageResp.ErrorCode)
+	}
+
+	b := make([]nugget.DirEntry, len(listPageResp.Entries))
+	for i := range listPageResp.Entries {
+		b[i] = &listPageResp.Entries[i]
+	}
+	return b, listPageResp.NextCursor, nil
 }
 
 // ReadData implements nugget.DataSource
@@ -95,32 +140,53 @@ func (c *RemoteSource) ReadData(node nugget.ChunkID) ([]byte, error) {
 	return []byte(""), ErrNotImplemented
 }
 
-// Fetch implements nugget.DataSource
+// Fetch implements nugget.DataSource. The data is streamed from servers which can stream data, so files
+// of any size are fetched without a timeout. FetchReader reads a file without holding all of it.
 func (c *RemoteSource) Fetch(path string) (nugget.EntryID, nugget.NodeMetadata, []byte, error) {
-	responseChan := make(chan interface{})
+	if c.Supports(packet.PktFetchStream) {
+		return c.fetchStream(path)
+	}
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
 	var fetchRequest packet.FetchReq
 	fetchRequest.ID = call.id
 	fetchRequest.Path = path
-	c.transiever.WriteFetchReq(&fetchRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return nugget.EntryID{}, nil, []byte(""), ErrTimeout
-	case r := <-responseChan:
-		fetchResp := r.(packet.FetchResp)
-		if fetchResp.ErrorCode != packet.ErrNoError {
-			return fetchResp.EntryID, &fetchResp.Meta, fetchResp.Data, packet.ErrorCodeToErr(fetchResp.ErrorCode)
-		}
-		return fetchResp.EntryID, &fetchResp.Meta, fetchResp.Data, nil
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteFetchReq(&fetchRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, []byte(""), err
+	}
+	fetchResp := r.(packet.FetchResp)
+	if fetchResp.ErrorCode != packet.ErrNoError {
+		return fetchResp.EntryID, &fetchResp.Meta, fetchResp.Data, packet.ErrorCodeToErr(fetchResp.ErrorCode)
 	}
+	return fetchResp.EntryID, &fetchResp.Meta, fetchResp.Data, nil
 }
 
-// Store implements nugget.DataSink
+// Store implements nugget.DataSink. Data larger than a single StreamData packet is streamed to servers
+// which can stream data. Otherwise, data larger than the server accepts in one packet is stored in parts,
+// with the first part stored and the rest written after it.
 func (c *RemoteSource) Store(path string, data []byte) (nugget.EntryID, nugget.NodeMetadata, error) {
-	responseChan := make(chan interface{})
+	if len(data) > packet.StreamChunkSize && c.Supports(packet.PktStoreStream) {
+		_, eID, meta, err := c.writeStream(path, 0, data, true)
+		return eID, meta, err
+	}
+	if max := c.maxDataSize(); len(data) > max {
+		if _, _, err := c.store(path, data[:max]); err != nil {
+			return nugget.EntryID{}, nil, err
+		}
+		_, eID, meta, err := c.Write(path, int64(max), data[max:])
+		return eID, meta, err
+	}
+	return c.store(path, data)
+}
+
+func (c *RemoteSource) store(path string, data []byte) (nugget.EntryID, nugget.NodeMetadata, error) {
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
@@ -128,69 +194,193 @@ func (c *RemoteSource) Store(path string, data []byte) (nugget.EntryID, nugget.N
 	storeRequest.ID = call.id
 	storeRequest.Path = path
 	storeRequest.Data = data
-	c.transiever.WriteStoreReq(&storeRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return nugget.EntryID{}, nil, ErrTimeout
-	case r := <-responseChan:
-		storeResp := r.(packet.StoreResp)
-		if storeResp.ErrorCode != packet.ErrNoError {
-			return nugget.EntryID{}, nil, packet.ErrorCodeToErr(storeResp.ErrorCode)
-		}
-		return storeResp.EntryID, &storeResp.Meta, nil
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteStoreReq(&storeRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, err
+	}
+	storeResp := r.(packet.StoreResp)
+	if storeResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, nil, packet.ErrorCodeToErr(storeResp.ErrorCode)
+	}
+	return storeResp.EntryID, &storeResp.Meta, nil
+}
+
+// Create implements nugget.DataSink. Servers without Create store an empty file with default
+// ownership and permissions instead.
+func (c *RemoteSource) Create(path string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	if !c.Supports(packet.PktCreate) {
+		return c.Store(path, []byte{})
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var createRequest packet.CreateReq
+	createRequest.ID = call.id
+	createRequest.Path = path
+	createRequest.Attr = attr
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteCreateReq(&createRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, err
+	}
+	createResp := r.(packet.CreateResp)
+	if createResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, nil, packet.ErrorCodeToErr(createResp.ErrorCode)
 	}
+	return createResp.EntryID, &createResp.Meta, nil
 }
 
 // Mkdir implements nugget.DataSink
-func (c *RemoteSource) Mkdir(path string) (nugget.EntryID, nugget.NodeMetadata, error) {
-	responseChan := make(chan interface{})
+func (c *RemoteSource) Mkdir(path string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
 	var mkdirRequest packet.MkdirReq
 	mkdirRequest.ID = call.id
 	mkdirRequest.Path = path
-	c.transiever.WriteMkdirReq(&mkdirRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return nugget.EntryID{}, nil, ErrTimeout
-	case r := <-responseChan:
-		mkdirResp := r.(packet.MkdirResp)
-		if mkdirResp.ErrorCode != packet.ErrNoError {
-			return nugget.EntryID{}, nil, packet.ErrorCodeToErr(mkdirResp.ErrorCode)
-		}
-		return mkdirResp.EntryID, &mkdirResp.Meta, nil
+	mkdirRequest.Attr = attr
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteMkdirReq(&mkdirRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, err
+	}
+	mkdirResp := r.(packet.MkdirResp)
+	if mkdirResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, nil, packet.ErrorCodeToErr(mkdirResp.ErrorCode)
 	}
+	return mkdirResp.EntryID, &mkdirResp.Meta, nil
 }
 
 // Delete implements nugget.DataSink
 func (c *RemoteSource) Delete(path string) error {
-	responseChan := make(chan interface{})
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
 	var deleteRequest packet.DeleteReq
 	deleteRequest.ID = call.id
 	deleteRequest.Path = path
-	c.transiever.WriteDeleteReq(&deleteRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return ErrTimeout
-	case r := <-responseChan:
-		deleteResp := r.(packet.DeleteResp)
-		if deleteResp.ErrorCode != packet.ErrNoError {
-			return packet.ErrorCodeToErr(deleteResp.ErrorCode)
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteDeleteReq(&deleteRequest)
+	})
+	if err != nil {
+		return err
+	}
+	deleteResp := r.(packet.DeleteResp)
+	if deleteResp.ErrorCode != packet.ErrNoError {
+		return packet.ErrorCodeToErr(deleteResp.ErrorCode)
+	}
+	return nil
+}
+
+// RemoveAll implements nugget.RemoveAllDataSink. Servers without RemoveAll have the subtree removed an
+// entry at a time, so a failure may leave part of it behind.
+func (c *RemoteSource) RemoveAll(path string) error {
+	if !c.Supports(packet.PktRemoveAll) {
+		return c.removeEach(path)
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var removeAllRequest packet.RemoveAllReq
+	removeAllRequest.ID = call.id
+	removeAllRequest.Path = path
+
+	r, err := c.roundTrip(call, removeAllTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteRemoveAllReq(&removeAllRequest)
+	})
+	if err != nil {
+		return err
+	}
+	removeAllResp := r.(packet.RemoveAllResp)
+	if removeAllResp.ErrorCode != packet.ErrNoError {
+		return packet.ErrorCodeToErr(removeAllResp.ErrorCode)
+	}
+	return nil
+}
+
+// Rename implements nugget.DataSink
+func (c *RemoteSource) Rename(oldPath, newPath string) error {
+	if !c.Supports(packet.PktRename) {
+		return packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var renameRequest packet.RenameReq
+	renameRequest.ID = call.id
+	renameRequest.OldPath = oldPath
+	renameRequest.NewPath = newPath
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteRenameReq(&renameRequest)
+	})
+	if err != nil {
+		return err
+	}
+	renameResp := r.(packet.RenameResp)
+	if renameResp.ErrorCode != packet.ErrNoError {
+		return packet.ErrorCodeToErr(renameResp.ErrorCode)
+	}
+	return nil
+}
+
+// removeEach deletes the entry at path and everything beneath it, one Delete at a time.
+func (c *RemoteSource) removeEach(path string) error {
+	eID, err := c.Lookup(path)
+	if err != nil {
+		return err
+	}
+	meta, err := c.ReadMeta(eID)
+	if err != nil {
+		return err
+	}
+	if meta.IsDirectory() {
+		entries, err := c.List(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = c.removeEach(entry.Identifier()); err != nil {
+				return err
+			}
 		}
-		return nil
 	}
+	return c.Delete(path)
 }
 
-// Write implements nugget.OptimisedDataSourceSink
+// Write implements nugget.OptimisedDataSourceSink. Data larger than the server accepts in one packet
+// is written in parts.
 func (c *RemoteSource) Write(path string, offset int64, data []byte) (int64, nugget.EntryID, nugget.NodeMetadata, error) {
-	responseChan := make(chan interface{})
+	if len(data) > packet.StreamChunkSize && c.Supports(packet.PktStoreStream) {
+		return c.writeStream(path, offset, data, false)
+	}
+	var written int64
+	for max := c.maxDataSize(); len(data) > max; data = data[max:] {
+		n, _, _, err := c.write(path, offset+written, data[:max])
+		written += n
+		if err != nil {
+			return written, nugget.EntryID{}, nil, err
+		}
+	}
+	n, eID, meta, err := c.write(path, offset+written, data)
+	return written + n, eID, meta, err
+}
+
+func (c *RemoteSource) write(path string, offset int64, data []byte) (int64, nugget.EntryID, nugget.NodeMetadata, error) {
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
@@ -199,23 +389,26 @@ func (c *RemoteSource) Write(path string, offset int64, data []byte) (int64, nug
 	writeRequest.Path = path
 	writeRequest.Offset = offset
 	writeRequest.Data = data
-	c.transiever.WriteWriteReq(&writeRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return 0, nugget.EntryID{}, nil, ErrTimeout
-	case r := <-responseChan:
-		writeResp := r.(packet.WriteResp)
-		if writeResp.ErrorCode != packet.ErrNoError {
-			return 0, nugget.EntryID{}, nil, packet.ErrorCodeToErr(writeResp.ErrorCode)
-		}
-		return writeResp.Written, writeResp.EntryID, &writeResp.Meta, nil
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteWriteReq(&writeRequest)
+	})
+	if err != nil {
+		return 0, nugget.EntryID{}, nil, err
 	}
+	writeResp := r.(packet.WriteResp)
+	if writeResp.ErrorCode != packet.ErrNoError {
+		return 0, nugget.EntryID{}, nil, packet.ErrorCodeToErr(writeResp.ErrorCode)
+	}
+	return writeResp.Written, writeResp.EntryID, &writeResp.Meta, nil
 }
 
 // Read implements nugget.OptimisedDataSourceSink
 func (c *RemoteSource) Read(path string, offset int64, size int64) ([]byte, error) {
-	responseChan := make(chan interface{})
+	if size > packet.StreamChunkSize && c.Supports(packet.PktFetchStream) {
+		return c.readStream(path, offset, size)
+	}
+	responseChan := make(chan interface{}, 1)
 	call := c.registerRPC(responseChan)
 	defer c.unregisterRPC(call)
 
@@ -224,22 +417,271 @@ func (c *RemoteSource) Read(path string, offset int64, size int64) ([]byte, erro
 	readRequest.Path = path
 	readRequest.Offset = offset
 	readRequest.Size = size
-	c.transiever.WriteReadReq(&readRequest)
-
-	select {
-	case <-time.After(defaultTimeout):
-		return []byte(""), ErrTimeout
-	case r := <-responseChan:
-		readResp := r.(packet.ReadResp)
-		if readResp.ErrorCode != packet.ErrNoError {
-			return []byte(""), packet.ErrorCodeToErr(readResp.ErrorCode)
-		}
-		return readResp.Data, nil
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteReadReq(&readRequest)
+	})
+	if err != nil {
+		return []byte(""), err
+	}
+	readResp := r.(packet.ReadResp)
+	if readResp.ErrorCode != packet.ErrNoError {
+		return []byte(""), packet.ErrorCodeToErr(readResp.ErrorCode)
+	}
+	return readResp.Data, nil
+}
+
+// Setattr implements nugget.SetattrDataSink
+func (c *RemoteSource) Setattr(path string, changes nugget.AttrChanges) (nugget.EntryID, nugget.NodeMetadata, error) {
+	if !c.Supports(packet.PktSetattr) {
+		return nugget.EntryID{}, nil, packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var setattrRequest packet.SetattrReq
+	setattrRequest.ID = call.id
+	setattrRequest.Path = path
+	setattrRequest.Changes = changes
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteSetattrReq(&setattrRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, err
+	}
+	setattrResp := r.(packet.SetattrResp)
+	if setattrResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, nil, packet.ErrorCodeToErr(setattrResp.ErrorCode)
+	}
+	return setattrResp.EntryID, &setattrResp.Meta, nil
+}
+
+// Symlink implements nugget.SymlinkDataSink
+func (c *RemoteSource) Symlink(path, target string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	if !c.Supports(packet.PktSymlink) {
+		return nugget.EntryID{}, nil, packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var symlinkRequest packet.SymlinkReq
+	symlinkRequest.ID = call.id
+	symlinkRequest.Path = path
+	symlinkRequest.Target = target
+	symlinkRequest.Attr = attr
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteSymlinkReq(&symlinkRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, err
+	}
+	symlinkResp := r.(packet.SymlinkResp)
+	if symlinkResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, nil, packet.ErrorCodeToErr(symlinkResp.ErrorCode)
+	}
+	return symlinkResp.EntryID, &symlinkResp.Meta, nil
+}
+
+// Readlink implements nugget.SymlinkDataSink
+func (c *RemoteSource) Readlink(path string) (string, error) {
+	if !c.Supports(packet.PktReadlink) {
+		return "", packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var readlinkRequest packet.ReadlinkReq
+	readlinkRequest.ID = call.id
+	readlinkRequest.Path = path
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteReadlinkReq(&readlinkRequest)
+	})
+	if err != nil {
+		return "", err
+	}
+	readlinkResp := r.(packet.ReadlinkResp)
+	if readlinkResp.ErrorCode != packet.ErrNoError {
+		return "", packet.ErrorCodeToErr(readlinkResp.ErrorCode)
+	}
+	return readlinkResp.Target, nil
+}
+
+// Link implements nugget.LinkDataSink
+func (c *RemoteSource) Link(oldPath, newPath string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	if !c.Supports(packet.PktLink) {
+		return nugget.EntryID{}, nil, packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var linkRequest packet.LinkReq
+	linkRequest.ID = call.id
+	linkRequest.OldPath = oldPath
+	linkRequest.NewPath = newPath
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteLinkReq(&linkRequest)
+	})
+	if err != nil {
+		return nugget.EntryID{}, nil, err
+	}
+	linkResp := r.(packet.LinkResp)
+	if linkResp.ErrorCode != packet.ErrNoError {
+		return nugget.EntryID{}, nil, packet.ErrorCodeToErr(linkResp.ErrorCode)
+	}
+	return linkResp.EntryID, &linkResp.Meta, nil
+}
+
+// Statfs implements nugget.StatfsDataSource
+func (c *RemoteSource) Statfs() (nugget.FSStats, error) {
+	if !c.Supports(packet.PktStatfs) {
+		return nugget.FSStats{}, packet.ErrNotSupported
 	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var statfsRequest packet.StatfsReq
+	statfsRequest.ID = call.id
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteStatfsReq(&statfsRequest)
+	})
+	if err != nil {
+		return nugget.FSStats{}, err
+	}
+	statfsResp := r.(packet.StatfsResp)
+	if statfsResp.ErrorCode != packet.ErrNoError {
+		return nugget.FSStats{}, packet.ErrorCodeToErr(statfsResp.ErrorCode)
+	}
+	return statfsResp.Stats, nil
 }
 
-// Close implements nugget.DataSink
+// Getxattr implements nugget.XattrDataSink
+func (c *RemoteSource) Getxattr(path, name string) ([]byte, error) {
+	if !c.Supports(packet.PktGetxattr) {
+		return nil, packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var getxattrRequest packet.GetxattrReq
+	getxattrRequest.ID = call.id
+	getxattrRequest.Path = path
+	getxattrRequest.Name = name
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteGetxattrReq(&getxattrRequest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	getxattrResp := r.(packet.GetxattrResp)
+	if getxattrResp.ErrorCode != packet.ErrNoError {
+		return nil, packet.ErrorCodeToErr(getxattrResp.ErrorCode)
+	}
+	return getxattrResp.Value, nil
+}
+
+// Listxattr implements nugget.XattrDataSink
+func (c *RemoteSource) Listxattr(path string) ([]string, error) {
+	if !c.Supports(packet.PktListxattr) {
+		return nil, packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var listxattrRequest packet.ListxattrReq
+	listxattrRequest.ID = call.id
+	listxattrRequest.Path = path
+
+	r, err := c.roundTrip(call, defaultTimeout, idempotent, func(t *packet.Transiever) error {
+		return t.WriteListxattrReq(&listxattrRequest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	listxattrResp := r.(packet.ListxattrResp)
+	if listxattrResp.ErrorCode != packet.ErrNoError {
+		return nil, packet.ErrorCodeToErr(listxattrResp.ErrorCode)
+	}
+	return listxattrResp.Names, nil
+}
+
+// Setxattr implements nugget.XattrDataSink
+func (c *RemoteSource) Setxattr(path, name string, value []byte, flags uint32) error {
+	if !c.Supports(packet.PktSetxattr) {
+		return packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var setxattrRequest packet.SetxattrReq
+	setxattrRequest.ID = call.id
+	setxattrRequest.Path = path
+	setxattrRequest.Name = name
+	setxattrRequest.Value = value
+	setxattrRequest.Flags = flags
+
+	// with XATTR_CREATE or XATTR_REPLACE set, sending the request again could fail where the first succeeded
+	r, err := c.roundTrip(call, defaultTimeout, setxattrRequest.Flags == 0, func(t *packet.Transiever) error {
+		return t.WriteSetxattrReq(&setxattrRequest)
+	})
+	if err != nil {
+		return err
+	}
+	return packet.ErrorCodeToErr(r.(packet.SetxattrResp).ErrorCode)
+}
+
+// Removexattr implements nugget.XattrDataSink
+func (c *RemoteSource) Removexattr(path, name string) error {
+	if !c.Supports(packet.PktRemovexattr) {
+		return packet.ErrNotSupported
+	}
+	responseChan := make(chan interface{}, 1)
+	call := c.registerRPC(responseChan)
+	defer c.unregisterRPC(call)
+
+	var removexattrRequest packet.RemovexattrReq
+	removexattrRequest.ID = call.id
+	removexattrRequest.Path = path
+	removexattrRequest.Name = name
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteRemovexattrReq(&removexattrRequest)
+	})
+	if err != nil {
+		return err
+	}
+	return packet.ErrorCodeToErr(r.(packet.RemovexattrResp).ErrorCode)
+}
+
+// Close implements nugget.DataSink, dropping the connection and waiting for the background routines to
+// exit. Calls waiting to reconnect fail with ErrDisconnected.
 func (c *RemoteSource) Close() error {
-	c.conn.Close()
-	return ErrNotImplemented
+	c.sessionLock.Lock()
+	if c.closed {
+		c.sessionLock.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.stop)
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+	s := c.current
+	c.sessionLock.Unlock()
+
+	s.close()
+	c.wg.Wait()
+	return nil
 }
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// ErrConnectionLost is returned by calls which were in flight when the connection to the server was lost,
+// and which cannot safely be sent again, as the server may already have applied them.
+var ErrConnectionLost = errors.New("Connection to the server lost; the request may or may not have been applied")
+
+// ErrDisconnected is returned by calls made while the connection to the server is down, if the
+// RemoteSource fails calls rather than waiting to reconnect, or has been closed.
+var ErrDisconnected = errors.New("Not connected to the server")
+
+// minReconnectDelay and maxReconnectDelay bound the exponential backoff between attempts to reconnect.
+const (
+	minReconnectDelay = time.Millisecond * 250
+	maxReconnectDelay = time.Second * 30
+)
+
+// Whether a call may be sent again if the connection is lost before it is answered: calls which have
+// the same effect however many times they are applied.
+const (
+	idempotent    = true
+	notIdempotent = false
+)
+
+// session is a single connection to the server, and the protocol negotiated over it.
+type session struct {
+	conn       *tls.Conn
+	transiever *packet.Transiever
+
+	version         uint32                  // protocol version agreed with the server
+	packets         map[packet.PktType]bool // request packet types the server handles
+	maxMessageSize  uint64                  // largest packet the server accepts
+	maxListPageSize int                     // most entries the server returns in a page
+
+	lock     sync.Mutex
+	pongTime time.Time     // when the server last answered a ping
+	latency  time.Duration // round trip time of the last ping answered
+
+	down      chan struct{} // closed once the connection has failed
+	closeOnce sync.Once
+}
+
+func newSession(conn *tls.Conn) *session {
+	return &session{
+		conn:       conn,
+		transiever: packet.MakeTransiever(conn, conn),
+		pongTime:   time.Now(),
+		down:       make(chan struct{}),
+	}
+}
+
+// close drops the connection, failing the calls waiting on it.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		s.conn.Close()
+		close(s.down)
+	})
+}
+
+// broken returns true if err, returned writing to the connection, means the connection has failed, in
+// which case it is closed. The read routine then notices, and reconnects.
+func (s *session) broken(err error) bool {
+	if _, isNetErr := err.(net.Error); isNetErr || s.isDown() {
+		s.close()
+		return true
+	}
+	return false
+}
+
+func (s *session) isDown() bool {
+	select {
+	case <-s.down:
+		return true
+	default:
+		return false
+	}
+}
+
+// ponged records the answer to a ping sent at the given time.
+func (s *session) ponged(sent time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pongTime = time.Now()
+	s.latency = s.pongTime.Sub(sent)
+}
+
+func (s *session) lastPong() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pongTime
+}
+
+func (s *session) lastLatency() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.latency
+}
+
+// dial connects to the server and negotiates the protocol to speak over the connection.
+func (c *RemoteSource) dial() (*session, error) {
+	conn, err := connect(c.addr, c.certPemPath, c.keyPemPath, c.caCertPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSession(conn)
+	if err = s.handshake(); err != nil {
+		if !rejectedHello(err) {
+			conn.Close()
+			return nil, err
+		}
+		// servers which predate the Hello exchange drop the connection when sent one
+		c.logger.Warning("net-hello", "Hello exchange failed, assuming a legacy server: ", err)
+		conn.Close()
+		if conn, err = connect(c.addr, c.certPemPath, c.keyPemPath, c.caCertPath); err != nil {
+			return nil, err
+		}
+		s = newSession(conn)
+		s.useLegacyProtocol()
+	}
+	c.logger.Info("net-hello", "Speaking protocol version ", s.version)
+	return s, nil
+}
+
+// start makes s the current connection, waking the calls waiting for one.
+func (c *RemoteSource) start(s *session) {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if c.closed {
+		s.close()
+		return
+	}
+
+	c.current = s
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+	c.wg.Add(1)
+	go c.readServiceRoutine(s)
+}
+
+// running returns false once the RemoteSource has been closed.
+func (c *RemoteSource) running() bool {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	return !c.closed
+}
+
+// sleep waits for d, returning false early if the RemoteSource is closed.
+func (c *RemoteSource) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+// session returns the current connection, which may be down.
+func (c *RemoteSource) session() *session {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	return c.current
+}
+
+// connected returns the current connection, waiting for it to be re-established if it is down, unless
+// calls fail while disconnected.
+func (c *RemoteSource) connected() (*session, error) {
+	for {
+		c.sessionLock.Lock()
+		s, reconnected, wait := c.current, c.reconnected, !c.failFast && !c.closed
+		c.sessionLock.Unlock()
+
+		if !s.isDown() {
+			return s, nil
+		}
+		if !wait {
+			return nil, ErrDisconnected
+		}
+		<-reconnected
+	}
+}
+
+// connectionLost is called by the read routine of s when the connection fails, and re-establishes it in
+// the background. Streams in progress cannot continue on a new connection, so are ended.
+func (c *RemoteSource) connectionLost(s *session, err error) {
+	s.close()
+	// the routine is added under the lock, so Close either prevents it or waits for it
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if c.closed {
+		return
+	}
+	c.logger.Error("net-read", "Connection lost: ", err)
+	c.closeStreams(ErrConnectionLost)
+	c.wg.Add(1)
+	go c.reconnectRoutine()
+}
+
+func (c *RemoteSource) reconnectRoutine() {
+	defer c.wg.Done()
+
+	delay := minReconnectDelay
+	for c.sleep(delay) {
+		s, err := c.dial()
+		if err == nil {
+			c.logger.Info("net-reconnect", "Reconnected to ", c.addr)
+			c.start(s)
+			return
+		}
+
+		delay = nextReconnectDelay(delay)
+		c.logger.Warning("net-reconnect", "Reconnecting failed, retrying in ", delay, ": ", err)
+	}
+}
+
+// nextReconnectDelay returns the wait before the attempt to reconnect following one made after delay.
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > maxReconnectDelay {
+		return maxReconnectDelay
+	}
+	return delay
+}
+
+// roundTrip sends the request of call using send, and waits up to timeout for the response. If the
+// connection is lost before the response arrives, idempotent calls are sent again once it is
+// re-established; other calls fail with ErrConnectionLost.
+func (c *RemoteSource) roundTrip(call *Call, timeout time.Duration, idempotent bool, send func(*packet.Transiever) error) (interface{}, error) {
+	for {
+		s, err := c.connected()
+		if err != nil {
+			return nil, err
+		}
+		if err = send(s.transiever); err != nil && !s.broken(err) {
+			return nil, err
+		}
+
+		select {
+		case r := <-call.responseChan:
+			return r, nil
+		case <-time.After(timeout):
+			return nil, ErrTimeout
+		case <-s.down:
+			select {
+			case r := <-call.responseChan: // answered just before the connection failed
+				return r, nil
+			default:
+			}
+			if !idempotent {
+				return nil, ErrConnectionLost
+			}
+			c.logger.Info("rpc", "Sending request ", call.id, " again once reconnected")
+		}
+	}
+}
+
+// Ready returns true if the connection is healthy and ready for RPCs.
+func (c *RemoteSource) Ready() bool {
+	return c.running() && !c.session().isDown()
+}
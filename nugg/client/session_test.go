@@ -0,0 +1,487 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/logger"
+	"github.com/twitchyliquid64/nugget/nuggdb"
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+var errDrop = errors.New("dropping the connection")
+
+var (
+	certsOnce          sync.Once
+	certPath, keyPath  string
+	serverTLSConfig    *tls.Config
+	certsErr           error
+	testCertificateDir string
+)
+
+// testCerts creates a self-signed certificate, used as the CA and by both ends. The client keeps the
+// TLS configuration it first loads, so every test shares the same certificate.
+func testCerts(t *testing.T) (string, string) {
+	certsOnce.Do(func() {
+		if testCertificateDir, certsErr = ioutil.TempDir("", "nugg_client_test"); certsErr != nil {
+			return
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			certsErr = err
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "test"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			certsErr = err
+			return
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		certPath, keyPath = path.Join(testCertificateDir, "cert.pem"), path.Join(testCertificateDir, "key.pem")
+		if certsErr = ioutil.WriteFile(certPath, certPEM, 0600); certsErr != nil {
+			return
+		}
+		if certsErr = ioutil.WriteFile(keyPath, keyPEM, 0600); certsErr != nil {
+			return
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			certsErr = err
+			return
+		}
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(certPEM)
+		serverTLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    roots,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+	})
+	if certsErr != nil {
+		t.Fatal("Setup error:", certsErr)
+	}
+	return certPath, keyPath
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testCertificateDir != "" {
+		os.RemoveAll(testCertificateDir)
+	}
+	os.Exit(code)
+}
+
+// fakeServer answers the Hello exchange, and passes the other requests it receives to handle. The
+// connection is dropped if handle returns an error.
+type fakeServer struct {
+	listener net.Listener
+	handle   func(pktType packet.PktType, trans *packet.Transiever) error
+
+	lock     sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func startFakeServer(t *testing.T, addr string, handle func(pktType packet.PktType, trans *packet.Transiever) error) *fakeServer {
+	testCerts(t)
+	listener, err := tls.Listen("tcp", addr, serverTLSConfig)
+	if err != nil {
+		t.Fatal("Setup error:", err)
+	}
+	s := &fakeServer{listener: listener, handle: handle}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted++
+		s.lock.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	trans := packet.MakeTransiever(conn, conn)
+	for {
+		pktType, err := trans.Decode()
+		if err != nil {
+			return
+		}
+		switch pktType {
+		case packet.PktHello:
+			var hello packet.Hello
+			if err = trans.GetHello(&hello); err != nil {
+				return
+			}
+			err = trans.WriteHelloResp(&packet.HelloResp{
+				Version:         packet.ProtocolVersion,
+				Packets:         clientPackets,
+				MaxMessageSize:  packet.DefaultMaxMessageSize,
+				MaxListPageSize: packet.MaxListPageSize,
+			})
+			trans.UseFrames(packet.DefaultMaxMessageSize)
+		case packet.PktPing:
+			var ping packet.PingPong
+			err = trans.GetPing(&ping)
+		default:
+			err = s.handle(pktType, trans)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+// stop closes the listener and every connection accepted.
+func (s *fakeServer) stop() {
+	s.listener.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func openTestClient(t *testing.T, s *fakeServer) *RemoteSource {
+	cert, key := testCerts(t)
+	c, err := Open(s.addr(), cert, key, cert, logger.New(ioutil.Discard, ioutil.Discard))
+	if err != nil {
+		t.Fatal("Setup error:", err)
+	}
+	return c
+}
+
+func waitReady(t *testing.T, c *RemoteSource) {
+	for i := 0; i < 100 && !c.Ready(); i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if !c.Ready() {
+		t.Fatal("Expected the client to reconnect")
+	}
+}
+
+func TestRoundTripResendsIdempotentCalls(t *testing.T) {
+	var lock sync.Mutex
+	var ids []uint64
+	s := startFakeServer(t, "127.0.0.1:0", func(pktType packet.PktType, trans *packet.Transiever) error {
+		var lookupReq packet.LookupReq
+		if err := trans.GetLookupReq(&lookupReq); err != nil {
+			return err
+		}
+		lock.Lock()
+		ids = append(ids, lookupReq.ID)
+		first := len(ids) == 1
+		lock.Unlock()
+		if first {
+			return errDrop // the connection fails before the request is answered
+		}
+		return trans.WriteLookupResp(&packet.LookupResp{ID: lookupReq.ID, EntryID: nugget.EntryID{1, 2, 3}})
+	})
+	defer s.stop()
+	c := openTestClient(t, s)
+	defer c.Close()
+
+	entryID, err := c.Lookup("/file")
+	if err != nil {
+		t.Fatal("Expected the lookup to be sent again once reconnected, got", err)
+	}
+	if entryID != (nugget.EntryID{1, 2, 3}) {
+		t.Error("Expected the EntryID answered, got", entryID)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Error("Expected the same request sent twice, got", ids)
+	}
+	if n := s.connections(); n != 2 {
+		t.Error("Expected 2 connections, got", n)
+	}
+}
+
+func TestRoundTripFailsCallsWhichMayHaveApplied(t *testing.T) {
+	var lock sync.Mutex
+	var mkdirs int
+	s := startFakeServer(t, "127.0.0.1:0", func(pktType packet.PktType, trans *packet.Transiever) error {
+		var mkdirReq packet.MkdirReq
+		if err := trans.GetMkdirReq(&mkdirReq); err != nil {
+			return err
+		}
+		lock.Lock()
+		mkdirs++
+		lock.Unlock()
+		return errDrop
+	})
+	defer s.stop()
+	c := openTestClient(t, s)
+	defer c.Close()
+
+	if _, _, err := c.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755}); err != ErrConnectionLost {
+		t.Error("Expected ErrConnectionLost, got", err)
+	}
+	waitReady(t, c)
+	lock.Lock()
+	defer lock.Unlock()
+	if mkdirs != 1 {
+		t.Error("Expected the mkdir to be sent once, was sent", mkdirs, "times")
+	}
+}
+
+func TestFailFastWhileDisconnected(t *testing.T) {
+	s := startFakeServer(t, "127.0.0.1:0", func(pktType packet.PktType, trans *packet.Transiever) error {
+		return errDrop
+	})
+	addr := s.addr()
+	c := openTestClient(t, s)
+	defer c.Close()
+	c.SetFailFast(true)
+
+	s.stop()
+	for i := 0; i < 100 && c.Ready(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	start := time.Now()
+	if _, err := c.Lookup("/file"); err != ErrDisconnected {
+		t.Error("Expected ErrDisconnected while disconnected, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected the call to fail without waiting, took", time.Since(start))
+	}
+
+	// the server returns, and the client reconnects in the background
+	s = startFakeServer(t, addr, func(pktType packet.PktType, trans *packet.Transiever) error {
+		var lookupReq packet.LookupReq
+		if err := trans.GetLookupReq(&lookupReq); err != nil {
+			return err
+		}
+		return trans.WriteLookupResp(&packet.LookupResp{ID: lookupReq.ID})
+	})
+	defer s.stop()
+	waitReady(t, c)
+	if _, err := c.Lookup("/file"); err != nil {
+		t.Error("Expected the lookup to succeed once reconnected, got", err)
+	}
+
+	c.Close()
+	if _, err := c.Lookup("/file"); err != ErrDisconnected {
+		t.Error("Expected ErrDisconnected once closed, got", err)
+	}
+}
+
+func TestCloseStopsReconnecting(t *testing.T) {
+	s := startFakeServer(t, "127.0.0.1:0", func(pktType packet.PktType, trans *packet.Transiever) error {
+		return errDrop
+	})
+	c := openTestClient(t, s)
+	s.stop()
+	for i := 0; i < 100 && c.Ready(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(maxReconnectDelay / 2):
+		t.Fatal("Expected Close to stop the routines without waiting out the backoff")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	delay := minReconnectDelay
+	for _, expected := range []time.Duration{time.Millisecond * 500, time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 16, maxReconnectDelay, maxReconnectDelay} {
+		if delay = nextReconnectDelay(delay); delay != expected {
+			t.Error("Expected a delay of", expected, "got", delay)
+		}
+	}
+}
+
+func TestDispatchDropsDuplicateResponses(t *testing.T) {
+	c := &RemoteSource{pending: map[uint64]*Call{}, logger: logger.New(ioutil.Discard, ioutil.Discard)}
+	call := c.registerRPC(make(chan interface{}, 1))
+
+	// a request sent again after reconnecting may be answered on both connections
+	c.dispatchCallResponse(call.id, packet.LookupResp{ID: call.id, EntryID: nugget.EntryID{1}})
+	c.dispatchCallResponse(call.id, packet.LookupResp{ID: call.id, EntryID: nugget.EntryID{2}})
+	c.dispatchCallResponse(call.id+1, packet.LookupResp{ID: call.id + 1})
+
+	if r := <-call.responseChan; r.(packet.LookupResp).EntryID != (nugget.EntryID{1}) {
+		t.Error("Expected the first response, got", r)
+	}
+	select {
+	case r := <-call.responseChan:
+		t.Error("Expected the duplicate response to be dropped, got", r)
+	default:
+	}
+}
+
+// dropFetchStreams returns a handler which drops the connection on every FetchStream request, counting them.
+func dropFetchStreams(lock *sync.Mutex, fetches *int) func(pktType packet.PktType, trans *packet.Transiever) error {
+	return func(pktType packet.PktType, trans *packet.Transiever) error {
+		var fetchStreamReq packet.FetchStreamReq
+		if err := trans.GetFetchStreamReq(&fetchStreamReq); err != nil {
+			return err
+		}
+		lock.Lock()
+		*fetches++
+		lock.Unlock()
+		return errDrop
+	}
+}
+
+func TestStreamRetriesEndWhenFailingFast(t *testing.T) {
+	var lock sync.Mutex
+	var fetches int
+	s := startFakeServer(t, "127.0.0.1:0", dropFetchStreams(&lock, &fetches))
+	defer s.stop()
+	c := openTestClient(t, s)
+	defer c.Close()
+	c.SetFailFast(true)
+
+	if _, _, _, err := c.Fetch("/file"); err != ErrDisconnected {
+		t.Error("Expected ErrDisconnected once the connection was lost, got", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if fetches != 1 {
+		t.Error("Expected the stream to be opened once, was opened", fetches, "times")
+	}
+}
+
+func TestStreamRetriesEndOnceClosed(t *testing.T) {
+	var lock sync.Mutex
+	var fetches int
+	s := startFakeServer(t, "127.0.0.1:0", dropFetchStreams(&lock, &fetches))
+	defer s.stop()
+	c := openTestClient(t, s)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read("/file", 0, packet.StreamChunkSize+1)
+		done <- err
+	}()
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		retried := fetches > 1
+		lock.Unlock()
+		if retried {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	c.Close()
+	select {
+	case err := <-done:
+		if err != ErrDisconnected {
+			t.Error("Expected ErrDisconnected once closed, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the read to stop retrying once closed")
+	}
+}
+
+func TestFetchReaderStreamsLargeRanges(t *testing.T) {
+	content := make([]byte, packet.StreamChunkSize*3)
+	rand.Read(content)
+	s := startFakeServer(t, "127.0.0.1:0", func(pktType packet.PktType, trans *packet.Transiever) error {
+		if pktType == packet.PktStreamAck {
+			var ack packet.StreamAck
+			return trans.GetStreamAck(&ack)
+		}
+		var fetchStreamReq packet.FetchStreamReq
+		if err := trans.GetFetchStreamReq(&fetchStreamReq); err != nil {
+			return err
+		}
+		err := trans.WriteFetchStreamResp(&packet.FetchStreamResp{
+			ID:   fetchStreamReq.ID,
+			Meta: nuggdb.EntryMetadata{Lname: "file", Size: uint64(len(content))},
+		})
+		if err != nil {
+			return err
+		}
+		data := content[fetchStreamReq.Offset : fetchStreamReq.Offset+fetchStreamReq.Size]
+		for seq := uint64(0); ; seq++ {
+			chunk := data
+			if len(chunk) > packet.StreamChunkSize {
+				chunk = chunk[:packet.StreamChunkSize]
+			}
+			data = data[len(chunk):]
+			err = trans.WriteStreamData(&packet.StreamData{ID: fetchStreamReq.ID, Seq: seq, Data: chunk, EOF: len(data) == 0})
+			if err != nil || len(data) == 0 {
+				return err
+			}
+		}
+	})
+	defer s.stop()
+	c := openTestClient(t, s)
+	defer c.Close()
+
+	offset, size := int64(100), int64(packet.StreamChunkSize*2)
+	r, err := c.FetchReader("/file", offset, size)
+	if err != nil {
+		t.Fatal("FetchReader failed:", err)
+	}
+	defer r.Close()
+	if _, isStream := r.(*StreamReader); !isStream || r.(*StreamReader).call == nil {
+		t.Fatal("Expected the range to be streamed")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Reading the stream failed:", err)
+	}
+	if !bytes.Equal(data, content[offset:offset+size]) {
+		t.Error("Expected the range requested, got", len(data), "bytes")
+	}
+	if meta := r.(*StreamReader).Meta(); meta == nil || meta.GetSize() != uint64(len(content)) {
+		t.Error("Expected the metadata of the file, got", meta)
+	}
+}
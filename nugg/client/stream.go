@@ -0,0 +1,474 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// StreamReader reads the data of a file as it is streamed from the server, so large files are read
+// with bounded memory and no overall timeout. It must be closed once done with.
+type StreamReader struct {
+	c    *RemoteSource
+	s    *session // the connection the data is streamed over
+	call *Call    // nil if the data was read with a single request
+
+	entryID nugget.EntryID
+	meta    nugget.NodeMetadata
+
+	chunk []byte
+	err   error
+}
+
+// FetchReader implements nugget.StreamDataSource, returning a *StreamReader for at most size bytes of the
+// file at path from offset, or the rest of the file if size is negative. Ranges no larger than a single
+// StreamData packet, and files on servers which cannot stream data, are read with a single request. A
+// stream cannot continue on a new connection, so if the connection is lost reading fails with
+// ErrConnectionLost.
+func (c *RemoteSource) FetchReader(path string, offset, size int64) (io.ReadCloser, error) {
+	if !c.Supports(packet.PktFetchStream) || (size >= 0 && size <= packet.StreamChunkSize) {
+		return c.readWhole(path, offset, size)
+	}
+	r, err := c.openReader(path, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readWhole reads a range of the file at path with a single request, for a StreamReader to return.
+func (c *RemoteSource) readWhole(path string, offset, size int64) (*StreamReader, error) {
+	if size >= 0 {
+		data, err := c.Read(path, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		return &StreamReader{c: c, chunk: data, err: io.EOF}, nil
+	}
+	entryID, meta, data, err := c.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return &StreamReader{c: c, entryID: entryID, meta: meta, chunk: data[offset:], err: io.EOF}, nil
+}
+
+// openReader opens a stream of at most size bytes of the file at path from offset, or the rest of the
+// file if size is negative. A stream cannot continue on a new connection, so if the connection is lost the
+// stream fails with ErrConnectionLost.
+func (c *RemoteSource) openReader(path string, offset, size int64) (*StreamReader, error) {
+	responseChan := make(chan interface{}, 1)
+	call := c.registerStream(responseChan, nil, packet.NewStreamBuffer())
+
+	var fetchStreamRequest packet.FetchStreamReq
+	fetchStreamRequest.ID = call.id
+	fetchStreamRequest.Path = path
+	fetchStreamRequest.Offset = offset
+	fetchStreamRequest.Size = size
+
+	r, err := c.roundTrip(call, defaultTimeout, notIdempotent, func(t *packet.Transiever) error {
+		return t.WriteFetchStreamReq(&fetchStreamRequest)
+	})
+	s := c.session()
+	if err == ErrTimeout {
+		s.transiever.WriteStreamAck(&packet.StreamAck{ID: call.id, Cancel: true})
+	}
+	if err != nil {
+		c.unregisterRPC(call)
+		return nil, err
+	}
+	fetchStreamResp := r.(packet.FetchStreamResp)
+	if fetchStreamResp.ErrorCode != packet.ErrNoError {
+		c.unregisterRPC(call)
+		return nil, packet.ErrorCodeToErr(fetchStreamResp.ErrorCode)
+	}
+	return &StreamReader{c: c, s: s, call: call, entryID: fetchStreamResp.EntryID, meta: &fetchStreamResp.Meta}, nil
+}
+
+// Read implements io.Reader.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.chunk, r.err = r.call.buffer.Next(defaultTimeout)
+		if r.err == packet.ErrStreamStalled {
+			r.err = ErrTimeout
+		}
+		if len(r.chunk) > 0 {
+			r.s.transiever.WriteStreamAck(&packet.StreamAck{ID: r.call.id, Bytes: uint32(len(r.chunk))})
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Close implements io.Closer, cancelling the stream if it has not been read to the end.
+func (r *StreamReader) Close() error {
+	if r.call == nil {
+		return nil
+	}
+	if r.err != io.EOF {
+		r.s.transiever.WriteStreamAck(&packet.StreamAck{ID: r.call.id, Cancel: true})
+	}
+	r.c.unregisterRPC(r.call)
+	r.call = nil
+	return nil
+}
+
+// EntryID returns the EntryID of the file being read, which is not known for ranges read with a single
+// request.
+func (r *StreamReader) EntryID() nugget.EntryID {
+	return r.entryID
+}
+
+// Meta returns the metadata of the file being read, as of when the stream was opened, or nil for ranges
+// read with a single request.
+func (r *StreamReader) Meta() nugget.NodeMetadata {
+	return r.meta
+}
+
+// StreamWriter writes data to a file as a stream, waiting for the server to acknowledge data it has
+// written before sending more, so large files are written with bounded memory and no overall timeout.
+// It must be closed to finish writing the file.
+type StreamWriter struct {
+	c    *RemoteSource
+	s    *session // the connection the data is streamed over
+	call *Call    // nil if the data is stored whole once the writer is closed
+	path string
+	data []byte // the data held until then
+
+	seq     uint64
+	written int64
+	entryID nugget.EntryID
+	meta    nugget.NodeMetadata
+	err     error
+	closed  bool
+}
+
+// StoreWriter creates or truncates the file at path, returning a StreamWriter for its new contents. The
+// file only switches to the new contents once the writer is closed. Servers which cannot stream data have
+// the data stored whole once the writer is closed. A stream cannot continue on a new connection, so if the
+// connection is lost writing fails with ErrConnectionLost.
+func (c *RemoteSource) StoreWriter(path string) (*StreamWriter, error) {
+	if !c.Supports(packet.PktStoreStream) {
+		return &StreamWriter{c: c, path: path}, nil
+	}
+	return c.openWriter(path, 0, true)
+}
+
+// openWriter opens a stream of data to write to the file at path from offset, creating or emptying it
+// first if truncate is set. A stream cannot continue on a new connection, so if the connection is lost the
+// stream fails with ErrConnectionLost.
+func (c *RemoteSource) openWriter(path string, offset int64, truncate bool) (*StreamWriter, error) {
+	s, err := c.connected()
+	if err != nil {
+		return nil, err
+	}
+	call := c.registerStream(make(chan interface{}, 1), packet.NewWindow(packet.StreamWindowSize), nil)
+
+	var storeStreamRequest packet.StoreStreamReq
+	storeStreamRequest.ID = call.id
+	storeStreamRequest.Path = path
+	storeStreamRequest.Offset = offset
+	storeStreamRequest.Truncate = truncate
+	if err = s.transiever.WriteStoreStreamReq(&storeStreamRequest); err != nil && !s.broken(err) {
+		c.unregisterRPC(call)
+		return nil, err
+	}
+	return &StreamWriter{c: c, s: s, call: call, path: path}, nil
+}
+
+// Write implements io.Writer.
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, packet.ErrStreamClosed
+	}
+	if w.call == nil {
+		w.data = append(w.data, p...)
+		return len(p), nil
+	}
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > packet.StreamChunkSize {
+			chunk = chunk[:packet.StreamChunkSize]
+		}
+		if err := w.send(chunk, false); err != nil {
+			w.err = err
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// send writes the next StreamData packet once the window allows it.
+func (w *StreamWriter) send(chunk []byte, eof bool) error {
+	if err := w.call.window.Take(int64(len(chunk)), defaultTimeout); err != nil {
+		if err == packet.ErrStreamStalled {
+			return ErrTimeout
+		}
+		// the window is closed when the server answers, which it does early if writing fails
+		select {
+		case r := <-w.call.responseChan:
+			w.finish(r.(packet.StoreStreamResp))
+			if w.err != nil {
+				return w.err
+			}
+		default:
+		}
+		if w.s.isDown() {
+			return ErrConnectionLost
+		}
+		return err
+	}
+
+	data := packet.StreamData{ID: w.call.id, Seq: w.seq, Data: chunk, EOF: eof}
+	w.seq++
+	if err := w.s.transiever.WriteStreamData(&data); err != nil {
+		if w.s.broken(err) {
+			return ErrConnectionLost
+		}
+		return err
+	}
+	return nil
+}
+
+// Close implements io.Closer, finishing the stream and waiting for the server to write the last of the
+// data. The error writing the file, if any, is returned.
+func (w *StreamWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.call == nil {
+		if w.err == nil {
+			w.entryID, w.meta, w.err = w.c.Store(w.path, w.data)
+			w.written = int64(len(w.data))
+		}
+		return w.err
+	}
+	defer w.c.unregisterRPC(w.call)
+
+	if w.err != nil {
+		// tell the server to stop waiting for data
+		w.s.transiever.WriteStreamData(&packet.StreamData{ID: w.call.id, Seq: w.seq, ErrorCode: packet.ErrIOErr})
+		return w.err
+	}
+	if w.err = w.send(nil, true); w.err != nil {
+		return w.err
+	}
+
+	// wait for the response, for as long as the server keeps acknowledging data
+	for {
+		select {
+		case r := <-w.call.responseChan:
+			w.finish(r.(packet.StoreStreamResp))
+			return w.err
+		case <-w.call.window.Changed():
+		case <-w.s.down:
+			w.err = ErrConnectionLost
+			return w.err
+		case <-time.After(defaultTimeout):
+			w.err = ErrTimeout
+			return w.err
+		}
+	}
+}
+
+// finish records the response to the stream.
+func (w *StreamWriter) finish(storeStreamResp packet.StoreStreamResp) {
+	w.written = storeStreamResp.Written
+	if storeStreamResp.ErrorCode != packet.ErrNoError {
+		w.err = packet.ErrorCodeToErr(storeStreamResp.ErrorCode)
+		return
+	}
+	w.entryID, w.meta = storeStreamResp.EntryID, &storeStreamResp.Meta
+}
+
+// Written returns the number of bytes the server wrote, once the writer is closed.
+func (w *StreamWriter) Written() int64 {
+	return w.written
+}
+
+// EntryID returns the EntryID of the file written, once the writer is closed.
+func (w *StreamWriter) EntryID() nugget.EntryID {
+	return w.entryID
+}
+
+// Meta returns the metadata of the file written, once the writer is closed.
+func (w *StreamWriter) Meta() nugget.NodeMetadata {
+	return w.meta
+}
+
+// fetchStream fetches the file at path over a stream. Reading is idempotent, so it starts again if the
+// connection is lost, once it is re-established.
+func (c *RemoteSource) fetchStream(path string) (nugget.EntryID, nugget.NodeMetadata, []byte, error) {
+	for {
+		entryID, meta, data, err := c.fetchStreamOnce(path)
+		if err != ErrConnectionLost {
+			return entryID, meta, data, err
+		}
+		if _, err = c.connected(); err != nil {
+			return nugget.EntryID{}, nil, []byte(""), err
+		}
+		c.logger.Info("rpc", "Fetching ", path, " again once reconnected")
+	}
+}
+
+func (c *RemoteSource) fetchStreamOnce(path string) (nugget.EntryID, nugget.NodeMetadata, []byte, error) {
+	r, err := c.openReader(path, 0, -1)
+	if err != nil {
+		return nugget.EntryID{}, nil, []byte(""), err
+	}
+	defer r.Close()
+
+	// the size reported by the server only sizes the buffer up to a window, so a bogus size cannot
+	// allocate more than the data which actually arrives
+	var buf bytes.Buffer
+	size := int64(r.Meta().GetSize())
+	if size > packet.StreamWindowSize {
+		size = packet.StreamWindowSize
+	}
+	buf.Grow(int(size))
+	_, err = io.Copy(&buf, r)
+	return r.EntryID(), r.Meta(), buf.Bytes(), err
+}
+
+// readStream reads up to size bytes of the file at path from offset over a stream. Reading is
+// idempotent, so it starts again if the connection is lost, once it is re-established.
+func (c *RemoteSource) readStream(path string, offset, size int64) ([]byte, error) {
+	for {
+		data, err := c.readStreamOnce(path, offset, size)
+		if err != ErrConnectionLost {
+			return data, err
+		}
+		if _, err = c.connected(); err != nil {
+			return []byte(""), err
+		}
+		c.logger.Info("rpc", "Reading ", path, " again once reconnected")
+	}
+}
+
+func (c *RemoteSource) readStreamOnce(path string, offset, size int64) ([]byte, error) {
+	r, err := c.openReader(path, offset, size)
+	if err != nil {
+		return []byte(""), err
+	}
+	defer r.Close()
+
+	// the data is read straight into a buffer of the size requested, or of the rest of the file if that
+	// is smaller, so no more is held than the caller asked for
+	if n := int64(r.Meta().GetSize()) - offset; n < size {
+		size = n
+	}
+	if size < 0 {
+		size = 0
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF { // the file was truncated since the stream was opened
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// writeStream writes data to the file at path from offset over a stream. Writing the same data at the same
+// offset is idempotent, so it starts again if the connection is lost, once it is re-established.
+func (c *RemoteSource) writeStream(path string, offset int64, data []byte, truncate bool) (int64, nugget.EntryID, nugget.NodeMetadata, error) {
+	for {
+		written, entryID, meta, err := c.writeStreamOnce(path, offset, data, truncate)
+		if err != ErrConnectionLost {
+			return written, entryID, meta, err
+		}
+		if _, err = c.connected(); err != nil {
+			return written, entryID, meta, err
+		}
+		c.logger.Info("rpc", "Writing ", path, " again once reconnected")
+	}
+}
+
+func (c *RemoteSource) writeStreamOnce(path string, offset int64, data []byte, truncate bool) (int64, nugget.EntryID, nugget.NodeMetadata, error) {
+	w, err := c.openWriter(path, offset, truncate)
+	if err != nil {
+		return 0, nugget.EntryID{}, nil, err
+	}
+	if _, err = io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		return w.Written(), nugget.EntryID{}, nil, err
+	}
+	err = w.Close()
+	return w.Written(), w.EntryID(), w.Meta(), err
+}
+
+func (c *RemoteSource) processFetchStreamResponse(t *packet.Transiever) error {
+	var fetchStreamResp packet.FetchStreamResp
+	err := t.GetFetchStreamResp(&fetchStreamResp)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(fetchStreamResp.ID, fetchStreamResp)
+	return nil
+}
+
+func (c *RemoteSource) processStoreStreamResponse(t *packet.Transiever) error {
+	var storeStreamResp packet.StoreStreamResp
+	err := t.GetStoreStreamResp(&storeStreamResp)
+	if err != nil {
+		return err
+	}
+
+	c.dispatchCallResponse(storeStreamResp.ID, storeStreamResp)
+	// the server has stopped reading the stream, so wake a writer waiting to send more
+	if call := c.findCall(storeStreamResp.ID); call != nil && call.window != nil {
+		call.window.Close()
+	}
+	return nil
+}
+
+func (c *RemoteSource) processStreamData(t *packet.Transiever) error {
+	var data packet.StreamData
+	err := t.GetStreamData(&data)
+	if err != nil {
+		return err
+	}
+
+	call := c.findCall(data.ID)
+	if call == nil || call.buffer == nil {
+		return nil // the stream was cancelled
+	}
+	if err = call.buffer.Put(&data); err != nil {
+		c.logger.Warning("net-read", "Ending stream ", data.ID, ": ", err)
+		return t.WriteStreamAck(&packet.StreamAck{ID: data.ID, Cancel: true})
+	}
+	return nil
+}
+
+func (c *RemoteSource) processStreamAck(t *packet.Transiever) error {
+	var ack packet.StreamAck
+	err := t.GetStreamAck(&ack)
+	if err != nil {
+		return err
+	}
+
+	if call := c.findCall(ack.ID); call != nil && call.window != nil {
+		if ack.Cancel {
+			call.window.Close()
+		} else {
+			call.window.Grant(int64(ack.Bytes))
+		}
+	}
+	return nil
+}
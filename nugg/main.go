@@ -27,6 +27,7 @@ var connectAddrVar string
 var caCertPemPathVar string
 var certPemPathVar string
 var keyPemPathVar string
+var onOutageVar string
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -39,6 +40,7 @@ func flags() {
 	flag.StringVar(&caCertPemPathVar, "cacert", "ca.pem", "Path to the PEM-formatted authority certificate")
 	flag.StringVar(&certPemPathVar, "cert", "cert.pem", "Path to the PEM-formatted client certificate")
 	flag.StringVar(&keyPemPathVar, "key", "key.pem", "Path to the PEM-formatted client key")
+	flag.StringVar(&onOutageVar, "on-outage", "block", "How filesystem calls behave while reconnecting to the remote: 'block' until reconnected, or fail with 'eio'")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -47,6 +49,10 @@ func flags() {
 		usage()
 		os.Exit(2)
 	}
+	if onOutageVar != "block" && onOutageVar != "eio" {
+		fmt.Fprintf(os.Stderr, "Err: --on-outage must be 'block' or 'eio', got '%s'\n", onOutageVar)
+		os.Exit(2)
+	}
 	checkCertFiles()
 }
 
@@ -56,12 +62,13 @@ func main() {
 	l := logger.New(os.Stdout, os.Stderr)
 	fatalErrChan := make(chan error)
 
-	c, err := client.Open(connectAddrVar, certPemPathVar, keyPemPathVar, caCertPemPathVar, l, fatalErrChan)
+	c, err := client.Open(connectAddrVar, certPemPathVar, keyPemPathVar, caCertPemPathVar, l)
 	if err != nil {
 		l.Error("main", "Could not connect to remote: ", err)
 		os.Exit(1)
 	}
 	defer c.Close()
+	c.SetFailFast(onOutageVar == "eio")
 
 	fuseConn := doMount(flag.Arg(0), l, c, fatalErrChan)
 	defer fuseConn.Close()
@@ -77,6 +84,9 @@ func doMount(mountpoint string, l *logger.Logger, provider *client.RemoteSource,
 	sysFS := sysstatfs.Make(inodeSource)
 	sysFS.SetComputedVariable("ok", func() []byte { return []byte(boolToIntString(provider.Ready())) })
 	sysFS.SetComputedVariable("latency", func() []byte { return []byte(strconv.FormatInt(provider.Latency(), 10)) })
+	sysFS.SetComputedVariable("protocol_version", func() []byte {
+		return []byte(strconv.FormatUint(uint64(provider.ProtocolVersion()), 10))
+	})
 
 	mainFS.SetOverride("sys", sysFS)
 
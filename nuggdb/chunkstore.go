@@ -4,9 +4,11 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
 	"github.com/twitchyliquid64/nugget"
 )
@@ -16,10 +18,15 @@ const chunkBucket = "ChunkIDToData"
 // ErrChunkNotFound is returned if the chunk requested was not found in the chunkstore.
 var ErrChunkNotFound = errors.New("Could not find chunk in chunkstore")
 
+// ErrChunkSealed is returned when modifying an encrypted chunk in place.
+var ErrChunkSealed = errors.New("Encrypted chunks cannot be modified in place")
+
 // Chunkstore is the concrete instance responsible
 // for storing / fetching chunks by chunk ID.
+// When encrypted, chunks are sealed as a whole, and so are never modified in place.
 type Chunkstore struct {
-	path string
+	path   string
+	sealer *sealer
 }
 
 // OpenChunkStore opens a chunkstore backed by the file at path.
@@ -46,12 +53,30 @@ func (cs *Chunkstore) Lookup(chunkID nugget.ChunkID) ([]byte, error) {
 		return []byte(""), ErrChunkNotFound
 	}
 
-	return ioutil.ReadFile(fPath)
+	data, err := ioutil.ReadFile(fPath)
+	if err != nil {
+		return data, err
+	}
+	return cs.sealer.open(data, chunkID[:])
+}
+
+// lookupDecoded returns the data held in a chunk encoded with codec.
+func (cs *Chunkstore) lookupDecoded(chunkID nugget.ChunkID, codec Codec) ([]byte, error) {
+	data, err := cs.Lookup(chunkID)
+	if err != nil {
+		return data, err
+	}
+	return codec.decode(data)
 }
 
+// Write writes data into the chunk at offset, returning the number of bytes written
+// and the new size of the chunk.
 func (cs *Chunkstore) Write(chunkID nugget.ChunkID, offset int64, data []byte) (int, int64, error) {
+	if cs.sealer != nil {
+		return 0, 0, ErrChunkSealed
+	}
 	fPath := path.Join(cs.path, cs.dirPrefix(chunkID), cs.fileName(chunkID))
-	fHandle, err := os.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	fHandle, err := os.OpenFile(fPath, os.O_WRONLY|os.O_CREATE, 0755)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return 0, 0, ErrChunkNotFound
@@ -70,7 +95,25 @@ func (cs *Chunkstore) Write(chunkID nugget.ChunkID, offset int64, data []byte) (
 	return written, stat.Size(), err
 }
 
-func (cs *Chunkstore) Read(chunkID nugget.ChunkID, offset int64, size int64) ([]byte, error) {
+// Read returns up to size bytes of the chunk starting at offset, where offset and size refer to
+// the data held in the chunk after decoding it with codec. io.EOF is returned if the chunk ends
+// before size bytes could be read.
+func (cs *Chunkstore) Read(chunkID nugget.ChunkID, codec Codec, offset int64, size int64) ([]byte, error) {
+	if codec != CodecNone || cs.sealer != nil {
+		// compressed and encrypted chunks cannot be read from the middle, so are decoded whole
+		data, err := cs.lookupDecoded(chunkID, codec)
+		if err != nil {
+			return []byte(""), err
+		}
+		if offset >= int64(len(data)) {
+			return []byte(""), io.EOF
+		}
+		if offset+size > int64(len(data)) {
+			return data[offset:], io.EOF
+		}
+		return data[offset : offset+size], nil
+	}
+
 	fPath := path.Join(cs.path, cs.dirPrefix(chunkID), cs.fileName(chunkID))
 	fHandle, err := os.Open(fPath)
 	if err != nil {
@@ -85,6 +128,35 @@ func (cs *Chunkstore) Read(chunkID nugget.ChunkID, offset int64, size int64) ([]
 	return buff[:n], err
 }
 
+// Truncate changes the size of a chunk, discarding data past size or extending it with zeros.
+func (cs *Chunkstore) Truncate(chunkID nugget.ChunkID, size int64) error {
+	if cs.sealer != nil {
+		return ErrChunkSealed
+	}
+	fPath := path.Join(cs.path, cs.dirPrefix(chunkID), cs.fileName(chunkID))
+	err := os.Truncate(fPath, size)
+	if os.IsNotExist(err) {
+		return ErrChunkNotFound
+	}
+	return err
+}
+
+// modTime returns the time a chunk was last written.
+func (cs *Chunkstore) modTime(chunkID nugget.ChunkID) (time.Time, error) {
+	stat, err := os.Stat(cs.chunkPath(chunkID))
+	if os.IsNotExist(err) {
+		return time.Time{}, ErrChunkNotFound
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// chunkPath returns the path of the file holding a chunk.
+func (cs *Chunkstore) chunkPath(chunkID nugget.ChunkID) string {
+	return path.Join(cs.path, cs.dirPrefix(chunkID), cs.fileName(chunkID))
+}
+
 func (cs *Chunkstore) dirPrefix(chunkID nugget.ChunkID) string {
 	return hex.EncodeToString(chunkID[:2])
 }
@@ -105,7 +177,40 @@ func (cs *Chunkstore) Commit(chunkID nugget.ChunkID, data []byte) error {
 	}
 
 	fPath := path.Join(cs.path, cs.dirPrefix(chunkID), cs.fileName(chunkID))
-	return ioutil.WriteFile(fPath, data, 0755)
+	return ioutil.WriteFile(fPath, cs.sealer.seal(data, chunkID[:]), 0755)
+}
+
+// commitOnce saves data for chunkID unless the chunk already exists. The data is written to a
+// temporary file which is renamed into place, so a chunk is never seen partially written.
+func (cs *Chunkstore) commitOnce(chunkID nugget.ChunkID, data []byte) error {
+	fPath := cs.chunkPath(chunkID)
+	if fileExists(fPath) {
+		return nil
+	}
+	dirPath := path.Join(cs.path, cs.dirPrefix(chunkID))
+	if !fileExists(dirPath) {
+		if err := os.Mkdir(dirPath, 0777); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(dirPath, ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(cs.sealer.seal(data, chunkID[:])); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), fPath); err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 // Forge saves data with a new chunk ID and returns it.
@@ -121,6 +226,38 @@ func (cs *Chunkstore) Close() error {
 	return nil
 }
 
+// ForEach calls fn with the ID and size of every chunk in the chunkstore. Files which are not named
+// like chunks are skipped. Iteration stops at the first error returned by fn.
+func (cs *Chunkstore) ForEach(fn func(chunkID nugget.ChunkID, size int64) error) error {
+	prefixes, err := ioutil.ReadDir(cs.path)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		prefixBytes, err := hex.DecodeString(prefix.Name())
+		if !prefix.IsDir() || err != nil || len(prefixBytes) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(cs.path, prefix.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			nameBytes, err := hex.DecodeString(file.Name())
+			if file.IsDir() || err != nil || len(nameBytes) != len(nugget.ChunkID{})-2 {
+				continue
+			}
+			var chunkID nugget.ChunkID
+			copy(chunkID[:2], prefixBytes)
+			copy(chunkID[2:], nameBytes)
+			if err = fn(chunkID, file.Size()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Delete removes a chunk from the chunkstore. Nil is returned if the chunk does not exist.
 func (cs *Chunkstore) Delete(chunkID nugget.ChunkID) error {
 	fPath := path.Join(cs.path, cs.dirPrefix(chunkID), cs.fileName(chunkID))
@@ -91,3 +91,28 @@ func TestForgeChunkstoreSucceedsAndLookup(t *testing.T) {
 		t.Error("Mismatch. Wanted", []byte{5, 2, 3, 4, 5}, "got", data)
 	}
 }
+
+func TestChunkstoreForEach(t *testing.T) {
+	cs, err := OpenChunkStore("testchunkstore.db")
+	defer func() {
+		cs.Close()
+		os.RemoveAll("testchunkstore.db")
+	}()
+	if err != nil {
+		t.Error(err)
+	}
+
+	id1, _ := cs.Forge([]byte("one"))
+	id2, _ := cs.Forge([]byte("three"))
+	found := map[nugget.ChunkID]int64{}
+	err = cs.ForEach(func(chunkID nugget.ChunkID, size int64) error {
+		found[chunkID] = size
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(found) != 2 || found[id1] != 3 || found[id2] != 5 {
+		t.Error("Unexpected chunks", found)
+	}
+}
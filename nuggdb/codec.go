@@ -0,0 +1,100 @@
+package nuggdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+)
+
+// codec.go implements the compression applied to chunk data at rest. The codec of a file is
+// recorded in its LocalityInfo, so files written with different codecs can live in one store.
+
+// Codec identifies how the data of a chunk is encoded on disk.
+type Codec uint8
+
+// Codecs which chunk data may be encoded with.
+const (
+	CodecNone  Codec = 0
+	CodecGzip  Codec = 1
+	CodecFlate Codec = 2
+)
+
+// ErrUnknownCodec is returned for a codec which is not supported by this build.
+var ErrUnknownCodec = errors.New("Unknown or unsupported compression codec")
+
+var codecNames = map[Codec]string{
+	CodecNone:  "none",
+	CodecGzip:  "gzip",
+	CodecFlate: "flate",
+}
+
+// ParseCodec returns the codec with the given name, as returned by Codec.String.
+func ParseCodec(name string) (Codec, error) {
+	for codec, codecName := range codecNames {
+		if codecName == name {
+			return codec, nil
+		}
+	}
+	return CodecNone, ErrUnknownCodec
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// encode returns data as it should be stored on disk.
+func (c Codec) encode(data []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		w := gzip.NewWriter(&buff)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case CodecFlate:
+		w, err := flate.NewWriter(&buff, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(data); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnknownCodec
+	}
+	return buff.Bytes(), nil
+}
+
+// decode returns the data held in an encoded chunk.
+func (c Codec) decode(data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CodecFlate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
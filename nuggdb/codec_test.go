@@ -0,0 +1,30 @@
+package nuggdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("nugget "), 100)
+	for codec, name := range codecNames {
+		parsed, err := ParseCodec(name)
+		if err != nil || parsed != codec {
+			t.Errorf("Expected %q to parse as %d, got %d (%v)", name, codec, parsed, err)
+		}
+		encoded, err := codec.encode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec != CodecNone && len(encoded) >= len(data) {
+			t.Errorf("Expected %s to compress, got %d bytes", codec, len(encoded))
+		}
+		decoded, err := codec.decode(encoded)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("Expected %s to round trip, got %d bytes (%v)", codec, len(decoded), err)
+		}
+	}
+	if _, err := ParseCodec("zstd"); err != ErrUnknownCodec {
+		t.Error("Expected unsupported codec to be rejected, got", err)
+	}
+}
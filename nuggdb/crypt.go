@@ -0,0 +1,130 @@
+package nuggdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io/ioutil"
+)
+
+// crypt.go implements encryption at rest. Chunk data, metadata, directory listings and the paths
+// held by the pathstore are sealed with AES-256-GCM, and pathstore keys are replaced by a keyed
+// hash of the path. Every value is bound to the key it is stored under, so values cannot be
+// swapped between keys undetected.
+//
+// A nil *sealer represents an unencrypted data directory, and passes everything through as is.
+
+// KeySize is the size of the key held in a key file.
+const KeySize = 32
+
+const keyCheckSetting = "KeyCheck"
+
+var (
+	// ErrInvalidKeyFile is returned for a key file which does not hold a KeySize byte key.
+	ErrInvalidKeyFile = errors.New("Key file must hold 32 bytes, either raw or hex encoded")
+	// ErrKeyRequired is returned when opening an encrypted data directory without a key.
+	ErrKeyRequired = errors.New("Data directory is encrypted, a key file is required")
+	// ErrWrongKey is returned when opening an encrypted data directory with the wrong key.
+	ErrWrongKey = errors.New("Key does not match the data directory")
+	// ErrNotEncrypted is returned when enabling encryption for a data directory which already holds data.
+	ErrNotEncrypted = errors.New("Encryption can only be enabled for an empty data directory")
+	// ErrSealCorrupt is returned when sealed data fails authentication.
+	ErrSealCorrupt = errors.New("Encrypted data is corrupt or has been tampered with")
+)
+
+type sealer struct {
+	aead     cipher.AEAD
+	pathKey  []byte
+	chunkKey []byte
+	check    []byte
+}
+
+// loadKeyFile returns a sealer using the key held in the file at keyPath.
+func loadKeyFile(keyPath string) (*sealer, error) {
+	contents, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key := contents
+	if len(key) != KeySize {
+		key, err = hex.DecodeString(string(bytes.TrimSpace(contents)))
+		if err != nil || len(key) != KeySize {
+			return nil, ErrInvalidKeyFile
+		}
+	}
+	return newSealer(key)
+}
+
+// newSealer derives independent keys for each purpose from key.
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(subkey(key, "data"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{
+		aead:     aead,
+		pathKey:  subkey(key, "path"),
+		chunkKey: subkey(key, "chunk"),
+		check:    subkey(key, "check"),
+	}, nil
+}
+
+func subkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("nugget " + purpose))
+	return mac.Sum(nil)
+}
+
+// seal encrypts data stored under key, prefixing it with a random nonce.
+func (s *sealer) seal(data, key []byte) []byte {
+	if s == nil {
+		return data
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(data)+s.aead.Overhead())
+	rand.Read(nonce)
+	return s.aead.Seal(nonce, nonce, data, key)
+}
+
+// open decrypts data sealed under key.
+func (s *sealer) open(data, key []byte) ([]byte, error) {
+	if s == nil {
+		return data, nil
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, ErrSealCorrupt
+	}
+	out, err := s.aead.Open(nil, data[:s.aead.NonceSize()], data[s.aead.NonceSize():], key)
+	if err != nil {
+		return nil, ErrSealCorrupt
+	}
+	return out, nil
+}
+
+// keyForPath returns the pathstore key of fPath.
+func (s *sealer) keyForPath(fPath string) []byte {
+	if s == nil {
+		return []byte(fPath)
+	}
+	mac := hmac.New(sha256.New, s.pathKey)
+	mac.Write([]byte(fPath))
+	return mac.Sum(nil)
+}
+
+// contentHash returns the hash content-addressed chunk IDs are derived with. A keyed hash is used
+// when encrypted, so chunk IDs cannot be used to confirm the contents of a chunk.
+func (s *sealer) contentHash() hash.Hash {
+	if s == nil {
+		return sha256.New()
+	}
+	return hmac.New(sha256.New, s.chunkKey)
+}
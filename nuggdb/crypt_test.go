@@ -0,0 +1,112 @@
+package nuggdb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/twitchyliquid64/nugget"
+)
+
+func TestProviderEncryptsDataDirectory(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_crypt_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+	dataDir := path.Join(baseDir, "data")
+	keyFile := path.Join(baseDir, "key")
+	wrongKeyFile := path.Join(baseDir, "wrongkey")
+	os.Mkdir(dataDir, 0755)
+	ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(bytes.Repeat([]byte{1}, KeySize))+"\n"), 0600)
+	ioutil.WriteFile(wrongKeyFile, bytes.Repeat([]byte{2}, KeySize), 0600)
+
+	p, err := CreateWithOptions(dataDir, emptyLogger(), Options{KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.chunkSize = 4
+	p.Mkdir("/secretdir", nugget.NodeAttributes{Mode: 0755})
+	p.Store("/secretdir/secretfile", []byte("topsecretdata"))
+	if _, _, _, err = p.Write("/secretdir/secretfile", 3, []byte("SECRET")); err != nil {
+		t.Error(err)
+	}
+	if err = p.Rename("/secretdir", "/hiddendir"); err != nil {
+		t.Error(err)
+	}
+	p.Close()
+
+	filepath.Walk(dataDir, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		contents, _ := ioutil.ReadFile(fPath)
+		for _, secret := range []string{"secret", "SECRET", "hidden", "data"} {
+			if bytes.Contains(contents, []byte(secret)) {
+				t.Errorf("Expected %q not to appear in %s", secret, fPath)
+			}
+		}
+		return nil
+	})
+
+	if _, err = Create(dataDir, emptyLogger()); err != ErrKeyRequired {
+		t.Error("Expected ErrKeyRequired, got", err)
+	}
+	if _, err = CreateWithOptions(dataDir, emptyLogger(), Options{KeyFile: wrongKeyFile}); err != ErrWrongKey {
+		t.Error("Expected ErrWrongKey, got", err)
+	}
+
+	p, err = CreateWithOptions(dataDir, emptyLogger(), Options{KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, data, err := p.Fetch("/hiddendir/secretfile"); err != nil || string(data) != "topSECRETdata" {
+		t.Errorf("Expected file to decrypt, got %q (%v)", data, err)
+	}
+	if entries, err := p.List("/hiddendir"); err != nil || len(entries) != 1 || entries[0].Identifier() != "/hiddendir/secretfile" {
+		t.Error("Expected listing to decrypt, got", entries, err)
+	}
+	p.Close()
+
+	c, err := OpenChecker(dataDir, emptyLogger(), keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if problems, err := c.Check(); err != nil || len(problems) != 0 {
+		t.Error("Expected no problems, got", problems, err)
+	}
+}
+
+func TestProviderRefusesToEncryptExistingData(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_crypt_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+	keyFile := path.Join(baseDir, "key")
+	ioutil.WriteFile(keyFile, bytes.Repeat([]byte{1}, KeySize), 0600)
+	dataDir := path.Join(baseDir, "data")
+	os.Mkdir(dataDir, 0755)
+
+	p, err := Create(dataDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Store("/plain", []byte("plain"))
+	p.Close()
+
+	if _, err = CreateWithOptions(dataDir, emptyLogger(), Options{KeyFile: keyFile}); err != ErrNotEncrypted {
+		t.Error("Expected ErrNotEncrypted, got", err)
+	}
+}
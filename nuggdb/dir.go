@@ -4,15 +4,25 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+
+	"github.com/twitchyliquid64/nugget"
 )
 
 type DirEntry struct {
 	EntryVersion uint16
 	IsDir        bool
+	IsLink       bool
 	Name         string
+	EntryID      nugget.EntryID // zero if the entry was indexed before EntryIDs were recorded
 }
 
+// DirEntrySize returns the size of a serialized DirEntry with a name of nameLen bytes.
 func DirEntrySize(nameLen int) int {
+	return 2 + 1 + 4 + nameLen
+}
+
+// dirEntrySizeV1 returns the size of a DirEntry serialized before names could exceed 65535 bytes.
+func dirEntrySizeV1(nameLen int) int {
 	return 2 + 1 + 2 + nameLen + 1
 }
 
@@ -24,10 +34,18 @@ func (e *DirEntry) IsDirectory() bool {
 	return e.IsDir
 }
 
+func (e *DirEntry) IsSymlink() bool {
+	return e.IsLink
+}
+
+func (e *DirEntry) ID() nugget.EntryID {
+	return e.EntryID
+}
+
 // Serialize returns a byte slice which represents the DirEntry structure.
 func (e *DirEntry) Serialize() []byte {
-	buff := make([]byte, DirEntrySize(len(e.Name))) //EntryVersion + Flags(IsDir) + nameSize(uint16) + Name + nullbyte
-	e.EntryVersion = 1
+	buff := make([]byte, DirEntrySize(len(e.Name))) //EntryVersion + Flags(IsDir, IsLink) + nameSize(uint32) + Name
+	e.EntryVersion = 2
 
 	//Version
 	binary.LittleEndian.PutUint16(buff[:2], e.EntryVersion)
@@ -36,34 +54,74 @@ func (e *DirEntry) Serialize() []byte {
 	if e.IsDir {
 		buff[2] |= (1 << 0)
 	}
+	if e.IsLink {
+		buff[2] |= (1 << 1)
+	}
 
 	//Name length + Name
-	binary.LittleEndian.PutUint16(buff[3:5], uint16(len(e.Name)))
-	copy(buff[6:6+len(e.Name)], []byte(e.Name))
+	binary.LittleEndian.PutUint32(buff[3:7], uint32(len(e.Name)))
+	copy(buff[7:], []byte(e.Name))
 	return buff
 }
 
-func deserializeDirEntry(data []byte) (DirEntry, error) {
+// deserializeDirEntry decodes the DirEntry at the start of data, returning it along with its
+// serialized size.
+func deserializeDirEntry(data []byte) (DirEntry, int, error) {
 	var out DirEntry
+	if len(data) < 2 {
+		return DirEntry{}, 0, errDirEntryCorrupt
+	}
 	out.EntryVersion = binary.LittleEndian.Uint16(data[0:2])
-	if out.EntryVersion == 1 {
+	switch out.EntryVersion {
+	case 1:
+		if len(data) < dirEntrySizeV1(0) {
+			return DirEntry{}, 0, errDirEntryCorrupt
+		}
 		out.IsDir = (data[2] & 1) == 1
-		nameSize := binary.LittleEndian.Uint16(data[3:5])
+		nameSize := int(binary.LittleEndian.Uint16(data[3:5]))
+		if len(data) < dirEntrySizeV1(nameSize) {
+			return DirEntry{}, 0, errDirEntryCorrupt
+		}
 		out.Name = string(data[6 : 6+nameSize])
-		return out, nil
+		return out, dirEntrySizeV1(nameSize), nil
+	case 2:
+		if len(data) < DirEntrySize(0) {
+			return DirEntry{}, 0, errDirEntryCorrupt
+		}
+		out.IsDir = (data[2] & 1) == 1
+		out.IsLink = (data[2] & (1 << 1)) != 0
+		nameSize := int(binary.LittleEndian.Uint32(data[3:7]))
+		if nameSize < 0 || len(data)-DirEntrySize(0) < nameSize {
+			return DirEntry{}, 0, errDirEntryCorrupt
+		}
+		out.Name = string(data[7 : 7+nameSize])
+		return out, DirEntrySize(nameSize), nil
 	}
 
-	return DirEntry{}, errors.New("Unknown version")
+	return DirEntry{}, 0, errors.New("Unknown version")
 }
 
+var errDirEntryCorrupt = errors.New("Directory entry is truncated")
+
+// Directory listings are serialized as a header followed by each DirEntry. Listings written before
+// version 2 have a uint16 entry count as their header. Version 2 listings start with the marker
+// 0xFFFF followed by the uint16 format version, which no version 1 listing can start with (a full
+// version 1 listing is followed by a version 1 entry), then a uint32 entry count.
+const (
+	dirListingMarker  = 0xFFFF
+	dirListingVersion = 2
+)
+
 type dirEntries []DirEntry
 
 func (dir dirEntries) Serialize() []byte {
 	b := new(bytes.Buffer)
 
-	lenBuff := make([]byte, 2)
-	binary.LittleEndian.PutUint16(lenBuff, uint16(len([]DirEntry(dir))))
-	b.Write(lenBuff)
+	header := make([]byte, 2+2+4)
+	binary.LittleEndian.PutUint16(header[0:2], dirListingMarker)
+	binary.LittleEndian.PutUint16(header[2:4], dirListingVersion)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len([]DirEntry(dir))))
+	b.Write(header)
 
 	for _, entry := range []DirEntry(dir) {
 		b.Write(entry.Serialize())
@@ -73,17 +131,28 @@ func (dir dirEntries) Serialize() []byte {
 }
 
 func deserializeDirEntries(data []byte) ([]DirEntry, error) {
+	if len(data) < 2 {
+		return nil, errDirEntryCorrupt
+	}
 	size := int(binary.LittleEndian.Uint16(data[0:2]))
-	out := make([]DirEntry, size)
-	var err error
-
 	cursor := 2
+	if len(data) >= 8 && size == dirListingMarker && binary.LittleEndian.Uint16(data[2:4]) == dirListingVersion {
+		size = int(binary.LittleEndian.Uint32(data[4:8]))
+		cursor = 8
+	}
+	if size > len(data) {
+		return nil, errDirEntryCorrupt // every entry takes at least one byte
+	}
+
+	out := make([]DirEntry, size)
 	for i := 0; i < size; i++ {
-		out[i], err = deserializeDirEntry(data[cursor:])
+		var n int
+		var err error
+		out[i], n, err = deserializeDirEntry(data[cursor:])
 		if err != nil {
 			return out, err
 		}
-		cursor += DirEntrySize(len(out[i].Name))
+		cursor += n
 	}
 	return out, nil
 }
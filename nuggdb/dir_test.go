@@ -2,29 +2,31 @@ package nuggdb
 
 import (
 	"encoding/binary"
+	"strconv"
+	"strings"
 	"testing"
 )
 
 func TestSerializeDirEntryCorrectLen(t *testing.T) {
 	d := DirEntry{Name: "yolo.swag/"}
 	s := d.Serialize()
-	if len(s) != (5 + len(d.Name) + 1) {
+	if len(s) != (7 + len(d.Name)) {
 		t.Error("Incorrect len")
 	}
 }
 
-func TestSerializeDirEntryProducesVersion1(t *testing.T) {
+func TestSerializeDirEntryProducesVersion2(t *testing.T) {
 	d := DirEntry{Name: "yolo.sw434634gdfsdfds zfdgdsag/"}
 	s := d.Serialize()
-	if binary.LittleEndian.Uint16(s[0:2]) != 1 {
-		t.Error("Expected 1")
+	if binary.LittleEndian.Uint16(s[0:2]) != 2 {
+		t.Error("Expected 2")
 	}
 }
 
 func TestSerializeDirEntryProducesCorrectNameLen(t *testing.T) {
 	d := DirEntry{Name: "yolo.sw434634gdfsdfds zfdgdsag/"}
 	s := d.Serialize()
-	if binary.LittleEndian.Uint16(s[3:5]) != uint16(len(d.Name)) {
+	if binary.LittleEndian.Uint32(s[3:7]) != uint32(len(d.Name)) {
 		t.Error("Expected ", len(d.Name))
 	}
 }
@@ -32,10 +34,13 @@ func TestSerializeDirEntryProducesCorrectNameLen(t *testing.T) {
 func TestDirEntryDeserialize(t *testing.T) {
 	d := DirEntry{Name: "yolo.sw434634gdfsdfdszfdgdsag/", IsDir: true}
 	s := d.Serialize()
-	d2, err := deserializeDirEntry(s)
+	d2, n, err := deserializeDirEntry(s)
 	if err != nil {
 		t.Error(err)
 	}
+	if n != len(s) {
+		t.Error("Size mismatch: ", n, len(s))
+	}
 	if d.Name != d2.Name {
 		t.Error("Name mismatch: ", d.Name, d2.Name)
 	}
@@ -50,11 +55,11 @@ func TestEntriesSerializeLen(t *testing.T) {
 	d3 := DirEntry{Name: "wut"}
 	entries := dirEntries{d1, d2, d3}
 	b := entries.Serialize()
-	if len(b) != (2 + DirEntrySize(len(d1.Name)) + DirEntrySize(len(d2.Name)) + DirEntrySize(len(d3.Name))) {
+	if len(b) != (8 + DirEntrySize(len(d1.Name)) + DirEntrySize(len(d2.Name)) + DirEntrySize(len(d3.Name))) {
 		t.Error("Incorrect len")
 	}
 
-	if binary.LittleEndian.Uint16(b[0:2]) != 3 {
+	if binary.LittleEndian.Uint32(b[4:8]) != 3 {
 		t.Error("Expected 3")
 	}
 }
@@ -85,3 +90,33 @@ func TestEntriesSerializeDeserialize(t *testing.T) {
 		t.Error("Third entry incorrect")
 	}
 }
+
+func TestEntriesDeserializeVersion1(t *testing.T) {
+	// a listing of one version 1 entry, as written before listings could exceed 65535 entries
+	b := []byte{1, 0, 1, 0, 1, 3, 0, 0, 'k', 'e', 'k'}
+	entries, err := deserializeDirEntries(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "kek" || !entries[0].IsDir {
+		t.Error("Expected version 1 entry to decode, got", entries)
+	}
+}
+
+func TestEntriesSerializeDeserializeLarge(t *testing.T) {
+	entries := make(dirEntries, 70000)
+	for i := range entries {
+		entries[i].Name = strconv.Itoa(i)
+	}
+	entries[1].Name = strings.Repeat("x", 70000)
+	reversedEntries, err := deserializeDirEntries(entries.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reversedEntries) != len(entries) {
+		t.Fatal("Expected", len(entries), "entries, got", len(reversedEntries))
+	}
+	if reversedEntries[1].Name != entries[1].Name || reversedEntries[69999].Name != "69999" {
+		t.Error("Expected names to survive")
+	}
+}
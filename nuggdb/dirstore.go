@@ -0,0 +1,228 @@
+package nuggdb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"path"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// dirstore.go keeps directory membership in the database, so it can be updated in the same
+// transaction as the paths and metadata it describes. Each child is a key of the index bucket,
+// made of the EntryID of its directory followed by its name, so linking and unlinking an entry
+// touch a single key, and a directory is listed by a cursor over the keys with its EntryID as
+// prefix. The value holds the type of the entry and its EntryID. When encrypted, the name in the
+// key is replaced by a keyed hash, and the name is sealed in the value instead.
+
+const dirIndexBucket = "DirIndex"
+
+// dirEntriesBucket holds the serialized listings written before the index, keyed by the EntryID of
+// the directory. They are moved into the index on startup.
+const dirEntriesBucket = "EntryIDToDirEntries"
+
+// Flags held in the first byte of an index value.
+const (
+	dirIndexIsDir  = 1 << 0
+	dirIndexIsLink = 1 << 1
+	dirIndexHasID  = 1 << 2 // the EntryID follows the flags, absent from entries indexed before hard links
+)
+
+// DefaultListPageSize is the number of entries returned by ListPage when no limit is given.
+const DefaultListPageSize = 1024
+
+// ErrInvalidCursor is returned by ListPage for a cursor it did not issue.
+var ErrInvalidCursor = errors.New("Invalid directory listing cursor")
+
+// dirIndexKey returns the index key of the entry called name in the directory with the given entryID.
+func dirIndexKey(s *sealer, dirID nugget.EntryID, name string) []byte {
+	key := append([]byte{}, dirID[:]...)
+	if s == nil {
+		return append(key, name...)
+	}
+	return append(key, s.keyForPath(name)...)
+}
+
+// putDirEntry adds entry, named by the name of the entry alone, to the directory with the given
+// entryID, returning false if it was already present.
+func putDirEntry(tx *bolt.Tx, s *sealer, dirID nugget.EntryID, entry DirEntry) (bool, error) {
+	b := tx.Bucket([]byte(dirIndexBucket))
+	key := dirIndexKey(s, dirID, entry.Name)
+	existed := b.Get(key) != nil
+
+	value := []byte{0}
+	if entry.IsDir {
+		value[0] |= dirIndexIsDir
+	}
+	if entry.IsLink {
+		value[0] |= dirIndexIsLink
+	}
+	if entry.EntryID != (nugget.EntryID{}) {
+		value[0] |= dirIndexHasID
+		value = append(value, entry.EntryID[:]...)
+	}
+	if s != nil {
+		value = s.seal(append(value, entry.Name...), key)
+	}
+	return !existed, b.Put(key, value)
+}
+
+// deleteDirEntry removes the entry called name from the directory with the given entryID, returning
+// false if it was not present.
+func deleteDirEntry(tx *bolt.Tx, s *sealer, dirID nugget.EntryID, name string) (bool, error) {
+	b := tx.Bucket([]byte(dirIndexBucket))
+	key := dirIndexKey(s, dirID, name)
+	if b.Get(key) == nil {
+		return false, nil
+	}
+	return true, b.Delete(key)
+}
+
+// forEachDirEntry calls fn for every entry of the directory at dirPath with the given entryID, in
+// key order. Entries are read straight from a cursor. Iteration stops at the first error returned
+// by fn.
+func forEachDirEntry(tx *bolt.Tx, s *sealer, dirID nugget.EntryID, dirPath string, fn func(entry DirEntry) error) error {
+	c := tx.Bucket([]byte(dirIndexBucket)).Cursor()
+	for k, v := c.Seek(dirID[:]); k != nil && bytes.HasPrefix(k, dirID[:]); k, v = c.Next() {
+		entry, err := decodeDirEntry(s, k, v)
+		if err != nil {
+			return err
+		}
+		entry.Name = path.Join(dirPath, entry.Name)
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageDirEntries returns up to limit entries of the directory at dirPath with the given entryID,
+// starting after the index key ending in after, or at the first entry if after is nil. The key
+// ending of the last entry is returned if more entries follow, and nil otherwise.
+func pageDirEntries(tx *bolt.Tx, s *sealer, dirID nugget.EntryID, dirPath string, after []byte, limit int) ([]DirEntry, []byte, error) {
+	var entries []DirEntry
+	c := tx.Bucket([]byte(dirIndexBucket)).Cursor()
+	k, v := c.Seek(append(append([]byte{}, dirID[:]...), after...))
+	if after != nil && k != nil && bytes.Equal(k[len(dirID):], after) {
+		k, v = c.Next()
+	}
+	var last []byte
+	for ; k != nil && bytes.HasPrefix(k, dirID[:]); k, v = c.Next() {
+		if len(entries) == limit {
+			return entries, append([]byte{}, last...), nil
+		}
+		entry, err := decodeDirEntry(s, k, v)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.Name = path.Join(dirPath, entry.Name)
+		entries = append(entries, entry)
+		last = k[len(dirID):]
+	}
+	return entries, nil, nil
+}
+
+// encodeListCursor returns the cursor handed out for the index key ending after.
+func encodeListCursor(after []byte) string {
+	if after == nil {
+		return ""
+	}
+	return hex.EncodeToString(after)
+}
+
+// decodeListCursor returns the index key ending described by cursor, or nil for an empty cursor.
+func decodeListCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	after, err := hex.DecodeString(cursor)
+	if err != nil || len(after) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return after, nil
+}
+
+// decodeDirEntry returns the entry held in an index record, named by the name of the entry alone.
+func decodeDirEntry(s *sealer, k, v []byte) (DirEntry, error) {
+	v, err := s.open(v, k)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if len(v) < 1 {
+		return DirEntry{}, errDirEntryCorrupt
+	}
+	entry := DirEntry{IsDir: v[0]&dirIndexIsDir != 0, IsLink: v[0]&dirIndexIsLink != 0}
+	rest := v[1:]
+	if v[0]&dirIndexHasID != 0 {
+		if len(rest) < len(entry.EntryID) {
+			return DirEntry{}, errDirEntryCorrupt
+		}
+		copy(entry.EntryID[:], rest)
+		rest = rest[len(entry.EntryID):]
+	}
+	if s == nil {
+		entry.Name = string(k[len(nugget.EntryID{}):])
+	} else {
+		entry.Name = string(rest)
+	}
+	return entry, nil
+}
+
+// hasDirEntries returns true if the directory with the given entryID has any entries.
+func hasDirEntries(tx *bolt.Tx, dirID nugget.EntryID) bool {
+	k, _ := tx.Bucket([]byte(dirIndexBucket)).Cursor().Seek(dirID[:])
+	return k != nil && bytes.HasPrefix(k, dirID[:])
+}
+
+// deleteDirEntries removes every entry of the directory with the given entryID.
+func deleteDirEntries(tx *bolt.Tx, dirID nugget.EntryID) error {
+	c := tx.Bucket([]byte(dirIndexBucket)).Cursor()
+	for k, _ := c.Seek(dirID[:]); k != nil && bytes.HasPrefix(k, dirID[:]); k, _ = c.Seek(dirID[:]) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirEntries decodes a listing written before the index, sealed by s.
+func readDirEntries(s *sealer, entryID nugget.EntryID, v []byte) ([]DirEntry, error) {
+	v, err := s.open(v, entryID[:])
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	return deserializeDirEntries(v)
+}
+
+// migrateDirListings moves the listings written before the index into it, then removes them.
+func (p *Provider) migrateDirListings() error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dirEntriesBucket))
+		if b == nil {
+			return nil
+		}
+		p.logger.Info("nuggdb", "Migrating directory listings to the index")
+		err := b.ForEach(func(k, v []byte) error {
+			var dirID nugget.EntryID
+			copy(dirID[:], k)
+			entries, err := readDirEntries(p.sealer, dirID, v)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				entry.EntryID, _ = p.pathstore.lookup(tx, entry.Name)
+				entry.Name = path.Base(entry.Name)
+				if _, err = putDirEntry(tx, p.sealer, dirID, entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(dirEntriesBucket))
+	})
+}
@@ -0,0 +1,708 @@
+package nuggdb
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/logger"
+)
+
+// fsck.go checks a data directory for disagreements between paths, metadata, directory listings
+// and chunks, and repairs them where possible.
+
+const (
+	// LostFoundPath is the directory which entries are moved into when they cannot be repaired in place.
+	LostFoundPath = "/lost+found"
+
+	quarantineDirname = "quarantine"
+)
+
+// ProblemKind describes a kind of inconsistency found by a Checker.
+type ProblemKind int
+
+const (
+	// DanglingPath is a path which maps to an EntryID without metadata.
+	DanglingPath ProblemKind = iota
+	// OrphanedMeta is metadata which no path maps to.
+	OrphanedMeta
+	// MissingParent is a path whose parent does not exist, or is not a directory.
+	MissingParent
+	// MissingChunk is a chunk referenced by metadata which is not in the chunkstore.
+	MissingChunk
+	// OrphanedChunk is a chunk in the chunkstore which is not referenced by any metadata.
+	OrphanedChunk
+	// SizeMismatch is metadata whose size disagrees with the chunks holding its data.
+	SizeMismatch
+	// ListingMismatch is a directory listing which disagrees with the pathstore.
+	ListingMismatch
+	// PendingIntent is an intent left behind by an interrupted operation.
+	PendingIntent
+	// RefcountMismatch is a chunk whose reference count disagrees with the metadata referencing it.
+	RefcountMismatch
+	// LinkCountMismatch is metadata whose link count disagrees with the paths referring to it.
+	LinkCountMismatch
+)
+
+var problemKindNames = map[ProblemKind]string{
+	DanglingPath:      "dangling path",
+	OrphanedMeta:      "orphaned metadata",
+	MissingParent:     "missing parent",
+	MissingChunk:      "missing chunk",
+	OrphanedChunk:     "orphaned chunk",
+	SizeMismatch:      "size mismatch",
+	ListingMismatch:   "listing mismatch",
+	PendingIntent:     "pending intent",
+	RefcountMismatch:  "refcount mismatch",
+	LinkCountMismatch: "link count mismatch",
+}
+
+func (k ProblemKind) String() string {
+	if name, ok := problemKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem describes a single inconsistency, and what was done about it.
+type Problem struct {
+	Kind    ProblemKind
+	Path    string
+	EntryID nugget.EntryID
+	ChunkID nugget.ChunkID
+	Detail  string
+	// Action describes how the problem was repaired or quarantined. It is empty if nothing was done.
+	Action string
+}
+
+func (p Problem) String() string {
+	out := p.Kind.String()
+	if p.Path != "" {
+		out += " " + p.Path
+	}
+	if p.EntryID != (nugget.EntryID{}) {
+		out += " entry=" + hex.EncodeToString(p.EntryID[:])
+	}
+	if p.ChunkID != (nugget.ChunkID{}) {
+		out += " chunk=" + hex.EncodeToString(p.ChunkID[:])
+	}
+	out += ": " + p.Detail
+	if p.Action != "" {
+		out += " (" + p.Action + ")"
+	}
+	return out
+}
+
+// Checker inspects a data directory for inconsistencies. The data directory must not be in use.
+type Checker struct {
+	p        *Provider
+	repair   bool
+	problems []Problem
+
+	// applied once the repair transaction has committed
+	obsolete      []intent
+	orphanedChunk []nugget.ChunkID
+}
+
+// OpenChecker opens the data directory at baseDir for checking. Data directories using the legacy
+// layout or listings must first be migrated, by opening them with Create. keyFile must be given if the data
+// directory is encrypted.
+func OpenChecker(baseDir string, l *logger.Logger, keyFile string) (*Checker, error) {
+	if !fileExists(path.Join(baseDir, dbFilename)) && fileExists(path.Join(baseDir, pathStoreFilename)) {
+		return nil, errors.New("Data directory uses the legacy layout and must be migrated first")
+	}
+	p, err := open(baseDir, l, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	err = p.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(dirEntriesBucket)) != nil {
+			return errors.New("Data directory has directory listings which must be migrated first")
+		}
+		return nil
+	})
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return &Checker{p: p}, nil
+}
+
+// Close closes the data directory.
+func (c *Checker) Close() error {
+	return c.p.Close()
+}
+
+// Check returns every problem found in the data directory, without changing anything.
+func (c *Checker) Check() ([]Problem, error) {
+	return c.run(false)
+}
+
+// Repair fixes every problem it can. Entries which cannot be fixed in place are moved into
+// LostFoundPath, and orphaned chunks are moved into a quarantine directory beside the chunkstore.
+// The Action of each returned problem describes what was done.
+func (c *Checker) Repair() ([]Problem, error) {
+	return c.run(true)
+}
+
+func (c *Checker) run(repair bool) ([]Problem, error) {
+	c.repair, c.problems, c.obsolete, c.orphanedChunk = repair, nil, nil, nil
+
+	chunkFiles := map[nugget.ChunkID]int64{}
+	err := c.p.chunkstore.ForEach(func(chunkID nugget.ChunkID, size int64) error {
+		chunkFiles[chunkID] = size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	check := func(tx *bolt.Tx) error {
+		return c.check(tx, chunkFiles)
+	}
+	if repair {
+		err = c.p.db.Update(check)
+	} else {
+		err = c.p.db.View(check)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, in := range c.obsolete {
+		c.p.resolveIntent(in)
+	}
+	if len(c.orphanedChunk) > 0 {
+		quarantineDir := path.Join(c.p.basedir, quarantineDirname)
+		if err = os.MkdirAll(quarantineDir, 0700); err != nil {
+			return c.problems, err
+		}
+		for _, chunkID := range c.orphanedChunk {
+			dest := path.Join(quarantineDir, hex.EncodeToString(chunkID[:]))
+			if err = os.Rename(c.p.chunkstore.chunkPath(chunkID), dest); err != nil {
+				return c.problems, err
+			}
+		}
+	}
+	return c.problems, nil
+}
+
+func (c *Checker) report(problem Problem, action string) {
+	if c.repair {
+		problem.Action = action
+	}
+	c.problems = append(c.problems, problem)
+}
+
+// check runs every check against the state in tx. Later checks rely on the repairs made by earlier
+// ones, so the directory listings, which are rebuilt from the pathstore, are checked last.
+func (c *Checker) check(tx *bolt.Tx, chunkFiles map[nugget.ChunkID]int64) error {
+	now := time.Now()
+	if err := c.checkEntries(tx, now); err != nil {
+		return err
+	}
+	if err := c.checkParents(tx, now); err != nil {
+		return err
+	}
+	if err := c.checkLinkCounts(tx); err != nil {
+		return err
+	}
+	referenced, err := c.checkChunks(tx, chunkFiles, now)
+	if err != nil {
+		return err
+	}
+	if err = c.checkRefs(tx); err != nil {
+		return err
+	}
+	if err = c.checkIntents(tx, chunkFiles, referenced); err != nil {
+		return err
+	}
+	return c.checkListings(tx)
+}
+
+// loadEntries returns every path in the pathstore in order, along with the maps of paths to EntryIDs
+// and EntryIDs to metadata.
+func (c *Checker) loadEntries(tx *bolt.Tx) ([]string, map[string]nugget.EntryID, map[nugget.EntryID]EntryMetadata, error) {
+	var order []string
+	paths := map[string]nugget.EntryID{}
+	err := tx.Bucket([]byte(pathEntryIDBucket)).ForEach(func(k, v []byte) error {
+		fPath, entryID, err := c.p.pathstore.decode(k, v)
+		if err != nil {
+			return err
+		}
+		order = append(order, fPath)
+		paths[fPath] = entryID
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sort.Strings(order) // keys are hashed when encrypted
+	metas := map[nugget.EntryID]EntryMetadata{}
+	err = tx.Bucket([]byte(entryIDToMetaBucket)).ForEach(func(k, v []byte) error {
+		meta, err := c.p.metastore.decode(k, v)
+		if err != nil {
+			return err
+		}
+		metas[meta.EntryID] = meta
+		return nil
+	})
+	return order, paths, metas, err
+}
+
+// checkEntries finds paths without metadata, and metadata without paths.
+func (c *Checker) checkEntries(tx *bolt.Tx, now time.Time) error {
+	order, paths, metas, err := c.loadEntries(tx)
+	if err != nil {
+		return err
+	}
+	referenced := map[nugget.EntryID]bool{}
+	for _, fPath := range order {
+		if _, ok := metas[paths[fPath]]; ok {
+			referenced[paths[fPath]] = true
+			continue
+		}
+		c.report(Problem{Kind: DanglingPath, Path: fPath, EntryID: paths[fPath], Detail: "path refers to an entry without metadata"}, "removed path")
+		if c.repair {
+			if err := c.p.pathstore.delete(tx, fPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	var orphans []string
+	for entryID := range metas {
+		if !referenced[entryID] {
+			orphans = append(orphans, hex.EncodeToString(entryID[:]))
+		}
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		var entryID nugget.EntryID
+		hex.Decode(entryID[:], []byte(name))
+		newPath := path.Join(LostFoundPath, name)
+		c.report(Problem{Kind: OrphanedMeta, EntryID: entryID, Detail: "no path refers to this entry"}, "linked at "+newPath)
+		if !c.repair {
+			continue
+		}
+		if err := c.ensureLostFound(tx, now); err != nil {
+			return err
+		}
+		meta := metas[entryID]
+		meta.Lname = name
+		if err := c.p.metastore.commit(tx, meta); err != nil {
+			return err
+		}
+		if err := c.p.pathstore.commit(tx, newPath, entryID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkParents finds paths whose parent is missing or is not a directory.
+func (c *Checker) checkParents(tx *bolt.Tx, now time.Time) error {
+	order, _, _, err := c.loadEntries(tx)
+	if err != nil {
+		return err
+	}
+	for _, fPath := range order {
+		if fPath == "/" {
+			continue
+		}
+		entryID, err := c.p.pathstore.lookup(tx, fPath)
+		if err == ErrPathNotFound {
+			continue // moved along with a quarantined parent
+		}
+		dirPath := path.Dir(fPath)
+		_, dirMeta, err := c.p.lookupTx(tx, dirPath)
+		switch {
+		case err == ErrPathNotFound:
+			c.report(Problem{Kind: MissingParent, Path: fPath, EntryID: entryID, Detail: "parent directory does not exist"}, "created "+dirPath)
+			if c.repair {
+				if _, err = c.p.mkdirTx(tx, dirPath, nugget.NodeAttributes{Mode: DefaultDirMode}, now, ""); err != nil {
+					return err
+				}
+			}
+		case err != nil:
+			return err
+		case !dirMeta.IsDir:
+			newPath, err := c.quarantine(tx, fPath, entryID, now)
+			if err != nil {
+				return err
+			}
+			c.report(Problem{Kind: MissingParent, Path: fPath, EntryID: entryID, Detail: "parent is not a directory"}, "moved to "+newPath)
+		}
+	}
+	return nil
+}
+
+// checkLinkCounts finds metadata whose link count disagrees with the number of paths referring to it.
+func (c *Checker) checkLinkCounts(tx *bolt.Tx) error {
+	order, paths, metas, err := c.loadEntries(tx)
+	if err != nil {
+		return err
+	}
+	counts := map[nugget.EntryID]uint32{}
+	var first []string // the first path of each entry, in order
+	for _, fPath := range order {
+		if counts[paths[fPath]] == 0 {
+			first = append(first, fPath)
+		}
+		counts[paths[fPath]]++
+	}
+
+	for _, fPath := range first {
+		meta, ok := metas[paths[fPath]]
+		if !ok || meta.Nlink == counts[meta.EntryID] {
+			continue
+		}
+		c.report(Problem{Kind: LinkCountMismatch, Path: fPath, EntryID: meta.EntryID,
+			Detail: fmt.Sprintf("link count is %d, %d paths refer to this entry", meta.Nlink, counts[meta.EntryID])}, "link count corrected")
+		if !c.repair {
+			continue
+		}
+		meta.Nlink = counts[meta.EntryID]
+		if err := c.p.metastore.commit(tx, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkChunks finds missing chunks, and chunks which disagree with the size of the file they belong
+// to. The set of chunks referenced by metadata is returned.
+func (c *Checker) checkChunks(tx *bolt.Tx, chunkFiles map[nugget.ChunkID]int64, now time.Time) (map[nugget.ChunkID]bool, error) {
+	order, paths, metas, err := c.loadEntries(tx)
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[nugget.ChunkID]bool{}
+	for _, meta := range metas {
+		for _, chunkID := range meta.Locality.ChunkIDs {
+			referenced[chunkID] = true
+		}
+	}
+
+	checked := map[nugget.EntryID]bool{} // hard linked files are checked once
+	for _, fPath := range order {
+		meta, ok := metas[paths[fPath]]
+		if !ok || meta.IsDir || checked[meta.EntryID] {
+			continue
+		}
+		checked[meta.EntryID] = true
+
+		var missing []nugget.ChunkID
+		for i, chunkID := range meta.Locality.ChunkIDs {
+			if _, ok := chunkFiles[chunkID]; !ok {
+				missing = append(missing, chunkID)
+				c.report(Problem{Kind: MissingChunk, Path: fPath, EntryID: meta.EntryID, ChunkID: chunkID,
+					Detail: fmt.Sprintf("chunk %d of %d does not exist", i+1, len(meta.Locality.ChunkIDs))}, "replaced with an empty chunk")
+			}
+		}
+		if len(missing) > 0 {
+			if !c.repair {
+				continue
+			}
+			empty, err := meta.Locality.Codec.encode(nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, chunkID := range missing {
+				if err := c.p.chunkstore.Commit(chunkID, empty); err != nil {
+					return nil, err
+				}
+				chunkFiles[chunkID] = 0
+			}
+			// the data is damaged, so move the file out of the way for someone to inspect
+			newPath, err := c.quarantine(tx, fPath, meta.EntryID, now)
+			if err != nil {
+				return nil, err
+			}
+			for i := len(c.problems) - len(missing); i < len(c.problems); i++ {
+				c.problems[i].Action += ", moved to " + newPath
+			}
+		}
+
+		if err := c.checkSize(tx, fPath, meta, chunkFiles); err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
+
+// checkSize compares the size of a file with the chunks holding its data.
+func (c *Checker) checkSize(tx *bolt.Tx, fPath string, meta EntryMetadata, chunkFiles map[nugget.ChunkID]int64) error {
+	if !meta.Locality.IsChunked() {
+		if len(meta.Locality.ChunkIDs) != 1 {
+			return nil
+		}
+		actual := uint64(chunkFiles[meta.Locality.ChunkIDs[0]])
+		if actual == meta.Size {
+			return nil
+		}
+		c.report(Problem{Kind: SizeMismatch, Path: fPath, EntryID: meta.EntryID,
+			Detail: fmt.Sprintf("size is %d, chunk holds %d bytes", meta.Size, actual)}, fmt.Sprintf("size set to %d", actual))
+		if !c.repair {
+			return nil
+		}
+		meta.Size = actual
+		return c.p.metastore.commit(tx, meta)
+	}
+
+	chunkSize := uint64(meta.Locality.ChunkSize)
+	want := int((meta.Size + chunkSize - 1) / chunkSize)
+	// the size of a compressed or encrypted chunk says nothing about the data it holds
+	for i := 0; i < len(meta.Locality.ChunkIDs) && i < want && meta.Locality.Codec == CodecNone && c.p.sealer == nil; i++ {
+		chunkID := meta.Locality.ChunkIDs[i]
+		limit := meta.Size - uint64(i)*chunkSize
+		if limit > chunkSize {
+			limit = chunkSize
+		}
+		if uint64(chunkFiles[chunkID]) <= limit {
+			continue
+		}
+		problem := Problem{Kind: SizeMismatch, Path: fPath, EntryID: meta.EntryID, ChunkID: chunkID,
+			Detail: fmt.Sprintf("chunk holds %d bytes past the end of the file", uint64(chunkFiles[chunkID])-limit)}
+		if c.p.metastore.refs(tx, chunkID) > 0 {
+			// content-addressed chunks may be shared, so are never modified
+			c.report(problem, "")
+			continue
+		}
+		c.report(problem, "chunk truncated")
+		if c.repair {
+			if err := c.p.chunkstore.Truncate(chunkID, int64(limit)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(meta.Locality.ChunkIDs) <= want {
+		return nil
+	}
+	extra := meta.Locality.ChunkIDs[want:]
+	c.report(Problem{Kind: SizeMismatch, Path: fPath, EntryID: meta.EntryID,
+		Detail: fmt.Sprintf("%d chunks past the end of the file", len(extra))}, "chunks removed")
+	if !c.repair {
+		return nil
+	}
+	meta.Locality.ChunkIDs = meta.Locality.ChunkIDs[:want]
+	if err := c.p.metastore.commit(tx, meta); err != nil {
+		return err
+	}
+	obsolete, err := c.p.releaseTx(tx, extra)
+	c.obsolete = append(c.obsolete, obsolete)
+	return err
+}
+
+// checkRefs compares the reference count of every chunk with the number of times metadata refers
+// to it. Chunks referenced more than once must be counted, or removing one reference would remove
+// the chunk.
+func (c *Checker) checkRefs(tx *bolt.Tx) error {
+	_, _, metas, err := c.loadEntries(tx)
+	if err != nil {
+		return err
+	}
+	expected := map[nugget.ChunkID]uint32{}
+	for _, meta := range metas {
+		for _, chunkID := range meta.Locality.ChunkIDs {
+			expected[chunkID]++
+		}
+	}
+	counted := map[nugget.ChunkID]uint32{}
+	tx.Bucket([]byte(chunkRefsBucket)).ForEach(func(k, v []byte) error {
+		var chunkID nugget.ChunkID
+		copy(chunkID[:], k)
+		counted[chunkID] = c.p.metastore.refs(tx, chunkID)
+		return nil
+	})
+
+	var mismatched []string
+	for chunkID, count := range counted {
+		if count != expected[chunkID] {
+			mismatched = append(mismatched, hex.EncodeToString(chunkID[:]))
+		}
+	}
+	for chunkID, count := range expected {
+		if _, ok := counted[chunkID]; !ok && count > 1 {
+			mismatched = append(mismatched, hex.EncodeToString(chunkID[:]))
+		}
+	}
+	sort.Strings(mismatched)
+	for _, name := range mismatched {
+		var chunkID nugget.ChunkID
+		hex.Decode(chunkID[:], []byte(name))
+		c.report(Problem{Kind: RefcountMismatch, ChunkID: chunkID,
+			Detail: fmt.Sprintf("counted %d references, metadata holds %d", counted[chunkID], expected[chunkID])},
+			fmt.Sprintf("count set to %d", expected[chunkID]))
+		if c.repair {
+			if err := c.p.metastore.setRefs(tx, chunkID, expected[chunkID]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkIntents reports intents left behind by interrupted operations, and chunks which are neither
+// referenced by metadata nor recorded in an intent.
+func (c *Checker) checkIntents(tx *bolt.Tx, chunkFiles map[nugget.ChunkID]int64, referenced map[nugget.ChunkID]bool) error {
+	inIntent := map[nugget.ChunkID]bool{}
+	var intents []intent
+	tx.Bucket([]byte(intentBucket)).ForEach(func(k, v []byte) error {
+		intents = append(intents, decodeIntent(k, v))
+		return nil
+	})
+	for _, in := range intents {
+		for _, chunkID := range in.chunks {
+			inIntent[chunkID] = true
+		}
+		c.report(Problem{Kind: PendingIntent, Detail: fmt.Sprintf("%d chunks from an interrupted operation", len(in.chunks))}, "chunks removed")
+		if !c.repair {
+			continue
+		}
+		// never remove a chunk which is still referenced
+		var unreferenced []nugget.ChunkID
+		for _, chunkID := range in.chunks {
+			if !referenced[chunkID] {
+				unreferenced = append(unreferenced, chunkID)
+			}
+		}
+		in.chunks = unreferenced
+		c.obsolete = append(c.obsolete, in)
+	}
+
+	var orphans []string
+	for chunkID := range chunkFiles {
+		if !referenced[chunkID] && !inIntent[chunkID] {
+			orphans = append(orphans, hex.EncodeToString(chunkID[:]))
+		}
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		var chunkID nugget.ChunkID
+		hex.Decode(chunkID[:], []byte(name))
+		c.report(Problem{Kind: OrphanedChunk, ChunkID: chunkID, Detail: "no entry refers to this chunk"}, "moved to "+quarantineDirname)
+		if c.repair {
+			c.orphanedChunk = append(c.orphanedChunk, chunkID)
+		}
+	}
+	return nil
+}
+
+// checkListings compares the listing of every directory with the paths beneath it in the pathstore,
+// rebuilding listings which disagree.
+func (c *Checker) checkListings(tx *bolt.Tx) error {
+	order, paths, metas, err := c.loadEntries(tx)
+	if err != nil {
+		return err
+	}
+	children := map[string][]string{}
+	for _, fPath := range order {
+		if fPath != "/" {
+			children[path.Dir(fPath)] = append(children[path.Dir(fPath)], fPath)
+		}
+	}
+
+	for _, dirPath := range order {
+		meta, ok := metas[paths[dirPath]]
+		if !ok || !meta.IsDir {
+			continue
+		}
+		expected := map[string]DirEntry{}
+		for _, child := range children[dirPath] {
+			childMeta := metas[paths[child]]
+			expected[child] = DirEntry{Name: path.Base(child), IsDir: childMeta.IsDir, IsLink: childMeta.IsLink, EntryID: paths[child]}
+		}
+
+		var problems []string
+		seen := map[string]bool{}
+		err := forEachDirEntry(tx, c.p.sealer, meta.EntryID, dirPath, func(entry DirEntry) error {
+			want, ok := expected[entry.Name]
+			switch {
+			case !ok:
+				problems = append(problems, "unexpected "+entry.Name)
+			case entry.IsDir != want.IsDir || entry.IsLink != want.IsLink:
+				problems = append(problems, "wrong type for "+entry.Name)
+			case entry.EntryID != (nugget.EntryID{}) && entry.EntryID != want.EntryID:
+				problems = append(problems, "wrong entry for "+entry.Name)
+			}
+			seen[entry.Name] = true
+			return nil
+		})
+		if err != nil {
+			problems = append(problems, "listing is unreadable")
+		}
+		for _, child := range children[dirPath] {
+			if !seen[child] {
+				problems = append(problems, "missing "+child)
+			}
+		}
+		if len(problems) == 0 && meta.Size != uint64(len(expected)) {
+			problems = append(problems, fmt.Sprintf("size is %d, listing holds %d entries", meta.Size, len(expected)))
+		}
+		if len(problems) == 0 {
+			continue
+		}
+
+		c.report(Problem{Kind: ListingMismatch, Path: dirPath, EntryID: meta.EntryID, Detail: strings.Join(problems, ", ")}, "listing rebuilt")
+		if !c.repair {
+			continue
+		}
+		if err = deleteDirEntries(tx, meta.EntryID); err != nil {
+			return err
+		}
+		for _, entry := range expected {
+			if _, err = putDirEntry(tx, c.p.sealer, meta.EntryID, entry); err != nil {
+				return err
+			}
+		}
+		meta.Size = uint64(len(expected))
+		if err = c.p.metastore.commit(tx, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureLostFound creates LostFoundPath if it does not exist.
+func (c *Checker) ensureLostFound(tx *bolt.Tx, now time.Time) error {
+	_, meta, err := c.p.lookupTx(tx, LostFoundPath)
+	if err == ErrPathNotFound {
+		_, err = c.p.mkdirTx(tx, LostFoundPath, nugget.NodeAttributes{Mode: 0700}, now, "")
+		return err
+	}
+	if err == nil && !meta.IsDir {
+		return errors.New("Cannot quarantine entries, " + LostFoundPath + " is not a directory")
+	}
+	return err
+}
+
+// quarantine moves the entry at fPath, along with every path beneath it, into LostFoundPath. Listings
+// are left to be rebuilt by checkListings. Nothing is changed unless repairing.
+func (c *Checker) quarantine(tx *bolt.Tx, fPath string, entryID nugget.EntryID, now time.Time) (string, error) {
+	newPath := path.Join(LostFoundPath, path.Base(fPath)+"."+hex.EncodeToString(entryID[:4]))
+	if !c.repair {
+		return newPath, nil
+	}
+	if err := c.ensureLostFound(tx, now); err != nil {
+		return "", err
+	}
+	if _, err := c.p.pathstore.rename(tx, fPath, newPath); err != nil {
+		return "", err
+	}
+	meta, err := c.p.metastore.lookup(tx, entryID)
+	if err != nil {
+		return "", err
+	}
+	meta.Lname = path.Base(newPath)
+	meta.Ctime = now
+	return newPath, c.p.metastore.commit(tx, meta)
+}
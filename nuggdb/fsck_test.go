@@ -0,0 +1,104 @@
+package nuggdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/twitchyliquid64/nugget"
+)
+
+func TestCheckerFindsAndRepairsProblems(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_fsck_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.chunkSize = 4
+	p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})
+	okID, _, _ := p.Store("/dir/ok", []byte("fine"))
+	p.Link("/dir/ok", "/dir/linked")
+	_, missingMeta, _ := p.Store("/dir/missing", []byte("01234567"))
+	_, oversizedMeta, _ := p.Store("/dir/oversized", []byte("0123"))
+
+	// a path without metadata, metadata without a path, and an unreferenced chunk
+	p.pathstore.Commit("/dir/dangling", nugget.EntryID{9})
+	p.metastore.Commit(EntryMetadata{Lname: "lost", EntryID: nugget.EntryID{8}, Nlink: 1})
+	// a name which the link count of its entry does not account for
+	p.pathstore.Commit("/dir/uncounted", okID)
+	orphan, _ := p.chunkstore.Forge([]byte("orphan"))
+	p.chunkstore.Delete(missingMeta.GetDataLocality().Chunks()[1])
+	p.chunkstore.Write(oversizedMeta.GetDataLocality().Chunks()[0], 4, []byte("extra"))
+	p.Close()
+
+	c, err := OpenChecker(baseDir, emptyLogger(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	problems, err := c.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[ProblemKind]int{}
+	for _, problem := range problems {
+		found[problem.Kind]++
+		if problem.Action != "" {
+			t.Error("Expected no action when checking, got", problem)
+		}
+	}
+	for _, kind := range []ProblemKind{DanglingPath, OrphanedMeta, MissingChunk, OrphanedChunk, SizeMismatch, ListingMismatch, LinkCountMismatch} {
+		if found[kind] == 0 {
+			t.Errorf("Expected a %s problem, got %v", kind, problems)
+		}
+	}
+
+	problems, err = c.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		if problem.Action == "" {
+			t.Error("Expected problem to be repaired:", problem)
+		}
+	}
+	if problems, err = c.Check(); err != nil || len(problems) != 0 {
+		t.Error("Expected no problems after repair, got", problems, err)
+	}
+
+	if _, err = c.p.chunkstore.Lookup(orphan); err != ErrChunkNotFound {
+		t.Error("Expected orphaned chunk to be quarantined")
+	}
+	if !fileExists(baseDir + "/" + quarantineDirname) {
+		t.Error("Expected quarantine directory to exist")
+	}
+	if _, err = c.p.Lookup("/dir/dangling"); err != ErrPathNotFound {
+		t.Error("Expected dangling path to be removed")
+	}
+	if _, err = c.p.Lookup(LostFoundPath + "/080000000000000000000000"); err != nil {
+		t.Error("Expected orphaned metadata to be linked into lost+found:", err)
+	}
+	if _, err = c.p.Lookup("/dir/missing"); err != ErrPathNotFound {
+		t.Error("Expected damaged file to be quarantined")
+	}
+	data, err := c.p.Read("/dir/oversized", 0, 100)
+	if err != nil || string(data) != "0123" {
+		t.Errorf("Expected oversized file to keep its data, got %q %v", data, err)
+	}
+	entries, err := c.p.List("/dir")
+	if err != nil || len(entries) != 4 {
+		t.Error("Expected listing to be rebuilt, got", entries, err)
+	}
+	if meta, err := c.p.ReadMeta(okID); err != nil || meta.GetNlink() != 3 {
+		t.Error("Expected link count to be corrected, got", meta, err)
+	}
+}
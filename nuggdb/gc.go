@@ -0,0 +1,216 @@
+package nuggdb
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// gc.go implements an online garbage collector, which removes chunks and metadata which nothing
+// refers to. Normal operation never leaves such garbage behind, as the intent log tracks every
+// chunk which is not yet (or no longer) referenced. Garbage is left by crashes in versions which
+// predate the intent log, or by bugs.
+//
+// Anything younger than the grace period is left alone, so chunks and entries which are part of an
+// operation in progress are never collected.
+
+const (
+	// DefaultGCInterval is how often the garbage collector runs in the background.
+	DefaultGCInterval = time.Hour
+	// DefaultGCGracePeriod is how old garbage must be before it is collected.
+	DefaultGCGracePeriod = time.Hour
+)
+
+// GCStats describes a run of the garbage collector.
+type GCStats struct {
+	Started       time.Time
+	Duration      time.Duration
+	ChunksScanned int
+	ChunksRemoved int
+	BytesRemoved  int64
+	MetaRemoved   int
+	Err           error
+}
+
+// StartGC runs the garbage collector every interval in the background, until the provider is closed.
+func (p *Provider) StartGC(interval, grace time.Duration) {
+	p.gcWait.Add(1)
+	go func() {
+		defer p.gcWait.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.gcStop:
+				return
+			case <-ticker.C:
+				stats := p.CollectGarbage(grace)
+				if stats.Err != nil {
+					p.logger.Error("nuggdb", "Garbage collection failed: ", stats.Err)
+				} else if stats.ChunksRemoved > 0 || stats.MetaRemoved > 0 {
+					p.logger.Info("nuggdb", "Garbage collection removed ", stats.ChunksRemoved, " chunks (", stats.BytesRemoved,
+						" bytes) and ", stats.MetaRemoved, " metadata entries in ", stats.Duration)
+				}
+			}
+		}
+	}()
+}
+
+// LastGCStats returns the stats of the most recent garbage collection, and false if the garbage
+// collector has not run yet.
+func (p *Provider) LastGCStats() (GCStats, bool) {
+	p.gcLock.Lock()
+	defer p.gcLock.Unlock()
+	return p.lastGC, !p.lastGC.Started.IsZero()
+}
+
+// CollectGarbage removes chunk files and metadata entries which nothing refers to, provided they
+// are older than grace.
+func (p *Provider) CollectGarbage(grace time.Duration) GCStats {
+	stats := GCStats{Started: time.Now()}
+	stats.Err = p.collectGarbage(grace, &stats)
+	stats.Duration = time.Since(stats.Started)
+
+	p.gcLock.Lock()
+	p.lastGC = stats
+	p.gcLock.Unlock()
+	return stats
+}
+
+func (p *Provider) collectGarbage(grace time.Duration, stats *GCStats) error {
+	cutoff := stats.Started.Add(-grace)
+
+	// Chunks are listed before the live set is read. Any chunk created after the listing is not
+	// considered, and any chunk referenced after the live set is read is younger than the cutoff.
+	candidates := map[nugget.ChunkID]int64{}
+	err := p.chunkstore.ForEach(func(chunkID nugget.ChunkID, size int64) error {
+		stats.ChunksScanned++
+		modTime, err := p.chunkstore.modTime(chunkID)
+		if err == nil && modTime.Before(cutoff) {
+			candidates[chunkID] = size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var orphanedMeta []nugget.EntryID
+	err = p.db.View(func(tx *bolt.Tx) error {
+		referenced := map[nugget.EntryID]bool{}
+		err := tx.Bucket([]byte(pathEntryIDBucket)).ForEach(func(k, v []byte) error {
+			var entryID nugget.EntryID
+			copy(entryID[:], v)
+			referenced[entryID] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(entryIDToMetaBucket)).ForEach(func(k, v []byte) error {
+			meta, err := p.metastore.decode(k, v)
+			if err != nil {
+				return err
+			}
+			for _, chunkID := range meta.Locality.ChunkIDs {
+				delete(candidates, chunkID)
+			}
+			if !referenced[meta.EntryID] && meta.Ctime.Before(cutoff) {
+				orphanedMeta = append(orphanedMeta, meta.EntryID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// chunks in the intent log are removed by whoever logged them
+		return tx.Bucket([]byte(intentBucket)).ForEach(func(k, v []byte) error {
+			for _, chunkID := range decodeIntent(k, v).chunks {
+				delete(candidates, chunkID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Content-addressed chunks may gain a reference at any time, so the final check is made in
+	// the same transaction which removes them.
+	var chunks []nugget.ChunkID
+	for chunkID := range candidates {
+		chunks = append(chunks, chunkID)
+	}
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		deleted, err := p.deleteUnreferencedTx(tx, chunks, intent{})
+		for _, chunkID := range deleted {
+			stats.ChunksRemoved++
+			stats.BytesRemoved += candidates[chunkID]
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(orphanedMeta) == 0 {
+		return nil
+	}
+	return p.removeOrphanedMeta(orphanedMeta, stats)
+}
+
+// removeOrphanedMeta removes the metadata entries in candidates which are still not referenced by
+// any path, along with their chunks.
+func (p *Provider) removeOrphanedMeta(candidates []nugget.EntryID, stats *GCStats) error {
+	var obsolete intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		referenced := map[nugget.EntryID]bool{}
+		err := tx.Bucket([]byte(pathEntryIDBucket)).ForEach(func(k, v []byte) error {
+			var entryID nugget.EntryID
+			copy(entryID[:], v)
+			referenced[entryID] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var chunks []nugget.ChunkID
+		for _, entryID := range candidates {
+			if referenced[entryID] {
+				continue
+			}
+			meta, err := p.metastore.lookup(tx, entryID)
+			if err == ErrMetaNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err = p.metastore.delete(tx, entryID); err != nil {
+				return err
+			}
+			if err = deleteXattrs(tx, entryID); err != nil {
+				return err
+			}
+			if err = releaseQuotasTx(tx, meta); err != nil {
+				return err
+			}
+			if meta.IsDir {
+				if err = deleteDirEntries(tx, entryID); err != nil {
+					return err
+				}
+			}
+			chunks = append(chunks, meta.Locality.ChunkIDs...)
+			stats.MetaRemoved++
+		}
+		stats.ChunksRemoved += len(chunks)
+		obsolete, err = p.releaseTx(tx, chunks)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.resolveIntent(obsolete)
+	return nil
+}
@@ -0,0 +1,66 @@
+package nuggdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/twitchyliquid64/nugget"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_gc_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, meta, _ := p.Store("/live", []byte("live"))
+	orphan, _ := p.chunkstore.Forge([]byte("orphan"))
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(p.chunkstore.chunkPath(orphan), old, old)
+	os.Chtimes(p.chunkstore.chunkPath(meta.GetDataLocality().Chunks()[0]), old, old)
+	recent, _ := p.chunkstore.Forge([]byte("recent"))
+	orphanedMetaChunk, _ := p.chunkstore.Forge([]byte("meta"))
+	p.metastore.Commit(EntryMetadata{Lname: "lost", EntryID: nugget.EntryID{8}, Size: 4, Ctime: old,
+		Locality: LocalityInfo{ChunkSize: DefaultChunkSize, ChunkIDs: []nugget.ChunkID{orphanedMetaChunk}}})
+
+	if _, ok := p.LastGCStats(); ok {
+		t.Error("Expected no stats before the first run")
+	}
+	stats := p.CollectGarbage(time.Hour)
+	if stats.Err != nil {
+		t.Fatal(stats.Err)
+	}
+	if stats.ChunksScanned != 4 || stats.ChunksRemoved != 2 || stats.BytesRemoved != 6 || stats.MetaRemoved != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if last, ok := p.LastGCStats(); !ok || last.ChunksRemoved != stats.ChunksRemoved {
+		t.Error("Expected last stats to be recorded")
+	}
+
+	for _, chunkID := range []nugget.ChunkID{orphan, orphanedMetaChunk} {
+		if _, err = p.chunkstore.Lookup(chunkID); err != ErrChunkNotFound {
+			t.Error("Expected garbage chunk to be removed")
+		}
+	}
+	if _, err = p.chunkstore.Lookup(recent); err != nil {
+		t.Error("Expected chunk within the grace period to be kept")
+	}
+	if _, _, data, err := p.Fetch("/live"); err != nil || string(data) != "live" {
+		t.Error("Expected live file to be intact", err)
+	}
+	if _, err = p.metastore.Lookup(nugget.EntryID{8}); err != ErrMetaNotFound {
+		t.Error("Expected orphaned metadata to be removed")
+	}
+}
@@ -0,0 +1,180 @@
+package nuggdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// intent.go implements a write-ahead log of chunk files which must be removed if found on startup.
+//
+// Chunk files live outside the database, so they cannot take part in a bolt transaction. Instead,
+// new chunks are recorded in an intent before they are written, and the transaction which makes
+// metadata reference them also removes the intent. Chunks which are no longer referenced are
+// recorded in an intent by the same transaction that drops the reference, and the intent is
+// removed once the chunk files are gone. Any intent left over after a crash therefore names
+// chunks which nothing references, and is resolved when the provider is next opened.
+
+const intentBucket = "Intents"
+
+// intent identifies a set of chunks recorded in the intent log. The zero intent records nothing.
+type intent struct {
+	seq    uint64
+	chunks []nugget.ChunkID
+
+	// set for new chunks which are content-addressed, and so may already be referenced
+	contentAddressed bool
+}
+
+func (in intent) key() []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, in.seq)
+	return k
+}
+
+// putIntent records chunks in the intent log as part of tx.
+func putIntent(tx *bolt.Tx, chunks []nugget.ChunkID) (intent, error) {
+	if len(chunks) == 0 {
+		return intent{}, nil
+	}
+	b := tx.Bucket([]byte(intentBucket))
+	seq, err := b.NextSequence()
+	if err != nil {
+		return intent{}, err
+	}
+
+	in := intent{seq: seq, chunks: chunks}
+	v := make([]byte, len(chunks)*len(nugget.ChunkID{}))
+	for i, chunkID := range chunks {
+		copy(v[i*len(chunkID):], chunkID[:])
+	}
+	return in, b.Put(in.key(), v)
+}
+
+// deleteIntent removes an intent from the log as part of tx.
+func deleteIntent(tx *bolt.Tx, in intent) error {
+	if in.seq == 0 {
+		return nil
+	}
+	return tx.Bucket([]byte(intentBucket)).Delete(in.key())
+}
+
+// decodeIntent returns the intent stored in the log under key k with value v.
+func decodeIntent(k, v []byte) intent {
+	in := intent{seq: binary.BigEndian.Uint64(k)}
+	for i := 0; i+len(nugget.ChunkID{}) <= len(v); i += len(nugget.ChunkID{}) {
+		var chunkID nugget.ChunkID
+		copy(chunkID[:], v[i:])
+		in.chunks = append(in.chunks, chunkID)
+	}
+	return in
+}
+
+// logIntent records chunks in the intent log in a transaction of its own.
+func (p *Provider) logIntent(chunks []nugget.ChunkID) (intent, error) {
+	var in intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		in, err = putIntent(tx, chunks)
+		return err
+	})
+	return in, err
+}
+
+// resolveIntent removes the chunks recorded by in, then removes in from the log. If any chunk
+// cannot be removed the intent is kept, so removal is attempted again when the provider is next opened.
+func (p *Provider) resolveIntent(in intent) {
+	if in.seq == 0 {
+		return
+	}
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		if _, err := p.deleteUnreferencedTx(tx, in.chunks, in); err != nil {
+			return err
+		}
+		return deleteIntent(tx, in)
+	})
+	if err != nil {
+		p.logger.Warning("nuggdb", "Could not remove unreferenced chunks, will retry on next startup: ", err)
+	}
+}
+
+// recoverIntents resolves every intent left in the log by a previous run.
+func (p *Provider) recoverIntents() error {
+	var pending []intent
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(intentBucket)).ForEach(func(k, v []byte) error {
+			pending = append(pending, decodeIntent(k, v))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		p.logger.Info("nuggdb", "Resolving ", len(pending), " intents left by a previous run")
+	}
+	for _, in := range pending {
+		p.resolveIntent(in)
+	}
+	return nil
+}
+
+// adoptTx clears the pending intent as part of tx, as the chunks it records are now referenced by
+// metadata. Content-addressed chunks may be shared, so their reference counts are incremented.
+func (p *Provider) adoptTx(tx *bolt.Tx, pending intent) error {
+	if pending.contentAddressed {
+		if err := p.metastore.addRefs(tx, pending.chunks); err != nil {
+			return err
+		}
+	}
+	return deleteIntent(tx, pending)
+}
+
+// releaseTx drops a reference to each chunk in chunks as part of tx. Chunks which are no longer
+// referenced are recorded in the returned intent, to be resolved once tx has committed.
+func (p *Provider) releaseTx(tx *bolt.Tx, chunks []nugget.ChunkID) (intent, error) {
+	released, err := p.metastore.releaseRefs(tx, chunks)
+	if err != nil {
+		return intent{}, err
+	}
+	return putIntent(tx, released)
+}
+
+// deleteUnreferencedTx removes the chunks in chunks which have no reference count and are not
+// recorded in any intent other than except, returning the chunks removed. Chunk files are removed
+// inside tx so no other transaction can take a reference to a chunk while it is being removed.
+// Chunks which do not exist are ignored.
+func (p *Provider) deleteUnreferencedTx(tx *bolt.Tx, chunks []nugget.ChunkID, except intent) ([]nugget.ChunkID, error) {
+	pending := map[nugget.ChunkID]bool{}
+	exceptKey := except.key()
+	err := tx.Bucket([]byte(intentBucket)).ForEach(func(k, v []byte) error {
+		if except.seq != 0 && bytes.Equal(k, exceptKey) {
+			return nil
+		}
+		for _, chunkID := range decodeIntent(k, v).chunks {
+			pending[chunkID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []nugget.ChunkID
+	for _, chunkID := range chunks {
+		if pending[chunkID] || p.metastore.refs(tx, chunkID) > 0 {
+			continue
+		}
+		if err := p.chunkstore.Delete(chunkID); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, chunkID)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,377 @@
+package nuggdb
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/twitchyliquid64/nugget"
+)
+
+// layout.go maps byte ranges of a file onto the fixed-size chunks which hold its data.
+
+// forgeChunks splits data into chunks of chunkSize bytes and saves each one with a new chunk ID,
+// encoded with the codec selected for new data. The new chunks are recorded in the returned intent, which the caller must clear in the same
+// transaction that commits metadata referencing them, or resolve if that transaction fails.
+func (p *Provider) forgeChunks(data []byte) (LocalityInfo, intent, error) {
+	var pieces [][]byte
+	for start := 0; start < len(data); start += int(p.chunkSize) {
+		end := start + int(p.chunkSize)
+		if end > len(data) {
+			end = len(data)
+		}
+		pieces = append(pieces, data[start:end])
+	}
+	chunks, pending, err := p.forge(p.codec, pieces)
+	if err != nil {
+		return LocalityInfo{}, intent{}, err
+	}
+	return LocalityInfo{ChunkSize: p.chunkSize, ChunkIDs: chunks, Codec: p.codec}, pending, nil
+}
+
+// forgeFrom reads r to the end, saving every chunkSize bytes read as a chunk with a new chunk ID, encoded
+// with the codec selected for new data, and returning the number of bytes read. Each chunk is recorded in
+// an intent of its own as it is saved, so data of any size is held in memory a chunk at a time. The caller
+// must clear the returned intents as for forgeChunks. If reading r fails, the chunks saved are removed.
+func (p *Provider) forgeFrom(r io.Reader) (LocalityInfo, []intent, uint64, error) {
+	locality := LocalityInfo{ChunkSize: p.chunkSize, Codec: p.codec}
+	var pending []intent
+	var size uint64
+	piece := make([]byte, p.chunkSize)
+	for {
+		n, err := io.ReadFull(r, piece)
+		if n > 0 {
+			chunks, in, forgeErr := p.forge(p.codec, [][]byte{piece[:n]})
+			if forgeErr != nil {
+				err = forgeErr
+			} else {
+				locality.ChunkIDs = append(locality.ChunkIDs, chunks...)
+				pending = append(pending, in)
+				size += uint64(n)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return locality, pending, size, nil
+		}
+		if err != nil {
+			for _, in := range pending {
+				p.resolveIntent(in)
+			}
+			return LocalityInfo{}, nil, 0, err
+		}
+	}
+}
+
+// forge saves each piece as a chunk with a new chunk ID, encoded with codec. The chunk IDs are
+// recorded in the intent log before any chunk is written. In content-addressed mode the chunk ID
+// is derived from the piece, and pieces which are already stored are not written again.
+func (p *Provider) forge(codec Codec, pieces [][]byte) ([]nugget.ChunkID, intent, error) {
+	chunks := make([]nugget.ChunkID, len(pieces))
+	for i := range chunks {
+		if p.contentAddressed {
+			chunks[i] = p.contentID(codec, pieces[i])
+		} else {
+			rand.Read(chunks[i][:])
+		}
+	}
+	pending, err := p.logIntent(chunks)
+	if err != nil {
+		return nil, intent{}, err
+	}
+	pending.contentAddressed = p.contentAddressed
+
+	for i, chunkID := range chunks {
+		var encoded []byte
+		if encoded, err = codec.encode(pieces[i]); err == nil {
+			if p.contentAddressed {
+				err = p.chunkstore.commitOnce(chunkID, encoded)
+			} else {
+				err = p.chunkstore.Commit(chunkID, encoded)
+			}
+		}
+		if err != nil {
+			p.resolveIntent(pending)
+			return nil, intent{}, err
+		}
+	}
+	return chunks, pending, nil
+}
+
+// contentID returns the content-addressed chunk ID for data encoded with codec. The same data
+// encoded with different codecs is stored in different chunks.
+func (p *Provider) contentID(codec Codec, data []byte) nugget.ChunkID {
+	h := p.sealer.contentHash()
+	if codec != CodecNone {
+		h.Write([]byte{byte(codec)})
+	}
+	h.Write(data)
+	var id nugget.ChunkID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// immutableChunks returns true if the chunks of the file described by meta are never modified
+// in place: content-addressed chunks may be shared, while compressed and encrypted chunks can
+// only be written as a whole.
+func (p *Provider) immutableChunks(meta *EntryMetadata) bool {
+	return p.contentAddressed || meta.Locality.Codec != CodecNone || p.sealer != nil
+}
+
+// readRange returns up to size bytes of the file described by meta, starting at offset.
+// Regions of the file which are not backed by chunk data read as zeros.
+func (p *Provider) readRange(meta *EntryMetadata, offset, size int64) ([]byte, error) {
+	if offset >= int64(meta.Size) || size <= 0 {
+		return []byte{}, nil
+	}
+	if offset+size > int64(meta.Size) {
+		size = int64(meta.Size) - offset
+	}
+
+	if !meta.Locality.IsChunked() {
+		data, err := p.chunkstore.Read(meta.Locality.ChunkAtIndex(0), meta.Locality.Codec, offset, size)
+		if err == io.EOF {
+			err = nil
+		}
+		return data, err
+	}
+
+	out := make([]byte, size)
+	chunkSize := int64(meta.Locality.ChunkSize)
+	for pos := offset; pos < offset+size; {
+		index := int(pos / chunkSize)
+		chunkOffset := pos % chunkSize
+		n := chunkSize - chunkOffset
+		if pos+n > offset+size {
+			n = offset + size - pos
+		}
+
+		if index < len(meta.Locality.ChunkIDs) {
+			data, err := p.chunkstore.Read(meta.Locality.ChunkIDs[index], meta.Locality.Codec, chunkOffset, n)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			copy(out[pos-offset:], data)
+		}
+		pos += n
+	}
+	return out, nil
+}
+
+// writeRange writes data into the file described by meta at offset, touching only the chunks
+// which overlap the write. New chunks are created as needed, and meta is updated to reflect
+// the new chunk list and size. The caller is responsible for committing meta, clearing the
+// returned intent, which records any new chunks, and releasing the chunks which were replaced.
+func (p *Provider) writeRange(meta *EntryMetadata, offset int64, data []byte) (int64, intent, []nugget.ChunkID, error) {
+	if !meta.Locality.IsChunked() {
+		if err := p.rechunk(meta); err != nil {
+			return 0, intent{}, nil, err
+		}
+	}
+	if p.immutableChunks(meta) {
+		return p.writeRangeCopy(meta, offset, data)
+	}
+	chunkSize := int64(meta.Locality.ChunkSize)
+	end := offset + int64(len(data))
+
+	var pending intent
+	if missing := (end+chunkSize-1)/chunkSize - int64(len(meta.Locality.ChunkIDs)); missing > 0 {
+		newChunks, in, err := p.forge(CodecNone, make([][]byte, missing))
+		if err != nil {
+			return 0, intent{}, nil, err
+		}
+		pending = in
+		meta.Locality.ChunkIDs = append(meta.Locality.ChunkIDs, newChunks...)
+	}
+
+	var written int64
+	for pos := offset; pos < end; {
+		index := int(pos / chunkSize)
+		chunkOffset := pos % chunkSize
+		n := chunkSize - chunkOffset
+		if pos+n > end {
+			n = end - pos
+		}
+
+		w, _, err := p.chunkstore.Write(meta.Locality.ChunkIDs[index], chunkOffset, data[pos-offset:pos-offset+n])
+		written += int64(w)
+		if err != nil {
+			return written, pending, nil, err
+		}
+		pos += n
+	}
+
+	if uint64(end) > meta.Size {
+		meta.Size = uint64(end)
+	}
+	return written, pending, nil, nil
+}
+
+// writeRangeCopy implements writeRange for chunks which are never modified in place. Each chunk
+// overlapping the write is copied, modified and saved as a new chunk with the same codec.
+func (p *Provider) writeRangeCopy(meta *EntryMetadata, offset int64, data []byte) (int64, intent, []nugget.ChunkID, error) {
+	if len(data) == 0 {
+		return 0, intent{}, nil, nil
+	}
+	chunkSize := int64(meta.Locality.ChunkSize)
+	end := offset + int64(len(data))
+	first := offset / chunkSize
+	if existing := int64(len(meta.Locality.ChunkIDs)); existing < first {
+		first = existing // chunks between the end of the file and the write are empty
+	}
+	last := (end - 1) / chunkSize
+
+	var pieces [][]byte
+	for index := first; index <= last; index++ {
+		var content []byte
+		if index < int64(len(meta.Locality.ChunkIDs)) {
+			var err error
+			if content, err = p.chunkstore.lookupDecoded(meta.Locality.ChunkIDs[index], meta.Locality.Codec); err != nil {
+				return 0, intent{}, nil, err
+			}
+		}
+		chunkStart := index * chunkSize
+		lo, hi := offset-chunkStart, end-chunkStart
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > chunkSize {
+			hi = chunkSize
+		}
+		if lo < hi {
+			if int64(len(content)) < hi {
+				content = append(content, make([]byte, hi-int64(len(content)))...)
+			}
+			copy(content[lo:hi], data[chunkStart+lo-offset:chunkStart+hi-offset])
+		}
+		pieces = append(pieces, content)
+	}
+
+	newChunks, pending, err := p.forge(meta.Locality.Codec, pieces)
+	if err != nil {
+		return 0, intent{}, nil, err
+	}
+	var replaced []nugget.ChunkID
+	for i, chunkID := range newChunks {
+		index := int(first) + i
+		if index < len(meta.Locality.ChunkIDs) {
+			replaced = append(replaced, meta.Locality.ChunkIDs[index])
+			meta.Locality.ChunkIDs[index] = chunkID
+		} else {
+			meta.Locality.ChunkIDs = append(meta.Locality.ChunkIDs, chunkID)
+		}
+	}
+
+	if uint64(end) > meta.Size {
+		meta.Size = uint64(end)
+	}
+	return int64(len(data)), pending, replaced, nil
+}
+
+// chunkDelta is a change to the chunk list of a file: the chunks set at some indices, and the length of
+// the list once changed. It is applied to the metadata read in the transaction committing the change, so
+// only the chunks touched by the operation are replaced.
+type chunkDelta struct {
+	chunkSize uint32
+	codec     Codec
+	set       map[int]nugget.ChunkID
+	length    int
+}
+
+// diffChunks returns the change made to the chunk list of a file, from before to after. If the layout
+// of the chunks changed, every chunk is replaced. before must not share its chunk list with after.
+func diffChunks(before, after LocalityInfo) chunkDelta {
+	relaid := before.ChunkSize != after.ChunkSize || before.Codec != after.Codec
+	d := chunkDelta{chunkSize: after.ChunkSize, codec: after.Codec, set: map[int]nugget.ChunkID{}, length: len(after.ChunkIDs)}
+	for i, chunkID := range after.ChunkIDs {
+		if relaid || i >= len(before.ChunkIDs) || before.ChunkIDs[i] != chunkID {
+			d.set[i] = chunkID
+		}
+	}
+	return d
+}
+
+// apply makes the change d to the chunk list l.
+func (d chunkDelta) apply(l *LocalityInfo) {
+	chunks := make([]nugget.ChunkID, d.length)
+	copy(chunks, l.ChunkIDs)
+	for i, chunkID := range d.set {
+		chunks[i] = chunkID
+	}
+	l.ChunkSize, l.Codec, l.ChunkIDs = d.chunkSize, d.codec, chunks
+}
+
+// cloneLocality returns a copy of l which does not share its chunk list.
+func cloneLocality(l LocalityInfo) LocalityInfo {
+	l.ChunkIDs = append([]nugget.ChunkID(nil), l.ChunkIDs...)
+	return l
+}
+
+// rechunk migrates a legacy single-chunk entry to the fixed-size chunk layout. On success,
+// meta is updated to reference the new chunks and the legacy chunk is removed.
+func (p *Provider) rechunk(meta *EntryMetadata) error {
+	data, err := p.readRange(meta, 0, int64(meta.Size))
+	if err != nil {
+		return err
+	}
+	locality, pending, err := p.forgeChunks(data)
+	if err != nil {
+		return err
+	}
+
+	// the size is unchanged, so no quota is charged and the path of the entry is not needed
+	newMeta, err := p.commitMeta("", meta.EntryID, 0, func(current *EntryMetadata) {
+		current.Locality = locality
+	}, pending, meta.Locality.ChunkIDs)
+	if err != nil {
+		return err
+	}
+	*meta = newMeta
+	return nil
+}
+
+// truncate changes the size of the file described by meta, returning the chunks which are no
+// longer part of the file. The chunk containing the new end of the file is cut short, or replaced
+// with a shorter copy if it is never modified in place. Growing a file does not touch any chunks, as regions
+// not backed by chunk data read as zeros. The caller is responsible for committing meta, clearing
+// the returned intent, which records any new chunk, then releasing the returned chunks.
+func (p *Provider) truncate(meta *EntryMetadata, size uint64) ([]nugget.ChunkID, intent, error) {
+	if size >= meta.Size {
+		meta.Size = size
+		return nil, intent{}, nil
+	}
+	if !meta.Locality.IsChunked() {
+		if err := p.rechunk(meta); err != nil {
+			return nil, intent{}, err
+		}
+	}
+
+	var removed []nugget.ChunkID
+	var pending intent
+	chunkSize := uint64(meta.Locality.ChunkSize)
+	keep := int((size + chunkSize - 1) / chunkSize)
+	if keep < len(meta.Locality.ChunkIDs) {
+		removed = append(removed, meta.Locality.ChunkIDs[keep:]...)
+		meta.Locality.ChunkIDs = meta.Locality.ChunkIDs[:keep]
+	}
+	if keep > 0 && keep == len(meta.Locality.ChunkIDs) && size%chunkSize != 0 {
+		lastChunk := meta.Locality.ChunkIDs[keep-1]
+		if p.immutableChunks(meta) {
+			content, err := p.chunkstore.lookupDecoded(lastChunk, meta.Locality.Codec)
+			if err != nil {
+				return nil, intent{}, err
+			}
+			if uint64(len(content)) > size%chunkSize {
+				newChunks, in, err := p.forge(meta.Locality.Codec, [][]byte{content[:size%chunkSize]})
+				if err != nil {
+					return nil, intent{}, err
+				}
+				pending = in
+				removed = append(removed, lastChunk)
+				meta.Locality.ChunkIDs[keep-1] = newChunks[0]
+			}
+		} else if err := p.chunkstore.Truncate(lastChunk, int64(size%chunkSize)); err != nil {
+			return nil, intent{}, err
+		}
+	}
+	meta.Size = size
+	return removed, pending, nil
+}
@@ -3,17 +3,39 @@ package nuggdb
 import (
 	"bytes"
 	"encoding/binary"
+	"os"
+	"time"
 
 	"github.com/twitchyliquid64/nugget"
 )
 
+// Default permissions for entries created without explicit attributes.
+const (
+	DefaultFileMode   os.FileMode = 0644
+	DefaultDirMode    os.FileMode = 0755
+	DefaultLegacyMode os.FileMode = 0777 // reported for entries written before permissions were stored
+)
+
+// ModeMask selects the bits of an os.FileMode which are stored in EntryMetadata.Mode.
+const ModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
 // EntryMetadata is a concrete implementation of nugget.NodeMetadata
 type EntryMetadata struct {
 	IsDir    bool
+	IsLink   bool // symbolic link, the target of which is held as the data of the entry
 	Lname    string
 	EntryID  nugget.EntryID
 	Size     uint64
 	Locality LocalityInfo
+	Nlink    uint32 // number of paths referring to the entry
+
+	Mode   os.FileMode //permission bits only
+	UID    uint32
+	GID    uint32
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+	Crtime time.Time
 }
 
 // ID returns the EntryID.
@@ -26,6 +48,11 @@ func (meta *EntryMetadata) IsDirectory() bool {
 	return meta.IsDir
 }
 
+// IsSymlink returns true if the metadata entry represents a symbolic link
+func (meta *EntryMetadata) IsSymlink() bool {
+	return meta.IsLink
+}
+
 // LocalName returns the localised name of the metadata entry - ie without path info.
 func (meta *EntryMetadata) LocalName() string {
 	return meta.Lname
@@ -41,53 +68,183 @@ func (meta *EntryMetadata) GetDataLocality() nugget.LocalityInfo {
 	return &meta.Locality
 }
 
+// GetNlink returns the number of paths referring to the entry.
+func (meta *EntryMetadata) GetNlink() uint32 {
+	return meta.Nlink
+}
+
+// GetMode returns the permission bits of the entry.
+func (meta *EntryMetadata) GetMode() os.FileMode {
+	return meta.Mode
+}
+
+// GetUID returns the user ID of the owner of the entry.
+func (meta *EntryMetadata) GetUID() uint32 {
+	return meta.UID
+}
+
+// GetGID returns the group ID of the owner of the entry.
+func (meta *EntryMetadata) GetGID() uint32 {
+	return meta.GID
+}
+
+// GetAtime returns the time the entry was last accessed.
+func (meta *EntryMetadata) GetAtime() time.Time {
+	return meta.Atime
+}
+
+// GetMtime returns the time the data of the entry was last modified.
+func (meta *EntryMetadata) GetMtime() time.Time {
+	return meta.Mtime
+}
+
+// GetCtime returns the time the entry was last changed.
+func (meta *EntryMetadata) GetCtime() time.Time {
+	return meta.Ctime
+}
+
+// GetCrtime returns the time the entry was created.
+func (meta *EntryMetadata) GetCrtime() time.Time {
+	return meta.Crtime
+}
+
+// Metadata encoding versions, stored in the second flags byte.
+const (
+	metaVersionLegacy     = 0 // single 16-byte ChunkID locality section
+	metaVersionChunked    = 1 // variable-length locality section
+	metaVersionAttributes = 2 // ownership, permission and time section before the locality section
+	metaVersionCodec      = 3 // codec byte in the locality section
+	metaVersionLongNames  = 4 // name section between the attribute and locality sections
+	metaVersionLinkCount  = 5 // link count between the name and locality sections
+)
+
+// MaxNameLen is the longest name, in bytes, an entry may have.
+const MaxNameLen = 255
+
+// metaHeaderSize is the size of the fixed portion of a serialized EntryMetadata.
+const metaHeaderSize = 12 + 100 + 8 + 2 //EntryID + LocalName + Size + flags
+
+// metaAttrSize is the size of the ownership, permission and time section of a serialized EntryMetadata.
+const metaAttrSize = 4 + 4 + 4 + 8*4 //Mode + UID + GID + Atime + Mtime + Ctime + Crtime
+
+// metaNameFieldSize is the size of the name field in the fixed portion of a serialized EntryMetadata.
+// Longer names spill over into the name section, which holds the length of the name followed by
+// the bytes which did not fit.
+const metaNameFieldSize = 100
+
 // Serialize returns a byte slice which represents the EntryMetadata structure.
+// Names longer than MaxNameLen are truncated.
 func (meta *EntryMetadata) Serialize() []byte {
-	buff := make([]byte, 12+100+8+2+16) //EntryID + LocalName + Size + flags + len(LocalityInfo)
+	name := meta.Lname
+	if len(name) > MaxNameLen {
+		name = name[:MaxNameLen]
+	}
+	var overflow string
+	if len(name) > metaNameFieldSize {
+		overflow = name[metaNameFieldSize:]
+	}
+	locality := meta.Locality.Serialize()
+	nameSection := metaHeaderSize + metaAttrSize
+	linkSection := nameSection + 1 + len(overflow)
+	buff := make([]byte, linkSection+4+len(locality))
 	copy(buff[:12], meta.EntryID[:])
-	copy(buff[12:100+12], meta.Lname)
+	copy(buff[12:metaNameFieldSize+12], name)
 	binary.LittleEndian.PutUint64(buff[12+100:12+100+8], meta.Size)
 	if meta.IsDir {
 		buff[12+100+8] |= (1 << 0)
 	}
-	copy(buff[12+100+8+2:], meta.Locality.Serialize())
+	if meta.IsLink {
+		buff[12+100+8] |= (1 << 1)
+	}
+	buff[12+100+8+1] = metaVersionLinkCount
+
+	attr := buff[metaHeaderSize : metaHeaderSize+metaAttrSize]
+	binary.LittleEndian.PutUint32(attr[0:4], uint32(meta.Mode))
+	binary.LittleEndian.PutUint32(attr[4:8], meta.UID)
+	binary.LittleEndian.PutUint32(attr[8:12], meta.GID)
+	putTime(attr[12:20], meta.Atime)
+	putTime(attr[20:28], meta.Mtime)
+	putTime(attr[28:36], meta.Ctime)
+	putTime(attr[36:44], meta.Crtime)
+
+	buff[nameSection] = byte(len(name))
+	copy(buff[nameSection+1:], overflow)
+	binary.LittleEndian.PutUint32(buff[linkSection:linkSection+4], meta.Nlink)
+	copy(buff[linkSection+4:], locality)
 	return buff
 }
 
-// LocalityInfo is a concrete implementation of nugget.LocalityInfo
-// TODO: Update to support multiple chunks, remember to update tests meta.Serialize as well
+// putTime encodes t as nanoseconds since the unix epoch. The zero time is encoded as 0.
+func putTime(buff []byte, t time.Time) {
+	if t.IsZero() {
+		binary.LittleEndian.PutUint64(buff, 0)
+		return
+	}
+	binary.LittleEndian.PutUint64(buff, uint64(t.UnixNano()))
+}
+
+// getTime decodes a time encoded by putTime.
+func getTime(buff []byte) time.Time {
+	ns := int64(binary.LittleEndian.Uint64(buff))
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// DefaultChunkSize is the size of the chunks new file data is split into.
+const DefaultChunkSize = 4 * 1024 * 1024
+
+// LocalityInfo is a concrete implementation of nugget.LocalityInfo.
+// File data is split into chunks of ChunkSize bytes, the last of which may be short.
+// A ChunkSize of zero represents a legacy entry, where all data lives in a single chunk.
+// Every chunk of a file is encoded with the same Codec.
 type LocalityInfo struct {
-	ChunkID nugget.ChunkID
+	ChunkSize uint32
+	ChunkIDs  []nugget.ChunkID
+	Codec     Codec
 }
 
-// IsChunked always returns false, multiple chunks per file is not yet implemented.
+// IsChunked returns true if the data is split into fixed-size chunks.
 func (l *LocalityInfo) IsChunked() bool {
-	return false
+	return l.ChunkSize > 0
 }
 
 // Chunks returns an ordered slice of all the chunks which make up the file.
 func (l *LocalityInfo) Chunks() []nugget.ChunkID {
-	return []nugget.ChunkID{l.ChunkID}
+	return l.ChunkIDs
 }
 
 // ChunkAtIndex returns the chunkID at the index of the array of chunks which make up the file.
+// An empty ChunkID is returned if pos is out of range.
 func (l *LocalityInfo) ChunkAtIndex(pos int) nugget.ChunkID {
-	return l.ChunkID
+	if pos < 0 || pos >= len(l.ChunkIDs) {
+		return nugget.ChunkID{}
+	}
+	return l.ChunkIDs[pos]
 }
 
 // Serialize returns a byte slice which represents the LocalityInfo structure.
 func (l *LocalityInfo) Serialize() []byte {
-	buff := make([]byte, 16)
-	copy(buff, l.ChunkID[:])
+	buff := make([]byte, 4+4+1+16*len(l.ChunkIDs)) //ChunkSize + numChunks + Codec + ChunkIDs
+	binary.LittleEndian.PutUint32(buff[0:4], l.ChunkSize)
+	binary.LittleEndian.PutUint32(buff[4:8], uint32(len(l.ChunkIDs)))
+	buff[8] = byte(l.Codec)
+	for i, chunkID := range l.ChunkIDs {
+		copy(buff[9+16*i:9+16*(i+1)], chunkID[:])
+	}
 	return buff
 }
 
-// MakeMetadata constructs a EntryMetadata from the byte slice.
+// MakeMetadata constructs a EntryMetadata from the byte slice. Entries written
+// before multi-chunk support are decoded as a single unchunked chunk, entries
+// written before attributes were stored are given DefaultLegacyMode, and entries
+// written before hard links are given a link count of one.
 func MakeMetadata(data []byte) EntryMetadata {
-	if len(data) != (12 + 100 + 8 + 2 + 16) {
+	if len(data) < metaHeaderSize {
 		panic("Len incorrect")
 	}
-	ret := EntryMetadata{}
+	ret := EntryMetadata{Nlink: 1}
 
 	copy(ret.EntryID[:], data[:12])
 	ret.Lname = string(bytes.Trim(data[12:12+100], "\x00"))
@@ -95,15 +252,110 @@ func MakeMetadata(data []byte) EntryMetadata {
 	ret.Size = binary.LittleEndian.Uint64(data[12+100 : 12+100+8])
 
 	ret.IsDir = (data[12+100+8] & 1) == 1
-	ret.Locality = MakeLocality(data[12+100+8+2:])
+	ret.IsLink = (data[12+100+8] & (1 << 1)) != 0
+	switch data[12+100+8+1] {
+	case metaVersionLegacy:
+		if len(data) != metaHeaderSize+16 {
+			panic("Len incorrect")
+		}
+		ret.Mode = DefaultLegacyMode
+		ret.Locality = makeLegacyLocality(data[metaHeaderSize:])
+	case metaVersionChunked:
+		ret.Mode = DefaultLegacyMode
+		ret.Locality = makeUncompressedLocality(data[metaHeaderSize:])
+	case metaVersionAttributes, metaVersionCodec, metaVersionLongNames, metaVersionLinkCount:
+		if len(data) < metaHeaderSize+metaAttrSize {
+			panic("Len incorrect")
+		}
+		attr := data[metaHeaderSize : metaHeaderSize+metaAttrSize]
+		ret.Mode = os.FileMode(binary.LittleEndian.Uint32(attr[0:4]))
+		ret.UID = binary.LittleEndian.Uint32(attr[4:8])
+		ret.GID = binary.LittleEndian.Uint32(attr[8:12])
+		ret.Atime = getTime(attr[12:20])
+		ret.Mtime = getTime(attr[20:28])
+		ret.Ctime = getTime(attr[28:36])
+		ret.Crtime = getTime(attr[36:44])
+		switch data[12+100+8+1] {
+		case metaVersionAttributes:
+			ret.Locality = makeUncompressedLocality(data[metaHeaderSize+metaAttrSize:])
+		case metaVersionCodec:
+			ret.Locality = MakeLocality(data[metaHeaderSize+metaAttrSize:])
+		default:
+			nameSection := data[metaHeaderSize+metaAttrSize:]
+			if len(nameSection) < 1 {
+				panic("Len incorrect")
+			}
+			nameLen := int(nameSection[0])
+			overflow := 0
+			if nameLen > metaNameFieldSize {
+				overflow = nameLen - metaNameFieldSize
+			}
+			if len(nameSection) < 1+overflow {
+				panic("Len incorrect")
+			}
+			ret.Lname = string(data[12:12+nameLen-overflow]) + string(nameSection[1:1+overflow])
+			locality := nameSection[1+overflow:]
+			if data[12+100+8+1] == metaVersionLinkCount {
+				if len(locality) < 4 {
+					panic("Len incorrect")
+				}
+				ret.Nlink = binary.LittleEndian.Uint32(locality[0:4])
+				locality = locality[4:]
+			}
+			ret.Locality = MakeLocality(locality)
+		}
+	default:
+		panic("Unknown metadata version")
+	}
 	return ret
 }
 
 // MakeLocality constructs a LocalityInfo struct from the byte slice.
 func MakeLocality(data []byte) LocalityInfo {
+	if len(data) < 9 {
+		panic("Len incorrect")
+	}
+	numChunks := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) != 9+16*numChunks {
+		panic("Len incorrect")
+	}
+	ret := LocalityInfo{
+		ChunkSize: binary.LittleEndian.Uint32(data[0:4]),
+		ChunkIDs:  make([]nugget.ChunkID, numChunks),
+		Codec:     Codec(data[8]),
+	}
+	for i := range ret.ChunkIDs {
+		copy(ret.ChunkIDs[i][:], data[9+16*i:9+16*(i+1)])
+	}
+	return ret
+}
+
+// makeUncompressedLocality decodes the locality section used before chunk data could be
+// compressed, which has no codec byte.
+func makeUncompressedLocality(data []byte) LocalityInfo {
+	if len(data) < 8 {
+		panic("Len incorrect")
+	}
+	numChunks := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) != 8+16*numChunks {
+		panic("Len incorrect")
+	}
+	ret := LocalityInfo{
+		ChunkSize: binary.LittleEndian.Uint32(data[0:4]),
+		ChunkIDs:  make([]nugget.ChunkID, numChunks),
+	}
+	for i := range ret.ChunkIDs {
+		copy(ret.ChunkIDs[i][:], data[8+16*i:8+16*(i+1)])
+	}
+	return ret
+}
+
+// makeLegacyLocality decodes the single-chunk locality section used before files
+// were split into multiple chunks.
+func makeLegacyLocality(data []byte) LocalityInfo {
 	var chunkID nugget.ChunkID
 	copy(chunkID[:], data)
 	return LocalityInfo{
-		ChunkID: chunkID,
+		ChunkIDs: []nugget.ChunkID{chunkID},
 	}
 }
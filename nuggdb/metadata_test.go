@@ -3,7 +3,10 @@ package nuggdb
 import (
 	"bytes"
 	"encoding/binary"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/twitchyliquid64/nugget"
 )
@@ -15,11 +18,13 @@ func TestSerialize(t *testing.T) {
 		Size:    54634532544,
 		IsDir:   true,
 		Locality: LocalityInfo{
-			ChunkID: nugget.ChunkID{'1', '2'},
+			ChunkSize: DefaultChunkSize,
+			ChunkIDs:  []nugget.ChunkID{{'1', '2'}, {'3'}},
+			Codec:     CodecGzip,
 		},
 	}
 
-	if len(a.Serialize()) != (12 + 100 + 8 + 2 + 16) {
+	if len(a.Serialize()) != (12 + 100 + 8 + 2 + metaAttrSize + 1 + 4 + 4 + 4 + 1 + 16*2) {
 		t.Error("Len incorrect")
 	}
 
@@ -43,9 +48,22 @@ func TestSerialize(t *testing.T) {
 		t.Error("IsDir does not match, got", isDir)
 	}
 
+	locality := a.Serialize()[12+100+8+2+metaAttrSize+1+4:]
+	chunkSize := binary.LittleEndian.Uint32(locality[0:4])
+	if chunkSize != a.Locality.ChunkSize {
+		t.Error("Expected chunk size to match, got", chunkSize)
+	}
+	numChunks := binary.LittleEndian.Uint32(locality[4:8])
+	if numChunks != 2 {
+		t.Error("Expected 2 chunks, got", numChunks)
+	}
+	if Codec(locality[8]) != CodecGzip {
+		t.Error("Expected codec to match, got", locality[8])
+	}
+
 	var chunk nugget.ChunkID
-	copy(chunk[:], a.Serialize()[12+100+8+2:12+100+8+2+16])
-	if chunk != a.Locality.ChunkID {
+	copy(chunk[:], locality[9+16:9+32])
+	if chunk != a.Locality.ChunkAtIndex(1) {
 		t.Error("Expected chunkID to match")
 	}
 }
@@ -57,8 +75,14 @@ func TestSerializeDeserialize(t *testing.T) {
 		Size:    54634532544,
 		IsDir:   true,
 		Locality: LocalityInfo{
-			ChunkID: nugget.ChunkID{'1', '2'},
+			ChunkSize: DefaultChunkSize,
+			ChunkIDs:  []nugget.ChunkID{{'1', '2'}, {'3'}},
+			Codec:     CodecFlate,
 		},
+		Mode:  0750 | os.ModeSetgid,
+		UID:   1000,
+		GID:   100,
+		Mtime: time.Date(2016, 2, 2, 4, 1, 0, 5, time.UTC),
 	}
 	buff := a.Serialize()
 	out := MakeMetadata(buff)
@@ -74,7 +98,141 @@ func TestSerializeDeserialize(t *testing.T) {
 	if out.EntryID != a.EntryID {
 		t.Error("Expected Size to match")
 	}
-	if out.Locality.ChunkID != a.Locality.ChunkID {
-		t.Error("Expected Locality.ChunkID to match")
+	if !out.Locality.IsChunked() || out.Locality.ChunkSize != a.Locality.ChunkSize {
+		t.Error("Expected Locality.ChunkSize to match")
+	}
+	if len(out.Locality.Chunks()) != 2 || out.Locality.ChunkAtIndex(0) != a.Locality.ChunkAtIndex(0) || out.Locality.ChunkAtIndex(1) != a.Locality.ChunkAtIndex(1) {
+		t.Error("Expected Locality.ChunkIDs to match")
+	}
+	if out.Locality.Codec != a.Locality.Codec {
+		t.Error("Expected Locality.Codec to match, got", out.Locality.Codec)
+	}
+	if out.Mode != a.Mode || out.UID != a.UID || out.GID != a.GID {
+		t.Error("Expected ownership and permissions to match, got", out.Mode, out.UID, out.GID)
+	}
+	if !out.Mtime.Equal(a.Mtime) {
+		t.Error("Expected Mtime to match, got", out.Mtime)
+	}
+	if !out.Atime.IsZero() {
+		t.Error("Expected zero Atime to be preserved, got", out.Atime)
+	}
+}
+
+func TestSerializeDeserializeLongName(t *testing.T) {
+	for _, name := range []string{"", "short", strings.Repeat("n", 100), strings.Repeat("l", 101), strings.Repeat("m", MaxNameLen)} {
+		a := EntryMetadata{
+			Lname: name,
+			Locality: LocalityInfo{
+				ChunkSize: DefaultChunkSize,
+				ChunkIDs:  []nugget.ChunkID{{'1', '2'}},
+			},
+		}
+		out := MakeMetadata(a.Serialize())
+		if out.Lname != name {
+			t.Errorf("Expected %d byte name to survive, got %d bytes", len(name), len(out.Lname))
+		}
+		if len(out.Locality.Chunks()) != 1 || out.Locality.ChunkAtIndex(0) != a.Locality.ChunkAtIndex(0) {
+			t.Error("Expected Locality.ChunkIDs to match, got", out.Locality.Chunks())
+		}
+	}
+
+	a := EntryMetadata{Lname: strings.Repeat("x", MaxNameLen+10)}
+	if out := MakeMetadata(a.Serialize()); len(out.Lname) != MaxNameLen {
+		t.Error("Expected long name to be truncated to MaxNameLen, got", len(out.Lname))
+	}
+}
+
+func TestSerializeDeserializeSymlink(t *testing.T) {
+	a := EntryMetadata{Lname: "link", IsLink: true, Size: 6}
+	out := MakeMetadata(a.Serialize())
+	if !out.IsLink || out.IsDir || out.Size != 6 {
+		t.Error("Expected symlink to survive, got", out)
+	}
+	if out := MakeMetadata((&EntryMetadata{Lname: "file"}).Serialize()); out.IsLink {
+		t.Error("Expected file not to be a symlink")
+	}
+}
+
+func TestSerializeDeserializeLinkCount(t *testing.T) {
+	a := EntryMetadata{Lname: "linked", Nlink: 3, Locality: LocalityInfo{ChunkSize: DefaultChunkSize}}
+	if out := MakeMetadata(a.Serialize()); out.Nlink != 3 {
+		t.Error("Expected link count to survive, got", out.Nlink)
+	}
+
+	// records written before hard links have no link count section
+	buff := a.Serialize()
+	buff[12+100+8+1] = metaVersionLongNames
+	linkSection := metaHeaderSize + metaAttrSize + 1
+	buff = append(buff[:linkSection], buff[linkSection+4:]...)
+	if out := MakeMetadata(buff); out.Nlink != 1 || out.Lname != "linked" {
+		t.Error("Expected a single link, got", out.Nlink, out.Lname)
+	}
+}
+
+func TestDeserializeFixedName(t *testing.T) {
+	a := EntryMetadata{
+		Lname: "fixed",
+		Locality: LocalityInfo{
+			ChunkSize: DefaultChunkSize,
+			ChunkIDs:  []nugget.ChunkID{{'3'}},
+			Codec:     CodecGzip,
+		},
+	}
+	// records written before long names have no name or link count section
+	buff := a.Serialize()
+	buff[12+100+8+1] = metaVersionCodec
+	nameSection := metaHeaderSize + metaAttrSize
+	buff = append(buff[:nameSection], buff[nameSection+1+4:]...)
+
+	out := MakeMetadata(buff)
+	if out.Lname != "fixed" || out.Locality.Codec != CodecGzip || out.Locality.ChunkAtIndex(0) != a.Locality.ChunkAtIndex(0) {
+		t.Error("Expected fixed name entry to decode, got", out)
+	}
+}
+
+func TestDeserializeUncompressedLocality(t *testing.T) {
+	a := EntryMetadata{
+		Lname: "old",
+		Locality: LocalityInfo{
+			ChunkSize: DefaultChunkSize,
+			ChunkIDs:  []nugget.ChunkID{{'1', '2'}},
+		},
+		Mode: 0640,
+	}
+	// records written before compression have no codec byte
+	buff := a.Serialize()
+	buff[12+100+8+1] = metaVersionAttributes
+	locality := metaHeaderSize + metaAttrSize
+	buff = append(buff[:locality], buff[locality+1+4:]...) // no name or link count section
+	buff = append(buff[:locality+8], buff[locality+9:]...)
+
+	out := MakeMetadata(buff)
+	if out.Mode != a.Mode || out.Locality.Codec != CodecNone {
+		t.Error("Expected uncompressed entry, got", out.Mode, out.Locality.Codec)
+	}
+	if len(out.Locality.Chunks()) != 1 || out.Locality.ChunkAtIndex(0) != a.Locality.ChunkAtIndex(0) {
+		t.Error("Expected Locality.ChunkIDs to match, got", out.Locality.Chunks())
+	}
+}
+
+func TestDeserializeLegacySingleChunk(t *testing.T) {
+	buff := make([]byte, 12+100+8+2+16)
+	copy(buff[:12], "abcdefghijkl")
+	copy(buff[12:12+100], "legacy")
+	binary.LittleEndian.PutUint64(buff[12+100:12+100+8], 1234)
+	copy(buff[12+100+8+2:], []byte{'7', '8'})
+
+	out := MakeMetadata(buff)
+	if out.Lname != "legacy" || out.Size != 1234 {
+		t.Error("Expected header fields to match")
+	}
+	if out.Locality.IsChunked() {
+		t.Error("Expected legacy entry to be unchunked")
+	}
+	if out.Mode != DefaultLegacyMode {
+		t.Error("Expected legacy entry to have DefaultLegacyMode, got", out.Mode)
+	}
+	if len(out.Locality.Chunks()) != 1 || (out.Locality.ChunkAtIndex(0) != nugget.ChunkID{'7', '8'}) {
+		t.Error("Expected single legacy chunk, got", out.Locality.Chunks())
 	}
 }
@@ -1,6 +1,7 @@
 package nuggdb
 
 import (
+	"encoding/binary"
 	"errors"
 	"time"
 
@@ -8,7 +9,10 @@ import (
 	"github.com/twitchyliquid64/nugget"
 )
 
-const entryIDToMetaBucket = "EntryIDToMeta"
+const (
+	entryIDToMetaBucket = "EntryIDToMeta"
+	chunkRefsBucket     = "ChunkIDToRefs"
+)
 
 // ErrMetaNotFound is returned if the entryID requested was not found in the metastore.
 var ErrMetaNotFound = errors.New("Could not find entry in metastore")
@@ -16,9 +20,11 @@ var ErrMetaNotFound = errors.New("Could not find entry in metastore")
 // Metastore is the concrete instance responsible
 // for storing / fetching the mapping between EntryIDs
 // and EntryMetadata's.
+// When encrypted, metadata is sealed.
 type Metastore struct {
-	path string
-	db   *bolt.DB
+	path   string
+	db     *bolt.DB
+	sealer *sealer
 }
 
 // OpenMetaStore opens a metastore backed by the file at path.
@@ -27,18 +33,32 @@ func OpenMetaStore(path string) (*Metastore, error) {
 	if err != nil {
 		return nil, err
 	}
+	ms, err := newMetaStore(path, db, nil)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ms, nil
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err2 := tx.CreateBucketIfNotExists([]byte(entryIDToMetaBucket))
-		return err2
+// newMetaStore returns a metastore which keeps its mappings in a bucket of db, sealed by s.
+func newMetaStore(path string, db *bolt.DB, s *sealer) (*Metastore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{entryIDToMetaBucket, chunkRefsBucket} {
+			if _, err2 := tx.CreateBucketIfNotExists([]byte(bucket)); err2 != nil {
+				return err2
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	metastore := &Metastore{
-		path: path,
-		db:   db,
+		path:   path,
+		db:     db,
+		sealer: s,
 	}
 	return metastore, nil
 }
@@ -47,32 +67,47 @@ func OpenMetaStore(path string) (*Metastore, error) {
 // is returned if no such mapping exists.
 func (ps *Metastore) Lookup(entryID nugget.EntryID) (EntryMetadata, error) {
 	var result EntryMetadata
-	var notFound bool
+	var lookupErr error
 	err := ps.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(entryIDToMetaBucket))
-		v := b.Get([]byte(entryID[:]))
-		if v != nil {
-			result = MakeMetadata(v)
-		} else {
-			notFound = true
-		}
+		result, lookupErr = ps.lookup(tx, entryID)
 		return nil
 	})
-	if notFound {
-		return result, ErrMetaNotFound
+	if lookupErr != nil {
+		return result, lookupErr
 	}
 	return result, err
 }
 
+func (ps *Metastore) lookup(tx *bolt.Tx, entryID nugget.EntryID) (EntryMetadata, error) {
+	b := tx.Bucket([]byte(entryIDToMetaBucket))
+	v := b.Get([]byte(entryID[:]))
+	if v == nil {
+		return EntryMetadata{}, ErrMetaNotFound
+	}
+	return ps.decode(entryID[:], v)
+}
+
+// decode returns the metadata held in a metastore record.
+func (ps *Metastore) decode(k, v []byte) (EntryMetadata, error) {
+	v, err := ps.sealer.open(v, k)
+	if err != nil {
+		return EntryMetadata{}, err
+	}
+	return MakeMetadata(v), nil
+}
+
 // Commit sets the Meta for a given EntryID.
 func (ps *Metastore) Commit(meta EntryMetadata) error {
 	return ps.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(entryIDToMetaBucket))
-		err := b.Put([]byte(meta.EntryID[:]), meta.Serialize())
-		return err
+		return ps.commit(tx, meta)
 	})
 }
 
+func (ps *Metastore) commit(tx *bolt.Tx, meta EntryMetadata) error {
+	b := tx.Bucket([]byte(entryIDToMetaBucket))
+	return b.Put([]byte(meta.EntryID[:]), ps.sealer.seal(meta.Serialize(), meta.EntryID[:]))
+}
+
 // Close closes the underlying database. This should be called before shutdown.
 func (ps *Metastore) Close() error {
 	return ps.db.Close()
@@ -81,8 +116,76 @@ func (ps *Metastore) Close() error {
 // Delete removes a metadata entry from the metastore. Nil is returned if the entryID is not mapped.
 func (ps *Metastore) Delete(entryID nugget.EntryID) error {
 	return ps.db.Update(func(tx *bolt.Tx) error {
+		return ps.delete(tx, entryID)
+	})
+}
+
+func (ps *Metastore) delete(tx *bolt.Tx, entryID nugget.EntryID) error {
+	b := tx.Bucket([]byte(entryIDToMetaBucket))
+	return b.Delete(entryID[:])
+}
+
+// ForEach calls fn for every metadata entry in the metastore. Iteration stops
+// at the first error returned by fn.
+func (ps *Metastore) ForEach(fn func(meta EntryMetadata) error) error {
+	return ps.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(entryIDToMetaBucket))
-		err := b.Delete(entryID[:])
-		return err
+		return b.ForEach(func(k, v []byte) error {
+			meta, err := ps.decode(k, v)
+			if err != nil {
+				return err
+			}
+			return fn(meta)
+		})
 	})
 }
+
+// refs returns the reference count of a chunk. Chunks without a reference count, which are
+// not content-addressed, have a single owner and return 0.
+func (ps *Metastore) refs(tx *bolt.Tx, chunkID nugget.ChunkID) uint32 {
+	v := tx.Bucket([]byte(chunkRefsBucket)).Get(chunkID[:])
+	if len(v) != 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(v)
+}
+
+func (ps *Metastore) setRefs(tx *bolt.Tx, chunkID nugget.ChunkID, count uint32) error {
+	b := tx.Bucket([]byte(chunkRefsBucket))
+	if count == 0 {
+		return b.Delete(chunkID[:])
+	}
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, count)
+	return b.Put(chunkID[:], v)
+}
+
+// addRefs increments the reference count of each chunk in chunks.
+func (ps *Metastore) addRefs(tx *bolt.Tx, chunks []nugget.ChunkID) error {
+	for _, chunkID := range chunks {
+		if err := ps.setRefs(tx, chunkID, ps.refs(tx, chunkID)+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseRefs decrements the reference count of each chunk in chunks, returning the chunks which
+// are no longer referenced. Chunks without a reference count are always returned.
+func (ps *Metastore) releaseRefs(tx *bolt.Tx, chunks []nugget.ChunkID) ([]nugget.ChunkID, error) {
+	var released []nugget.ChunkID
+	for _, chunkID := range chunks {
+		count := ps.refs(tx, chunkID)
+		if count > 1 {
+			if err := ps.setRefs(tx, chunkID, count-1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := ps.setRefs(tx, chunkID, 0); err != nil {
+			return nil, err
+		}
+		released = append(released, chunkID)
+	}
+	return released, nil
+}
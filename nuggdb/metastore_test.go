@@ -56,7 +56,8 @@ func TestMetaChangeTakesEffect(t *testing.T) {
 		Lname:   "bro",
 		IsDir:   true,
 		Locality: LocalityInfo{
-			ChunkID: nugget.ChunkID{'\x42'},
+			ChunkSize: DefaultChunkSize,
+			ChunkIDs:  []nugget.ChunkID{{'\x42'}},
 		},
 	}
 
@@ -105,7 +106,8 @@ func TestMetaCommitReadSucceeds(t *testing.T) {
 		Lname:   "bro",
 		IsDir:   true,
 		Locality: LocalityInfo{
-			ChunkID: nugget.ChunkID{'\x42'},
+			ChunkSize: DefaultChunkSize,
+			ChunkIDs:  []nugget.ChunkID{{'\x42'}},
 		},
 	}
 
@@ -130,7 +132,7 @@ func TestMetaCommitReadSucceeds(t *testing.T) {
 	if v.EntryID != meta.EntryID {
 		t.Error("EntryID mismatch")
 	}
-	if v.Locality.ChunkID != meta.Locality.ChunkID {
+	if v.Locality.ChunkAtIndex(0) != meta.Locality.ChunkAtIndex(0) {
 		t.Error("ChunkID mismatch")
 	}
 }
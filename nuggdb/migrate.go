@@ -0,0 +1,89 @@
+package nuggdb
+
+import (
+	"os"
+	"path"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// migrateLegacyStores moves the contents of the separate path and metadata databases written by
+// earlier versions into the provider database. Directory listings, which used to be stored as chunk
+// data, are moved into the directory index and their chunks are removed. Once migrated,
+// the old databases are renamed with a .migrated suffix.
+func (p *Provider) migrateLegacyStores() error {
+	pathsFile := path.Join(p.basedir, pathStoreFilename)
+	metaFile := path.Join(p.basedir, metaStoreFilename)
+	if !fileExists(pathsFile) || !fileExists(metaFile) {
+		return nil
+	}
+	p.logger.Info("nuggdb", "Migrating ", pathsFile, " and ", metaFile, " to ", dbFilename)
+
+	legacyPaths, err := OpenPathStore(pathsFile)
+	if err != nil {
+		return err
+	}
+	legacyMeta, err := OpenMetaStore(metaFile)
+	if err != nil {
+		legacyPaths.Close()
+		return err
+	}
+
+	var obsolete intent
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		err := legacyPaths.ForEach(func(fPath string, entryID nugget.EntryID) error {
+			return p.pathstore.commit(tx, fPath, entryID)
+		})
+		if err != nil {
+			return err
+		}
+
+		var listingChunks []nugget.ChunkID
+		err = legacyMeta.ForEach(func(meta EntryMetadata) error {
+			if meta.IsDir {
+				data, err := p.readRange(&meta, 0, int64(meta.Size))
+				if err != nil && err != ErrChunkNotFound {
+					return err
+				}
+				var entries []DirEntry
+				if len(data) > 0 {
+					if entries, err = deserializeDirEntries(data); err != nil {
+						return err
+					}
+				}
+				for _, entry := range entries {
+					entry.EntryID, _ = p.pathstore.lookup(tx, entry.Name)
+					entry.Name = path.Base(entry.Name)
+					if _, err = putDirEntry(tx, p.sealer, meta.EntryID, entry); err != nil {
+						return err
+					}
+				}
+				listingChunks = append(listingChunks, meta.Locality.ChunkIDs...)
+				meta.Locality = LocalityInfo{}
+				meta.Size = uint64(len(entries))
+			}
+			return p.metastore.commit(tx, meta)
+		})
+		if err != nil {
+			return err
+		}
+		obsolete, err = putIntent(tx, listingChunks)
+		return err
+	})
+	legacyPaths.Close()
+	legacyMeta.Close()
+	if err != nil {
+		return err
+	}
+
+	// once renamed, the listing chunks are no longer needed to repeat the migration
+	if err = os.Rename(pathsFile, pathsFile+".migrated"); err != nil {
+		return err
+	}
+	if err = os.Rename(metaFile, metaFile+".migrated"); err != nil {
+		return err
+	}
+	p.resolveIntent(obsolete)
+	return nil
+}
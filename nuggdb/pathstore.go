@@ -1,6 +1,7 @@
 package nuggdb
 
 import (
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"time"
@@ -17,9 +18,11 @@ var ErrPathNotFound = errors.New("Could not find path in pathstore")
 // Pathstore is the concrete instance responsible
 // for storing / fetching the mapping between paths
 // and entity IDs.
+// When encrypted, paths are keyed by a keyed hash, and the path itself is sealed after the EntryID.
 type Pathstore struct {
-	path string
-	db   *bolt.DB
+	path   string
+	db     *bolt.DB
+	sealer *sealer
 }
 
 // OpenPathStore opens a pathstore backed by the file at path.
@@ -28,8 +31,17 @@ func OpenPathStore(path string) (*Pathstore, error) {
 	if err != nil {
 		return nil, err
 	}
+	ps, err := newPathStore(path, db, nil)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ps, nil
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+// newPathStore returns a pathstore which keeps its mappings in a bucket of db, sealed by s.
+func newPathStore(path string, db *bolt.DB, s *sealer) (*Pathstore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
 		_, err2 := tx.CreateBucketIfNotExists([]byte(pathEntryIDBucket))
 		return err2
 	})
@@ -38,8 +50,9 @@ func OpenPathStore(path string) (*Pathstore, error) {
 	}
 
 	pathstore := &Pathstore{
-		path: path,
-		db:   db,
+		path:   path,
+		db:     db,
+		sealer: s,
 	}
 	return pathstore, nil
 }
@@ -48,32 +61,58 @@ func OpenPathStore(path string) (*Pathstore, error) {
 // is returned if no such mapping exists.
 func (ps *Pathstore) Lookup(path string) (nugget.EntryID, error) {
 	var result nugget.EntryID
-	var notFound bool
+	var lookupErr error
 	err := ps.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(pathEntryIDBucket))
-		v := b.Get([]byte(path))
-		if v != nil {
-			copy(result[:], v)
-		} else {
-			notFound = true
-		}
+		result, lookupErr = ps.lookup(tx, path)
 		return nil
 	})
-	if notFound {
-		return result, ErrPathNotFound
+	if lookupErr != nil {
+		return result, lookupErr
 	}
 	return result, err
 }
 
+func (ps *Pathstore) lookup(tx *bolt.Tx, path string) (nugget.EntryID, error) {
+	var result nugget.EntryID
+	b := tx.Bucket([]byte(pathEntryIDBucket))
+	v := b.Get(ps.sealer.keyForPath(path))
+	if v == nil {
+		return result, ErrPathNotFound
+	}
+	copy(result[:], v)
+	return result, nil
+}
+
+// decode returns the path and entryID of a pathstore record.
+func (ps *Pathstore) decode(k, v []byte) (string, nugget.EntryID, error) {
+	var entryID nugget.EntryID
+	copy(entryID[:], v)
+	if ps.sealer == nil {
+		return string(k), entryID, nil
+	}
+	if len(v) < len(entryID) {
+		return "", entryID, ErrSealCorrupt
+	}
+	path, err := ps.sealer.open(v[len(entryID):], k)
+	return string(path), entryID, err
+}
+
 // Commit sets the entryID for path.
 func (ps *Pathstore) Commit(path string, entryID nugget.EntryID) error {
 	return ps.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(pathEntryIDBucket))
-		err := b.Put([]byte(path), []byte(entryID[:]))
-		return err
+		return ps.commit(tx, path, entryID)
 	})
 }
 
+func (ps *Pathstore) commit(tx *bolt.Tx, path string, entryID nugget.EntryID) error {
+	b := tx.Bucket([]byte(pathEntryIDBucket))
+	key := ps.sealer.keyForPath(path)
+	if ps.sealer == nil {
+		return b.Put(key, []byte(entryID[:]))
+	}
+	return b.Put(key, append(entryID[:], ps.sealer.seal([]byte(path), key)...))
+}
+
 // Forge commits a random EntryID for path, and returns it.
 func (ps *Pathstore) Forge(path string) (nugget.EntryID, error) {
 	var id nugget.EntryID
@@ -90,8 +129,91 @@ func (ps *Pathstore) Close() error {
 // Delete removes a path entry from the pathstore. Nil is returned if the path is not mapped.
 func (ps *Pathstore) Delete(path string) error {
 	return ps.db.Update(func(tx *bolt.Tx) error {
+		return ps.delete(tx, path)
+	})
+}
+
+func (ps *Pathstore) delete(tx *bolt.Tx, path string) error {
+	b := tx.Bucket([]byte(pathEntryIDBucket))
+	return b.Delete(ps.sealer.keyForPath(path))
+}
+
+// ForEach calls fn for every path mapped in the pathstore, in key order. Iteration stops
+// at the first error returned by fn.
+func (ps *Pathstore) ForEach(fn func(path string, entryID nugget.EntryID) error) error {
+	return ps.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(pathEntryIDBucket))
-		err := b.Delete([]byte(path))
+		return b.ForEach(func(k, v []byte) error {
+			path, entryID, err := ps.decode(k, v)
+			if err != nil {
+				return err
+			}
+			return fn(path, entryID)
+		})
+	})
+}
+
+// Rename moves the mapping for oldPath, along with the mappings for every path beneath it, to
+// newPath in a single transaction. The new paths of all moved mappings are returned.
+// ErrPathNotFound is returned if oldPath is not mapped.
+func (ps *Pathstore) Rename(oldPath, newPath string) ([]string, error) {
+	var moved []string
+	err := ps.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		moved, err = ps.rename(tx, oldPath, newPath)
 		return err
 	})
+	return moved, err
+}
+
+func (ps *Pathstore) rename(tx *bolt.Tx, oldPath, newPath string) ([]string, error) {
+	entryID, err := ps.lookup(tx, oldPath)
+	if err != nil {
+		return nil, err
+	}
+
+	oldPaths := []string{oldPath}
+	entryIDs := []nugget.EntryID{entryID}
+	if ps.sealer == nil {
+		prefix := []byte(oldPath + "/")
+		c := tx.Bucket([]byte(pathEntryIDBucket)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var entryID nugget.EntryID
+			copy(entryID[:], v)
+			oldPaths = append(oldPaths, string(k))
+			entryIDs = append(entryIDs, entryID)
+		}
+	} else {
+		// hashed keys cannot be scanned by prefix, so the paths beneath oldPath are found by
+		// walking the directory index
+		for i := 0; i < len(oldPaths); i++ {
+			err := forEachDirEntry(tx, ps.sealer, entryIDs[i], oldPaths[i], func(entry DirEntry) error {
+				entryID, err := ps.lookup(tx, entry.Name)
+				if err == ErrPathNotFound {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				oldPaths = append(oldPaths, entry.Name)
+				entryIDs = append(entryIDs, entryID)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var moved []string
+	for i, oldKey := range oldPaths {
+		if err := ps.delete(tx, oldKey); err != nil {
+			return nil, err
+		}
+		newKey := newPath + oldKey[len(oldPath):]
+		if err := ps.commit(tx, newKey, entryIDs[i]); err != nil {
+			return nil, err
+		}
+		moved = append(moved, newKey)
+	}
+	return moved, nil
 }
@@ -105,3 +105,40 @@ func TestForgeWorks(t *testing.T) {
 		t.Error("Expected specific EntryID, got ", result)
 	}
 }
+
+func TestRenameMovesSubtree(t *testing.T) {
+	p, err := OpenPathStore("testpathstore.db")
+	defer func() {
+		p.Close()
+		os.Remove("testpathstore.db")
+	}()
+	if err != nil {
+		t.Error(err)
+	}
+
+	p.Commit("/dir", nugget.EntryID{'1'})
+	p.Commit("/dir/a", nugget.EntryID{'2'})
+	p.Commit("/dir/sub/b", nugget.EntryID{'3'})
+	p.Commit("/dirx", nugget.EntryID{'4'})
+
+	moved, err := p.Rename("/dir", "/new")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(moved) != 3 {
+		t.Error("Expected 3 moved paths, got", moved)
+	}
+
+	for path, id := range map[string]nugget.EntryID{"/new": {'1'}, "/new/a": {'2'}, "/new/sub/b": {'3'}, "/dirx": {'4'}} {
+		result, err := p.Lookup(path)
+		if err != nil {
+			t.Error(path, err)
+		}
+		if result != id {
+			t.Error("Expected specific EntryID for", path, "got", result)
+		}
+	}
+	if _, err = p.Lookup("/dir/a"); err != ErrPathNotFound {
+		t.Error("Expected ErrPathNotFound, got", err)
+	}
+}
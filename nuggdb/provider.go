@@ -5,54 +5,287 @@ package nuggdb
 // disk using boltdb (key-value store).
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"errors"
+	"io"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/twitchyliquid64/nugget"
 	"github.com/twitchyliquid64/nugget/logger"
 )
 
 const (
+	dbFilename         = "nugget.db"
 	pathStoreFilename  = "paths.db"
 	metaStoreFilename  = "meta.db"
 	chunkStoreFilename = "data.db"
 )
 
-// Provider represents a nugget database, reading and storing file information backed by boltDB databases.
+const (
+	settingsBucket          = "Settings"
+	contentAddressedSetting = "ContentAddressed"
+)
+
+// ErrPathExists is returned when creating an entry at a path which is already in use.
+var ErrPathExists = errors.New("Path already exists")
+
+// ErrNotEmpty is returned when deleting, or replacing, a directory which still has entries.
+var ErrNotEmpty = errors.New("Directory not empty")
+
+// ErrNameTooLong is returned when creating an entry with a name longer than MaxNameLen.
+var ErrNameTooLong = errors.New("File name too long")
+
+// ErrNotDir is returned when a path which must be a directory, or be beneath one, is not.
+var ErrNotDir = errors.New("Not a directory")
+
+// ErrIsDir is returned for an operation which cannot be applied to a directory.
+var ErrIsDir = errors.New("Is a directory")
+
+// ErrNoSpace is returned when there is no space left to store an entry or its data.
+var ErrNoSpace = errors.New("No space left")
+
+// ErrPermission is returned for an operation which is not permitted.
+var ErrPermission = errors.New("Operation not permitted")
+
+// ErrInvalid is returned for an operation whose arguments do not make sense, such as moving a
+// directory beneath itself.
+var ErrInvalid = errors.New("Invalid argument")
+
+// ErrLinkDirectory is returned when creating a hard link to a directory.
+var ErrLinkDirectory = errors.New("Cannot hard link a directory")
+
+// ErrNotSymlink is returned when reading the target of an entry which is not a symbolic link.
+var ErrNotSymlink = errors.New("Not a symbolic link")
+
+// ErrInvalidLinkTarget is returned when creating a symbolic link with an empty target, or a target
+// longer than MaxLinkTargetLen.
+var ErrInvalidLinkTarget = errors.New("Symbolic link target must be between 1 and 4096 bytes")
+
+// MaxLinkTargetLen is the longest target, in bytes, a symbolic link may have.
+const MaxLinkTargetLen = 4096
+
+// Provider represents a nugget database, reading and storing file information backed by boltDB.
+// Paths, metadata and directory listings are kept in buckets of a single database, so every change
+// to them is made in one transaction. Chunk data is kept in files, and is tracked by the intent log.
 type Provider struct {
+	db         *bolt.DB
 	pathstore  *Pathstore
 	metastore  *Metastore
 	chunkstore *Chunkstore
 	basedir    string
+	chunkSize  uint32
+	logger     *logger.Logger
+
+	// chunk IDs are derived from chunk data, and chunks are shared between entries
+	contentAddressed bool
+	// codec used to encode the chunks of newly written files
+	codec Codec
+	// encrypts everything stored in the data directory, nil if it is not encrypted
+	sealer *sealer
+	// largest extended attribute value accepted by Setxattr
+	maxXattrSize int
+
+	gcStop chan struct{}
+	gcWait sync.WaitGroup
+	gcLock sync.Mutex
+	lastGC GCStats
+
+	statfsLock    sync.Mutex
+	chunkBytes    uint64    // bytes held by chunk files when last counted
+	chunkBytesAge time.Time // when chunkBytes was counted
+
+	entryLock  sync.Mutex
+	entryLocks map[nugget.EntryID]*heldEntry // entries whose chunks are being changed
+}
+
+// heldEntry is the lock of an entry whose chunks are being changed, and the number of callers holding
+// or waiting for it.
+type heldEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// lockEntry serializes changes to the chunks of the entry eID, which read its metadata, change its
+// chunks, then commit, so one change cannot commit over another. The returned function unlocks it.
+func (p *Provider) lockEntry(eID nugget.EntryID) func() {
+	p.entryLock.Lock()
+	if p.entryLocks == nil {
+		p.entryLocks = map[nugget.EntryID]*heldEntry{}
+	}
+	held, ok := p.entryLocks[eID]
+	if !ok {
+		held = &heldEntry{}
+		p.entryLocks[eID] = held
+	}
+	held.refs++
+	p.entryLock.Unlock()
+
+	held.Lock()
+	return func() {
+		held.Unlock()
+		p.entryLock.Lock()
+		defer p.entryLock.Unlock()
+		if held.refs--; held.refs == 0 {
+			delete(p.entryLocks, eID)
+		}
+	}
+}
+
+// Options configures optional behaviour of a Provider.
+type Options struct {
+	// ContentAddressed derives chunk IDs from a hash of the chunk data, so identical chunks are
+	// stored once and shared between files. Once enabled for a data directory it stays enabled.
+	ContentAddressed bool
+	// Codec compresses the chunks of files written from now on. Existing files keep the codec
+	// they were written with, so it may be changed freely.
+	Codec Codec
+	// KeyFile is the path of a file holding the key the data directory is encrypted with. It must
+	// be given when the data directory is first used, and every time it is opened after that.
+	KeyFile string
+	// MaxXattrSize is the largest extended attribute value which may be stored. DefaultMaxXattrSize
+	// is used if zero.
+	MaxXattrSize int
 }
 
 // Create initializes the backend of a nugget filesystem, returning an object that implements
 // nugget.DataSource & nugget.DataSink.
 func Create(baseDir string, l *logger.Logger) (*Provider, error) {
+	return CreateWithOptions(baseDir, l, Options{})
+}
+
+// CreateWithOptions initializes the backend of a nugget filesystem like Create, enabling the
+// behaviour selected in opts.
+func CreateWithOptions(baseDir string, l *logger.Logger, opts Options) (*Provider, error) {
+	if _, ok := codecNames[opts.Codec]; !ok {
+		return nil, ErrUnknownCodec
+	}
+	ret, err := open(baseDir, l, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ContentAddressed && !ret.contentAddressed {
+		if err = ret.putSetting(contentAddressedSetting, []byte{1}); err != nil {
+			ret.Close()
+			return nil, err
+		}
+		ret.contentAddressed = true
+	}
+	ret.codec = opts.Codec
+	if opts.MaxXattrSize > 0 {
+		ret.maxXattrSize = opts.MaxXattrSize
+	}
+	if err = ret.migrateLegacyStores(); err != nil {
+		ret.Close()
+		return nil, err
+	}
+	if err = ret.migrateDirListings(); err != nil {
+		ret.Close()
+		return nil, err
+	}
+	if err = ret.recoverIntents(); err != nil {
+		ret.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// open opens the database and chunkstore in baseDir, without migrating or recovering anything.
+// The data directory is encrypted with the key in keyFile, if one is given.
+func open(baseDir string, l *logger.Logger, keyFile string) (*Provider, error) {
 	var err error
 	ret := &Provider{
-		basedir: baseDir,
+		basedir:      baseDir,
+		chunkSize:    DefaultChunkSize,
+		logger:       l,
+		gcStop:       make(chan struct{}),
+		maxXattrSize: DefaultMaxXattrSize,
 	}
 	if !fileExists(baseDir) {
 		return nil, errors.New("Could not stat base directory")
 	}
-	ret.pathstore, err = OpenPathStore(path.Join(baseDir, pathStoreFilename))
+	if keyFile != "" {
+		if ret.sealer, err = loadKeyFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	dbPath := path.Join(baseDir, dbFilename)
+	ret.db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, err
 	}
-	ret.metastore, err = OpenMetaStore(path.Join(baseDir, metaStoreFilename))
+	err = ret.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{dirIndexBucket, xattrBucket, quotaBucket, ownerBucket, intentBucket, settingsBucket} {
+			if _, err2 := tx.CreateBucketIfNotExists([]byte(bucket)); err2 != nil {
+				return err2
+			}
+		}
+		ret.contentAddressed = len(tx.Bucket([]byte(settingsBucket)).Get([]byte(contentAddressedSetting))) > 0
+		return ret.checkKey(tx)
+	})
 	if err != nil {
+		ret.db.Close()
+		return nil, err
+	}
+	if ret.pathstore, err = newPathStore(dbPath, ret.db, ret.sealer); err != nil {
+		ret.db.Close()
+		return nil, err
+	}
+	if ret.metastore, err = newMetaStore(dbPath, ret.db, ret.sealer); err != nil {
+		ret.db.Close()
 		return nil, err
 	}
 	ret.chunkstore, err = OpenChunkStore(path.Join(baseDir, chunkStoreFilename))
 	if err != nil {
+		ret.db.Close()
 		return nil, err
 	}
+	ret.chunkstore.sealer = ret.sealer
 	return ret, nil
 }
 
+// checkKey verifies the key the data directory is opened with against the one it is encrypted
+// with. Encryption is enabled when a key is first given for an empty data directory.
+func (p *Provider) checkKey(tx *bolt.Tx) error {
+	settings := tx.Bucket([]byte(settingsBucket))
+	check := settings.Get([]byte(keyCheckSetting))
+	switch {
+	case p.sealer == nil && check != nil:
+		return ErrKeyRequired
+	case p.sealer == nil:
+		return nil
+	case check != nil:
+		if !hmac.Equal(check, p.sealer.check) {
+			return ErrWrongKey
+		}
+		return nil
+	}
+
+	if fileExists(path.Join(p.basedir, pathStoreFilename)) {
+		return ErrNotEncrypted
+	}
+	for _, bucket := range []string{pathEntryIDBucket, entryIDToMetaBucket} {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			if k, _ := b.Cursor().First(); k != nil {
+				return ErrNotEncrypted
+			}
+		}
+	}
+	return settings.Put([]byte(keyCheckSetting), p.sealer.check)
+}
+
+// putSetting stores a setting of the data directory.
+func (p *Provider) putSetting(name string, value []byte) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(settingsBucket)).Put([]byte(name), value)
+	})
+}
+
 // Lookup looks up a specific path, returning the EntryID of the path if one exists.
 func (p *Provider) Lookup(path string) (nugget.EntryID, error) {
 	return p.pathstore.Lookup(path)
@@ -64,286 +297,860 @@ func (p *Provider) ReadMeta(entry nugget.EntryID) (nugget.NodeMetadata, error) {
 	return &meta, err
 }
 
-//ReadData returns the data stored at the given chunkID
+//ReadData returns the data stored at the given chunkID, as stored on disk. The data is encoded
+//with the codec in the locality information of the entry it belongs to.
 func (p *Provider) ReadData(chunkID nugget.ChunkID) ([]byte, error) {
 	return p.chunkstore.Lookup(chunkID)
 }
 
 // Mkdir creates and commits a new directory, returning the entryID and metadata of the directory file.
-func (p *Provider) Mkdir(fPath string) (nugget.EntryID, nugget.NodeMetadata, error) {
-	eID, meta, newFile, err := p.store(fPath, dirEntries{}.Serialize(), true)
-	if err == nil && newFile {
-		err = p.appendDirectoryEntry(fPath, true)
+// ErrPathExists is returned if fPath is already in use.
+func (p *Provider) Mkdir(fPath string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return p.mkdir(fPath, attr, "")
+}
+
+// mkdir creates a new directory like Mkdir, owned by client.
+func (p *Provider) mkdir(fPath string, attr nugget.NodeAttributes, client string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	var meta EntryMetadata
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		if _, err := p.pathstore.lookup(tx, fPath); err == nil {
+			return ErrPathExists
+		} else if err != ErrPathNotFound {
+			return err
+		}
+		var err error
+		meta, err = p.mkdirTx(tx, fPath, attr, time.Now(), client)
+		return err
+	})
+	if err != nil {
+		return meta.EntryID, nil, err
 	}
-	return eID, meta, err
+	return meta.EntryID, &meta, nil
 }
 
-//Delete deletes a file or directory.
-func (p *Provider) Delete(fPath string) error {
-	eID, errLookup := p.Lookup(fPath)
-	if errLookup != nil {
-		return errLookup
+// Create creates and commits a new empty file with the given ownership and permissions,
+// returning the entryID and metadata of the file. ErrPathExists is returned if fPath exists.
+func (p *Provider) Create(fPath string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return p.store(fPath, []byte{}, &attr, true, "")
+}
+
+// Symlink creates and commits a new symbolic link at fPath pointing to target, owned by the owner
+// in attr, returning the entryID and metadata of the link. The target is stored as the data of the
+// link, and is not required to exist. ErrPathExists is returned if fPath is already in use.
+func (p *Provider) Symlink(fPath, target string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return p.symlink(fPath, target, attr, "")
+}
+
+// symlink creates a new symbolic link like Symlink, owned by client.
+func (p *Provider) symlink(fPath, target string, attr nugget.NodeAttributes, client string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	if len(target) == 0 || len(target) > MaxLinkTargetLen {
+		return nugget.EntryID{}, nil, ErrInvalidLinkTarget
+	}
+	locality, pending, err := p.forgeChunks([]byte(target))
+	if err != nil {
+		return nugget.EntryID{}, nil, err
 	}
 
-	meta, errMeta := p.ReadMeta(eID)
-	if errMeta != nil {
-		return errMeta
+	now := time.Now()
+	meta := EntryMetadata{
+		IsLink:   true,
+		Lname:    path.Base(fPath),
+		Size:     uint64(len(target)),
+		Locality: locality,
+		Nlink:    1,
+		Mode:     os.ModePerm, // the permissions of a link are never checked
+		UID:      attr.UID,
+		GID:      attr.GID,
+		Atime:    now,
+		Mtime:    now,
+		Ctime:    now,
+		Crtime:   now,
 	}
+	rand.Read(meta.EntryID[:])
 
-	//Remove the link first, we can always put it back if we need to
-	pathErr := p.pathstore.Delete(fPath)
-	if pathErr != nil {
-		return pathErr //failure without affecting consistency
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		if _, err := p.pathstore.lookup(tx, fPath); err == nil {
+			return ErrPathExists
+		} else if err != ErrPathNotFound {
+			return err
+		}
+		if err := p.linkTx(tx, fPath, meta, now); err != nil {
+			return err
+		}
+		if err := p.metastore.commit(tx, meta); err != nil {
+			return err
+		}
+		if err := p.pathstore.commit(tx, fPath, meta.EntryID); err != nil {
+			return err
+		}
+		if err := p.chargeDirsTx(tx, fPath, entryUsage(meta)); err != nil {
+			return err
+		}
+		if err := p.claimTx(tx, client, meta); err != nil {
+			return err
+		}
+		return p.adoptTx(tx, pending)
+	})
+	if err != nil {
+		p.resolveIntent(pending) // the new chunks were never referenced
+		return nugget.EntryID{}, nil, err
 	}
+	return meta.EntryID, &meta, nil
+}
 
-	//Remove the metadata next, we can always put it back if we need to
-	entryIDErr := p.metastore.Delete(eID)
-	if entryIDErr != nil {
-		p.pathstore.Commit(fPath, eID) //Rollback pathstore deletion
-		return entryIDErr              //failure without affecting consistency
+// Link creates newPath as another name for the file at oldPath, returning the entryID and updated
+// metadata of the file. Every name shares the data, metadata and EntryID of the file, which is only
+// freed once every name has been deleted. ErrLinkDirectory is returned if oldPath is a directory,
+// and ErrPathExists if newPath is already in use.
+func (p *Provider) Link(oldPath, newPath string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	var meta EntryMetadata
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if _, meta, err = p.lookupTx(tx, oldPath); err != nil {
+			return err
+		}
+		if meta.IsDir {
+			return ErrLinkDirectory
+		}
+		if _, err = p.pathstore.lookup(tx, newPath); err == nil {
+			return ErrPathExists
+		} else if err != ErrPathNotFound {
+			return err
+		}
+
+		now := time.Now()
+		meta.Nlink++
+		meta.Ctime = now
+		if err = p.linkTx(tx, newPath, meta, now); err != nil {
+			return err
+		}
+		if err = p.pathstore.commit(tx, newPath, meta.EntryID); err != nil {
+			return err
+		}
+		if err = p.chargeDirsTx(tx, newPath, entryUsage(meta)); err != nil {
+			return err
+		}
+		return p.metastore.commit(tx, meta)
+	})
+	if err != nil {
+		return meta.EntryID, nil, err
 	}
+	return meta.EntryID, &meta, nil
+}
 
-	//Delete the data, if this works we are done
-	chunkErr := p.chunkstore.Delete(meta.GetDataLocality().Chunks()[0])
-	if chunkErr != nil {
-		p.metastore.Commit(EntryMetadata{
-			EntryID:  eID,
-			IsDir:    meta.IsDirectory(),
-			Lname:    meta.LocalName(),
-			Size:     meta.GetSize(),
-			Locality: LocalityInfo{ChunkID: meta.GetDataLocality().Chunks()[0]},
-		}) //Rollback
-		p.pathstore.Commit(fPath, eID) //Rollback
-		return chunkErr                //failure without affecting consistency
+// Readlink returns the target of the symbolic link at fPath. ErrNotSymlink is returned if fPath
+// is not a symbolic link.
+func (p *Provider) Readlink(fPath string) (string, error) {
+	var meta EntryMetadata
+	err := p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		_, meta, err = p.lookupTx(tx, fPath)
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
-	return p.removeDirectoryEntry(fPath)
+	if !meta.IsLink {
+		return "", ErrNotSymlink
+	}
+	target, err := p.readRange(&meta, 0, int64(meta.Size))
+	return string(target), err
 }
 
-func (p *Provider) removeDirectoryEntry(fPath string) error {
-	dirPath := path.Dir(fPath)
-	_, meta, data, err := p.Fetch(dirPath)
-	if err != nil && err != ErrPathNotFound {
+//Delete deletes a file or an empty directory. ErrNotEmpty is returned for a directory with entries.
+func (p *Provider) Delete(fPath string) error {
+	var obsolete intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		obsolete, err = p.deleteTx(tx, fPath, time.Now())
+		return err
+	})
+	if err != nil {
 		return err
-	} else if err == nil {
-		if !meta.IsDirectory() {
-			return errors.New("Cannot make file on top of a non-directory path")
-		}
 	}
+	p.resolveIntent(obsolete)
+	return nil
+}
 
-	var entries []DirEntry
-	if len(data) > 0 {
-		entries, err = deserializeDirEntries(data)
+// RemoveAll deletes the file or directory at fPath and everything beneath it in a single
+// transaction, so either the whole subtree is removed or none of it is.
+func (p *Provider) RemoveAll(fPath string) error {
+	var obsolete intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		chunks, err := p.removeAllTx(tx, fPath, time.Now())
 		if err != nil {
 			return err
 		}
+		obsolete, err = p.releaseTx(tx, chunks)
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	p.resolveIntent(obsolete)
+	return nil
+}
 
-	var outEntries []DirEntry
-	for _, entry := range entries {
-		if entry.Name != fPath {
-			outEntries = append(outEntries, entry)
+// removeAllTx removes the entry at fPath and everything beneath it as part of tx, returning the chunks
+// of the removed entries. The chunks must be released with releaseTx.
+func (p *Provider) removeAllTx(tx *bolt.Tx, fPath string, now time.Time) ([]nugget.ChunkID, error) {
+	eID, meta, err := p.lookupTx(tx, fPath)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []nugget.ChunkID
+	if meta.IsDir {
+		// the children are collected first, as removing them modifies the index beneath the cursor
+		var children []string
+		err = forEachDirEntry(tx, p.sealer, eID, fPath, func(entry DirEntry) error {
+			children = append(children, entry.Name)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			removed, err := p.removeAllTx(tx, child, now)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, removed...)
 		}
 	}
+	removed, err := p.removeTx(tx, fPath, now)
+	return append(chunks, removed...), err
+}
 
-	_, _, _, err = p.store(dirPath, dirEntries(outEntries).Serialize(), true)
-	return err
+// deleteTx removes the entry at fPath and its link in the parent directory as part of tx. Unless other
+// names refer to the entry, its metadata is removed and its chunks are recorded in the returned intent,
+// to be resolved once tx has committed.
+func (p *Provider) deleteTx(tx *bolt.Tx, fPath string, now time.Time) (intent, error) {
+	chunks, err := p.removeTx(tx, fPath, now)
+	if err != nil {
+		return intent{}, err
+	}
+	return p.releaseTx(tx, chunks)
 }
 
-func (p *Provider) appendDirectoryEntry(fPath string, isDir bool) error {
-	dirPath := path.Dir(fPath)
-	_, meta, data, err := p.Fetch(dirPath)
-	if err != nil && err != ErrPathNotFound {
-		return err
-	} else if err == nil {
-		if !meta.IsDirectory() {
-			return errors.New("Cannot make file on top of a non-directory path")
+// removeTx removes the entry at fPath and its link in the parent directory as part of tx, returning
+// the chunks of the entry if no other names refer to it. The chunks must be released with releaseTx.
+// ErrNotEmpty is returned for a directory with entries.
+func (p *Provider) removeTx(tx *bolt.Tx, fPath string, now time.Time) ([]nugget.ChunkID, error) {
+	eID, meta, err := p.lookupTx(tx, fPath)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsDir && hasDirEntries(tx, eID) {
+		return nil, ErrNotEmpty
+	}
+	if err = p.chargeDirsTx(tx, fPath, entryUsage(meta).negate()); err != nil {
+		return nil, err
+	}
+	if err = p.pathstore.delete(tx, fPath); err != nil {
+		return nil, err
+	}
+	if meta.Nlink > 1 {
+		// other names still refer to the entry
+		meta.Nlink--
+		meta.Ctime = now
+		if err = p.metastore.commit(tx, meta); err != nil {
+			return nil, err
 		}
+		return nil, p.unlinkTx(tx, fPath, now)
 	}
+	if err = p.metastore.delete(tx, eID); err != nil {
+		return nil, err
+	}
+	if err = deleteXattrs(tx, eID); err != nil {
+		return nil, err
+	}
+	if err = releaseQuotasTx(tx, meta); err != nil {
+		return nil, err
+	}
+	if err = p.unlinkTx(tx, fPath, now); err != nil {
+		return nil, err
+	}
+	return meta.Locality.ChunkIDs, nil
+}
 
-	var entries []DirEntry
-	if len(data) > 0 {
-		entries, err = deserializeDirEntries(data)
-		if err != nil {
-			return err
-		}
+// Rename moves the file or directory at oldPath, and everything beneath it, to newPath. If newPath
+// already exists it is replaced, provided a file is replaced with a file, or an empty directory
+// is replaced with a directory.
+func (p *Provider) Rename(oldPath, newPath string) error {
+	if oldPath == newPath {
+		return nil
+	}
+	if oldPath == "/" || newPath == "/" || strings.HasPrefix(newPath, oldPath+"/") {
+		return ErrInvalid
 	}
 
-	for _, entry := range entries {
-		if entry.Name == fPath {
-			return nil
+	var obsolete intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		obsolete, err = p.renameTx(tx, oldPath, newPath, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.resolveIntent(obsolete)
+	return nil
+}
+
+// renameTx moves the entry at oldPath, and everything beneath it, to newPath as part of tx. The chunks
+// of any replaced entry are recorded in the returned intent, to be resolved once tx has committed.
+func (p *Provider) renameTx(tx *bolt.Tx, oldPath, newPath string, now time.Time) (intent, error) {
+	var obsolete intent
+	eID, meta, err := p.lookupTx(tx, oldPath)
+	if err != nil {
+		return obsolete, err
+	}
+
+	_, parentMeta, err := p.lookupTx(tx, path.Dir(newPath))
+	if err == nil && !parentMeta.IsDir {
+		return obsolete, ErrNotDir
+	} else if err != nil && err != ErrPathNotFound {
+		return obsolete, err
+	}
+
+	targetID, targetMeta, err := p.lookupTx(tx, newPath)
+	if err == nil {
+		if targetID == eID {
+			return obsolete, nil // both paths are names of the same entry
+		}
+		if meta.IsDir && !targetMeta.IsDir {
+			return obsolete, ErrNotDir
+		}
+		if !meta.IsDir && targetMeta.IsDir {
+			return obsolete, ErrIsDir
 		}
+		if targetMeta.IsDir && hasDirEntries(tx, targetID) {
+			return obsolete, ErrNotEmpty
+		}
+		if obsolete, err = p.deleteTx(tx, newPath, now); err != nil {
+			return obsolete, err
+		}
+	} else if err != ErrPathNotFound {
+		return obsolete, err
+	}
+
+	oldQuotas, err := p.dirQuotaKeysTx(tx, oldPath)
+	if err != nil {
+		return obsolete, err
 	}
-	//doesnt exist, add it
-	entries = append(entries, DirEntry{Name: fPath, IsDir: isDir})
-	_, _, _, err = p.store(dirPath, dirEntries(entries).Serialize(), true)
-	return err
+	if _, err = p.pathstore.rename(tx, oldPath, newPath); err != nil {
+		return obsolete, err
+	}
+
+	meta.Lname = path.Base(newPath)
+	meta.Ctime = now
+	if err = p.metastore.commit(tx, meta); err != nil {
+		return obsolete, err
+	}
+	if err = p.unlinkTx(tx, oldPath, now); err != nil {
+		return obsolete, err
+	}
+	if err = p.linkTx(tx, newPath, meta, now); err != nil {
+		return obsolete, err
+	}
+	return obsolete, p.moveDirsTx(tx, oldQuotas, newPath, eID, meta)
 }
 
-//Store completely overwrites a file at fPath.
-func (p *Provider) Store(fPath string, data []byte) (nugget.EntryID, nugget.NodeMetadata, error) {
-	eID, meta, newFile, err := p.store(fPath, data, false)
-	if err == nil && newFile {
-		err = p.appendDirectoryEntry(fPath, false)
+// lookupTx returns the entryID and metadata of the entry at fPath as part of tx.
+func (p *Provider) lookupTx(tx *bolt.Tx, fPath string) (nugget.EntryID, EntryMetadata, error) {
+	eID, err := p.pathstore.lookup(tx, fPath)
+	if err != nil {
+		return eID, EntryMetadata{}, err
 	}
+	meta, err := p.metastore.lookup(tx, eID)
 	return eID, meta, err
 }
 
+// mkdirTx creates an empty directory at fPath as part of tx, linking it into its parent. The directory
+// is owned by client, unless client is empty.
+func (p *Provider) mkdirTx(tx *bolt.Tx, fPath string, attr nugget.NodeAttributes, now time.Time, client string) (EntryMetadata, error) {
+	meta := EntryMetadata{
+		IsDir:  true,
+		Lname:  path.Base(fPath),
+		Nlink:  1,
+		Mode:   attr.Mode & ModeMask,
+		UID:    attr.UID,
+		GID:    attr.GID,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Crtime: now,
+	}
+	rand.Read(meta.EntryID[:])
+
+	if err := p.metastore.commit(tx, meta); err != nil {
+		return meta, err
+	}
+	if err := p.pathstore.commit(tx, fPath, meta.EntryID); err != nil {
+		return meta, err
+	}
+	if err := p.linkTx(tx, fPath, meta, now); err != nil {
+		return meta, err
+	}
+	if err := p.chargeDirsTx(tx, fPath, entryUsage(meta)); err != nil {
+		return meta, err
+	}
+	return meta, p.claimTx(tx, client, meta)
+}
+
+// linkTx adds fPath, described by meta, to the listing of its parent directory as part of tx, or
+// updates its listing entry if already present. Missing parent directories are created with default
+// permissions. ErrNameTooLong is returned if the name of fPath is longer than MaxNameLen.
+func (p *Provider) linkTx(tx *bolt.Tx, fPath string, meta EntryMetadata, now time.Time) error {
+	if fPath == "/" {
+		return nil
+	}
+	if len(path.Base(fPath)) > MaxNameLen {
+		return ErrNameTooLong
+	}
+	dirPath := path.Dir(fPath)
+	dirID, dirMeta, err := p.lookupTx(tx, dirPath)
+	if err == ErrPathNotFound {
+		dirMeta, err = p.mkdirTx(tx, dirPath, nugget.NodeAttributes{Mode: DefaultDirMode}, now, "")
+		dirID = dirMeta.EntryID
+	}
+	if err != nil {
+		return err
+	}
+	if !dirMeta.IsDir {
+		return ErrNotDir
+	}
+
+	added, err := putDirEntry(tx, p.sealer, dirID, DirEntry{Name: path.Base(fPath), IsDir: meta.IsDir, IsLink: meta.IsLink, EntryID: meta.EntryID})
+	if err != nil || !added {
+		return err
+	}
+	dirMeta.Size++
+	dirMeta.Mtime, dirMeta.Ctime = now, now
+	return p.metastore.commit(tx, dirMeta)
+}
+
+// unlinkTx removes fPath from the listing of its parent directory as part of tx.
+func (p *Provider) unlinkTx(tx *bolt.Tx, fPath string, now time.Time) error {
+	dirID, dirMeta, err := p.lookupTx(tx, path.Dir(fPath))
+	if err == ErrPathNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !dirMeta.IsDir {
+		return ErrNotDir
+	}
+
+	removed, err := deleteDirEntry(tx, p.sealer, dirID, path.Base(fPath))
+	if err != nil {
+		return err
+	}
+	if removed && dirMeta.Size > 0 {
+		dirMeta.Size--
+	}
+	dirMeta.Mtime, dirMeta.Ctime = now, now
+	return p.metastore.commit(tx, dirMeta)
+}
+
+//Store completely overwrites a file at fPath.
+func (p *Provider) Store(fPath string, data []byte) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return p.store(fPath, data, nil, false, "")
+}
+
+// StoreFrom implements nugget.StreamDataSink. The data is written to new chunks as it is read from r,
+// and the file only switches to them once r is exhausted, so a failure part way leaves the file as it was.
+func (p *Provider) StoreFrom(fPath string, r io.Reader) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return p.storeFrom(fPath, r, "")
+}
+
+// Write writes data into the file at fPath starting at offset. Only the chunks which overlap
+// the written range are touched. A write growing the file is charged to its quotas before any
+// chunk is touched, so a write failing with ErrNoSpace leaves the file as it was. Writes to the
+// same entry are serialized, so concurrent writes to different chunks are all kept.
 func (p *Provider) Write(fPath string, offset int64, data []byte) (written int64, eID nugget.EntryID, meta nugget.NodeMetadata, err error) {
 	eID, err = p.Lookup(fPath)
 	if err != nil {
 		return
 	}
-	var readMeta nugget.NodeMetadata
-	readMeta, err = p.ReadMeta(eID)
+	defer p.lockEntry(eID)()
+	var readMeta EntryMetadata
+	readMeta, err = p.metastore.Lookup(eID)
 	if err != nil {
 		return
 	}
-	dispMeta := readMeta.(*EntryMetadata)
+	meta = &readMeta
+	if readMeta.IsDir {
+		err = ErrIsDir
+		return
+	}
+	if readMeta.IsLink {
+		err = ErrInvalid
+		return
+	}
 
-	var w int
-	var size int64
-	w, size, err = p.chunkstore.Write(readMeta.GetDataLocality().Chunks()[0], offset, data)
-	written = int64(w)
-	dispMeta.Size = uint64(size)
+	var reserved int64
+	if end := offset + int64(len(data)); end > int64(readMeta.Size) {
+		reserved = end - int64(readMeta.Size)
+		if err = p.reserve(fPath, eID, reserved); err != nil {
+			return
+		}
+	}
+
+	before := cloneLocality(readMeta.Locality)
+	var pending intent
+	var replaced []nugget.ChunkID
+	written, pending, replaced, err = p.writeRange(&readMeta, offset, data)
 	if err != nil {
+		p.resolveIntent(pending)
+		p.reserve(fPath, eID, -reserved)
 		return
 	}
+	now := time.Now()
 
-	err = p.metastore.Commit(*dispMeta)
+	delta := diffChunks(before, readMeta.Locality)
+	readMeta, err = p.commitMeta(fPath, eID, reserved, func(current *EntryMetadata) {
+		delta.apply(&current.Locality)
+		if readMeta.Size > current.Size {
+			current.Size = readMeta.Size
+		}
+		current.Mtime, current.Ctime = now, now
+	}, pending, replaced)
+	if err != nil {
+		p.reserve(fPath, eID, -reserved)
+	}
 	return
 }
 
+// reserve charges n bytes to the quotas of the entry eID at fPath ahead of a change to its size, or
+// returns them if n is negative.
+func (p *Provider) reserve(fPath string, eID nugget.EntryID, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return p.chargeEntryTx(tx, fPath, eID, usage{bytes: n})
+	})
+}
+
+// Setattr applies changes to the attributes of the entry at fPath. Changing the size truncates
+// or extends the file.
+func (p *Provider) Setattr(fPath string, changes nugget.AttrChanges) (nugget.EntryID, nugget.NodeMetadata, error) {
+	eID, err := p.Lookup(fPath)
+	if err != nil {
+		return eID, nil, err
+	}
+	defer p.lockEntry(eID)()
+	meta, err := p.metastore.Lookup(eID)
+	if err != nil {
+		return eID, nil, err
+	}
+
+	now := time.Now()
+	var removedChunks []nugget.ChunkID
+	var pending intent
+	before := cloneLocality(meta.Locality)
+	if changes.Valid&nugget.AttrSize != 0 {
+		if meta.IsDir {
+			return eID, &meta, ErrIsDir
+		}
+		if meta.IsLink {
+			return eID, &meta, ErrInvalid
+		}
+		removedChunks, pending, err = p.truncate(&meta, changes.Size)
+		if err != nil {
+			return eID, &meta, err
+		}
+		meta.Mtime = now
+	}
+	delta := diffChunks(before, meta.Locality)
+	meta, err = p.commitMeta(fPath, eID, 0, func(current *EntryMetadata) {
+		if changes.Valid&nugget.AttrSize != 0 {
+			delta.apply(&current.Locality)
+			current.Size, current.Mtime = meta.Size, now
+		}
+		if changes.Valid&nugget.AttrMode != 0 {
+			current.Mode = changes.Mode & ModeMask
+		}
+		if changes.Valid&nugget.AttrUID != 0 {
+			current.UID = changes.UID
+		}
+		if changes.Valid&nugget.AttrGID != 0 {
+			current.GID = changes.GID
+		}
+		if changes.Valid&nugget.AttrAtime != 0 {
+			current.Atime = changes.Atime
+		}
+		if changes.Valid&nugget.AttrMtime != 0 {
+			current.Mtime = changes.Mtime
+		}
+		current.Ctime = now
+	}, pending, removedChunks)
+	return eID, &meta, err
+}
+
+// commitMeta commits a change to the metadata of the existing entry eID at fPath, returning the
+// metadata committed. The entry is read again in the transaction and passed to change, which sets only
+// the fields owned by the operation, so changes made by other operations since the entry was last read,
+// such as to its link count, are kept. The pending intent, which records new chunks referenced by the
+// change, is cleared in the same transaction. Chunks in obsoleteChunks are no longer referenced, and
+// are released once the transaction has committed. A change in size is counted against the quotas of
+// the entry, less the reserved bytes already charged, failing with ErrNoSpace if one is exceeded.
+func (p *Provider) commitMeta(fPath string, eID nugget.EntryID, reserved int64, change func(current *EntryMetadata), pending intent, obsoleteChunks []nugget.ChunkID) (EntryMetadata, error) {
+	var meta EntryMetadata
+	var obsolete intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		// the entry may have been removed since it was read
+		current, err := p.metastore.lookup(tx, eID)
+		if err != nil {
+			return err
+		}
+		meta = current
+		change(&meta)
+		if grown := int64(meta.Size) - int64(current.Size) - reserved; !meta.IsDir && grown != 0 {
+			if err = p.chargeEntryTx(tx, fPath, eID, usage{bytes: grown}); err != nil {
+				return err
+			}
+		}
+		if err := p.metastore.commit(tx, meta); err != nil {
+			return err
+		}
+		if err := p.adoptTx(tx, pending); err != nil {
+			return err
+		}
+		obsolete, err = p.releaseTx(tx, obsoleteChunks)
+		return err
+	})
+	if err != nil {
+		p.resolveIntent(pending)
+		return meta, err
+	}
+	p.resolveIntent(obsolete)
+	return meta, nil
+}
+
+// Read returns up to size bytes of the file at fPath starting at offset. Only the chunks which
+// overlap the requested range are read.
 func (p *Provider) Read(fPath string, offset int64, size int64) ([]byte, error) {
 	eID, err := p.Lookup(fPath)
 	if err != nil {
 		return []byte(""), err
 	}
-	meta, err := p.ReadMeta(eID)
+	meta, err := p.metastore.Lookup(eID)
 	if err != nil {
 		return []byte(""), err
 	}
 
-	return p.chunkstore.Read(meta.GetDataLocality().Chunks()[0], offset, size)
+	return p.readRange(&meta, offset, size)
 }
 
-// Fetch returns the full tree of information about a file.
+// Fetch returns the full tree of information about a file. The data of a directory is its serialized listing.
 func (p *Provider) Fetch(fPath string) (eID nugget.EntryID, meta nugget.NodeMetadata, data []byte, err error) {
-	eID, err = p.Lookup(fPath)
+	var readMeta EntryMetadata
+	var entries []DirEntry
+	err = p.db.View(func(tx *bolt.Tx) error {
+		var err error
+		eID, readMeta, err = p.lookupTx(tx, fPath)
+		if err != nil || !readMeta.IsDir {
+			return err
+		}
+		return forEachDirEntry(tx, p.sealer, eID, fPath, func(entry DirEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+	})
 	if err != nil {
 		return
 	}
-	meta, err = p.ReadMeta(eID)
-	if err != nil {
+	meta = &readMeta
+	if readMeta.IsDir {
+		data = dirEntries(entries).Serialize()
 		return
 	}
-	data, err = p.ReadData(meta.GetDataLocality().Chunks()[0])
+	data, err = p.readRange(&readMeta, 0, int64(readMeta.Size))
 	return
 }
 
-func (p *Provider) store(fPath string, data []byte, isDir bool) (nugget.EntryID, nugget.NodeMetadata, bool, error) {
-	existingEntryID, pathSearchError := p.Lookup(fPath)
-	if pathSearchError != nil && pathSearchError != ErrPathNotFound {
-		return existingEntryID, nil, false, pathSearchError
-	} // return an error for all path errors, except where file does not exist.
-
-	//commit data first
-	chunkID, chunkWriteError := p.chunkstore.Forge(data)
-	if chunkWriteError != nil {
-		return existingEntryID, nil, false, chunkWriteError
+// store writes data as the complete contents of the file at fPath. An existing entry keeps its EntryID,
+// and its ownership, permissions and creation time are carried over, unless attr is provided. If
+// mustNotExist is set, an existing entry is left alone and ErrPathExists is returned instead. The data
+// is written to new chunks, then the metadata is switched to them in a single transaction. A new entry
+// is owned by client, while an existing entry keeps its owner.
+func (p *Provider) store(fPath string, data []byte, attr *nugget.NodeAttributes, mustNotExist bool, client string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	locality, pending, err := p.forgeChunks(data)
+	if err != nil {
+		return nugget.EntryID{}, nil, err
 	} //return error if we could not write the raw data
+	return p.commitStore(fPath, uint64(len(data)), locality, []intent{pending}, attr, mustNotExist, client)
+}
 
-	//now we make a brand new metadata entry
-	var newEntryID nugget.EntryID
-	rand.Read(newEntryID[:])
-	meta := EntryMetadata{
-		EntryID: newEntryID,
-		IsDir:   isDir,
-		Lname:   path.Base(fPath),
-		Size:    uint64(len(data)),
-		Locality: LocalityInfo{
-			ChunkID: chunkID,
-		},
+// storeFrom stores the data read from r as the complete contents of the file at fPath, as store does.
+func (p *Provider) storeFrom(fPath string, r io.Reader, client string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	locality, pending, size, err := p.forgeFrom(r)
+	if err != nil {
+		return nugget.EntryID{}, nil, err
 	}
+	return p.commitStore(fPath, size, locality, pending, nil, false, client)
+}
 
-	metaWriteError := p.metastore.Commit(meta)
-	if metaWriteError != nil {
-		p.chunkstore.Delete(chunkID) // Undo our only change - new chunk
-		return existingEntryID, &meta, false, metaWriteError
+// commitStore switches the file at fPath to size bytes of data held in new chunks, creating it if
+// needed, or failing with ErrPathExists if mustNotExist is set and it exists. The pending intents, which
+// record the new chunks, are cleared in the same transaction.
+func (p *Provider) commitStore(fPath string, size uint64, locality LocalityInfo, pending []intent, attr *nugget.NodeAttributes, mustNotExist bool, client string) (nugget.EntryID, nugget.NodeMetadata, error) {
+	if eID, err := p.Lookup(fPath); err == nil {
+		// the chunks of an existing entry are replaced, so not while it is being written
+		defer p.lockEntry(eID)()
 	}
-
-	pathWriteError := p.pathstore.Commit(fPath, newEntryID)
-	if pathWriteError != nil {
-		p.chunkstore.Delete(chunkID)   // Undo our changes: new chunk
-		p.metastore.Delete(newEntryID) // Undo our changes: new Entry
-		//TODO: Report leaks for errors when rolling back
+	now := time.Now()
+	meta := EntryMetadata{
+		Lname:    path.Base(fPath),
+		Size:     size,
+		Locality: locality,
+		Nlink:    1,
+		Mode:     DefaultFileMode,
+		Atime:    now,
+		Mtime:    now,
+		Ctime:    now,
+		Crtime:   now,
 	}
+	rand.Read(meta.EntryID[:])
 
-	if pathSearchError == nil { //path already exists, need to delete crap
-		swapErr := p.deleteGracefullyOrRollbackNewFile(fPath, chunkID, existingEntryID, &meta)
-		if swapErr != nil {
-			return newEntryID, nil, false, swapErr
+	var obsolete intent
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		added := entryUsage(meta)
+		existingEntryID, existingMeta, err := p.lookupTx(tx, fPath)
+		switch err {
+		case nil:
+			if mustNotExist {
+				return ErrPathExists
+			}
+			if existingMeta.IsDir {
+				return ErrIsDir
+			}
+			if existingMeta.IsLink {
+				return ErrInvalid
+			}
+			// the entry keeps its EntryID, so its inode, every name of it, its attributes and its owner
+			meta.EntryID, meta.Nlink = existingEntryID, existingMeta.Nlink
+			meta.Mode, meta.UID, meta.GID = existingMeta.Mode, existingMeta.UID, existingMeta.GID
+			meta.Atime, meta.Crtime = existingMeta.Atime, existingMeta.Crtime
+			added = usage{bytes: int64(meta.Size) - int64(existingMeta.Size)}
+			if err = chargeOwnerTx(tx, meta.EntryID, added); err != nil {
+				return err
+			}
+			if obsolete, err = p.releaseTx(tx, existingMeta.Locality.ChunkIDs); err != nil {
+				return err
+			}
+		case ErrPathNotFound:
+			if err = p.claimTx(tx, client, meta); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+		if attr != nil {
+			meta.Mode, meta.UID, meta.GID = attr.Mode&ModeMask, attr.UID, attr.GID
+		}
+		if err = p.linkTx(tx, fPath, meta, now); err != nil {
+			return err
 		}
-	}
-
-	return newEntryID, &meta, pathSearchError == ErrPathNotFound, pathWriteError
-}
 
-func (p *Provider) deleteGracefullyOrRollbackNewFile(fPath string, newChunkID nugget.ChunkID, oldEntryID nugget.EntryID, newMeta *EntryMetadata) error {
-	abort := func() {
-		p.chunkstore.Delete(newChunkID)       // Undo our changes: new chunk
-		p.metastore.Delete(newMeta.ID())      // Undo our changes: new Entry
-		p.pathstore.Commit(fPath, oldEntryID) // Undo our changes: write back pointer to old entryMetadata
-		//TODO: Report or handle errors when rolling back
-	}
-	oldMeta, err := p.metastore.Lookup(oldEntryID)
+		if err = p.metastore.commit(tx, meta); err != nil {
+			return err
+		}
+		if err = p.pathstore.commit(tx, fPath, meta.EntryID); err != nil {
+			return err
+		}
+		if err = p.chargeDirsTx(tx, fPath, added); err != nil {
+			return err
+		}
+		for _, in := range pending {
+			if err = p.adoptTx(tx, in); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		abort()
-		return err
+		for _, in := range pending {
+			p.resolveIntent(in) // the new chunks were never referenced
+		}
+		return nugget.EntryID{}, nil, err
 	}
-	err = p.metastore.Delete(oldEntryID)
+	p.resolveIntent(obsolete)
+	return meta.EntryID, &meta, nil
+}
+
+// List returns information about the directory at fPath. Entries are read from a cursor over
+// the directory index, in index order.
+func (p *Provider) List(fPath string) ([]nugget.DirEntry, error) {
+	var entries []DirEntry
+	err := p.db.View(func(tx *bolt.Tx) error {
+		eID, meta, err := p.lookupTx(tx, fPath)
+		if err != nil {
+			return err
+		}
+		if !meta.IsDir {
+			return ErrNotDir
+		}
+		return forEachDirEntry(tx, p.sealer, eID, fPath, func(entry DirEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+	})
 	if err != nil {
-		abort()
-		return err
+		return nil, err
 	}
-	err = p.chunkstore.Delete(oldMeta.GetDataLocality().Chunks()[0])
-	if err != nil {
-		p.metastore.Commit(oldMeta) //Undo our delete: write back old MetaEntry
-		abort()
-		return err
+
+	b := make([]nugget.DirEntry, len(entries))
+	for i := range entries {
+		b[i] = &entries[i]
 	}
-	return nil
+	return b, nil
 }
 
-// List returns information about the directory at fPath.
-func (p *Provider) List(fPath string) ([]nugget.DirEntry, error) {
-	_, meta, data, err := p.Fetch(fPath)
+// ListPage implements nugget.PagedDataSource. Entries are returned in index order, and the
+// cursor records the position of the last entry returned, so entries linked or unlinked between
+// pages do not cause others to be skipped or repeated. DefaultListPageSize entries are returned
+// if limit is not positive.
+func (p *Provider) ListPage(fPath string, cursor string, limit int) ([]nugget.DirEntry, string, error) {
+	after, err := decodeListCursor(cursor)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	if !meta.IsDirectory() {
-		return nil, errors.New("Cannot List on non-directory file")
+	if limit <= 0 {
+		limit = DefaultListPageSize
 	}
-	entries, err := deserializeDirEntries(data)
+
+	var entries []DirEntry
+	err = p.db.View(func(tx *bolt.Tx) error {
+		eID, meta, err := p.lookupTx(tx, fPath)
+		if err != nil {
+			return err
+		}
+		if !meta.IsDir {
+			return ErrNotDir
+		}
+		entries, after, err = pageDirEntries(tx, p.sealer, eID, fPath, after, limit)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	b := make([]nugget.DirEntry, len(entries))
 	for i := range entries {
 		b[i] = &entries[i]
 	}
-	return b, err
+	return b, encodeListCursor(after), nil
 }
 
 // Close closes all underlying files and makes the provider unusable.
 func (p *Provider) Close() error {
-	e := p.pathstore.Close()
-	if e != nil {
-		p.metastore.Close()
-		p.chunkstore.Close()
-		return e
-	}
-	e = p.metastore.Close()
+	close(p.gcStop)
+	p.gcWait.Wait()
+
+	e := p.db.Close()
 	if e != nil {
 		p.chunkstore.Close()
 		return e
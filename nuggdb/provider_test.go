@@ -1,10 +1,19 @@
 package nuggdb
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/twitchyliquid64/nugget"
 	"github.com/twitchyliquid64/nugget/logger"
 )
@@ -83,7 +92,7 @@ func TestProviderStore(t *testing.T) {
 	}
 }
 
-func TestProviderStoreTwiceHasDifferentIDs(t *testing.T) {
+func TestProviderStoreTwiceKeepsID(t *testing.T) {
 	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
 	defer func() {
 		os.RemoveAll(baseDir)
@@ -107,8 +116,8 @@ func TestProviderStoreTwiceHasDifferentIDs(t *testing.T) {
 	if err2 != nil {
 		t.Error(err)
 	}
-	if entryID == entryID2 {
-		t.Error("Expected different entryIDs")
+	if entryID != entryID2 {
+		t.Error("Expected the entryID to be kept, so the inode is stable")
 	}
 	if meta.GetDataLocality().Chunks()[0] == meta2.GetDataLocality().Chunks()[0] {
 		t.Error("Expected different chunkIDs")
@@ -118,8 +127,8 @@ func TestProviderStoreTwiceHasDifferentIDs(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if foundEntry != entryID2 {
-		t.Error("Expected lookup ID to match second entryID")
+	if foundEntry != entryID {
+		t.Error("Expected lookup ID to match the entryID")
 	}
 	if string(foundData) != "yolo2" {
 		t.Error("Data incorrect")
@@ -127,3 +136,1354 @@ func TestProviderStoreTwiceHasDifferentIDs(t *testing.T) {
 }
 
 //TODO: Tests for each of the error conditions in Provider.Store()
+
+func TestProviderStoreSplitsChunks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	_, meta, err := p.Store("/chunky", []byte("0123456789"))
+	if err != nil {
+		t.Error(err)
+	}
+	if !meta.GetDataLocality().IsChunked() || len(meta.GetDataLocality().Chunks()) != 3 {
+		t.Error("Expected 3 chunks, got", meta.GetDataLocality().Chunks())
+	}
+	chunk, err := p.ReadData(meta.GetDataLocality().ChunkAtIndex(2))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(chunk) != "89" {
+		t.Error("Last chunk incorrect, got", string(chunk))
+	}
+
+	_, _, foundData, err := p.Fetch("/chunky")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(foundData) != "0123456789" {
+		t.Error("Data incorrect, got", string(foundData))
+	}
+
+	data, err := p.Read("/chunky", 3, 6)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "345678" {
+		t.Error("Read data incorrect, got", string(data))
+	}
+	data, err = p.Read("/chunky", 8, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "89" {
+		t.Error("Read past end incorrect, got", string(data))
+	}
+}
+
+func TestProviderWriteTouchesAffectedChunks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	_, meta, err := p.Store("/chunky", []byte("0123456789"))
+	if err != nil {
+		t.Error(err)
+	}
+	firstChunk := meta.GetDataLocality().ChunkAtIndex(0)
+
+	written, _, newMeta, err := p.Write("/chunky", 6, []byte("abcdefgh"))
+	if err != nil {
+		t.Error(err)
+	}
+	if written != 8 {
+		t.Error("Expected 8 bytes written, got", written)
+	}
+	if newMeta.GetSize() != 14 || len(newMeta.GetDataLocality().Chunks()) != 4 {
+		t.Error("Expected 14 bytes in 4 chunks, got", newMeta.GetSize(), newMeta.GetDataLocality().Chunks())
+	}
+	if newMeta.GetDataLocality().ChunkAtIndex(0) != firstChunk {
+		t.Error("Expected untouched chunk to be kept")
+	}
+
+	_, _, foundData, err := p.Fetch("/chunky")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(foundData) != "012345abcdefgh" {
+		t.Error("Data incorrect, got", string(foundData))
+	}
+
+	_, _, _, err = p.Write("/chunky", 18, []byte("z"))
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, foundData, err = p.Fetch("/chunky")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(foundData) != "012345abcdefgh\x00\x00\x00\x00z" {
+		t.Errorf("Sparse data incorrect, got %q", foundData)
+	}
+}
+
+func TestProviderWriteMigratesLegacyEntry(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	legacyChunk, err := p.chunkstore.Forge([]byte("0123456789"))
+	if err != nil {
+		t.Error(err)
+	}
+	legacy := EntryMetadata{
+		EntryID:  nugget.EntryID{'l'},
+		Lname:    "legacy",
+		Size:     10,
+		Locality: LocalityInfo{ChunkIDs: []nugget.ChunkID{legacyChunk}},
+	}
+	if err = p.metastore.Commit(legacy); err != nil {
+		t.Error(err)
+	}
+	if err = p.pathstore.Commit("/legacy", legacy.EntryID); err != nil {
+		t.Error(err)
+	}
+
+	data, err := p.Read("/legacy", 2, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "234" {
+		t.Error("Legacy read incorrect, got", string(data))
+	}
+
+	_, _, meta, err := p.Write("/legacy", 1, []byte("X"))
+	if err != nil {
+		t.Error(err)
+	}
+	if !meta.GetDataLocality().IsChunked() || len(meta.GetDataLocality().Chunks()) != 3 {
+		t.Error("Expected entry to be migrated to 3 chunks, got", meta.GetDataLocality().Chunks())
+	}
+	if _, err = p.ReadData(legacyChunk); err != ErrChunkNotFound {
+		t.Error("Expected legacy chunk to be removed, got", err)
+	}
+	_, _, foundData, err := p.Fetch("/legacy")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(foundData) != "0X23456789" {
+		t.Error("Data incorrect, got", string(foundData))
+	}
+}
+
+func TestProviderCreateStoresAttributes(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	_, _, err = p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0700, UID: 1000, GID: 1000})
+	if err != nil {
+		t.Error(err)
+	}
+	_, meta, err := p.Create("/dir/file", nugget.NodeAttributes{Mode: 0640, UID: 1000, GID: 100})
+	if err != nil {
+		t.Error(err)
+	}
+	if meta.GetMode() != 0640 || meta.GetUID() != 1000 || meta.GetGID() != 100 {
+		t.Error("Attributes incorrect, got", meta.GetMode(), meta.GetUID(), meta.GetGID())
+	}
+	if meta.GetCrtime().IsZero() || meta.GetMtime().IsZero() {
+		t.Error("Expected times to be set")
+	}
+
+	// overwriting the file keeps ownership, permissions and creation time
+	_, meta2, err := p.Store("/dir/file", []byte("new data"))
+	if err != nil {
+		t.Error(err)
+	}
+	if meta2.GetMode() != 0640 || meta2.GetUID() != 1000 || meta2.GetGID() != 100 {
+		t.Error("Attributes not carried over, got", meta2.GetMode(), meta2.GetUID(), meta2.GetGID())
+	}
+	if !meta2.GetCrtime().Equal(meta.GetCrtime()) {
+		t.Error("Expected creation time to be carried over")
+	}
+
+	// creating it again fails, rather than emptying it
+	if _, _, err = p.Create("/dir/file", nugget.NodeAttributes{Mode: 0600}); err != ErrPathExists {
+		t.Error("Expected ErrPathExists, got", err)
+	}
+	if _, _, data, _ := p.Fetch("/dir/file"); string(data) != "new data" {
+		t.Error("Expected the data to be kept, got", string(data))
+	}
+
+	eID, err := p.Lookup("/dir")
+	if err != nil {
+		t.Error(err)
+	}
+	dirMeta, err := p.ReadMeta(eID)
+	if err != nil {
+		t.Error(err)
+	}
+	if dirMeta.GetMode() != 0700 || dirMeta.GetUID() != 1000 {
+		t.Error("Directory attributes incorrect, got", dirMeta.GetMode(), dirMeta.GetUID())
+	}
+}
+
+func TestProviderSetattrTruncatesAndChangesAttributes(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	_, meta, err := p.Store("/trunc", []byte("0123456789"))
+	if err != nil {
+		t.Error(err)
+	}
+	lastChunk := meta.GetDataLocality().ChunkAtIndex(2)
+
+	_, newMeta, err := p.Setattr("/trunc", nugget.AttrChanges{Valid: nugget.AttrSize | nugget.AttrMode | nugget.AttrUID, Size: 5, Mode: 0600, UID: 1000})
+	if err != nil {
+		t.Error(err)
+	}
+	if newMeta.GetSize() != 5 || len(newMeta.GetDataLocality().Chunks()) != 2 {
+		t.Error("Expected 5 bytes in 2 chunks, got", newMeta.GetSize(), newMeta.GetDataLocality().Chunks())
+	}
+	if newMeta.GetMode() != 0600 || newMeta.GetUID() != 1000 {
+		t.Error("Attributes incorrect, got", newMeta.GetMode(), newMeta.GetUID())
+	}
+	if _, err = p.ReadData(lastChunk); err != ErrChunkNotFound {
+		t.Error("Expected truncated chunk to be removed, got", err)
+	}
+
+	_, _, err = p.Setattr("/trunc", nugget.AttrChanges{Valid: nugget.AttrSize, Size: 9})
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, foundData, err := p.Fetch("/trunc")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(foundData) != "01234\x00\x00\x00\x00" {
+		t.Errorf("Data incorrect, got %q", foundData)
+	}
+}
+
+func TestProviderRename(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	p.Mkdir("/src", nugget.NodeAttributes{Mode: 0755})
+	p.Mkdir("/src/sub", nugget.NodeAttributes{Mode: 0755})
+	p.Store("/src/sub/file", []byte("data"))
+	p.Mkdir("/dst", nugget.NodeAttributes{Mode: 0755})
+
+	if err = p.Rename("/src", "/dst/moved"); err != nil {
+		t.Error(err)
+	}
+	_, meta, data, err := p.Fetch("/dst/moved/sub/file")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "data" || meta.LocalName() != "file" {
+		t.Error("Moved file incorrect")
+	}
+	if _, err = p.Lookup("/src/sub/file"); err != ErrPathNotFound {
+		t.Error("Expected old path to be gone, got", err)
+	}
+
+	entries, err := p.List("/dst/moved/sub")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 1 || entries[0].Identifier() != "/dst/moved/sub/file" {
+		t.Error("Expected listing to be rewritten, got", entries)
+	}
+	entries, err = p.List("/")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 1 || entries[0].Identifier() != "/dst" {
+		t.Error("Expected old entry to be removed from the root listing, got", entries)
+	}
+	entries, err = p.List("/dst")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 1 || entries[0].Identifier() != "/dst/moved" {
+		t.Error("Expected new entry in the destination listing, got", entries)
+	}
+
+	// replacing an existing file
+	p.Store("/dst/a", []byte("a"))
+	p.Store("/dst/b", []byte("b"))
+	if err = p.Rename("/dst/a", "/dst/b"); err != nil {
+		t.Error(err)
+	}
+	_, meta, data, err = p.Fetch("/dst/b")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "a" || meta.LocalName() != "b" {
+		t.Error("Expected target to be replaced")
+	}
+
+	// replacing a non-empty directory is refused
+	if err = p.Rename("/dst/b", "/dst/moved"); err == nil {
+		t.Error("Expected error replacing directory with a file")
+	}
+	p.Mkdir("/empty", nugget.NodeAttributes{Mode: 0755})
+	if err = p.Rename("/empty", "/dst/moved"); err == nil {
+		t.Error("Expected error replacing non-empty directory")
+	}
+	if err = p.Rename("/dst", "/dst/moved/inside"); err == nil {
+		t.Error("Expected error moving a directory beneath itself")
+	}
+}
+
+func TestProviderRecoversIntents(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// simulate a crash after chunks were written, but before any metadata referenced them
+	_, _, err = p.forge(CodecNone, [][]byte{[]byte("orphan")})
+	if err != nil {
+		t.Error(err)
+	}
+	var orphan nugget.ChunkID
+	p.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket([]byte(intentBucket)).Cursor().First()
+		copy(orphan[:], v)
+		return nil
+	})
+	if _, err = p.chunkstore.Lookup(orphan); err != nil {
+		t.Error("Expected orphaned chunk to exist, got", err)
+	}
+	p.Close()
+
+	p, err = Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer p.Close()
+	if _, err = p.chunkstore.Lookup(orphan); err != ErrChunkNotFound {
+		t.Error("Expected orphaned chunk to be removed, got", err)
+	}
+	p.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte(intentBucket)).Cursor().First(); k != nil {
+			t.Error("Expected intent log to be empty")
+		}
+		return nil
+	})
+}
+
+func TestProviderFailedStoreLeavesNoChunks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+
+	p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})
+	if _, _, err = p.Store("/dir", []byte("data")); err == nil {
+		t.Error("Expected error overwriting a directory")
+	}
+	if _, _, err = p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755}); err != ErrPathExists {
+		t.Error("Expected ErrPathExists, got", err)
+	}
+
+	prefixes, err := ioutil.ReadDir(path.Join(baseDir, chunkStoreFilename))
+	if err != nil {
+		t.Error(err)
+	}
+	for _, prefix := range prefixes {
+		chunks, _ := ioutil.ReadDir(path.Join(baseDir, chunkStoreFilename, prefix.Name()))
+		if len(chunks) > 0 {
+			t.Error("Expected chunks of the failed store to be removed, found", chunks[0].Name())
+		}
+	}
+}
+
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("stream failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestProviderStoreFromSwitchesOnceRead(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Error(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	entryID, _, err := p.Store("/file", []byte("original"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = p.StoreFrom("/file", &failingReader{data: []byte("replacement")}); err == nil {
+		t.Error("Expected the error reading the stream")
+	}
+	if _, _, data, _ := p.Fetch("/file"); string(data) != "original" {
+		t.Error("Expected a failed stream to leave the file as it was, got", string(data))
+	}
+	if count := countChunks(t, p); count != 2 {
+		t.Error("Expected the chunks of the failed stream to be removed, have", count)
+	}
+
+	eID, meta, err := p.StoreFrom("/file", strings.NewReader("replacement"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eID != entryID {
+		t.Error("Expected the entryID to be kept")
+	}
+	if meta.GetSize() != 11 || len(meta.GetDataLocality().Chunks()) != 3 {
+		t.Error("Expected 11 bytes in 3 chunks, got", meta.GetSize(), "bytes in", len(meta.GetDataLocality().Chunks()))
+	}
+	if _, _, data, _ := p.Fetch("/file"); string(data) != "replacement" {
+		t.Error("Expected the streamed data, got", string(data))
+	}
+	if count := countChunks(t, p); count != 3 {
+		t.Error("Expected the chunks of the old data to be removed, have", count)
+	}
+}
+
+func TestProviderMigratesLegacyStores(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	// lay out a filesystem the way earlier versions did: separate databases, listings in chunks
+	paths, err := OpenPathStore(path.Join(baseDir, pathStoreFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metas, err := OpenMetaStore(path.Join(baseDir, metaStoreFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := OpenChunkStore(path.Join(baseDir, chunkStoreFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := dirEntries{{Name: "/file"}}.Serialize()
+	listingChunk, _ := chunks.Forge(listing)
+	fileChunk, _ := chunks.Forge([]byte("legacy"))
+	root := EntryMetadata{IsDir: true, Lname: "/", EntryID: nugget.EntryID{1}, Size: uint64(len(listing)),
+		Locality: LocalityInfo{ChunkIDs: []nugget.ChunkID{listingChunk}}}
+	file := EntryMetadata{Lname: "file", EntryID: nugget.EntryID{2}, Size: 6,
+		Locality: LocalityInfo{ChunkIDs: []nugget.ChunkID{fileChunk}}}
+	metas.Commit(root)
+	metas.Commit(file)
+	paths.Commit("/", root.EntryID)
+	paths.Commit("/file", file.EntryID)
+	paths.Close()
+	metas.Close()
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	entries, err := p.List("/")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 1 || entries[0].Identifier() != "/file" {
+		t.Error("Expected migrated listing, got", entries)
+	}
+	_, _, data, err := p.Fetch("/file")
+	if err != nil || string(data) != "legacy" {
+		t.Error("Expected migrated file, got", string(data), err)
+	}
+	if _, err = p.chunkstore.Lookup(listingChunk); err != ErrChunkNotFound {
+		t.Error("Expected listing chunk to be removed, got", err)
+	}
+	if fileExists(path.Join(baseDir, pathStoreFilename)) || !fileExists(path.Join(baseDir, pathStoreFilename+".migrated")) {
+		t.Error("Expected legacy path database to be renamed")
+	}
+}
+
+func countChunks(t *testing.T, p *Provider) int {
+	count := 0
+	if err := p.chunkstore.ForEach(func(chunkID nugget.ChunkID, size int64) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	return count
+}
+
+func TestProviderContentAddressedSharesChunks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := CreateWithOptions(baseDir, emptyLogger(), Options{ContentAddressed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.chunkSize = 4
+
+	p.Store("/a", []byte("01234567"))
+	p.Store("/b", []byte("0123abcd"))
+	p.Store("/c", []byte("01234567"))
+	if n := countChunks(t, p); n != 3 {
+		t.Error("Expected identical chunks to be stored once, got", n, "chunks")
+	}
+
+	// writes and truncation must not disturb other files sharing the chunk
+	if _, _, _, err = p.Write("/a", 1, []byte("xx")); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = p.Setattr("/c", nugget.AttrChanges{Valid: nugget.AttrSize, Size: 2}); err != nil {
+		t.Error(err)
+	}
+	for fPath, expected := range map[string]string{"/a": "0xx34567", "/b": "0123abcd", "/c": "01"} {
+		if _, _, data, err := p.Fetch(fPath); err != nil || string(data) != expected {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", fPath, expected, data, err)
+		}
+	}
+
+	p.Delete("/a")
+	if _, _, data, err := p.Fetch("/b"); err != nil || string(data) != "0123abcd" {
+		t.Errorf("Expected shared chunk to survive, got %q (%v)", data, err)
+	}
+	p.Delete("/b")
+	p.Delete("/c")
+	if n := countChunks(t, p); n != 0 {
+		t.Error("Expected every chunk to be removed with its last reference, got", n, "chunks")
+	}
+	p.Close()
+
+	// the mode is remembered by the data directory
+	p, err = Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if !p.contentAddressed {
+		t.Error("Expected content-addressed mode to persist")
+	}
+}
+
+func TestProviderCompressesChunks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := CreateWithOptions(baseDir, emptyLogger(), Options{Codec: CodecGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	_, meta, err := p.Store("/gzip", []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := p.ReadData(meta.GetDataLocality().ChunkAtIndex(0))
+	if err != nil || len(raw) < 2 || raw[0] != 0x1f || raw[1] != 0x8b {
+		t.Errorf("Expected chunk to be stored gzipped, got %q (%v)", raw, err)
+	}
+	if data, err := p.Read("/gzip", 3, 6); err != nil || string(data) != "345678" {
+		t.Errorf("Expected read across chunks to decompress, got %q (%v)", data, err)
+	}
+
+	// the codec only applies to new files, existing files keep theirs
+	p.codec = CodecNone
+	p.Store("/plain", []byte("abcdef"))
+	if _, _, _, err = p.Write("/gzip", 2, []byte("xx")); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = p.Setattr("/gzip", nugget.AttrChanges{Valid: nugget.AttrSize, Size: 7}); err != nil {
+		t.Error(err)
+	}
+	for fPath, expected := range map[string]string{"/gzip": "01xx456", "/plain": "abcdef"} {
+		if _, _, data, err := p.Fetch(fPath); err != nil || string(data) != expected {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", fPath, expected, data, err)
+		}
+	}
+	entryID, _ := p.Lookup("/gzip")
+	if meta, _ := p.metastore.Lookup(entryID); meta.Locality.Codec != CodecGzip {
+		t.Error("Expected written file to keep its codec, got", meta.Locality.Codec)
+	}
+	if n := countChunks(t, p); n != 4 {
+		t.Error("Expected replaced chunks to be removed, got", n, "chunks")
+	}
+}
+
+func TestProviderLongNames(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	longName := "/" + strings.Repeat("d", MaxNameLen) + "/" + strings.Repeat("f", MaxNameLen)
+	_, meta, err := p.Store(longName, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.LocalName() != path.Base(longName) {
+		t.Error("Expected name to be stored in full, got", len(meta.LocalName()), "bytes")
+	}
+	entries, err := p.List(path.Dir(longName))
+	if err != nil || len(entries) != 1 || entries[0].Identifier() != longName {
+		t.Error("Expected long name to be listed, got", entries, err)
+	}
+
+	if _, _, err = p.Store("/"+strings.Repeat("x", MaxNameLen+1), []byte("data")); err != ErrNameTooLong {
+		t.Error("Expected ErrNameTooLong, got", err)
+	}
+	if err = p.Rename(longName, "/"+strings.Repeat("x", MaxNameLen+1)); err != ErrNameTooLong {
+		t.Error("Expected ErrNameTooLong, got", err)
+	}
+}
+
+func TestProviderMigratesDirListings(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Store("/dir/a", []byte("a"))
+	p.Store("/dir/b", []byte("b"))
+	dirID, _ := p.Lookup("/dir")
+
+	// replace the index with the serialized listings earlier versions kept
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteDirEntries(tx, dirID); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(dirEntriesBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put(dirID[:], dirEntries{{Name: "/dir/a"}, {Name: "/dir/b"}}.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	if _, err = OpenChecker(baseDir, emptyLogger(), ""); err == nil {
+		t.Error("Expected checker to refuse unmigrated listings")
+	}
+
+	p, err = Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	entries, err := p.List("/dir")
+	if err != nil || len(entries) != 2 || entries[0].Identifier() != "/dir/a" || entries[1].Identifier() != "/dir/b" {
+		t.Error("Expected migrated listing, got", entries, err)
+	}
+	p.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(dirEntriesBucket)) != nil {
+			t.Error("Expected old listings to be removed")
+		}
+		return nil
+	})
+}
+
+func TestProviderListsLargeDirectory(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// each entry is a single key, so the directory is not rewritten for every create
+	for batch := 0; batch < 70; batch++ {
+		err = p.db.Update(func(tx *bolt.Tx) error {
+			for i := batch * 1000; i < (batch+1)*1000; i++ {
+				fPath := "/big/" + strconv.Itoa(i)
+				meta := EntryMetadata{Lname: path.Base(fPath)}
+				rand.Read(meta.EntryID[:])
+				if err := p.metastore.commit(tx, meta); err != nil {
+					return err
+				}
+				if err := p.pathstore.commit(tx, fPath, meta.EntryID); err != nil {
+					return err
+				}
+				if err := p.linkTx(tx, fPath, meta, time.Now()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Delete("/big/5")
+
+	entries, err := p.List("/big")
+	if err != nil || len(entries) != 69999 {
+		t.Fatal("Expected 69999 entries, got", len(entries), err)
+	}
+	_, meta, _, err := p.Fetch("/big")
+	if err != nil || meta.GetSize() != 69999 {
+		t.Error("Expected directory size to count entries, got", meta, err)
+	}
+
+	count, pages := 0, 0
+	for cursor := ""; pages == 0 || cursor != ""; pages++ {
+		entries, cursor, err = p.ListPage("/big", cursor, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(entries)
+	}
+	if count != 69999 || pages != 69 {
+		t.Errorf("Expected 69999 entries over 69 pages, got %d over %d", count, pages)
+	}
+}
+
+func TestProviderListPage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		p.Store("/dir/"+name, []byte(name))
+	}
+
+	entries, cursor, err := p.ListPage("/dir", "", 2)
+	if err != nil || len(entries) != 2 || entries[1].Identifier() != "/dir/b" || cursor == "" {
+		t.Fatal("Unexpected first page", entries, cursor, err)
+	}
+	// entries removed before the cursor must not shift the next page
+	p.Delete("/dir/a")
+	p.Delete("/dir/b")
+	entries, cursor, err = p.ListPage("/dir", cursor, 2)
+	if err != nil || len(entries) != 2 || entries[0].Identifier() != "/dir/c" || entries[1].Identifier() != "/dir/d" || cursor == "" {
+		t.Fatal("Unexpected second page", entries, cursor, err)
+	}
+	entries, cursor, err = p.ListPage("/dir", cursor, 2)
+	if err != nil || len(entries) != 1 || entries[0].Identifier() != "/dir/e" || cursor != "" {
+		t.Fatal("Unexpected last page", entries, cursor, err)
+	}
+
+	if _, _, err = p.ListPage("/dir", "not a cursor", 2); err != ErrInvalidCursor {
+		t.Error("Expected ErrInvalidCursor, got", err)
+	}
+	if _, _, err = p.ListPage("/missing", "", 2); err != ErrPathNotFound {
+		t.Error("Expected ErrPathNotFound, got", err)
+	}
+}
+
+func TestProviderSymlink(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Store("/dir/file", []byte("data"))
+	_, meta, err := p.Symlink("/dir/link", "../dir/file", nugget.NodeAttributes{UID: 1000, GID: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsSymlink() || meta.IsDirectory() || meta.GetSize() != uint64(len("../dir/file")) || meta.GetUID() != 1000 {
+		t.Error("Unexpected symlink metadata", meta)
+	}
+	if _, _, err = p.Symlink("/dir/link", "elsewhere", nugget.NodeAttributes{}); err != ErrPathExists {
+		t.Error("Expected ErrPathExists, got", err)
+	}
+	if _, _, err = p.Symlink("/dir/empty", "", nugget.NodeAttributes{}); err != ErrInvalidLinkTarget {
+		t.Error("Expected ErrInvalidLinkTarget, got", err)
+	}
+
+	if target, err := p.Readlink("/dir/link"); err != nil || target != "../dir/file" {
+		t.Errorf("Expected target ../dir/file, got %q (%v)", target, err)
+	}
+	if _, err = p.Readlink("/dir/file"); err != ErrNotSymlink {
+		t.Error("Expected ErrNotSymlink, got", err)
+	}
+	if _, _, err = p.Store("/dir/link", []byte("data")); err == nil {
+		t.Error("Expected Store over a symlink to fail")
+	}
+
+	if err = p.Rename("/dir/link", "/dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := p.List("/dir")
+	if err != nil || len(entries) != 2 {
+		t.Fatal("Expected 2 entries, got", entries, err)
+	}
+	for _, entry := range entries {
+		if entry.IsSymlink() != (entry.Identifier() == "/dir/moved") {
+			t.Error("Unexpected symlink flag on", entry.Identifier())
+		}
+	}
+	if target, err := p.Readlink("/dir/moved"); err != nil || target != "../dir/file" {
+		t.Errorf("Expected target to survive rename, got %q (%v)", target, err)
+	}
+
+	if err = p.Delete("/dir/moved"); err != nil {
+		t.Error(err)
+	}
+	if _, err = p.Readlink("/dir/moved"); err != ErrPathNotFound {
+		t.Error("Expected ErrPathNotFound, got", err)
+	}
+}
+
+func TestProviderHardLink(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	origID, _, _ := p.Store("/a/file", []byte("shared data"))
+	eID, meta, err := p.Link("/a/file", "/b/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eID != origID || meta.GetNlink() != 2 {
+		t.Error("Expected link to share the entry, got", eID, meta.GetNlink())
+	}
+	if _, _, err = p.Link("/a/file", "/b/other"); err != ErrPathExists {
+		t.Error("Expected ErrPathExists, got", err)
+	}
+	if _, _, err = p.Link("/a", "/c"); err != ErrLinkDirectory {
+		t.Error("Expected ErrLinkDirectory, got", err)
+	}
+	entries, err := p.List("/b")
+	if err != nil || len(entries) != 1 || entries[0].ID() != origID {
+		t.Error("Expected listing to carry the EntryID, got", entries, err)
+	}
+
+	// changes through one name are seen through the other
+	if _, _, _, err = p.Write("/b/other", 0, []byte("SHARED")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, data, err := p.Fetch("/a/file"); err != nil || string(data) != "SHARED data" {
+		t.Errorf("Expected write through the link, got %q (%v)", data, err)
+	}
+	if storedID, _, err := p.Store("/a/file", []byte("replaced")); err != nil || storedID != origID {
+		t.Error("Expected store to keep the shared entry, got", storedID, err)
+	}
+	if _, _, data, err := p.Fetch("/b/other"); err != nil || string(data) != "replaced" {
+		t.Errorf("Expected store through the link, got %q (%v)", data, err)
+	}
+	if err = p.Rename("/a/file", "/b/other"); err != nil {
+		t.Error("Expected rename onto another name of the entry to succeed, got", err)
+	}
+
+	if err = p.Delete("/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, data, err := p.Fetch("/b/other")
+	if err != nil || string(data) != "replaced" || meta.GetNlink() != 1 {
+		t.Errorf("Expected remaining name to keep the data, got %q (%v)", data, err)
+	}
+	if err = p.Delete("/b/other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.ReadMeta(origID); err != ErrMetaNotFound {
+		t.Error("Expected metadata to be freed with the last name, got", err)
+	}
+	if chunks := countChunks(t, p); chunks != 0 {
+		t.Error("Expected chunks to be freed with the last name, got", chunks)
+	}
+}
+
+func TestProviderConcurrentWritesKeepEveryChunk(t *testing.T) {
+	for _, opts := range []Options{{}, {ContentAddressed: true}} {
+		baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+		if err != nil {
+			t.Fatal("Setup error:", err)
+		}
+		defer os.RemoveAll(baseDir)
+
+		p, err := CreateWithOptions(baseDir, emptyLogger(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		p.chunkSize = 4
+
+		const writers = 160
+		if _, _, err = p.Store("/file", make([]byte, writers*2)); err != nil {
+			t.Fatal(err)
+		}
+		// half of the writes overwrite existing chunks, and half grow the file
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, _, _, err := p.Write("/file", int64(i*4), []byte(fmt.Sprintf("%04d", i))); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		_, _, data, err := p.Fetch("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != writers*4 {
+			t.Fatal("Expected", writers*4, "bytes, got", len(data))
+		}
+		for i := 0; i < writers; i++ {
+			if got := string(data[i*4 : i*4+4]); got != fmt.Sprintf("%04d", i) {
+				t.Errorf("Options %+v: expected chunk %d to hold %04d, got %q", opts, i, i, got)
+			}
+		}
+	}
+}
+
+func TestChunkDeltaKeepsOtherChanges(t *testing.T) {
+	a, b, c, d, e := nugget.ChunkID{1}, nugget.ChunkID{2}, nugget.ChunkID{3}, nugget.ChunkID{4}, nugget.ChunkID{5}
+	before := LocalityInfo{ChunkSize: 4, ChunkIDs: []nugget.ChunkID{a, b}}
+
+	// one operation replaces the second chunk and appends a third
+	after := cloneLocality(before)
+	after.ChunkIDs[1] = c
+	after.ChunkIDs = append(after.ChunkIDs, d)
+	delta := diffChunks(before, after)
+	if len(before.ChunkIDs) != 2 || before.ChunkIDs[1] != b {
+		t.Fatal("Expected cloneLocality to copy the chunk list")
+	}
+
+	// while another committed a change to the first chunk
+	current := LocalityInfo{ChunkSize: 4, ChunkIDs: []nugget.ChunkID{e, b}}
+	delta.apply(&current)
+	expected := []nugget.ChunkID{e, c, d}
+	if len(current.ChunkIDs) != len(expected) {
+		t.Fatal("Expected", expected, "got", current.ChunkIDs)
+	}
+	for i := range expected {
+		if current.ChunkIDs[i] != expected[i] {
+			t.Error("Expected", expected, "got", current.ChunkIDs)
+		}
+	}
+
+	// cutting the list short is kept too
+	delta = diffChunks(current, LocalityInfo{ChunkSize: 4, ChunkIDs: []nugget.ChunkID{e}})
+	delta.apply(&current)
+	if len(current.ChunkIDs) != 1 || current.ChunkIDs[0] != e {
+		t.Error("Expected the list to be cut to the first chunk, got", current.ChunkIDs)
+	}
+}
+
+func TestProviderWriteRejectsDirsAndLinks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})
+	if _, _, _, err = p.Write("/dir", 0, []byte("data")); err != ErrIsDir {
+		t.Error("Expected ErrIsDir writing a directory, got", err)
+	}
+	if _, _, err = p.Symlink("/link", "/target", nugget.NodeAttributes{Mode: 0777}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = p.Write("/link", 0, []byte("elsewhere")); err != ErrInvalid {
+		t.Error("Expected ErrInvalid writing a symlink, got", err)
+	}
+	if target, _ := p.Readlink("/link"); target != "/target" {
+		t.Error("Expected the link target to be unchanged, got", target)
+	}
+}
+
+func TestProviderCommitMetaKeepsConcurrentLinks(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	eID, _, err := p.Store("/a", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a write reads the metadata, then a link is made before the write commits
+	stale, err := p.metastore.Lookup(eID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = p.Link("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	stale.Size = 2
+	meta, err := p.commitMeta("/a", eID, 0, func(current *EntryMetadata) {
+		current.Size = stale.Size
+	}, intent{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Nlink != 2 || meta.Size != 2 {
+		t.Error("Expected the link count of the link and the size of the write, got", meta.Nlink, meta.Size)
+	}
+
+	if err = p.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, data, err := p.Fetch("/b"); err != nil || string(data) != "da" {
+		t.Errorf("Expected the remaining name to keep the entry, got %q (%v)", data, err)
+	}
+}
+
+func TestProviderRemoveAll(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	p.Store("/tree/a", []byte("some data"))
+	p.Store("/tree/sub/b", []byte("more data"))
+	p.Store("/tree/sub/deeper/c", []byte("even more data"))
+	p.Store("/keep", []byte("kept"))
+	p.Link("/tree/sub/b", "/linked")
+
+	if err = p.Delete("/tree/sub"); err != ErrNotEmpty {
+		t.Error("Expected ErrNotEmpty, got", err)
+	}
+	if _, err = p.Lookup("/tree/sub/deeper/c"); err != nil {
+		t.Error("Expected refused delete to leave the tree intact, got", err)
+	}
+	if err = p.Rename("/keep", "/tree"); err == nil {
+		t.Error("Expected replacing a directory with a file to fail")
+	}
+
+	if err = p.RemoveAll("/tree"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fPath := range []string{"/tree", "/tree/a", "/tree/sub", "/tree/sub/b", "/tree/sub/deeper", "/tree/sub/deeper/c"} {
+		if _, err = p.Lookup(fPath); err != ErrPathNotFound {
+			t.Error("Expected", fPath, "to be removed, got", err)
+		}
+	}
+	entries, err := p.List("/")
+	if err != nil || len(entries) != 2 {
+		t.Error("Expected / to hold /keep and /linked, got", entries, err)
+	}
+	if _, meta, data, err := p.Fetch("/linked"); err != nil || string(data) != "more data" || meta.GetNlink() != 1 {
+		t.Errorf("Expected the other name of a removed file to survive, got %q (%v)", data, err)
+	}
+	if err = p.RemoveAll("/tree"); err != ErrPathNotFound {
+		t.Error("Expected ErrPathNotFound, got", err)
+	}
+
+	p.Delete("/keep")
+	p.Delete("/linked")
+	if chunks := countChunks(t, p); chunks != 0 {
+		t.Error("Expected every chunk to be freed, got", chunks)
+	}
+}
+
+func TestProviderReturnsTypedErrors(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})
+	p.Mkdir("/other", nugget.NodeAttributes{Mode: 0755})
+	p.Store("/dir/file", []byte("data"))
+	p.Store("/file", []byte("data"))
+
+	tcs := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"mkdir existing", second(p.Mkdir("/dir", nugget.NodeAttributes{})), ErrPathExists},
+		{"store beneath file", second(p.Store("/file/child", nil)), ErrNotDir},
+		{"store over dir", second(p.Store("/dir", nil)), ErrIsDir},
+		{"list file", listErr(p.List("/file")), ErrNotDir},
+		{"rename dir over file", p.Rename("/other", "/file"), ErrNotDir},
+		{"rename file over dir", p.Rename("/file", "/other"), ErrIsDir},
+		{"rename over non-empty dir", p.Rename("/other", "/dir"), ErrNotEmpty},
+		{"rename beneath itself", p.Rename("/dir", "/dir/sub"), ErrInvalid},
+		{"delete non-empty dir", p.Delete("/dir"), ErrNotEmpty},
+	}
+	for _, tc := range tcs {
+		if tc.err != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, tc.err)
+		}
+	}
+}
+
+func second(_ nugget.EntryID, _ nugget.NodeMetadata, err error) error {
+	return err
+}
+
+func listErr(_ []nugget.DirEntry, err error) error {
+	return err
+}
+
+func TestProviderStatfs(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_provider_test")
+	defer func() {
+		os.RemoveAll(baseDir)
+	}()
+	if err != nil {
+		t.Error("Setup error:", err)
+		t.FailNow()
+	}
+
+	p, err := Create(baseDir, emptyLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.chunkSize = 4
+
+	p.Store("/dir/a", []byte("0123456789"))
+	p.Store("/b", []byte("abcd"))
+	stats, err := p.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalBytes == 0 || stats.FreeBytes > stats.TotalBytes {
+		t.Error("Expected the size of the backing volume, got", stats.TotalBytes, stats.FreeBytes)
+	}
+	if stats.Entries != 4 {
+		t.Error("Expected 4 entries (/, /dir, /dir/a and /b), got", stats.Entries)
+	}
+	if stats.ChunkBytes != 14 {
+		t.Error("Expected 14 chunk bytes, got", stats.ChunkBytes)
+	}
+
+	// chunk bytes are counted again once the last count expires
+	p.Store("/c", []byte("more"))
+	if stats, _ = p.Statfs(); stats.ChunkBytes != 14 || stats.Entries != 5 {
+		t.Error("Expected cached chunk bytes and a fresh entry count, got", stats.ChunkBytes, stats.Entries)
+	}
+	p.chunkBytesAge = time.Time{}
+	if stats, _ = p.Statfs(); stats.ChunkBytes != 18 {
+		t.Error("Expected 18 chunk bytes, got", stats.ChunkBytes)
+	}
+}
@@ -0,0 +1,473 @@
+package nuggdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// quota.go limits the bytes and entries held beneath a directory, and created by a client. Every quota
+// is a record of the quota bucket, keyed by 'd' followed by the EntryID of the directory, or by 'c'
+// followed by the name of the client (a keyed hash of the name when encrypted). A record holds the
+// limits and the usage counted against them, which is updated in the same transaction as the change
+// being counted. The owner bucket maps the EntryID of each entry created on behalf of a client to the
+// key of the client, so the usage of an entry is returned to its client when it is removed.
+//
+// Usage beneath a directory is counted per name: every name of a hard linked file counts the size of
+// the file, and a write counts against the directories above the name it was made through.
+
+const (
+	quotaBucket = "Quotas"
+	ownerBucket = "Owners"
+)
+
+const quotaRecordLen = 32
+
+// ErrNoQuota is returned when reading a quota which has not been set.
+var ErrNoQuota = errors.New("No quota set")
+
+// ErrInvalidQuota is returned by ParseQuota for a malformed quota.
+var ErrInvalidQuota = errors.New("Quota must be formatted <target>:<bytes>[:<entries>]")
+
+var errQuotaCorrupt = errors.New("Quota record is truncated")
+
+// Quota limits the bytes of file data and the number of entries beneath a directory, or created by
+// a client. A limit of zero is unlimited.
+type Quota struct {
+	MaxBytes   uint64
+	MaxEntries uint64
+}
+
+// QuotaUsage describes a quota and the usage counted against it.
+type QuotaUsage struct {
+	Quota
+	Bytes   uint64
+	Entries uint64
+}
+
+// usage is a change to the bytes and entries counted against a quota.
+type usage struct {
+	bytes, entries int64
+}
+
+// entryUsage returns the usage of the entry described by meta. The size of a directory is the
+// number of its entries, so only its entry is counted.
+func entryUsage(meta EntryMetadata) usage {
+	if meta.IsDir {
+		return usage{entries: 1}
+	}
+	return usage{bytes: int64(meta.Size), entries: 1}
+}
+
+func (u usage) negate() usage {
+	return usage{bytes: -u.bytes, entries: -u.entries}
+}
+
+// addUsage adds delta to count, stopping at zero.
+func addUsage(count uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > count {
+		return 0
+	}
+	return count + uint64(delta)
+}
+
+func dirQuotaKey(dirID nugget.EntryID) []byte {
+	return append([]byte{'d'}, dirID[:]...)
+}
+
+func clientQuotaKey(s *sealer, client string) []byte {
+	return append([]byte{'c'}, s.keyForPath(client)...)
+}
+
+func encodeQuota(q QuotaUsage) []byte {
+	out := make([]byte, quotaRecordLen)
+	binary.BigEndian.PutUint64(out[0:], q.MaxBytes)
+	binary.BigEndian.PutUint64(out[8:], q.MaxEntries)
+	binary.BigEndian.PutUint64(out[16:], q.Bytes)
+	binary.BigEndian.PutUint64(out[24:], q.Entries)
+	return out
+}
+
+func decodeQuota(v []byte) (QuotaUsage, error) {
+	var q QuotaUsage
+	if len(v) != quotaRecordLen {
+		return q, errQuotaCorrupt
+	}
+	q.MaxBytes = binary.BigEndian.Uint64(v[0:])
+	q.MaxEntries = binary.BigEndian.Uint64(v[8:])
+	q.Bytes = binary.BigEndian.Uint64(v[16:])
+	q.Entries = binary.BigEndian.Uint64(v[24:])
+	return q, nil
+}
+
+// chargeQuotaTx adds u to the usage of the quota stored under key, if there is one. ErrNoSpace is
+// returned if u grows the usage beyond a limit of the quota.
+func chargeQuotaTx(tx *bolt.Tx, key []byte, u usage) error {
+	b := tx.Bucket([]byte(quotaBucket))
+	v := b.Get(key)
+	if v == nil {
+		return nil
+	}
+	q, err := decodeQuota(v)
+	if err != nil {
+		return err
+	}
+	q.Bytes = addUsage(q.Bytes, u.bytes)
+	q.Entries = addUsage(q.Entries, u.entries)
+	if u.bytes > 0 && q.MaxBytes > 0 && q.Bytes > q.MaxBytes {
+		return ErrNoSpace
+	}
+	if u.entries > 0 && q.MaxEntries > 0 && q.Entries > q.MaxEntries {
+		return ErrNoSpace
+	}
+	return b.Put(key, encodeQuota(q))
+}
+
+// dirQuotaKeysTx returns the keys of the quotas on the directories above fPath.
+func (p *Provider) dirQuotaKeysTx(tx *bolt.Tx, fPath string) ([][]byte, error) {
+	b := tx.Bucket([]byte(quotaBucket))
+	if k, _ := b.Cursor().Seek([]byte{'d'}); k == nil || k[0] != 'd' {
+		return nil, nil // no directory has a quota
+	}
+
+	fPath = path.Clean(fPath)
+	if !path.IsAbs(fPath) {
+		return nil, ErrInvalid
+	}
+	var keys [][]byte
+	for dirPath := fPath; dirPath != "/" && dirPath != "."; {
+		dirPath = path.Dir(dirPath)
+		dirID, err := p.pathstore.lookup(tx, dirPath)
+		if err == ErrPathNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if key := dirQuotaKey(dirID); b.Get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// chargeDirsTx adds u to the usage of the quotas on the directories above fPath as part of tx.
+func (p *Provider) chargeDirsTx(tx *bolt.Tx, fPath string, u usage) error {
+	keys, err := p.dirQuotaKeysTx(tx, fPath)
+	if err != nil {
+		return err
+	}
+	return chargeKeysTx(tx, keys, u)
+}
+
+// chargeEntryTx adds u to the usage of the quotas of the entry eID at fPath as part of tx: those on the
+// directories above fPath, and that of its owner.
+func (p *Provider) chargeEntryTx(tx *bolt.Tx, fPath string, eID nugget.EntryID, u usage) error {
+	if err := p.chargeDirsTx(tx, fPath, u); err != nil {
+		return err
+	}
+	return chargeOwnerTx(tx, eID, u)
+}
+
+func chargeKeysTx(tx *bolt.Tx, keys [][]byte, u usage) error {
+	for _, key := range keys {
+		if err := chargeQuotaTx(tx, key, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveDirsTx moves the usage of the entry at newPath, and everything beneath it, from the quotas in
+// oldKeys to the quotas on the directories above newPath, as part of tx. The subtree is only walked
+// if the quotas differ.
+func (p *Provider) moveDirsTx(tx *bolt.Tx, oldKeys [][]byte, newPath string, eID nugget.EntryID, meta EntryMetadata) error {
+	newKeys, err := p.dirQuotaKeysTx(tx, newPath)
+	if err != nil {
+		return err
+	}
+	removed, added := keysMissing(oldKeys, newKeys), keysMissing(newKeys, oldKeys)
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+	u, err := p.subtreeUsageTx(tx, newPath, eID, meta)
+	if err != nil {
+		return err
+	}
+	if err = chargeKeysTx(tx, removed, u.negate()); err != nil {
+		return err
+	}
+	return chargeKeysTx(tx, added, u)
+}
+
+// keysMissing returns the keys in keys which are not in other.
+func keysMissing(keys, other [][]byte) [][]byte {
+	var out [][]byte
+outer:
+	for _, key := range keys {
+		for _, o := range other {
+			if bytes.Equal(key, o) {
+				continue outer
+			}
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// subtreeUsageTx returns the usage of the entry at fPath and everything beneath it.
+func (p *Provider) subtreeUsageTx(tx *bolt.Tx, fPath string, eID nugget.EntryID, meta EntryMetadata) (usage, error) {
+	u := entryUsage(meta)
+	if !meta.IsDir {
+		return u, nil
+	}
+	err := forEachDirEntry(tx, p.sealer, eID, fPath, func(entry DirEntry) error {
+		childMeta, err := p.metastore.lookup(tx, entry.EntryID)
+		if err != nil {
+			return err
+		}
+		childUsage, err := p.subtreeUsageTx(tx, entry.Name, entry.EntryID, childMeta)
+		u.bytes += childUsage.bytes
+		u.entries += childUsage.entries
+		return err
+	})
+	return u, err
+}
+
+// claimTx records client as the owner of the new entry described by meta as part of tx, counting the
+// entry against the quota of the client. Entries created without a client have no owner.
+func (p *Provider) claimTx(tx *bolt.Tx, client string, meta EntryMetadata) error {
+	if client == "" {
+		return nil
+	}
+	key := clientQuotaKey(p.sealer, client)
+	if err := tx.Bucket([]byte(ownerBucket)).Put(meta.EntryID[:], key); err != nil {
+		return err
+	}
+	return chargeQuotaTx(tx, key, entryUsage(meta))
+}
+
+// chargeOwnerTx adds u to the usage of the client owning the entry with the given EntryID, if any.
+func chargeOwnerTx(tx *bolt.Tx, eID nugget.EntryID, u usage) error {
+	key := tx.Bucket([]byte(ownerBucket)).Get(eID[:])
+	if key == nil {
+		return nil
+	}
+	return chargeQuotaTx(tx, append([]byte{}, key...), u)
+}
+
+// releaseQuotasTx returns the usage of the removed entry described by meta to its owner, and removes
+// its owner record and the quota on it, as part of tx.
+func releaseQuotasTx(tx *bolt.Tx, meta EntryMetadata) error {
+	if err := chargeOwnerTx(tx, meta.EntryID, entryUsage(meta).negate()); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(ownerBucket)).Delete(meta.EntryID[:]); err != nil {
+		return err
+	}
+	if !meta.IsDir {
+		return nil
+	}
+	return tx.Bucket([]byte(quotaBucket)).Delete(dirQuotaKey(meta.EntryID))
+}
+
+// putQuotaTx sets the limits of the quota stored under key as part of tx. The usage of an existing
+// quota is kept, otherwise it is counted by calling count. A zero q removes the quota.
+func putQuotaTx(tx *bolt.Tx, key []byte, q Quota, count func() (usage, error)) error {
+	b := tx.Bucket([]byte(quotaBucket))
+	if q == (Quota{}) {
+		return b.Delete(key)
+	}
+
+	var existing QuotaUsage
+	if v := b.Get(key); v != nil {
+		var err error
+		if existing, err = decodeQuota(v); err != nil {
+			return err
+		}
+	} else {
+		u, err := count()
+		if err != nil {
+			return err
+		}
+		existing.Bytes, existing.Entries = addUsage(0, u.bytes), addUsage(0, u.entries)
+	}
+	existing.Quota = q
+	return b.Put(key, encodeQuota(existing))
+}
+
+// getQuota returns the quota stored under key, or ErrNoQuota if there is none.
+func (p *Provider) getQuota(key func(tx *bolt.Tx) ([]byte, error)) (QuotaUsage, error) {
+	var q QuotaUsage
+	err := p.db.View(func(tx *bolt.Tx) error {
+		k, err := key(tx)
+		if err != nil {
+			return err
+		}
+		v := tx.Bucket([]byte(quotaBucket)).Get(k)
+		if v == nil {
+			return ErrNoQuota
+		}
+		q, err = decodeQuota(v)
+		return err
+	})
+	return q, err
+}
+
+// SetDirQuota limits the bytes and entries beneath the directory at dirPath. Once exceeded, changes
+// which would add to the usage of the directory fail with ErrNoSpace. The usage of a new quota is
+// counted by walking the directory. A zero q removes the quota.
+func (p *Provider) SetDirQuota(dirPath string, q Quota) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		dirID, meta, err := p.lookupTx(tx, dirPath)
+		if err != nil {
+			return err
+		}
+		if !meta.IsDir {
+			return ErrNotDir
+		}
+		return putQuotaTx(tx, dirQuotaKey(dirID), q, func() (usage, error) {
+			u, err := p.subtreeUsageTx(tx, dirPath, dirID, meta)
+			u.entries-- // the directory itself is not beneath it
+			return u, err
+		})
+	})
+}
+
+// DirQuota returns the quota on the directory at dirPath, along with its usage.
+func (p *Provider) DirQuota(dirPath string) (QuotaUsage, error) {
+	return p.getQuota(func(tx *bolt.Tx) ([]byte, error) {
+		dirID, err := p.pathstore.lookup(tx, dirPath)
+		return dirQuotaKey(dirID), err
+	})
+}
+
+// SetClientQuota limits the bytes and entries owned by client, which are the entries created through
+// the provider returned by ForClient. Once exceeded, changes which would add to the usage of the client
+// fail with ErrNoSpace. The usage of a new quota is counted from the entries the client owns. A zero q
+// removes the quota.
+func (p *Provider) SetClientQuota(client string, q Quota) error {
+	key := clientQuotaKey(p.sealer, client)
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return putQuotaTx(tx, key, q, func() (usage, error) {
+			var u usage
+			err := tx.Bucket([]byte(ownerBucket)).ForEach(func(k, v []byte) error {
+				if !bytes.Equal(v, key) {
+					return nil
+				}
+				var eID nugget.EntryID
+				copy(eID[:], k)
+				meta, err := p.metastore.lookup(tx, eID)
+				if err == ErrMetaNotFound {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				entry := entryUsage(meta)
+				u.bytes += entry.bytes
+				u.entries += entry.entries
+				return nil
+			})
+			return u, err
+		})
+	})
+}
+
+// ClientQuota returns the quota of client, along with its usage.
+func (p *Provider) ClientQuota(client string) (QuotaUsage, error) {
+	return p.getQuota(func(tx *bolt.Tx) ([]byte, error) {
+		return clientQuotaKey(p.sealer, client), nil
+	})
+}
+
+// ForClient returns a view of the provider which records client as the owner of the entries created
+// through it, counting them against the quota of the client. Directories created implicitly, as the
+// parents of a new entry, have no owner.
+func (p *Provider) ForClient(client string) nugget.DataSourceSink {
+	return &clientProvider{Provider: p, client: client}
+}
+
+// clientProvider is a Provider which creates entries on behalf of a client.
+type clientProvider struct {
+	*Provider
+	client string
+}
+
+func (c *clientProvider) Store(fPath string, data []byte) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return c.store(fPath, data, nil, false, c.client)
+}
+
+func (c *clientProvider) StoreFrom(fPath string, r io.Reader) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return c.storeFrom(fPath, r, c.client)
+}
+
+func (c *clientProvider) Create(fPath string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return c.store(fPath, []byte{}, &attr, true, c.client)
+}
+
+func (c *clientProvider) Mkdir(fPath string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return c.mkdir(fPath, attr, c.client)
+}
+
+func (c *clientProvider) Symlink(fPath, target string, attr nugget.NodeAttributes) (nugget.EntryID, nugget.NodeMetadata, error) {
+	return c.symlink(fPath, target, attr, c.client)
+}
+
+// QuotaFlag is a flag.Value collecting the quotas given by a flag which may be repeated, each formatted
+// as for ParseQuota. Quotas are checked as they are given, so a malformed one is reported with the flag.
+type QuotaFlag []string
+
+func (f *QuotaFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value.
+func (f *QuotaFlag) Set(spec string) error {
+	if _, _, err := ParseQuota(spec); err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// ParseQuota parses a quota formatted <target>:<bytes>[:<entries>], where target is a directory or a
+// client name. Bytes may end in K, M, G or T to count in units of 1024 bytes and its powers.
+func ParseQuota(spec string) (target string, q Quota, err error) {
+	parts := strings.Split(spec, ":")
+	n := len(parts)
+	if n < 2 {
+		return "", q, ErrInvalidQuota
+	}
+	if n > 2 {
+		entries, err1 := strconv.ParseUint(parts[n-1], 10, 64)
+		size, err2 := parseSize(parts[n-2])
+		if err1 == nil && err2 == nil && strings.Join(parts[:n-2], ":") != "" {
+			return strings.Join(parts[:n-2], ":"), Quota{MaxBytes: size, MaxEntries: entries}, nil
+		}
+	}
+	target = strings.Join(parts[:n-1], ":")
+	if q.MaxBytes, err = parseSize(parts[n-1]); err != nil || target == "" {
+		return "", Quota{}, ErrInvalidQuota
+	}
+	return target, q, nil
+}
+
+// parseSize parses a number of bytes, which may end in K, M, G or T.
+func parseSize(s string) (uint64, error) {
+	multiplier := uint64(1)
+	if s == "" {
+		return 0, ErrInvalidQuota
+	}
+	if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+		multiplier = 1 << (10 * uint(i+1))
+		s = s[:len(s)-1]
+	}
+	size, err := strconv.ParseUint(s, 10, 64)
+	return size * multiplier, err
+}
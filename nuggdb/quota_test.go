@@ -0,0 +1,281 @@
+package nuggdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/twitchyliquid64/nugget"
+)
+
+func makeQuotaProvider(t *testing.T, encrypted bool) (*Provider, func()) {
+	baseDir, err := ioutil.TempDir("", "nuggdb_quota_test")
+	if err != nil {
+		t.Fatal("Setup error:", err)
+	}
+	dataDir := path.Join(baseDir, "data")
+	os.Mkdir(dataDir, 0755)
+	var opts Options
+	if encrypted {
+		opts.KeyFile = path.Join(baseDir, "key")
+		ioutil.WriteFile(opts.KeyFile, bytes.Repeat([]byte{1}, KeySize), 0600)
+	}
+	p, err := CreateWithOptions(dataDir, emptyLogger(), opts)
+	if err != nil {
+		os.RemoveAll(baseDir)
+		t.Fatal(err)
+	}
+	return p, func() {
+		p.Close()
+		os.RemoveAll(baseDir)
+	}
+}
+
+func checkQuotaUsage(t *testing.T, what string, q QuotaUsage, err error, bytes, entries uint64) {
+	if err != nil {
+		t.Errorf("%s: %v", what, err)
+	} else if q.Bytes != bytes || q.Entries != entries {
+		t.Errorf("%s: expected %d bytes and %d entries, got %d and %d", what, bytes, entries, q.Bytes, q.Entries)
+	}
+}
+
+func TestProviderDirQuota(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		p, done := makeQuotaProvider(t, encrypted)
+		defer done()
+
+		p.Mkdir("/q", nugget.NodeAttributes{Mode: 0755})
+		p.Store("/q/a", []byte("0123456789"))
+		p.Store("/other", []byte("abcd"))
+		if err := p.SetDirQuota("/q", Quota{MaxBytes: 16, MaxEntries: 3}); err != nil {
+			t.Fatal(err)
+		}
+		q, err := p.DirQuota("/q")
+		checkQuotaUsage(t, "initial usage", q, err, 10, 1)
+		if err = p.SetDirQuota("/other", Quota{MaxBytes: 1}); err != ErrNotDir {
+			t.Error("Expected ErrNotDir, got", err)
+		}
+
+		if err = second(p.Store("/q/b", []byte("01234567"))); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if _, err = p.Lookup("/q/b"); err != ErrPathNotFound {
+			t.Error("Expected /q/b to not be stored, got", err)
+		}
+		if _, _, _, err = p.Write("/q/a", 10, []byte("abcdef")); err != nil {
+			t.Error(err)
+		}
+		if _, _, _, err = p.Write("/q/a", 16, []byte("!")); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		// a write over existing data which grows the file beyond the quota changes nothing
+		if _, _, _, err = p.Write("/q/a", 8, []byte("XXXXXXXXXX")); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if _, _, data, err := p.Fetch("/q/a"); err != nil || string(data) != "0123456789abcdef" {
+			t.Errorf("Expected a failed write to leave the file unchanged, got %q (%v)", data, err)
+		}
+		q, err = p.DirQuota("/q")
+		checkQuotaUsage(t, "usage after failed writes", q, err, 16, 1)
+		if err = second(p.Setattr("/q/a", nugget.AttrChanges{Valid: nugget.AttrSize, Size: 17})); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if err = second(p.Setattr("/q/a", nugget.AttrChanges{Valid: nugget.AttrSize, Size: 2})); err != nil {
+			t.Error(err)
+		}
+		q, err = p.DirQuota("/q")
+		checkQuotaUsage(t, "usage after truncation", q, err, 2, 1)
+
+		// entries are counted beneath subdirectories, and with every name of a file
+		p.Mkdir("/q/sub", nugget.NodeAttributes{Mode: 0755})
+		if err = second(p.Link("/q/a", "/q/sub/link")); err != nil {
+			t.Error(err)
+		}
+		if err = second(p.Mkdir("/q/sub/dir", nugget.NodeAttributes{Mode: 0755})); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		q, err = p.DirQuota("/q")
+		checkQuotaUsage(t, "usage after link", q, err, 4, 3)
+
+		// moving entries in and out of the directory moves their usage
+		if err = p.Rename("/q/sub", "/sub"); err != nil {
+			t.Error(err)
+		}
+		q, err = p.DirQuota("/q")
+		checkQuotaUsage(t, "usage after moving out", q, err, 2, 1)
+		if err = p.Rename("/other", "/q/other"); err != nil {
+			t.Error(err)
+		}
+		if err = p.Rename("/sub", "/q/sub"); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if _, err = p.Lookup("/sub/link"); err != nil {
+			t.Error("Expected a failed rename to leave /sub in place, got", err)
+		}
+		if err = p.Delete("/q/a"); err != nil {
+			t.Error(err)
+		}
+		q, err = p.DirQuota("/q")
+		checkQuotaUsage(t, "usage after delete", q, err, 4, 1)
+
+		// the quota moves with its directory, and is kept when reopened
+		if err = p.Rename("/q", "/r"); err != nil {
+			t.Error(err)
+		}
+		if err = second(p.Store("/r/big", make([]byte, 13))); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if err = p.SetDirQuota("/r", Quota{MaxBytes: 100}); err != nil {
+			t.Error(err)
+		}
+		q, err = p.DirQuota("/r")
+		checkQuotaUsage(t, "usage after raising the limit", q, err, 4, 1)
+		if err = second(p.Store("/r/big", make([]byte, 13))); err != nil {
+			t.Error(err)
+		}
+
+		if err = p.SetDirQuota("/r", Quota{}); err != nil {
+			t.Error(err)
+		}
+		if _, err = p.DirQuota("/r"); err != ErrNoQuota {
+			t.Error("Expected ErrNoQuota, got", err)
+		}
+	}
+}
+
+func TestProviderDirQuotaRejectsRelativePaths(t *testing.T) {
+	p, done := makeQuotaProvider(t, false)
+	defer done()
+
+	p.Mkdir("/q", nugget.NodeAttributes{Mode: 0755})
+	if err := p.SetDirQuota("/q", Quota{MaxBytes: 16}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := p.Store("foo", []byte("data"))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != ErrInvalid {
+			t.Error("Expected ErrInvalid, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Store of a relative path did not return")
+	}
+}
+
+func TestProviderClientQuota(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		p, done := makeQuotaProvider(t, encrypted)
+		defer done()
+
+		alice := p.ForClient("alice")
+		if _, ok := alice.(nugget.OptimisedDataSourceSink); !ok {
+			t.Error("Expected the client view to be an OptimisedDataSourceSink")
+		}
+		if _, ok := alice.(nugget.SymlinkDataSink); !ok {
+			t.Error("Expected the client view to be a SymlinkDataSink")
+		}
+		alice.Store("/a", []byte("01234"))
+		p.Store("/mine", []byte("not counted"))
+		if err := p.SetClientQuota("alice", Quota{MaxBytes: 8, MaxEntries: 3}); err != nil {
+			t.Fatal(err)
+		}
+		q, err := p.ClientQuota("alice")
+		checkQuotaUsage(t, "initial usage", q, err, 5, 1)
+		if _, err = p.ClientQuota("bob"); err != ErrNoQuota {
+			t.Error("Expected ErrNoQuota, got", err)
+		}
+
+		if err = second(alice.Store("/b", []byte("0123"))); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if err = second(p.Store("/b", []byte("0123"))); err != nil {
+			t.Error(err)
+		}
+		// growing an entry counts against its owner, whoever writes to it
+		if _, _, _, err = p.Write("/a", 3, []byte("XXXXXX")); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		if _, _, data, err := p.Fetch("/a"); err != nil || string(data) != "01234" {
+			t.Errorf("Expected a failed write to leave the file unchanged, got %q (%v)", data, err)
+		}
+		q, err = p.ClientQuota("alice")
+		checkQuotaUsage(t, "usage after a failed write", q, err, 5, 1)
+		if err = second(p.Store("/a", []byte("01234567"))); err != nil {
+			t.Error(err)
+		}
+		if err = second(alice.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})); err != nil {
+			t.Error(err)
+		}
+		if err = second(alice.(nugget.SymlinkDataSink).Symlink("/dir/link", "a", nugget.NodeAttributes{})); err != ErrNoSpace {
+			t.Error("Expected ErrNoSpace, got", err)
+		}
+		q, err = p.ClientQuota("alice")
+		checkQuotaUsage(t, "usage after writes", q, err, 8, 2)
+
+		// hard links share the entry, which is returned to its owner with its last name
+		p.Link("/a", "/dir/a")
+		p.Delete("/a")
+		q, err = p.ClientQuota("alice")
+		checkQuotaUsage(t, "usage after deleting a name", q, err, 8, 2)
+		if err = p.RemoveAll("/dir"); err != nil {
+			t.Error(err)
+		}
+		q, err = p.ClientQuota("alice")
+		checkQuotaUsage(t, "usage after removal", q, err, 0, 0)
+		if err = second(alice.Create("/c", nugget.NodeAttributes{Mode: 0644})); err != nil {
+			t.Error(err)
+		}
+		q, err = p.ClientQuota("alice")
+		checkQuotaUsage(t, "usage after create", q, err, 0, 1)
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	tcs := []struct {
+		spec   string
+		target string
+		quota  Quota
+		err    error
+	}{
+		{"/dir:1024", "/dir", Quota{MaxBytes: 1024}, nil},
+		{"/dir:10K:5", "/dir", Quota{MaxBytes: 10 * 1024, MaxEntries: 5}, nil},
+		{"client:2G", "client", Quota{MaxBytes: 2 << 30}, nil},
+		{"a:b:1M", "a:b", Quota{MaxBytes: 1 << 20}, nil},
+		{"a:b:1M:7", "a:b", Quota{MaxBytes: 1 << 20, MaxEntries: 7}, nil},
+		{"/dir:0", "/dir", Quota{}, nil},
+		{"/dir", "", Quota{}, ErrInvalidQuota},
+		{":10", "", Quota{}, ErrInvalidQuota},
+		{"/dir:", "", Quota{}, ErrInvalidQuota},
+		{"/dir:lots", "", Quota{}, ErrInvalidQuota},
+	}
+	for _, tc := range tcs {
+		target, q, err := ParseQuota(tc.spec)
+		if target != tc.target || q != tc.quota || err != tc.err {
+			t.Errorf("ParseQuota(%q) = %q, %+v, %v, expected %q, %+v, %v", tc.spec, target, q, err, tc.target, tc.quota, tc.err)
+		}
+	}
+}
+
+func TestQuotaFlag(t *testing.T) {
+	var f QuotaFlag
+	if err := f.Set("/dir:10K"); err != nil {
+		t.Error(err)
+	}
+	if err := f.Set("/dir"); err != ErrInvalidQuota {
+		t.Error("Expected ErrInvalidQuota, got", err)
+	}
+	if err := f.Set("alice:1G:100"); err != nil {
+		t.Error(err)
+	}
+	if len(f) != 2 || f.String() != "/dir:10K,alice:1G:100" {
+		t.Error("Expected the valid quotas to be collected, got", f.String())
+	}
+}
@@ -0,0 +1,57 @@
+package nuggdb
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// StatfsInterval is how long the chunk bytes reported by Statfs are reused before the chunkstore
+// is walked again, as counting them reads every chunk directory.
+const StatfsInterval = 30 * time.Second
+
+// Statfs reports the size and free space of the volume holding the data directory, the number of
+// entries stored, and the bytes held by chunks. The chunk bytes may be up to StatfsInterval old.
+func (p *Provider) Statfs() (nugget.FSStats, error) {
+	var stats nugget.FSStats
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p.basedir, &st); err != nil {
+		return stats, err
+	}
+	stats.TotalBytes = st.Blocks * uint64(st.Bsize)
+	stats.FreeBytes = st.Bavail * uint64(st.Bsize)
+
+	err := p.db.View(func(tx *bolt.Tx) error {
+		stats.Entries = uint64(tx.Bucket([]byte(entryIDToMetaBucket)).Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	stats.ChunkBytes, err = p.countChunkBytes()
+	return stats, err
+}
+
+// countChunkBytes returns the bytes held by chunk files, counting them again if the last count is
+// older than StatfsInterval.
+func (p *Provider) countChunkBytes() (uint64, error) {
+	p.statfsLock.Lock()
+	defer p.statfsLock.Unlock()
+	if time.Since(p.chunkBytesAge) < StatfsInterval {
+		return p.chunkBytes, nil
+	}
+
+	var total uint64
+	err := p.chunkstore.ForEach(func(chunkID nugget.ChunkID, size int64) error {
+		total += uint64(size)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	p.chunkBytes, p.chunkBytesAge = total, time.Now()
+	return total, nil
+}
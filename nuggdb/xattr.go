@@ -0,0 +1,180 @@
+package nuggdb
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// xattr.go stores the extended attributes of entries. Each attribute is a key of the xattr bucket,
+// made of the EntryID of its entry followed by its name, so every name of a hard linked file sees
+// the same attributes, and the attributes of an entry are listed by a cursor over the keys with its
+// EntryID as prefix. When encrypted, the name in the key is replaced by a keyed hash, and the name
+// is sealed in the value along with the attribute.
+
+const xattrBucket = "Xattrs"
+
+// DefaultMaxXattrSize is the largest attribute value stored when no limit is configured.
+const DefaultMaxXattrSize = 64 * 1024
+
+// MaxXattrNameLen is the longest name, in bytes, an extended attribute may have.
+const MaxXattrNameLen = 255
+
+// Flags accepted by Setxattr, matching XATTR_CREATE and XATTR_REPLACE on linux.
+const (
+	XattrCreate  = 1 << 0 // fail if the attribute exists
+	XattrReplace = 1 << 1 // fail if the attribute does not exist
+)
+
+var (
+	// ErrXattrNotFound is returned for an extended attribute which does not exist.
+	ErrXattrNotFound = errors.New("Extended attribute not found")
+	// ErrXattrExists is returned by Setxattr with XattrCreate for an attribute which exists.
+	ErrXattrExists = errors.New("Extended attribute already exists")
+	// ErrXattrTooLarge is returned by Setxattr for a value larger than the configured limit.
+	ErrXattrTooLarge = errors.New("Extended attribute value too large")
+)
+
+// xattrKey returns the key of the attribute called name of the entry with the given entryID.
+func xattrKey(s *sealer, entryID nugget.EntryID, name string) []byte {
+	key := append([]byte{}, entryID[:]...)
+	if s == nil {
+		return append(key, name...)
+	}
+	return append(key, s.keyForPath(name)...)
+}
+
+// decodeXattr returns the name and value held in an xattr record.
+func decodeXattr(s *sealer, k, v []byte) (string, []byte, error) {
+	if s == nil {
+		return string(k[len(nugget.EntryID{}):]), v, nil
+	}
+	v, err := s.open(v, k)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(v) < 1 || len(v) < 1+int(v[0]) {
+		return "", nil, ErrSealCorrupt
+	}
+	return string(v[1 : 1+int(v[0])]), v[1+int(v[0]):], nil
+}
+
+// deleteXattrs removes every attribute of the entry with the given entryID.
+func deleteXattrs(tx *bolt.Tx, entryID nugget.EntryID) error {
+	c := tx.Bucket([]byte(xattrBucket)).Cursor()
+	for k, _ := c.Seek(entryID[:]); k != nil && bytes.HasPrefix(k, entryID[:]); k, _ = c.Seek(entryID[:]) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putXattr stores the attribute called name of the entry with the given entryID.
+func (p *Provider) putXattr(tx *bolt.Tx, entryID nugget.EntryID, name string, value []byte) error {
+	key := xattrKey(p.sealer, entryID, name)
+	v := value
+	if p.sealer != nil {
+		v = p.sealer.seal(append(append([]byte{byte(len(name))}, name...), value...), key)
+	}
+	return tx.Bucket([]byte(xattrBucket)).Put(key, v)
+}
+
+// Getxattr returns the value of the extended attribute called name of the entry at fPath.
+// ErrXattrNotFound is returned if the attribute does not exist.
+func (p *Provider) Getxattr(fPath, name string) ([]byte, error) {
+	var value []byte
+	err := p.db.View(func(tx *bolt.Tx) error {
+		eID, err := p.pathstore.lookup(tx, fPath)
+		if err != nil {
+			return err
+		}
+		key := xattrKey(p.sealer, eID, name)
+		v := tx.Bucket([]byte(xattrBucket)).Get(key)
+		if v == nil {
+			return ErrXattrNotFound
+		}
+		_, v, err = decodeXattr(p.sealer, key, v)
+		value = append([]byte{}, v...)
+		return err
+	})
+	return value, err
+}
+
+// Listxattr returns the names of the extended attributes of the entry at fPath, in key order.
+func (p *Provider) Listxattr(fPath string) ([]string, error) {
+	var names []string
+	err := p.db.View(func(tx *bolt.Tx) error {
+		eID, err := p.pathstore.lookup(tx, fPath)
+		if err != nil {
+			return err
+		}
+		c := tx.Bucket([]byte(xattrBucket)).Cursor()
+		for k, v := c.Seek(eID[:]); k != nil && bytes.HasPrefix(k, eID[:]); k, v = c.Next() {
+			name, _, err := decodeXattr(p.sealer, k, v)
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Setxattr sets the extended attribute called name of the entry at fPath to value. flags is a
+// combination of XattrCreate and XattrReplace. ErrXattrTooLarge is returned if value is larger than
+// the configured limit, and ErrNameTooLong if name is longer than MaxXattrNameLen.
+func (p *Provider) Setxattr(fPath, name string, value []byte, flags uint32) error {
+	if len(name) == 0 || len(name) > MaxXattrNameLen {
+		return ErrNameTooLong
+	}
+	if len(value) > p.maxXattrSize {
+		return ErrXattrTooLarge
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		eID, meta, err := p.lookupTx(tx, fPath)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(xattrBucket))
+		key := xattrKey(p.sealer, eID, name)
+		exists := b.Get(key) != nil
+		if exists && flags&XattrCreate != 0 {
+			return ErrXattrExists
+		}
+		if !exists && flags&XattrReplace != 0 {
+			return ErrXattrNotFound
+		}
+
+		if err = p.putXattr(tx, eID, name, value); err != nil {
+			return err
+		}
+		meta.Ctime = time.Now()
+		return p.metastore.commit(tx, meta)
+	})
+}
+
+// Removexattr removes the extended attribute called name of the entry at fPath. ErrXattrNotFound
+// is returned if the attribute does not exist.
+func (p *Provider) Removexattr(fPath, name string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		eID, meta, err := p.lookupTx(tx, fPath)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(xattrBucket))
+		key := xattrKey(p.sealer, eID, name)
+		if b.Get(key) == nil {
+			return ErrXattrNotFound
+		}
+		if err = b.Delete(key); err != nil {
+			return err
+		}
+		meta.Ctime = time.Now()
+		return p.metastore.commit(tx, meta)
+	})
+}
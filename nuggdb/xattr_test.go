@@ -0,0 +1,100 @@
+package nuggdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/twitchyliquid64/nugget"
+)
+
+func TestProviderXattrs(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		baseDir, err := ioutil.TempDir("", "nuggdb_xattr_test")
+		if err != nil {
+			t.Fatal("Setup error:", err)
+		}
+		defer os.RemoveAll(baseDir)
+		dataDir := path.Join(baseDir, "data")
+		os.Mkdir(dataDir, 0755)
+		opts := Options{MaxXattrSize: 8}
+		if encrypted {
+			opts.KeyFile = path.Join(baseDir, "key")
+			ioutil.WriteFile(opts.KeyFile, bytes.Repeat([]byte{1}, KeySize), 0600)
+		}
+
+		p, err := CreateWithOptions(dataDir, emptyLogger(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+
+		p.Mkdir("/dir", nugget.NodeAttributes{Mode: 0755})
+		p.Store("/dir/file", []byte("data"))
+		if err = p.Setxattr("/dir/file", "user.b", []byte("two"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Setxattr("/dir/file", "user.a", []byte("one"), XattrCreate); err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Setxattr("/dir", "user.a", []byte("dir"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Setxattr("/dir/file", "user.a", []byte("again"), XattrCreate); err != ErrXattrExists {
+			t.Error("Expected ErrXattrExists, got", err)
+		}
+		if err = p.Setxattr("/dir/file", "user.c", []byte("new"), XattrReplace); err != ErrXattrNotFound {
+			t.Error("Expected ErrXattrNotFound, got", err)
+		}
+		if err = p.Setxattr("/dir/file", "user.c", []byte("too large"), 0); err != ErrXattrTooLarge {
+			t.Error("Expected ErrXattrTooLarge, got", err)
+		}
+		if err = p.Setxattr("/missing", "user.a", nil, 0); err != ErrPathNotFound {
+			t.Error("Expected ErrPathNotFound, got", err)
+		}
+
+		if v, err := p.Getxattr("/dir/file", "user.a"); err != nil || string(v) != "one" {
+			t.Errorf("Expected %q, got %q (%v)", "one", v, err)
+		}
+		if v, err := p.Getxattr("/dir", "user.a"); err != nil || string(v) != "dir" {
+			t.Errorf("Expected %q, got %q (%v)", "dir", v, err)
+		}
+		if _, err = p.Getxattr("/dir/file", "user.c"); err != ErrXattrNotFound {
+			t.Error("Expected ErrXattrNotFound, got", err)
+		}
+		names, err := p.Listxattr("/dir/file")
+		if err != nil || len(names) != 2 {
+			t.Error("Expected two attributes, got", names, err)
+		}
+
+		// attributes follow the entry through links, renames and overwrites
+		p.Link("/dir/file", "/other")
+		p.Rename("/dir/file", "/dir/renamed")
+		p.Delete("/other")
+		p.Store("/dir/renamed", []byte("new data"))
+		if v, err := p.Getxattr("/dir/renamed", "user.b"); err != nil || string(v) != "two" {
+			t.Errorf("Expected %q, got %q (%v)", "two", v, err)
+		}
+
+		if err = p.Removexattr("/dir/renamed", "user.b"); err != nil {
+			t.Error(err)
+		}
+		if err = p.Removexattr("/dir/renamed", "user.b"); err != ErrXattrNotFound {
+			t.Error("Expected ErrXattrNotFound, got", err)
+		}
+		if names, err = p.Listxattr("/dir/renamed"); err != nil || len(names) != 1 || names[0] != "user.a" {
+			t.Error("Expected only user.a to remain, got", names, err)
+		}
+
+		p.Delete("/dir/renamed")
+		p.db.View(func(tx *bolt.Tx) error {
+			if n := tx.Bucket([]byte(xattrBucket)).Stats().KeyN; n != 1 {
+				t.Error("Expected attributes to be removed with their entry, got", n, "remaining")
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// nuggfsck checks a nuggdb data directory for inconsistencies, optionally repairing them.
+// The data directory must not be in use by nugglocal or nuggserv.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/twitchyliquid64/nugget/logger"
+	"github.com/twitchyliquid64/nugget/nuggdb"
+)
+
+// Exit codes, following fsck(8).
+const (
+	exitClean       = 0
+	exitRepaired    = 1
+	exitUncorrected = 4
+	exitOperational = 8
+)
+
+var repairVar bool
+var keyFileVar string
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [--repair] [--key-file <path>] <path-to-data-dir>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func flags() {
+	flag.BoolVar(&repairVar, "repair", false, "Fix problems where possible, quarantining anything which cannot be fixed")
+	flag.StringVar(&keyFileVar, "key-file", "", "Path to the key the data directory is encrypted with")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(exitOperational)
+	}
+}
+
+func main() {
+	flags()
+	l := logger.New(os.Stdout, os.Stderr)
+
+	checker, err := nuggdb.OpenChecker(flag.Arg(0), l, keyFileVar)
+	if err != nil {
+		l.Error("fsck", "Could not open data directory (is it in use?): ", err)
+		os.Exit(exitOperational)
+	}
+
+	var problems []nuggdb.Problem
+	if repairVar {
+		problems, err = checker.Repair()
+	} else {
+		problems, err = checker.Check()
+	}
+	checker.Close()
+
+	unresolved := 0
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if problem.Action == "" {
+			unresolved++
+		}
+	}
+	if err != nil {
+		l.Error("fsck", "Check failed: ", err)
+		os.Exit(exitOperational)
+	}
+	fmt.Printf("%d problems found, %d unresolved\n", len(problems), unresolved)
+
+	switch {
+	case len(problems) == 0:
+		os.Exit(exitClean)
+	case unresolved > 0:
+		os.Exit(exitUncorrected)
+	default:
+		os.Exit(exitRepaired)
+	}
+}
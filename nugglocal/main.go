@@ -6,7 +6,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -18,6 +20,15 @@ import (
 	"github.com/twitchyliquid64/nugget/sysstatfs"
 )
 
+var gcIntervalVar time.Duration
+var gcGraceVar time.Duration
+var contentAddressedVar bool
+var compressionVar string
+var keyFileVar string
+var maxXattrSizeVar int
+var dirQuotasVar nuggdb.QuotaFlag
+var codec nuggdb.Codec
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s <path-to-mountpoint> <path-to-data-dir>\n", os.Args[0])
@@ -25,6 +36,13 @@ func usage() {
 }
 
 func flags() {
+	flag.DurationVar(&gcIntervalVar, "gc-interval", nuggdb.DefaultGCInterval, "How often to remove unreferenced chunks and metadata, 0 disables garbage collection")
+	flag.DurationVar(&gcGraceVar, "gc-grace", nuggdb.DefaultGCGracePeriod, "How old unreferenced chunks and metadata must be before they are removed")
+	flag.BoolVar(&contentAddressedVar, "content-addressed", false, "Store identical chunks once, deriving chunk IDs from their contents. Stays enabled for the data directory once set")
+	flag.StringVar(&compressionVar, "compression", "none", "Codec to compress newly written chunks with: none, gzip or flate")
+	flag.StringVar(&keyFileVar, "key-file", "", "Path to a file holding a 32 byte key to encrypt the data directory with. Encryption can only be enabled for an empty data directory, and the key is required from then on")
+	flag.IntVar(&maxXattrSizeVar, "max-xattr-size", nuggdb.DefaultMaxXattrSize, "Largest extended attribute value, in bytes, which may be stored")
+	flag.Var(&dirQuotasVar, "dir-quota", "Limit the bytes and entries beneath a directory, formatted <path>:<bytes>[:<entries>]. May be repeated. Quotas are kept in the data directory, a quota of 0 removes one")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -32,6 +50,11 @@ func flags() {
 		usage()
 		os.Exit(2)
 	}
+	var err error
+	if codec, err = nuggdb.ParseCodec(compressionVar); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --compression %q: %v\n", compressionVar, err)
+		os.Exit(2)
+	}
 }
 
 func main() {
@@ -50,13 +73,23 @@ func doMount(l *logger.Logger) (*fuse.Conn, nugget.DataSourceSink, chan error) {
 	inodeSource := inodeFactory.MakePathAwareFactory()
 
 	//Initialize the filesystem backend
-	provider, err := nuggdb.Create(flag.Arg(1), l)
+	provider, err := nuggdb.CreateWithOptions(flag.Arg(1), l, nuggdb.Options{ContentAddressed: contentAddressedVar, Codec: codec, KeyFile: keyFileVar, MaxXattrSize: maxXattrSizeVar})
 	if err != nil {
 		log.Fatal("FS init failure: ", err)
 	}
+	for _, spec := range dirQuotasVar {
+		dirPath, q, _ := nuggdb.ParseQuota(spec)
+		if err = provider.SetDirQuota(dirPath, q); err != nil {
+			log.Fatal("Quota failure for ", dirPath, ": ", err)
+		}
+	}
+	if gcIntervalVar > 0 {
+		provider.StartGC(gcIntervalVar, gcGraceVar)
+	}
 	mainFS := nuggtofuse.Make(provider, inodeSource, l)
 
 	sysFS := sysstatfs.Make(inodeSource)
+	setGCVariables(sysFS, provider)
 	mainFS.SetOverride("sys", sysFS)
 
 	//Create the mount
@@ -76,6 +109,33 @@ func doMount(l *logger.Logger) (*fuse.Conn, nugget.DataSourceSink, chan error) {
 	return c, provider, fatalErrorChan
 }
 
+// setGCVariables exposes the stats of the most recent garbage collection in sysFS.
+func setGCVariables(sysFS *sysstatfs.FS, provider *nuggdb.Provider) {
+	gcStat := func(name string, value func(stats nuggdb.GCStats) string) {
+		sysFS.SetComputedVariable(name, func() []byte {
+			stats, ok := provider.LastGCStats()
+			if !ok {
+				return []byte{}
+			}
+			return []byte(value(stats))
+		})
+	}
+	gcStat("gc_last_run", func(stats nuggdb.GCStats) string { return stats.Started.String() })
+	gcStat("gc_duration_ms", func(stats nuggdb.GCStats) string {
+		return strconv.FormatInt(int64(stats.Duration/time.Millisecond), 10)
+	})
+	gcStat("gc_chunks_scanned", func(stats nuggdb.GCStats) string { return strconv.Itoa(stats.ChunksScanned) })
+	gcStat("gc_chunks_removed", func(stats nuggdb.GCStats) string { return strconv.Itoa(stats.ChunksRemoved) })
+	gcStat("gc_bytes_removed", func(stats nuggdb.GCStats) string { return strconv.FormatInt(stats.BytesRemoved, 10) })
+	gcStat("gc_meta_removed", func(stats nuggdb.GCStats) string { return strconv.Itoa(stats.MetaRemoved) })
+	gcStat("gc_error", func(stats nuggdb.GCStats) string {
+		if stats.Err == nil {
+			return ""
+		}
+		return stats.Err.Error()
+	})
+}
+
 func fsServeRoutine(c *fuse.Conn, fatalError chan error, fsBackend fs.FS) {
 	err := fs.Serve(c, fsBackend)
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/twitchyliquid64/nugget/logger"
 	"github.com/twitchyliquid64/nugget/nuggdb"
@@ -18,6 +19,16 @@ var listenerAddrVar string
 var caCertPemPathVar string
 var certPemPathVar string
 var keyPemPathVar string
+var gcIntervalVar time.Duration
+var gcGraceVar time.Duration
+var contentAddressedVar bool
+var compressionVar string
+var keyFileVar string
+var maxXattrSizeVar int
+var dirQuotasVar nuggdb.QuotaFlag
+var clientQuotasVar nuggdb.QuotaFlag
+var workersVar int
+var codec nuggdb.Codec
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -30,6 +41,15 @@ func flags() {
 	flag.StringVar(&caCertPemPathVar, "cacert", "ca.pem", "Path to the PEM-formatted authority certificate")
 	flag.StringVar(&certPemPathVar, "cert", "cert.pem", "Path to the PEM-formatted server certificate")
 	flag.StringVar(&keyPemPathVar, "key", "key.pem", "Path to the PEM-formatted server key")
+	flag.DurationVar(&gcIntervalVar, "gc-interval", nuggdb.DefaultGCInterval, "How often to remove unreferenced chunks and metadata, 0 disables garbage collection")
+	flag.DurationVar(&gcGraceVar, "gc-grace", nuggdb.DefaultGCGracePeriod, "How old unreferenced chunks and metadata must be before they are removed")
+	flag.BoolVar(&contentAddressedVar, "content-addressed", false, "Store identical chunks once, deriving chunk IDs from their contents. Stays enabled for the data directory once set")
+	flag.StringVar(&compressionVar, "compression", "none", "Codec to compress newly written chunks with: none, gzip or flate")
+	flag.StringVar(&keyFileVar, "key-file", "", "Path to a file holding a 32 byte key to encrypt the data directory with. Encryption can only be enabled for an empty data directory, and the key is required from then on")
+	flag.IntVar(&maxXattrSizeVar, "max-xattr-size", nuggdb.DefaultMaxXattrSize, "Largest extended attribute value, in bytes, which may be stored")
+	flag.Var(&dirQuotasVar, "dir-quota", "Limit the bytes and entries beneath a directory, formatted <path>:<bytes>[:<entries>]. May be repeated. Quotas are kept in the data directory, a quota of 0 removes one")
+	flag.Var(&clientQuotasVar, "client-quota", "Limit the bytes and entries created by the client with the given certificate common name, formatted <name>:<bytes>[:<entries>]. May be repeated. Quotas are kept in the data directory, a quota of 0 removes one")
+	flag.IntVar(&workersVar, "workers", serv.DefaultWorkers, "How many requests from each client are processed at once")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -37,6 +57,11 @@ func flags() {
 		usage()
 		os.Exit(1)
 	}
+	var err error
+	if codec, err = nuggdb.ParseCodec(compressionVar); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --compression %q: %v\n", compressionVar, err)
+		os.Exit(1)
+	}
 }
 
 func main() {
@@ -45,15 +70,22 @@ func main() {
 	l := logger.New(os.Stdout, os.Stderr)
 
 	// open our backing data stores
-	provider, err := nuggdb.Create(flag.Arg(0), l)
+	provider, err := nuggdb.CreateWithOptions(flag.Arg(0), l, nuggdb.Options{ContentAddressed: contentAddressedVar, Codec: codec, KeyFile: keyFileVar, MaxXattrSize: maxXattrSizeVar})
 	if err != nil {
 		l.Error("server", "Error initializing data storage: ", err)
 		os.Exit(1)
 	}
 	defer provider.Close()
+	if err = setQuotas(provider); err != nil {
+		l.Error("server", "Error setting quotas: ", err)
+		os.Exit(1)
+	}
+	if gcIntervalVar > 0 {
+		provider.StartGC(gcIntervalVar, gcGraceVar)
+	}
 
 	// open the network
-	s, err := serv.NewServer(listenerAddrVar, certPemPathVar, keyPemPathVar, caCertPemPathVar, provider, l)
+	s, err := serv.NewServer(listenerAddrVar, certPemPathVar, keyPemPathVar, caCertPemPathVar, provider, workersVar, l)
 	if err != nil {
 		l.Error("server", "Error initializing network: ", err)
 		os.Exit(1)
@@ -66,6 +98,22 @@ func main() {
 	waitInterrupt(fatalErrChan, l)
 }
 
+func setQuotas(provider *nuggdb.Provider) error {
+	for _, spec := range dirQuotasVar {
+		dirPath, q, _ := nuggdb.ParseQuota(spec)
+		if err := provider.SetDirQuota(dirPath, q); err != nil {
+			return fmt.Errorf("%s: %v", dirPath, err)
+		}
+	}
+	for _, spec := range clientQuotasVar {
+		client, q, _ := nuggdb.ParseQuota(spec)
+		if err := provider.SetClientQuota(client, q); err != nil {
+			return fmt.Errorf("%s: %v", client, err)
+		}
+	}
+	return nil
+}
+
 func checkCertFiles() {
 	if !fileExists(caCertPemPathVar) {
 		fmt.Fprintf(os.Stderr, "Err: Could not stat '%s'\n", caCertPemPathVar)
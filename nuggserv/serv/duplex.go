@@ -2,6 +2,7 @@ package serv
 
 import (
 	"net"
+	"sync"
 
 	"github.com/twitchyliquid64/nugget"
 	"github.com/twitchyliquid64/nugget/nuggdb"
@@ -13,11 +14,27 @@ import (
 type Duplex struct {
 	Conn    net.Conn
 	Manager *Manager
+
+	// serves the requests of the client, charging the entries it creates to the client
+	provider nugget.DataSourceSink
+	// processes requests concurrently, once decoded by ClientReadLoop
+	work *workQueue
+
+	streamLock sync.Mutex
+	streams    map[uint64]*stream
 }
 
 // ClientReadLoop is the routine responsible for recieving and decoding packets
 // from the remote end.
 func (c *Duplex) ClientReadLoop() {
+	client := clientName(c.Conn)
+	c.Manager.logger.Info("client-read", "Client connected: ", client)
+	c.provider = c.Manager.providerFor(client)
+
+	c.work = newWorkQueue(c.Manager.workers, c.fail)
+	defer c.work.wait()
+	defer c.closeStreams()
+
 	trans := packet.MakeTransiever(c.Conn, c.Conn)
 	for {
 		pktType, err := trans.Decode()
@@ -28,6 +45,8 @@ func (c *Duplex) ClientReadLoop() {
 
 		var processingError error
 		switch pktType {
+		case packet.PktHello:
+			processingError = c.processHelloPkt(trans)
 		case packet.PktPing:
 			processingError = c.processPingPkt(trans)
 		case packet.PktLookup:
@@ -36,6 +55,22 @@ func (c *Duplex) ClientReadLoop() {
 			processingError = c.processReadMetaPkt(trans)
 		case packet.PktList:
 			processingError = c.processListPkt(trans)
+		case packet.PktListPage:
+			processingError = c.processListPagePkt(trans)
+		case packet.PktSymlink:
+			processingError = c.processSymlinkPkt(trans)
+		case packet.PktReadlink:
+			processingError = c.processReadlinkPkt(trans)
+		case packet.PktLink:
+			processingError = c.processLinkPkt(trans)
+		case packet.PktGetxattr:
+			processingError = c.processGetxattrPkt(trans)
+		case packet.PktListxattr:
+			processingError = c.processListxattrPkt(trans)
+		case packet.PktSetxattr:
+			processingError = c.processSetxattrPkt(trans)
+		case packet.PktRemovexattr:
+			processingError = c.processRemovexattrPkt(trans)
 		case packet.PktFetch:
 			processingError = c.processFetchPkt(trans)
 		case packet.PktReadData:
@@ -46,12 +81,42 @@ func (c *Duplex) ClientReadLoop() {
 			processingError = c.processMkdirPkt(trans)
 		case packet.PktDelete:
 			processingError = c.processDeletePkt(trans)
+		case packet.PktRemoveAll:
+			processingError = c.processRemoveAllPkt(trans)
+		case packet.PktStatfs:
+			processingError = c.processStatfsPkt(trans)
 		case packet.PktWrite:
 			processingError = c.processWritePkt(trans)
 		case packet.PktRead:
 			processingError = c.processReadPkt(trans)
+		case packet.PktCreate:
+			processingError = c.processCreatePkt(trans)
+		case packet.PktSetattr:
+			processingError = c.processSetattrPkt(trans)
+		case packet.PktRename:
+			processingError = c.processRenamePkt(trans)
+		case packet.PktFetchStream:
+			processingError = c.processFetchStreamPkt(trans)
+		case packet.PktStoreStream:
+			processingError = c.processStoreStreamPkt(trans)
+		case packet.PktStreamData:
+			processingError = c.processStreamDataPkt(trans)
+		case packet.PktStreamAck:
+			processingError = c.processStreamAckPkt(trans)
+		default:
+			c.Manager.logger.Warning("client-read", "Discarding packet of unknown type ", pktType)
+			processingError = c.rejectPkt(trans, pktType)
 		}
 
+		// A request which could not be decoded from its frame fails on its own, leaving the
+		// connection usable. StreamAcks have no response, and are dropped.
+		if frameErr, ok := processingError.(*packet.FrameError); ok {
+			c.Manager.logger.Warning("client-read", frameErr)
+			processingError = nil
+			if frameErr.Type != packet.PktStreamAck {
+				processingError = trans.WriteErrorResp(frameErr.Type+1, frameErr.ID, packet.ErrInvalid)
+			}
+		}
 		if processingError != nil {
 			c.Manager.logger.Error("client-read", processingError)
 			return
@@ -59,6 +124,12 @@ func (c *Duplex) ClientReadLoop() {
 	}
 }
 
+// fail is called when a response could not be written, closing the connection so ClientReadLoop stops.
+func (c *Duplex) fail(err error) {
+	c.Manager.logger.Error("client-write", err)
+	c.Conn.Close()
+}
+
 func (c *Duplex) processReadPkt(trans *packet.Transiever) error {
 	var readRequest packet.ReadReq
 	err := trans.GetReadReq(&readRequest)
@@ -67,42 +138,39 @@ func (c *Duplex) processReadPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Read request for ", readRequest.Path)
 
-	var readResponse packet.ReadResp
-	readResponse.ID = readRequest.ID
-
-	if c.Manager.isOptimisedProvider {
-		p := c.Manager.provider.(nugget.OptimisedDataSourceSink)
-		data, err := p.Read(readRequest.Path, readRequest.Offset, readRequest.Size)
-		if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-			readResponse.ErrorCode = packet.ErrNoEntity
-		} else if err != nil {
-			c.Manager.logger.Warning("client-read", "Read() error: ", err)
-			readResponse.ErrorCode = packet.ErrUnspec
-		}
-		readResponse.Data = data
+	c.work.read([]string{readRequest.Path}, func() error {
+		var readResponse packet.ReadResp
+		readResponse.ID = readRequest.ID
 
-	} else {
-		c.Manager.logger.Warning("client-read", "Provider is not optimized - falling back to Fetch/slice strategy.")
-		_, _, data, err := c.Manager.provider.Fetch(readRequest.Path)
-		if err != nil {
-			if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-				readResponse.ErrorCode = packet.ErrNoEntity
-			} else {
-				readResponse.ErrorCode = packet.ErrUnspec
+		if c.Manager.isOptimisedProvider {
+			p := c.provider.(nugget.OptimisedDataSourceSink)
+			data, err := p.Read(readRequest.Path, readRequest.Offset, readRequest.Size)
+			if err != nil && packet.ErrToErrorCode(err) == packet.ErrUnspec {
+				c.Manager.logger.Warning("client-read", "Read() error: ", err)
 			}
+			readResponse.ErrorCode = packet.ErrToErrorCode(err)
+			readResponse.Data = data
+
 		} else {
-			if readRequest.Offset > int64(len(data)) {
-				data = nil
+			c.Manager.logger.Warning("client-read", "Provider is not optimized - falling back to Fetch/slice strategy.")
+			_, _, data, err := c.provider.Fetch(readRequest.Path)
+			if err != nil {
+				readResponse.ErrorCode = packet.ErrToErrorCode(err)
 			} else {
-				data = data[readRequest.Offset:]
-			}
-			if int64(len(data)) > readRequest.Size {
-				data = data[:readRequest.Size]
+				if readRequest.Offset > int64(len(data)) {
+					data = nil
+				} else {
+					data = data[readRequest.Offset:]
+				}
+				if int64(len(data)) > readRequest.Size {
+					data = data[:readRequest.Size]
+				}
+				readResponse.Data = data
 			}
-			readResponse.Data = data
 		}
-	}
-	return trans.WriteReadResp(&readResponse)
+		return trans.WriteReadResp(&readResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processWritePkt(trans *packet.Transiever) error {
@@ -113,50 +181,41 @@ func (c *Duplex) processWritePkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Write request for ", writeRequest.Path)
 
-	var writeResponse packet.WriteResp
-	writeResponse.ID = writeRequest.ID
+	c.work.write([]string{writeRequest.Path}, func() error {
+		var writeResponse packet.WriteResp
+		writeResponse.ID = writeRequest.ID
 
-	if c.Manager.isOptimisedProvider {
-		p := c.Manager.provider.(nugget.OptimisedDataSourceSink)
-		written, entryID, meta, err := p.Write(writeRequest.Path, writeRequest.Offset, writeRequest.Data)
+		if c.Manager.isOptimisedProvider {
+			p := c.provider.(nugget.OptimisedDataSourceSink)
+			written, entryID, meta, err := p.Write(writeRequest.Path, writeRequest.Offset, writeRequest.Data)
 
-		writeResponse.Written = written
-		writeResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
-		writeResponse.EntryID = entryID
-		if err != nil {
-			if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-				writeResponse.ErrorCode = packet.ErrNoEntity
-			} else {
-				writeResponse.ErrorCode = packet.ErrUnspec
+			writeResponse.Written = written
+			if meta != nil {
+				writeResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
 			}
-		}
+			writeResponse.EntryID = entryID
+			writeResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	} else {
-		c.Manager.logger.Warning("client-read", "Provider is not optimized - falling back to Fetch/Write.")
-		_, _, data, err := c.Manager.provider.Fetch(writeRequest.Path)
-		if err != nil {
-			if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-				writeResponse.ErrorCode = packet.ErrNoEntity
-			} else {
-				writeResponse.ErrorCode = packet.ErrUnspec
-			}
 		} else {
-			newData := doWrite(writeRequest.Offset, writeRequest.Data, data)
-			entryID, meta, err := c.Manager.provider.Store(writeRequest.Path, newData)
-			writeResponse.Written = int64(len(writeRequest.Data))
-			writeResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
-			writeResponse.EntryID = entryID
+			c.Manager.logger.Warning("client-read", "Provider is not optimized - falling back to Fetch/Write.")
+			_, _, data, err := c.provider.Fetch(writeRequest.Path)
 			if err != nil {
-				if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-					writeResponse.ErrorCode = packet.ErrNoEntity
-				} else {
-					writeResponse.ErrorCode = packet.ErrUnspec
+				writeResponse.ErrorCode = packet.ErrToErrorCode(err)
+			} else {
+				newData := doWrite(writeRequest.Offset, writeRequest.Data, data)
+				entryID, meta, err := c.provider.Store(writeRequest.Path, newData)
+				writeResponse.Written = int64(len(writeRequest.Data))
+				if meta != nil {
+					writeResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
 				}
+				writeResponse.EntryID = entryID
+				writeResponse.ErrorCode = packet.ErrToErrorCode(err)
 			}
 		}
-	}
 
-	return trans.WriteWriteResp(&writeResponse)
+		return trans.WriteWriteResp(&writeResponse)
+	})
+	return nil
 }
 
 // doWrite does the buffer manipulation to perform a write. Data buffers are kept
@@ -188,18 +247,61 @@ func (c *Duplex) processDeletePkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Delete request for ", deleteRequest.Path)
 
-	var deleteResponse packet.DeleteResp
-	deleteResponse.ID = deleteRequest.ID
-	err = c.Manager.provider.Delete(deleteRequest.Path)
+	c.work.write([]string{deleteRequest.Path}, func() error {
+		var deleteResponse packet.DeleteResp
+		deleteResponse.ID = deleteRequest.ID
+		err := c.provider.Delete(deleteRequest.Path)
+		deleteResponse.ErrorCode = packet.ErrToErrorCode(err)
+
+		return trans.WriteDeleteResp(&deleteResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processRemoveAllPkt(trans *packet.Transiever) error {
+	var removeAllRequest packet.RemoveAllReq
+	err := trans.GetRemoveAllReq(&removeAllRequest)
 	if err != nil {
-		if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-			deleteResponse.ErrorCode = packet.ErrNoEntity
-		} else {
-			deleteResponse.ErrorCode = packet.ErrUnspec
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got RemoveAll request for ", removeAllRequest.Path)
+
+	c.work.write([]string{removeAllRequest.Path}, func() error {
+		var removeAllResponse packet.RemoveAllResp
+		removeAllResponse.ID = removeAllRequest.ID
+
+		p, ok := c.provider.(nugget.RemoveAllDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support RemoveAll.")
+			removeAllResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteRemoveAllResp(&removeAllResponse)
 		}
+
+		err := p.RemoveAll(removeAllRequest.Path)
+		removeAllResponse.ErrorCode = packet.ErrToErrorCode(err)
+
+		return trans.WriteRemoveAllResp(&removeAllResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processRenamePkt(trans *packet.Transiever) error {
+	var renameRequest packet.RenameReq
+	err := trans.GetRenameReq(&renameRequest)
+	if err != nil {
+		return err
 	}
+	c.Manager.logger.Info("client-read", "Got Rename request for ", renameRequest.OldPath, " -> ", renameRequest.NewPath)
+
+	c.work.write([]string{renameRequest.OldPath, renameRequest.NewPath}, func() error {
+		var renameResponse packet.RenameResp
+		renameResponse.ID = renameRequest.ID
+		err := c.provider.Rename(renameRequest.OldPath, renameRequest.NewPath)
+		renameResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	return trans.WriteDeleteResp(&deleteResponse)
+		return trans.WriteRenameResp(&renameResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processMkdirPkt(trans *packet.Transiever) error {
@@ -210,20 +312,366 @@ func (c *Duplex) processMkdirPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Mkdir request for ", mkdirRequest.Path)
 
-	var mkdirResponse packet.MkdirResp
-	mkdirResponse.ID = mkdirRequest.ID
-	entryID, meta, err := c.Manager.provider.Mkdir(mkdirRequest.Path)
-	mkdirResponse.EntryID = entryID
-	mkdirResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+	c.work.write([]string{mkdirRequest.Path}, func() error {
+		var mkdirResponse packet.MkdirResp
+		mkdirResponse.ID = mkdirRequest.ID
+		entryID, meta, err := c.provider.Mkdir(mkdirRequest.Path, mkdirRequest.Attr)
+		mkdirResponse.EntryID = entryID
+		if meta != nil {
+			mkdirResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		mkdirResponse.ErrorCode = packet.ErrToErrorCode(err)
+
+		return trans.WriteMkdirResp(&mkdirResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processSetattrPkt(trans *packet.Transiever) error {
+	var setattrRequest packet.SetattrReq
+	err := trans.GetSetattrReq(&setattrRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Setattr request for ", setattrRequest.Path)
+
+	c.work.write([]string{setattrRequest.Path}, func() error {
+		var setattrResponse packet.SetattrResp
+		setattrResponse.ID = setattrRequest.ID
+
+		p, ok := c.provider.(nugget.SetattrDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Setattr.")
+			setattrResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteSetattrResp(&setattrResponse)
+		}
+
+		entryID, meta, err := p.Setattr(setattrRequest.Path, setattrRequest.Changes)
+		setattrResponse.EntryID = entryID
+		if meta != nil {
+			setattrResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		setattrResponse.ErrorCode = packet.ErrToErrorCode(err)
+
+		return trans.WriteSetattrResp(&setattrResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processSymlinkPkt(trans *packet.Transiever) error {
+	var symlinkRequest packet.SymlinkReq
+	err := trans.GetSymlinkReq(&symlinkRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Symlink request for ", symlinkRequest.Path)
+
+	c.work.write([]string{symlinkRequest.Path}, func() error {
+		var symlinkResponse packet.SymlinkResp
+		symlinkResponse.ID = symlinkRequest.ID
+
+		p, ok := c.provider.(nugget.SymlinkDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Symlink.")
+			symlinkResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteSymlinkResp(&symlinkResponse)
+		}
+
+		entryID, meta, err := p.Symlink(symlinkRequest.Path, symlinkRequest.Target, symlinkRequest.Attr)
+		symlinkResponse.EntryID = entryID
+		if meta != nil {
+			symlinkResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		symlinkResponse.ErrorCode = packet.ErrToErrorCode(err)
+
+		return trans.WriteSymlinkResp(&symlinkResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processReadlinkPkt(trans *packet.Transiever) error {
+	var readlinkRequest packet.ReadlinkReq
+	err := trans.GetReadlinkReq(&readlinkRequest)
 	if err != nil {
-		if err == nuggdb.ErrChunkNotFound || err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-			mkdirResponse.ErrorCode = packet.ErrNoEntity
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Readlink request for ", readlinkRequest.Path)
+
+	c.work.read([]string{readlinkRequest.Path}, func() error {
+		var readlinkResponse packet.ReadlinkResp
+		readlinkResponse.ID = readlinkRequest.ID
+
+		p, ok := c.provider.(nugget.SymlinkDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Readlink.")
+			readlinkResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteReadlinkResp(&readlinkResponse)
+		}
+
+		target, err := p.Readlink(readlinkRequest.Path)
+		if err != nil {
+			readlinkResponse.ErrorCode = packet.ErrToErrorCode(err)
 		} else {
-			mkdirResponse.ErrorCode = packet.ErrUnspec
+			readlinkResponse.Target = target
+		}
+
+		return trans.WriteReadlinkResp(&readlinkResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processLinkPkt(trans *packet.Transiever) error {
+	var linkRequest packet.LinkReq
+	err := trans.GetLinkReq(&linkRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Link request for ", linkRequest.OldPath, " -> ", linkRequest.NewPath)
+
+	c.work.write([]string{linkRequest.OldPath, linkRequest.NewPath}, func() error {
+		var linkResponse packet.LinkResp
+		linkResponse.ID = linkRequest.ID
+
+		p, ok := c.provider.(nugget.LinkDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Link.")
+			linkResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteLinkResp(&linkResponse)
+		}
+
+		entryID, meta, err := p.Link(linkRequest.OldPath, linkRequest.NewPath)
+		linkResponse.EntryID = entryID
+		if meta != nil {
+			linkResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		linkResponse.ErrorCode = packet.ErrToErrorCode(err)
+
+		return trans.WriteLinkResp(&linkResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processGetxattrPkt(trans *packet.Transiever) error {
+	var getxattrRequest packet.GetxattrReq
+	err := trans.GetGetxattrReq(&getxattrRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Getxattr request for ", getxattrRequest.Path, " (", getxattrRequest.Name, ")")
+
+	c.work.read([]string{getxattrRequest.Path}, func() error {
+		var getxattrResponse packet.GetxattrResp
+		getxattrResponse.ID = getxattrRequest.ID
+
+		p, ok := c.provider.(nugget.XattrDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Getxattr.")
+			getxattrResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteGetxattrResp(&getxattrResponse)
+		}
+
+		var err error
+		getxattrResponse.Value, err = p.Getxattr(getxattrRequest.Path, getxattrRequest.Name)
+		getxattrResponse.ErrorCode = packet.ErrToErrorCode(err)
+		return trans.WriteGetxattrResp(&getxattrResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processListxattrPkt(trans *packet.Transiever) error {
+	var listxattrRequest packet.ListxattrReq
+	err := trans.GetListxattrReq(&listxattrRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Listxattr request for ", listxattrRequest.Path)
+
+	c.work.read([]string{listxattrRequest.Path}, func() error {
+		var listxattrResponse packet.ListxattrResp
+		listxattrResponse.ID = listxattrRequest.ID
+
+		p, ok := c.provider.(nugget.XattrDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Listxattr.")
+			listxattrResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteListxattrResp(&listxattrResponse)
+		}
+
+		var err error
+		listxattrResponse.Names, err = p.Listxattr(listxattrRequest.Path)
+		listxattrResponse.ErrorCode = packet.ErrToErrorCode(err)
+		return trans.WriteListxattrResp(&listxattrResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processSetxattrPkt(trans *packet.Transiever) error {
+	var setxattrRequest packet.SetxattrReq
+	err := trans.GetSetxattrReq(&setxattrRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Setxattr request for ", setxattrRequest.Path, " (", setxattrRequest.Name, ")")
+
+	c.work.write([]string{setxattrRequest.Path}, func() error {
+		var setxattrResponse packet.SetxattrResp
+		setxattrResponse.ID = setxattrRequest.ID
+
+		p, ok := c.provider.(nugget.XattrDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Setxattr.")
+			setxattrResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteSetxattrResp(&setxattrResponse)
+		}
+
+		err := p.Setxattr(setxattrRequest.Path, setxattrRequest.Name, setxattrRequest.Value, setxattrRequest.Flags)
+		setxattrResponse.ErrorCode = packet.ErrToErrorCode(err)
+		return trans.WriteSetxattrResp(&setxattrResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processRemovexattrPkt(trans *packet.Transiever) error {
+	var removexattrRequest packet.RemovexattrReq
+	err := trans.GetRemovexattrReq(&removexattrRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Removexattr request for ", removexattrRequest.Path, " (", removexattrRequest.Name, ")")
+
+	c.work.write([]string{removexattrRequest.Path}, func() error {
+		var removexattrResponse packet.RemovexattrResp
+		removexattrResponse.ID = removexattrRequest.ID
+
+		p, ok := c.provider.(nugget.XattrDataSink)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Removexattr.")
+			removexattrResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteRemovexattrResp(&removexattrResponse)
 		}
+
+		err := p.Removexattr(removexattrRequest.Path, removexattrRequest.Name)
+		removexattrResponse.ErrorCode = packet.ErrToErrorCode(err)
+		return trans.WriteRemovexattrResp(&removexattrResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processStatfsPkt(trans *packet.Transiever) error {
+	var statfsRequest packet.StatfsReq
+	err := trans.GetStatfsReq(&statfsRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Statfs request")
+
+	c.work.read(nil, func() error {
+		var statfsResponse packet.StatfsResp
+		statfsResponse.ID = statfsRequest.ID
+
+		p, ok := c.provider.(nugget.StatfsDataSource)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support Statfs.")
+			statfsResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteStatfsResp(&statfsResponse)
+		}
+
+		var err error
+		statfsResponse.Stats, err = p.Statfs()
+		statfsResponse.ErrorCode = packet.ErrToErrorCode(err)
+		return trans.WriteStatfsResp(&statfsResponse)
+	})
+	return nil
+}
+
+// rejectPkt drops a packet of a type which is not understood. When packets are carried in frames, the
+// request is answered with ErrUnsupported, in a packet of the type following its own as every response does.
+func (c *Duplex) rejectPkt(trans *packet.Transiever, pktType packet.PktType) error {
+	if !trans.Framed() {
+		return trans.Discard()
+	}
+	return trans.WriteErrorResp(pktType+1, trans.RequestID(), packet.ErrUnsupported)
+}
+
+func (c *Duplex) processHelloPkt(trans *packet.Transiever) error {
+	var hello packet.Hello
+	err := trans.GetHello(&hello)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got Hello from client speaking version ", hello.Version)
+
+	helloResponse := packet.HelloResp{
+		Version:         packet.ProtocolVersion,
+		Packets:         c.supportedPackets(),
+		MaxMessageSize:  packet.DefaultMaxMessageSize,
+		MaxListPageSize: packet.MaxListPageSize,
+	}
+	if hello.Version < helloResponse.Version {
+		helloResponse.Version = hello.Version
+	}
+	if helloResponse.Version >= packet.FramedVersion {
+		// streams are only carried in frames
+		helloResponse.Packets = append(helloResponse.Packets, packet.PktFetchStream, packet.PktStoreStream, packet.PktStreamData, packet.PktStreamAck)
+	}
+	if err = trans.WriteHelloResp(&helloResponse); err != nil {
+		return err
+	}
+	if helloResponse.Version >= packet.FramedVersion {
+		trans.UseFrames(helloResponse.MaxMessageSize)
+	}
+	return nil
+}
+
+// supportedPackets returns the request packet types handled for the provider of the client. Packets
+// for optional methods the provider does not implement are left out, so the client can avoid them.
+func (c *Duplex) supportedPackets() []packet.PktType {
+	out := append([]packet.PktType{packet.PktHello, packet.PktCreate, packet.PktRename}, packet.LegacyPackets...)
+	if _, ok := c.provider.(nugget.SetattrDataSink); ok {
+		out = append(out, packet.PktSetattr)
+	}
+	if _, ok := c.provider.(nugget.PagedDataSource); ok {
+		out = append(out, packet.PktListPage)
+	}
+	if _, ok := c.provider.(nugget.SymlinkDataSink); ok {
+		out = append(out, packet.PktSymlink, packet.PktReadlink)
+	}
+	if _, ok := c.provider.(nugget.LinkDataSink); ok {
+		out = append(out, packet.PktLink)
+	}
+	if _, ok := c.provider.(nugget.XattrDataSink); ok {
+		out = append(out, packet.PktGetxattr, packet.PktListxattr, packet.PktSetxattr, packet.PktRemovexattr)
+	}
+	if _, ok := c.provider.(nugget.RemoveAllDataSink); ok {
+		out = append(out, packet.PktRemoveAll)
+	}
+	if _, ok := c.provider.(nugget.StatfsDataSource); ok {
+		out = append(out, packet.PktStatfs)
+	}
+	return out
+}
+
+func (c *Duplex) processCreatePkt(trans *packet.Transiever) error {
+	var createRequest packet.CreateReq
+	err := trans.GetCreateReq(&createRequest)
+	if err != nil {
+		return err
 	}
+	c.Manager.logger.Info("client-read", "Got Create request for ", createRequest.Path)
+
+	c.work.write([]string{createRequest.Path}, func() error {
+		var createResponse packet.CreateResp
+		createResponse.ID = createRequest.ID
+		entryID, meta, err := c.provider.Create(createRequest.Path, createRequest.Attr)
+		createResponse.EntryID = entryID
+		if meta != nil {
+			createResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		createResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	return trans.WriteMkdirResp(&mkdirResponse)
+		return trans.WriteCreateResp(&createResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processStorePkt(trans *packet.Transiever) error {
@@ -234,16 +682,19 @@ func (c *Duplex) processStorePkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Store request for ", storeRequest.Path)
 
-	var storeResponse packet.StoreResp
-	storeResponse.ID = storeRequest.ID
-	entryID, meta, err := c.Manager.provider.Store(storeRequest.Path, storeRequest.Data)
-	storeResponse.EntryID = entryID
-	storeResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
-	if err != nil {
-		storeResponse.ErrorCode = packet.ErrUnspec
-	}
+	c.work.write([]string{storeRequest.Path}, func() error {
+		var storeResponse packet.StoreResp
+		storeResponse.ID = storeRequest.ID
+		entryID, meta, err := c.provider.Store(storeRequest.Path, storeRequest.Data)
+		storeResponse.EntryID = entryID
+		if meta != nil {
+			storeResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		storeResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	return trans.WriteStoreResp(&storeResponse)
+		return trans.WriteStoreResp(&storeResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processReadDataPkt(trans *packet.Transiever) error {
@@ -254,19 +705,16 @@ func (c *Duplex) processReadDataPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got ReadData request for ", readDataRequest.ChunkID)
 
-	var readDataResponse packet.ReadDataResp
-	readDataResponse.ID = readDataRequest.ID
-	d, err := c.Manager.provider.ReadData(readDataRequest.ChunkID)
-	readDataResponse.Data = d
-	if err != nil {
-		if err == nuggdb.ErrChunkNotFound {
-			readDataResponse.ErrorCode = packet.ErrNoEntity
-		} else {
-			readDataResponse.ErrorCode = packet.ErrUnspec
-		}
-	}
+	c.work.read(nil, func() error {
+		var readDataResponse packet.ReadDataResp
+		readDataResponse.ID = readDataRequest.ID
+		d, err := c.provider.ReadData(readDataRequest.ChunkID)
+		readDataResponse.Data = d
+		readDataResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	return trans.WriteReadDataResp(&readDataResponse)
+		return trans.WriteReadDataResp(&readDataResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processListPkt(trans *packet.Transiever) error {
@@ -277,24 +725,63 @@ func (c *Duplex) processListPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got List request for ", listRequest.Path)
 
-	var listResponse packet.ListResp
-	listResponse.ID = listRequest.ID
-	entries, err := c.Manager.provider.List(listRequest.Path)
-	if err != nil {
-		if err == nuggdb.ErrPathNotFound {
-			listResponse.ErrorCode = packet.ErrNoEntity
+	c.work.read([]string{listRequest.Path}, func() error {
+		var listResponse packet.ListResp
+		listResponse.ID = listRequest.ID
+		entries, err := c.provider.List(listRequest.Path)
+		if err != nil {
+			listResponse.ErrorCode = packet.ErrToErrorCode(err)
 		} else {
-			listResponse.ErrorCode = packet.ErrUnspec
-		}
-	} else {
-		b := make([]nuggdb.DirEntry, len(entries))
-		for i := range entries {
-			b[i] = *(entries[i].(*nuggdb.DirEntry))
+			b := make([]nuggdb.DirEntry, len(entries))
+			for i := range entries {
+				b[i] = *(entries[i].(*nuggdb.DirEntry))
+			}
+			listResponse.Entries = b
 		}
-		listResponse.Entries = b
+
+		return trans.WriteListResp(&listResponse)
+	})
+	return nil
+}
+
+func (c *Duplex) processListPagePkt(trans *packet.Transiever) error {
+	var listPageRequest packet.ListPageReq
+	err := trans.GetListPageReq(&listPageRequest)
+	if err != nil {
+		return err
 	}
+	c.Manager.logger.Info("client-read", "Got ListPage request for ", listPageRequest.Path)
+
+	c.work.read([]string{listPageRequest.Path}, func() error {
+		var listPageResponse packet.ListPageResp
+		listPageResponse.ID = listPageRequest.ID
 
-	return trans.WriteListResp(&listResponse)
+		p, ok := c.provider.(nugget.PagedDataSource)
+		if !ok {
+			c.Manager.logger.Warning("client-read", "Provider does not support ListPage.")
+			listPageResponse.ErrorCode = packet.ErrUnsupported
+			return trans.WriteListPageResp(&listPageResponse)
+		}
+
+		limit := listPageRequest.Limit
+		if limit <= 0 || limit > packet.MaxListPageSize {
+			limit = packet.MaxListPageSize
+		}
+		entries, next, err := p.ListPage(listPageRequest.Path, listPageRequest.Cursor, limit)
+		if err != nil {
+			listPageResponse.ErrorCode = packet.ErrToErrorCode(err)
+		} else {
+			b := make([]nuggdb.DirEntry, len(entries))
+			for i := range entries {
+				b[i] = *(entries[i].(*nuggdb.DirEntry))
+			}
+			listPageResponse.Entries = b
+			listPageResponse.NextCursor = next
+		}
+
+		return trans.WriteListPageResp(&listPageResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processReadMetaPkt(trans *packet.Transiever) error {
@@ -305,21 +792,20 @@ func (c *Duplex) processReadMetaPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got ReadMeta request for ", readMetaRequest.EntryID)
 
-	var readMetaResponse packet.ReadMetaResp
-	readMetaResponse.ID = readMetaRequest.ID
+	c.work.read(nil, func() error {
+		var readMetaResponse packet.ReadMetaResp
+		readMetaResponse.ID = readMetaRequest.ID
 
-	meta, err := c.Manager.provider.ReadMeta(readMetaRequest.EntryID)
-	if err != nil {
-		if err == nuggdb.ErrMetaNotFound {
-			readMetaResponse.ErrorCode = packet.ErrNoEntity
+		meta, err := c.provider.ReadMeta(readMetaRequest.EntryID)
+		if err != nil {
+			readMetaResponse.ErrorCode = packet.ErrToErrorCode(err)
 		} else {
-			readMetaResponse.ErrorCode = packet.ErrUnspec
+			readMetaResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
 		}
-	} else {
-		readMetaResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
-	}
 
-	return trans.WriteReadMetaResp(&readMetaResponse)
+		return trans.WriteReadMetaResp(&readMetaResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processFetchPkt(trans *packet.Transiever) error {
@@ -330,22 +816,21 @@ func (c *Duplex) processFetchPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Fetch request for ", fetchReq.Path)
 
-	var fetchResponse packet.FetchResp
-	fetchResponse.ID = fetchReq.ID
+	c.work.read([]string{fetchReq.Path}, func() error {
+		var fetchResponse packet.FetchResp
+		fetchResponse.ID = fetchReq.ID
 
-	entryID, metadata, data, err := c.Manager.provider.Fetch(fetchReq.Path)
-	fetchResponse.Meta = *(metadata.(*nuggdb.EntryMetadata))
-	fetchResponse.Data = data
-	fetchResponse.EntryID = entryID
-	if err != nil {
-		if err == nuggdb.ErrMetaNotFound || err == nuggdb.ErrPathNotFound {
-			fetchResponse.ErrorCode = packet.ErrNoEntity
-		} else {
-			fetchResponse.ErrorCode = packet.ErrUnspec
+		entryID, metadata, data, err := c.provider.Fetch(fetchReq.Path)
+		if metadata != nil {
+			fetchResponse.Meta = *(metadata.(*nuggdb.EntryMetadata))
 		}
-	}
+		fetchResponse.Data = data
+		fetchResponse.EntryID = entryID
+		fetchResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	return trans.WriteFetchResp(&fetchResponse)
+		return trans.WriteFetchResp(&fetchResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processLookupPkt(trans *packet.Transiever) error {
@@ -356,19 +841,17 @@ func (c *Duplex) processLookupPkt(trans *packet.Transiever) error {
 	}
 	c.Manager.logger.Info("client-read", "Got Lookup request for ", lookupRequest.Path)
 
-	var lookupResponse packet.LookupResp
-	lookupResponse.ID = lookupRequest.ID
+	c.work.read([]string{lookupRequest.Path}, func() error {
+		var lookupResponse packet.LookupResp
+		lookupResponse.ID = lookupRequest.ID
 
-	lookupResponse.EntryID, err = c.Manager.provider.Lookup(lookupRequest.Path)
-	if err != nil {
-		if err == nuggdb.ErrPathNotFound {
-			lookupResponse.ErrorCode = packet.ErrNoEntity
-		} else {
-			lookupResponse.ErrorCode = packet.ErrUnspec
-		}
-	}
+		var err error
+		lookupResponse.EntryID, err = c.provider.Lookup(lookupRequest.Path)
+		lookupResponse.ErrorCode = packet.ErrToErrorCode(err)
 
-	return trans.WriteLookupResp(&lookupResponse)
+		return trans.WriteLookupResp(&lookupResponse)
+	})
+	return nil
 }
 
 func (c *Duplex) processPingPkt(trans *packet.Transiever) error {
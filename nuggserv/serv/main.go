@@ -48,7 +48,8 @@ func initNetwork(listenAddr, certPemPath, keyPemPath, caCertPath string) (net.Li
 // NewServer initializes a network server on listeAddr, accepting connections which can authenticate themselves
 // as based of the certificate at caCertPath. The TLS server authenticates itself using the cert/key at
 // certPemPath and keyPemPath respectively.
-func NewServer(listenAddr, certPemPath, keyPemPath, caCertPath string, provider nugget.DataSourceSink, logger *logger.Logger) (*Manager, error) {
+// Each connection processes up to workers requests at once, or DefaultWorkers if workers is zero.
+func NewServer(listenAddr, certPemPath, keyPemPath, caCertPath string, provider nugget.DataSourceSink, workers int, logger *logger.Logger) (*Manager, error) {
 	listener, err := initNetwork(listenAddr, certPemPath, keyPemPath, caCertPath)
 	if err != nil {
 		return nil, err
@@ -62,6 +63,7 @@ func NewServer(listenAddr, certPemPath, keyPemPath, caCertPath string, provider
 		logger:              logger,
 		provider:            provider,
 		isOptimisedProvider: isOptimisedProvider,
+		workers:             workers,
 	}
 
 	go m.mainloop()
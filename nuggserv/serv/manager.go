@@ -17,4 +17,14 @@ type Manager struct {
 	logger              *logger.Logger
 	provider            nugget.DataSourceSink
 	isOptimisedProvider bool
+	workers             int
+}
+
+// providerFor returns the provider to serve the named client with. Providers which can attribute
+// changes to a client create entries on its behalf, so they count against its quota.
+func (m *Manager) providerFor(client string) nugget.DataSourceSink {
+	if p, ok := m.provider.(nugget.ClientDataSourceSink); ok && client != "" {
+		return p.ForClient(client)
+	}
+	return m.provider
 }
@@ -0,0 +1,324 @@
+package serv
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/nuggdb"
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// streamTimeout bounds how long a stream waits for the client to send data or acknowledgements.
+const streamTimeout = time.Minute
+
+// stream is a transfer in progress with the client, identified by the ID of the request opening it.
+type stream struct {
+	window *packet.Window       // credit for the data sent on a fetch stream
+	buffer *packet.StreamBuffer // data received on a store stream
+}
+
+// openStream registers a stream, so the StreamData and StreamAck packets following its request can be
+// routed to it.
+func (c *Duplex) openStream(id uint64, s *stream) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	if c.streams == nil {
+		c.streams = map[uint64]*stream{}
+	}
+	c.streams[id] = s
+}
+
+func (c *Duplex) findStream(id uint64) *stream {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	return c.streams[id]
+}
+
+func (c *Duplex) closeStream(id uint64) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	delete(c.streams, id)
+}
+
+// closeStreams ends every stream, as the connection has gone.
+func (c *Duplex) closeStreams() {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	for id, s := range c.streams {
+		if s.window != nil {
+			s.window.Close()
+		}
+		if s.buffer != nil {
+			s.buffer.Close(packet.ErrStreamClosed)
+		}
+		delete(c.streams, id)
+	}
+}
+
+func (c *Duplex) processFetchStreamPkt(trans *packet.Transiever) error {
+	var fetchStreamRequest packet.FetchStreamReq
+	err := trans.GetFetchStreamReq(&fetchStreamRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got FetchStream request for ", fetchStreamRequest.Path)
+
+	window := packet.NewWindow(packet.StreamWindowSize)
+	c.openStream(fetchStreamRequest.ID, &stream{window: window})
+	c.work.read([]string{fetchStreamRequest.Path}, func() error {
+		defer c.closeStream(fetchStreamRequest.ID)
+		return c.sendFetchStream(trans, &fetchStreamRequest, window)
+	})
+	return nil
+}
+
+// sendFetchStream answers a FetchStreamReq, sending the data of the file as the window allows.
+func (c *Duplex) sendFetchStream(trans *packet.Transiever, req *packet.FetchStreamReq, window *packet.Window) error {
+	var fetchStreamResponse packet.FetchStreamResp
+	fetchStreamResponse.ID = req.ID
+
+	entryID, meta, readAt, err := c.openRead(req.Path)
+	fetchStreamResponse.EntryID = entryID
+	if meta != nil {
+		fetchStreamResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+	}
+	fetchStreamResponse.ErrorCode = packet.ErrToErrorCode(err)
+	if err = trans.WriteFetchStreamResp(&fetchStreamResponse); err != nil || fetchStreamResponse.ErrorCode != packet.ErrNoError {
+		return err
+	}
+
+	offset, end := req.Offset, int64(meta.GetSize())
+	if req.Size >= 0 && req.Offset+req.Size < end {
+		end = req.Offset + req.Size
+	}
+	for seq := uint64(0); ; seq++ {
+		data := packet.StreamData{ID: req.ID, Seq: seq}
+		if n := end - offset; n > 0 {
+			if n > packet.StreamChunkSize {
+				n = packet.StreamChunkSize
+			}
+			if err = window.Take(n, streamTimeout); err != nil {
+				// the client cancelled the stream, or stopped reading it
+				c.Manager.logger.Warning("client-read", "FetchStream for ", req.Path, " ended early: ", err)
+				data.ErrorCode = packet.ErrIOErr
+				if err == packet.ErrStreamStalled {
+					data.ErrorCode = packet.ErrTimeout
+				}
+				return trans.WriteStreamData(&data)
+			}
+			if data.Data, err = readAt(offset, n); err != nil {
+				data.Data, data.ErrorCode = nil, packet.ErrToErrorCode(err)
+				return trans.WriteStreamData(&data)
+			}
+			if int64(len(data.Data)) < n { // the file was truncated since the stream was opened
+				end = offset + int64(len(data.Data))
+			}
+			offset += int64(len(data.Data))
+		}
+		data.EOF = offset >= end
+		if err = trans.WriteStreamData(&data); err != nil || data.EOF {
+			return err
+		}
+	}
+}
+
+// openRead looks up the file at fPath, returning a function to read ranges of its data. Providers which
+// cannot read part of a file, and directories, are read whole.
+func (c *Duplex) openRead(fPath string) (nugget.EntryID, nugget.NodeMetadata, func(offset, size int64) ([]byte, error), error) {
+	if c.Manager.isOptimisedProvider {
+		entryID, err := c.provider.Lookup(fPath)
+		if err != nil {
+			return entryID, nil, nil, err
+		}
+		meta, err := c.provider.ReadMeta(entryID)
+		if err != nil {
+			return entryID, nil, nil, err
+		}
+		if !meta.IsDirectory() {
+			p := c.provider.(nugget.OptimisedDataSourceSink)
+			return entryID, meta, func(offset, size int64) ([]byte, error) {
+				return p.Read(fPath, offset, size)
+			}, nil
+		}
+	}
+
+	entryID, meta, data, err := c.provider.Fetch(fPath)
+	if err != nil {
+		return entryID, nil, nil, err
+	}
+	return entryID, meta, func(offset, size int64) ([]byte, error) {
+		if offset > int64(len(data)) {
+			return nil, nil
+		}
+		if end := offset + size; end < int64(len(data)) {
+			return data[offset:end], nil
+		}
+		return data[offset:], nil
+	}, nil
+}
+
+func (c *Duplex) processStoreStreamPkt(trans *packet.Transiever) error {
+	var storeStreamRequest packet.StoreStreamReq
+	err := trans.GetStoreStreamReq(&storeStreamRequest)
+	if err != nil {
+		return err
+	}
+	c.Manager.logger.Info("client-read", "Got StoreStream request for ", storeStreamRequest.Path)
+
+	buffer := packet.NewStreamBuffer()
+	c.openStream(storeStreamRequest.ID, &stream{buffer: buffer})
+	c.work.write([]string{storeStreamRequest.Path}, func() error {
+		var storeStreamResponse packet.StoreStreamResp
+		storeStreamResponse.ID = storeStreamRequest.ID
+
+		written, entryID, meta, err := c.receiveStoreStream(trans, &storeStreamRequest, buffer)
+		// data arriving after a failure is dropped
+		c.closeStream(storeStreamRequest.ID)
+		storeStreamResponse.Written = written
+		storeStreamResponse.EntryID = entryID
+		if meta != nil {
+			storeStreamResponse.Meta = *(meta.(*nuggdb.EntryMetadata))
+		}
+		storeStreamResponse.ErrorCode = packet.ErrToErrorCode(err)
+		if err != nil && storeStreamResponse.ErrorCode == packet.ErrUnspec {
+			c.Manager.logger.Warning("client-read", "StoreStream error: ", err)
+		}
+		return trans.WriteStoreStreamResp(&storeStreamResponse)
+	})
+	return nil
+}
+
+// receiveStoreStream writes the data received for a StoreStreamReq to the file. A stream truncating the
+// file is staged in new chunks by providers which can store a stream, and the file only switches to it
+// once the stream ends, so a failed stream leaves the file as it was. Otherwise the data is written as it
+// arrives by providers which can write part of a file, and stored whole once the stream ends by others.
+func (c *Duplex) receiveStoreStream(trans *packet.Transiever, req *packet.StoreStreamReq, buffer *packet.StreamBuffer) (int64, nugget.EntryID, nugget.NodeMetadata, error) {
+	r := &streamReader{trans: trans, id: req.ID, buffer: buffer}
+
+	if stager, canStage := c.provider.(nugget.StreamDataSink); canStage && req.Truncate && req.Offset == 0 {
+		entryID, meta, err := stager.StoreFrom(req.Path, r)
+		if err != nil {
+			return 0, entryID, meta, err
+		}
+		return r.read, entryID, meta, nil
+	}
+
+	if p, isOptimised := c.provider.(nugget.OptimisedDataSourceSink); isOptimised && !req.Truncate {
+		var written int64
+		var entryID nugget.EntryID
+		var meta nugget.NodeMetadata
+		for {
+			chunk, err := r.next()
+			if err == io.EOF {
+				return written, entryID, meta, nil
+			}
+			if err != nil {
+				return written, entryID, meta, err
+			}
+			n, eID, m, err := p.Write(req.Path, req.Offset+written, chunk)
+			written += n
+			if err != nil {
+				return written, entryID, meta, err
+			}
+			entryID, meta = eID, m
+		}
+	}
+
+	var data []byte
+	var err error
+	if !req.Truncate {
+		if _, _, data, err = c.provider.Fetch(req.Path); err != nil {
+			return 0, nugget.EntryID{}, nil, err
+		}
+	}
+	received, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, nugget.EntryID{}, nil, err
+	}
+	entryID, meta, err := c.provider.Store(req.Path, doWrite(req.Offset, received, data))
+	if err != nil {
+		return 0, entryID, meta, err
+	}
+	return r.read, entryID, meta, nil
+}
+
+// streamReader reads the data received on a store stream, acknowledging each part as it is taken from
+// the buffer, so the client sends more while it is written.
+type streamReader struct {
+	trans  *packet.Transiever
+	id     uint64
+	buffer *packet.StreamBuffer
+	chunk  []byte
+	read   int64 // bytes returned by Read
+}
+
+// next returns the next part of the data received, or io.EOF once the stream has ended.
+func (r *streamReader) next() ([]byte, error) {
+	if len(r.chunk) == 0 {
+		chunk, err := r.buffer.Next(streamTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.trans.WriteStreamAck(&packet.StreamAck{ID: r.id, Bytes: uint32(len(chunk))}); err != nil {
+			return nil, err
+		}
+		r.chunk = chunk
+	}
+	chunk := r.chunk
+	r.chunk = nil
+	return chunk, nil
+}
+
+// Read implements io.Reader.
+func (r *streamReader) Read(p []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		chunk, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = chunk
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+func (c *Duplex) processStreamDataPkt(trans *packet.Transiever) error {
+	var data packet.StreamData
+	err := trans.GetStreamData(&data)
+	if err != nil {
+		return err
+	}
+
+	s := c.findStream(data.ID)
+	if s == nil || s.buffer == nil {
+		c.Manager.logger.Warning("client-read", "Dropping StreamData for unknown stream ", data.ID)
+		return nil
+	}
+	if err = s.buffer.Put(&data); err != nil {
+		c.Manager.logger.Warning("client-read", "Ending stream ", data.ID, ": ", err)
+	}
+	return nil
+}
+
+func (c *Duplex) processStreamAckPkt(trans *packet.Transiever) error {
+	var ack packet.StreamAck
+	err := trans.GetStreamAck(&ack)
+	if err != nil {
+		return err
+	}
+
+	s := c.findStream(ack.ID)
+	if s == nil || s.window == nil {
+		return nil // the stream has already ended
+	}
+	if ack.Cancel {
+		s.window.Close()
+	} else {
+		s.window.Grant(int64(ack.Bytes))
+	}
+	return nil
+}
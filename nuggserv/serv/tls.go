@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"net"
 )
 
 var gTLSConfig *tls.Config
@@ -44,3 +45,17 @@ func tlsConfig(certPemPath, keyPemPath, caCertPath string) (*tls.Config, error)
 
 	return gTLSConfig, nil
 }
+
+// clientName returns the common name of the certificate the client at conn authenticated with, or
+// an empty string if it is not known.
+func clientName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.Handshake() != nil {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
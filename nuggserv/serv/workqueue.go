@@ -0,0 +1,137 @@
+package serv
+
+import (
+	"path"
+	"sync"
+)
+
+// DefaultWorkers is the number of requests from a single connection which are processed at once, unless
+// configured otherwise.
+const DefaultWorkers = 16
+
+// queuedPerWorker bounds the requests of a connection which are queued or running, as a multiple of the
+// number of workers.
+const queuedPerWorker = 16
+
+// workQueue processes the requests of a connection with a bounded number running at once, so one slow
+// request does not hold up the others, and responses are written as requests complete. Requests which
+// change a path wait for every request on that path received before them, and requests which read a path
+// wait for the changes received before them, so the order of operations on a path is kept. Once too many
+// requests are queued, queueing another blocks the read loop until one completes, so a client cannot grow
+// the queue without bound. StreamData and StreamAck packets are never queued, so running streams keep
+// receiving them until the cap is reached, and a stream left waiting past that fails after streamTimeout.
+type workQueue struct {
+	slots  chan struct{}
+	queued chan struct{}
+	wg     sync.WaitGroup
+	failed func(error)
+
+	lock  sync.Mutex
+	paths map[string]*pathQueue
+}
+
+// pathQueue tracks the requests queued on a path: the last change, and the reads received since.
+type pathQueue struct {
+	write chan struct{}
+	reads []chan struct{}
+}
+
+// newWorkQueue returns a workQueue running up to workers requests at once, and holding up to
+// workers*queuedPerWorker requests queued or running. failed is called with the errors
+// returned by requests, which are errors writing to the connection.
+func newWorkQueue(workers int, failed func(error)) *workQueue {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &workQueue{
+		slots:  make(chan struct{}, workers),
+		queued: make(chan struct{}, workers*queuedPerWorker),
+		failed: failed,
+		paths:  map[string]*pathQueue{},
+	}
+}
+
+// read queues a request which reads the given paths, blocking while the queue is full.
+func (q *workQueue) read(paths []string, fn func() error) {
+	q.run(false, paths, fn)
+}
+
+// write queues a request which changes the given paths, blocking while the queue is full.
+func (q *workQueue) write(paths []string, fn func() error) {
+	q.run(true, paths, fn)
+}
+
+func (q *workQueue) run(write bool, paths []string, fn func() error) {
+	q.queued <- struct{}{}
+	done := make(chan struct{})
+	var waits []chan struct{}
+
+	q.lock.Lock()
+	for i := range paths {
+		paths[i] = path.Clean(paths[i])
+		pq, ok := q.paths[paths[i]]
+		if !ok {
+			pq = &pathQueue{}
+			q.paths[paths[i]] = pq
+		}
+		if pq.write != nil && pq.write != done {
+			waits = append(waits, pq.write)
+		}
+		if write {
+			waits = append(waits, pq.reads...)
+			pq.write, pq.reads = done, nil
+		} else {
+			pq.reads = append(pq.reads, done)
+		}
+	}
+	q.lock.Unlock()
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		// A request only takes a slot once the requests it waits on are done, so a request holding a slot
+		// is never waiting on one without.
+		for _, w := range waits {
+			<-w
+		}
+		q.slots <- struct{}{}
+		err := fn()
+		q.finish(paths, done)
+		<-q.slots
+		<-q.queued
+		if err != nil {
+			q.failed(err)
+		}
+	}()
+}
+
+// finish forgets a completed request, unblocking the requests waiting on it.
+func (q *workQueue) finish(paths []string, done chan struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, p := range paths {
+		pq, ok := q.paths[p]
+		if !ok {
+			continue
+		}
+		if pq.write == done {
+			pq.write = nil
+		}
+		for i := range pq.reads {
+			if pq.reads[i] == done {
+				pq.reads = append(pq.reads[:i], pq.reads[i+1:]...)
+				break
+			}
+		}
+		if pq.write == nil && len(pq.reads) == 0 {
+			delete(q.paths, p)
+		}
+	}
+	close(done)
+}
+
+// wait blocks until every queued request has completed.
+func (q *workQueue) wait() {
+	q.wg.Wait()
+}
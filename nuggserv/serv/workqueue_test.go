@@ -0,0 +1,150 @@
+package serv
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkQueueKeepsPathOrder(t *testing.T) {
+	q := newWorkQueue(4, func(err error) { t.Error("Unexpected failure:", err) })
+
+	var lock sync.Mutex
+	var order []string
+	record := func(what string) {
+		lock.Lock()
+		defer lock.Unlock()
+		order = append(order, what)
+	}
+
+	release := make(chan struct{})
+	q.write([]string{"/a"}, func() error {
+		<-release
+		record("write /a")
+		return nil
+	})
+	q.read([]string{"/a/"}, func() error {
+		record("read /a")
+		return nil
+	})
+	q.read([]string{"/a"}, func() error {
+		record("read /a")
+		return nil
+	})
+	q.write([]string{"/a"}, func() error {
+		record("write /a again")
+		return nil
+	})
+	otherDone := make(chan struct{})
+	q.read([]string{"/b"}, func() error {
+		record("read /b")
+		close(otherDone)
+		return nil
+	})
+
+	// requests on other paths are not held up
+	select {
+	case <-otherDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request on /b waited for the write to /a")
+	}
+	close(release)
+	q.wait()
+
+	expected := []string{"read /b", "write /a", "read /a", "read /a", "write /a again"}
+	if len(order) != len(expected) {
+		t.Fatal("Expected", expected, "got", order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatal("Expected", expected, "got", order)
+		}
+	}
+}
+
+func TestWorkQueueSaturated(t *testing.T) {
+	failed := make(chan error, 1)
+	q := newWorkQueue(2, func(err error) { failed <- err })
+
+	// every worker is taken by a stream waiting on packets delivered by the read loop
+	acks := make(chan struct{})
+	var running sync.WaitGroup
+	running.Add(2)
+	for _, p := range []string{"/s1", "/s2"} {
+		q.read([]string{p}, func() error {
+			running.Done()
+			<-acks
+			return nil
+		})
+	}
+	running.Wait()
+
+	// below the cap, the read loop queues more requests without blocking, and so can deliver the acks
+	queued := make(chan struct{})
+	var ran sync.WaitGroup
+	ran.Add(3)
+	go func() {
+		for _, p := range []string{"/x", "/y", "/z"} {
+			q.read([]string{p}, func() error {
+				select {
+				case <-acks:
+				default:
+					t.Error("Request ran while every worker was busy")
+				}
+				ran.Done()
+				return nil
+			})
+		}
+		q.write([]string{"/x"}, func() error { return errors.New("write failed") })
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queueing a request blocked while every worker was busy")
+	}
+
+	close(acks)
+	ran.Wait()
+	q.wait()
+	select {
+	case err := <-failed:
+		if err.Error() != "write failed" {
+			t.Error("Expected the error of the request, got", err)
+		}
+	default:
+		t.Error("Expected the error of the request to be reported")
+	}
+}
+
+func TestWorkQueueBlocksWhenFull(t *testing.T) {
+	q := newWorkQueue(1, func(err error) { t.Error("Unexpected failure:", err) })
+
+	release := make(chan struct{})
+	for i := 0; i < queuedPerWorker; i++ {
+		q.read(nil, func() error {
+			<-release
+			return nil
+		})
+	}
+
+	queued := make(chan struct{})
+	go func() {
+		q.read(nil, func() error { return nil })
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("Expected queueing to block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected queueing to resume once requests completed")
+	}
+	q.wait()
+}
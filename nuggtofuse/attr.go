@@ -0,0 +1,112 @@
+package nuggtofuse
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// fillAttr copies the ownership, permission, size and time information in meta into a.
+func fillAttr(a *fuse.Attr, meta nugget.NodeMetadata) {
+	a.Mode = meta.GetMode()
+	if meta.IsDirectory() {
+		a.Mode |= os.ModeDir
+	} else if meta.IsSymlink() {
+		a.Mode |= os.ModeSymlink
+	}
+	a.Size = meta.GetSize()
+	a.Nlink = meta.GetNlink()
+	a.Uid = meta.GetUID()
+	a.Gid = meta.GetGID()
+	a.Atime = meta.GetAtime()
+	a.Mtime = meta.GetMtime()
+	a.Ctime = meta.GetCtime()
+	a.Crtime = meta.GetCrtime()
+}
+
+// requestAttributes returns the attributes a node created by the given request should have.
+func requestAttributes(hdr *fuse.Header, mode, umask os.FileMode) nugget.NodeAttributes {
+	return nugget.NodeAttributes{
+		Mode: mode &^ umask,
+		UID:  hdr.Uid,
+		GID:  hdr.Gid,
+	}
+}
+
+// attrChanges converts a FUSE setattr request into the changes to be applied by the provider.
+func attrChanges(req *fuse.SetattrRequest) nugget.AttrChanges {
+	var changes nugget.AttrChanges
+	if req.Valid.Mode() {
+		changes.Valid |= nugget.AttrMode
+		changes.Mode = req.Mode
+	}
+	if req.Valid.Uid() {
+		changes.Valid |= nugget.AttrUID
+		changes.UID = req.Uid
+	}
+	if req.Valid.Gid() {
+		changes.Valid |= nugget.AttrGID
+		changes.GID = req.Gid
+	}
+	if req.Valid.Size() {
+		changes.Valid |= nugget.AttrSize
+		changes.Size = req.Size
+	}
+	if req.Valid.Atime() || req.Valid.AtimeNow() {
+		changes.Valid |= nugget.AttrAtime
+		changes.Atime = req.Atime
+		if req.Valid.AtimeNow() {
+			changes.Atime = time.Now()
+		}
+	}
+	if req.Valid.Mtime() || req.Valid.MtimeNow() {
+		changes.Valid |= nugget.AttrMtime
+		changes.Mtime = req.Mtime
+		if req.Valid.MtimeNow() {
+			changes.Mtime = time.Now()
+		}
+	}
+	return changes
+}
+
+// setattr applies a FUSE setattr request to the entry at fullPath.
+func (fs *FS) setattr(fullPath string, req *fuse.SetattrRequest) error {
+	changes := attrChanges(req)
+	if changes.Valid == 0 {
+		return nil
+	}
+
+	if setattrProvider, ok := fs.provider.(nugget.SetattrDataSink); ok {
+		_, _, err := setattrProvider.Setattr(fullPath, changes)
+		if err != packet.ErrNotSupported {
+			if err != nil {
+				return fs.fuseErr("fuse-setattr", "provider.Setattr("+fullPath+")", err)
+			}
+			return nil
+		}
+		// the remote end predates Setattr, so it is treated like a provider without it
+	}
+
+	if changes.Valid != nugget.AttrSize {
+		fs.logger.Error("fuse-setattr", "Provider does not support Setattr, cannot change attributes of ", fullPath)
+		return fuse.Errno(syscall.ENOSYS)
+	}
+	fs.logger.Warning("fuse-setattr", "Provider does not support Setattr, falling back to Fetch/Store strategy.")
+	_, _, data, err := fs.provider.Fetch(fullPath)
+	if err != nil {
+		return fs.fuseErr("fuse-setattr", "Fetch of "+fullPath, err)
+	}
+	if uint64(len(data)) > changes.Size {
+		data = data[:changes.Size]
+	} else {
+		data = append(data, make([]byte, changes.Size-uint64(len(data)))...)
+	}
+	if _, _, err = fs.provider.Store(fullPath, data); err != nil {
+		return fs.fuseErr("fuse-setattr", "Store of "+fullPath, err)
+	}
+	return nil
+}
@@ -2,12 +2,13 @@ package nuggtofuse
 
 import (
 	"context"
-	"os"
 	"path"
 	"strings"
+	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/twitchyliquid64/nugget"
 	"github.com/twitchyliquid64/nugget/nuggdb"
 	"github.com/twitchyliquid64/nugget/packet"
 )
@@ -24,28 +25,73 @@ type Dir struct {
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	d.fs.logger.Info("fuse-attr", "Got request for ", d.fullPath)
 	a.Inode = d.inode
-	a.Mode = os.ModeDir | 0777
+
+	entryID, err := d.fs.provider.Lookup(d.fullPath)
+	if err != nil {
+		return d.fs.fuseErr("fuse-attr", "Lookup for "+d.fullPath, err)
+	}
+
+	meta, err := d.fs.provider.ReadMeta(entryID)
+	if err != nil {
+		return d.fs.fuseErr("fuse-attr", "ReadMeta for "+d.fullPath, err)
+	}
+	fillAttr(a, meta)
 	return nil
 }
 
+// Setattr implements fs.NodeSetattrer, allowing changes to ownership, permissions and times.
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	d.fs.logger.Info("fuse-setattr", "Got request for ", d.fullPath, " with ", req.Valid)
+	return d.fs.setattr(d.fullPath, req)
+}
+
 // ReadDirAll implements fs.HandleReadDirAller for listing directories.
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	d.fs.logger.Info("fuse-readdirall", "Got request on ", d.fullPath)
+	return d.fs.readDir(d.fullPath)
+}
 
+// readDir returns the entries of the directory at fullPath. Providers which support it are
+// listed a page at a time, so large directories are never transferred in a single response.
+func (fs *FS) readDir(fullPath string) ([]fuse.Dirent, error) {
 	var out []fuse.Dirent
-	entries, err := d.fs.provider.List(d.fullPath)
-	if err == nuggdb.ErrPathNotFound {
+	appendEntries := func(entries []nugget.DirEntry) {
+		for _, entry := range entries {
+			dirent := fuse.Dirent{Inode: entryInode(entry.ID()), Name: path.Base(entry.Identifier()), Type: fuse.DT_File}
+			if entry.ID() == (nugget.EntryID{}) {
+				dirent.Inode = fs.getInode(entry.Identifier()) // indexed before EntryIDs were recorded
+			}
+			if entry.IsDirectory() {
+				dirent.Type = fuse.DT_Dir
+			} else if entry.IsSymlink() {
+				dirent.Type = fuse.DT_Link
+			}
+			out = append(out, dirent)
+		}
+	}
+
+	pagedProvider, ok := fs.provider.(nugget.PagedDataSource)
+	if !ok {
+		entries, err := fs.provider.List(fullPath)
+		if err == nuggdb.ErrPathNotFound || err == packet.ErrNoEnt {
+			return out, nil
+		} else if err != nil {
+			return out, fs.fuseErr("fuse-readdirall", "provider.List("+fullPath+")", err)
+		}
+		appendEntries(entries)
 		return out, nil
-	} else if err != nil {
-		d.fs.logger.Error("fuse-readdirall", "provider.List("+d.fullPath+") Failed: ", err)
-		return out, fuse.EIO
-	}
-	for _, entry := range entries {
-		if entry.IsDirectory() {
-			out = append(out, fuse.Dirent{Inode: uint64(d.fs.getInode(entry.Identifier())), Name: path.Base(entry.Identifier()), Type: fuse.DT_Dir})
-		} else {
-			out = append(out, fuse.Dirent{Inode: uint64(d.fs.getInode(entry.Identifier())), Name: path.Base(entry.Identifier()), Type: fuse.DT_File})
+	}
+
+	for cursor, first := "", true; first || cursor != ""; first = false {
+		var entries []nugget.DirEntry
+		var err error
+		entries, cursor, err = pagedProvider.ListPage(fullPath, cursor, packet.MaxListPageSize)
+		if err == nuggdb.ErrPathNotFound || err == packet.ErrNoEnt {
+			return out, nil
+		} else if err != nil {
+			return out, fs.fuseErr("fuse-readdirall", "provider.ListPage("+fullPath+")", err)
 		}
+		appendEntries(entries)
 	}
 	return out, nil
 }
@@ -54,23 +100,22 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	d.fs.logger.Info("fuse-lookup", "Query for: ", path.Join(d.fullPath, name))
 	eID, err := d.fs.provider.Lookup(path.Join(d.fullPath, name))
-	if err == nuggdb.ErrPathNotFound || err == packet.ErrNoEnt {
-		return nil, fuse.ENOENT
-	} else if err != nil {
-		d.fs.logger.Error("fuse-lookup", "Lookup for "+path.Join(d.fullPath, name)+" failed: ", err)
-		return nil, fuse.EIO
+	if err != nil {
+		return nil, d.fs.fuseErr("fuse-lookup", "Lookup for "+path.Join(d.fullPath, name), err)
 	}
 
 	meta, err := d.fs.provider.ReadMeta(eID)
 	if err != nil {
-		d.fs.logger.Error("fs-lookup", "ReadMeta for "+path.Join(d.fullPath, name)+" failed: ", err)
-		return nil, fuse.EIO
+		return nil, d.fs.fuseErr("fs-lookup", "ReadMeta for "+path.Join(d.fullPath, name), err)
 	}
 
 	if meta.IsDirectory() {
-		return d.fs.getDir(path.Join(d.fullPath, name)), nil
+		return d.fs.getDir(path.Join(d.fullPath, name), eID), nil
 	}
-	return d.fs.getFile(path.Join(d.fullPath, name)), nil
+	if meta.IsSymlink() {
+		return d.fs.getSymlink(path.Join(d.fullPath, name), eID), nil
+	}
+	return d.fs.getFile(path.Join(d.fullPath, name), eID), nil
 }
 
 // Create implements fs.NodeCreater. It is called to create and open a new
@@ -82,8 +127,11 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		return nil, nil, fuse.EPERM
 	}
 	d.fs.logger.Info("fuse-create", "Name: ", path.Join(d.fullPath, req.Name))
-	d.fs.provider.Store(path.Join(d.fullPath, req.Name), []byte{})
-	f := d.fs.getFile(path.Join(d.fullPath, req.Name))
+	eID, _, err := d.fs.provider.Create(path.Join(d.fullPath, req.Name), requestAttributes(&req.Header, req.Mode, req.Umask))
+	if err != nil {
+		return nil, nil, d.fs.fuseErr("fuse-create", "provider.Create("+path.Join(d.fullPath, req.Name)+")", err)
+	}
+	f := d.fs.getFile(path.Join(d.fullPath, req.Name), eID)
 	return f, f, nil
 }
 
@@ -95,12 +143,36 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		return nil, fuse.EPERM
 	}
 
-	_, _, err := d.fs.provider.Mkdir(path.Join(d.fullPath, req.Name))
+	eID, _, err := d.fs.provider.Mkdir(path.Join(d.fullPath, req.Name), requestAttributes(&req.Header, req.Mode, req.Umask))
 	if err == nil {
-		return d.fs.getDir(path.Join(d.fullPath, req.Name)), nil
+		return d.fs.getDir(path.Join(d.fullPath, req.Name), eID), nil
+	}
+	return nil, d.fs.fuseErr("fuse-mkdir", "provider.Mkdir("+path.Join(d.fullPath, req.Name)+")", err)
+}
+
+// Rename implements fs.NodeRenamer, moving an entry in this directory to newDir.
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	d.fs.logger.Info("fuse-rename", "Got request for: ", path.Join(d.fullPath, req.OldName), " -> ", req.NewName)
+	newDirPath, ok := d.fs.nodePath(newDir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
 	}
-	d.fs.logger.Error("fuse-mkdir", "provider.Mkdir("+path.Join(d.fullPath, req.Name)+") failed: ", err)
-	return nil, fuse.EIO
+	return d.fs.rename(path.Join(d.fullPath, req.OldName), path.Join(newDirPath, req.NewName))
+}
+
+// Link implements fs.NodeLinker, giving an existing file another name in this directory.
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	d.fs.logger.Info("fuse-link", "Got request for: ", path.Join(d.fullPath, req.NewName))
+	if strings.Contains(req.NewName, "/") {
+		d.fs.logger.Error("fuse-link", "Cannot create node which contains slashes: ", req.NewName)
+		return nil, fuse.EPERM
+	}
+	return d.fs.link(old, path.Join(d.fullPath, req.NewName))
+}
+
+// Forget implements fs.NodeForgetter, called once the kernel no longer refers to this node.
+func (d *Dir) Forget() {
+	d.fs.forgetNode(d.fullPath, d)
 }
 
 // Remove implements NodeRemover, which allows the removal of files.
@@ -111,10 +183,5 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return fuse.EPERM
 	}
 
-	err := d.fs.provider.Delete(path.Join(d.fullPath, req.Name))
-	if err != nil {
-		d.fs.logger.Error("fuse-remove", "provider.Delete("+path.Join(d.fullPath, req.Name)+") Failed: ", err)
-		return fuse.EIO
-	}
-	return nil
+	return d.fs.remove(path.Join(d.fullPath, req.Name), req.Dir)
 }
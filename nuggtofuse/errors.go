@@ -0,0 +1,21 @@
+package nuggtofuse
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// fuseErr maps err, returned by the provider for what, to the error reported to the kernel using the
+// mapping shared with nuggserv. Errors without a mapping are logged and reported as EIO.
+func (fs *FS) fuseErr(op, what string, err error) error {
+	if err == nil {
+		return nil
+	}
+	errno := packet.Errno(err)
+	if errno == syscall.EIO {
+		fs.logger.Error(op, what+" failed: ", err)
+	}
+	return fuse.Errno(errno)
+}
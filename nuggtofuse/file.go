@@ -2,6 +2,7 @@ package nuggtofuse
 
 import (
 	"context"
+	"io"
 
 	"github.com/twitchyliquid64/nugget"
 
@@ -25,35 +26,63 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	return f, nil
 }
 
+// Forget implements fs.NodeForgetter, called once the kernel no longer refers to this node.
+func (f *File) Forget() {
+	f.fs.forgetNode(f.fullPath, f)
+}
+
 // Attr implements fs.Node, allowing the Variable to masquerade as a fuse file.
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	f.fs.logger.Info("fuse-attr", "Got request for ", f.fullPath)
 	a.Inode = f.inode
-	a.Mode = 0777
 
 	entryID, err := f.fs.provider.Lookup(f.fullPath)
 	if err != nil {
-		return err
+		return f.fs.fuseErr("fuse-attr", "Lookup of "+f.fullPath, err)
 	}
 
 	meta, err := f.fs.provider.ReadMeta(entryID)
 	if err != nil {
-		return err
+		return f.fs.fuseErr("fuse-attr", "ReadMeta of "+f.fullPath, err)
 	}
-	a.Size = meta.GetSize()
+	fillAttr(a, meta)
 
 	return nil
 }
 
+// Setattr implements fs.NodeSetattrer, allowing truncation and changes to ownership,
+// permissions and times.
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.fs.logger.Info("fuse-setattr", "Got request for ", f.fullPath, " with ", req.Valid)
+	return f.fs.setattr(f.fullPath, req)
+}
+
 // Read implements fs.HandleRead, allowing file reads.
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	f.fs.logger.Info("fuse-read", "Got request for ", f.fullPath, " with size=", req.Size, " and offset=", req.Offset)
 
+	if streamProvider, ok := f.fs.provider.(nugget.StreamDataSource); ok {
+		r, err := streamProvider.FetchReader(f.fullPath, req.Offset, int64(req.Size))
+		if err != nil {
+			return f.fs.fuseErr("fuse-read", "FetchReader of "+f.fullPath, err)
+		}
+		defer r.Close()
+		// the data is read straight into the response, so no more is held than the kernel asked for
+		if cap(resp.Data) < req.Size {
+			resp.Data = make([]byte, req.Size)
+		}
+		n, err := io.ReadFull(r, resp.Data[:req.Size])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return f.fs.fuseErr("fuse-read", "Read of "+f.fullPath, err)
+		}
+		resp.Data = resp.Data[:n]
+		return nil
+	}
+
 	if optimizedProvider, ok := f.fs.provider.(nugget.OptimisedDataSourceSink); ok {
 		data, err := optimizedProvider.Read(f.fullPath, req.Offset, int64(req.Size))
 		if err != nil {
-			f.fs.logger.Error("fuse-read", "Failed Read operation: ", err)
-			return fuse.EIO
+			return f.fs.fuseErr("fuse-read", "Read of "+f.fullPath, err)
 		}
 		resp.Data = data
 		return nil
@@ -61,8 +90,11 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 
 	f.fs.logger.Warning("fuse-read", "Provider is not optimized, falling back to Fetch/slice strategy.")
 	_, _, data, err := f.fs.provider.Fetch(f.fullPath)
+	if err != nil {
+		return f.fs.fuseErr("fuse-read", "Fetch of "+f.fullPath, err)
+	}
 	fuseutil.HandleRead(req, resp, data)
-	return err
+	return nil
 }
 
 func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
@@ -71,8 +103,7 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 	if optimizedProvider, ok := f.fs.provider.(nugget.OptimisedDataSourceSink); ok {
 		written, _, _, err := optimizedProvider.Write(f.fullPath, req.Offset, req.Data)
 		if err != nil {
-			f.fs.logger.Error("fuse-write", "Failed Write operation: ", err)
-			return fuse.EIO
+			return f.fs.fuseErr("fuse-write", "Write of "+f.fullPath, err)
 		}
 		resp.Size = int(written)
 		return nil
@@ -81,15 +112,13 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 	f.fs.logger.Warning("fuse-write", "Provider is not optimized, falling back to Fetch/store strategy.")
 	_, _, data, err := f.fs.provider.Fetch(f.fullPath)
 	if err != nil {
-		f.fs.logger.Error("fuse-write", "Failed fetch operation: ", err)
-		return fuse.EIO
+		return f.fs.fuseErr("fuse-write", "Fetch of "+f.fullPath, err)
 	}
 
 	newData := doWrite(req.Offset, req.Data, data)
 	_, _, err = f.fs.provider.Store(f.fullPath, newData)
 	if err != nil {
-		f.fs.logger.Error("fuse-write", "Failed store operation: ", err)
-		return fuse.EIO
+		return f.fs.fuseErr("fuse-write", "Store of "+f.fullPath, err)
 	}
 	resp.Size = len(req.Data)
 	return nil
@@ -2,10 +2,12 @@ package nuggtofuse
 
 import (
 	"context"
+	"encoding/binary"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -24,6 +26,9 @@ type FS struct {
 	provider    nugget.DataSourceSink
 	logger      *logger.Logger
 	overrides   map[string]fs.Node
+
+	nodeLock sync.Mutex
+	nodes    map[string]fs.Node // live File/Dir/Symlink nodes by full path, so they can be updated on rename
 }
 
 // Make creates wraps a provider in a structure that can represent a FUSE filesystem.
@@ -33,25 +38,119 @@ func Make(provider nugget.DataSourceSink, inodeSource *inodeFactory.PathAwareFac
 		provider:    provider,
 		logger:      l,
 		overrides:   map[string]fs.Node{},
+		nodes:       map[string]fs.Node{},
 	}
 	r.rootInode = inodeSource.GetInode()
 	return r
 }
 
-func (fs *FS) getFile(fullPath string) *File {
-	return &File{
+// entryInode returns the inode of the entry with the given EntryID. Inodes are derived from the
+// EntryID, so every name of a hard linked file reports the same inode, which also survives renames
+// and remounts. The top bit is always set, keeping them apart from the inodes issued by InodeSource.
+func entryInode(eID nugget.EntryID) uint64 {
+	return binary.LittleEndian.Uint64(eID[:8]) | 1<<63
+}
+
+func (fs *FS) getFile(fullPath string, eID nugget.EntryID) *File {
+	fs.nodeLock.Lock()
+	defer fs.nodeLock.Unlock()
+	if f, ok := fs.nodes[fullPath].(*File); ok && f.inode == entryInode(eID) {
+		return f
+	}
+	f := &File{
 		fs:       fs,
-		inode:    fs.getInode(fullPath),
+		inode:    entryInode(eID),
 		fullPath: fullPath,
 	}
+	fs.nodes[fullPath] = f
+	return f
 }
 
-func (fs *FS) getDir(fullPath string) *Dir {
-	return &Dir{
+func (fs *FS) getDir(fullPath string, eID nugget.EntryID) *Dir {
+	fs.nodeLock.Lock()
+	defer fs.nodeLock.Unlock()
+	if d, ok := fs.nodes[fullPath].(*Dir); ok && d.inode == entryInode(eID) {
+		return d
+	}
+	d := &Dir{
 		fs:       fs,
-		inode:    fs.getInode(fullPath),
+		inode:    entryInode(eID),
 		fullPath: fullPath,
 	}
+	fs.nodes[fullPath] = d
+	return d
+}
+
+func (fs *FS) getSymlink(fullPath string, eID nugget.EntryID) *Symlink {
+	fs.nodeLock.Lock()
+	defer fs.nodeLock.Unlock()
+	if l, ok := fs.nodes[fullPath].(*Symlink); ok && l.inode == entryInode(eID) {
+		return l
+	}
+	l := &Symlink{
+		fs:       fs,
+		inode:    entryInode(eID),
+		fullPath: fullPath,
+	}
+	fs.nodes[fullPath] = l
+	return l
+}
+
+// forgetNode stops tracking node, once the kernel will no longer refer to it.
+func (fs *FS) forgetNode(fullPath string, node fs.Node) {
+	fs.nodeLock.Lock()
+	defer fs.nodeLock.Unlock()
+	if fs.nodes[fullPath] == node {
+		delete(fs.nodes, fullPath)
+	}
+}
+
+// nodePath returns the full path of a directory node from this filesystem.
+func (fs *FS) nodePath(node fs.Node) (string, bool) {
+	switch n := node.(type) {
+	case *FS:
+		return "/", n == fs
+	case *Dir:
+		return n.fullPath, n.fs == fs
+	}
+	return "", false
+}
+
+// rename moves oldPath to newPath in the provider, then updates any live nodes beneath oldPath
+// so they refer to their new location.
+func (fs *FS) rename(oldPath, newPath string) error {
+	err := fs.provider.Rename(oldPath, newPath)
+	if err != nil {
+		return fs.fuseErr("fuse-rename", "provider.Rename("+oldPath+", "+newPath+")", err)
+	}
+
+	fs.nodeLock.Lock()
+	defer fs.nodeLock.Unlock()
+	delete(fs.nodes, newPath) // replaced by the rename, if it existed
+	var movedPaths []string
+	for p := range fs.nodes {
+		if p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+			movedPaths = append(movedPaths, p)
+		}
+	}
+	for _, p := range movedPaths {
+		node := fs.nodes[p]
+		delete(fs.nodes, p)
+		p = newPath + p[len(oldPath):]
+		switch n := node.(type) {
+		case *File:
+			n.fullPath = p
+		case *Dir:
+			n.fullPath = p
+		case *Symlink:
+			n.fullPath = p
+		}
+		fs.nodes[p] = node
+	}
+	if pathInodeFactory, ok := fs.InodeSource.(*inodeFactory.PathAwareFactory); ok {
+		pathInodeFactory.Move(oldPath, newPath)
+	}
+	return nil
 }
 
 // SetOverride allows you to add another directory to the root of the filesystem, which will be exposed via FUSE.
@@ -77,23 +176,22 @@ func (fs *FS) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	}
 
 	eID, err := fs.provider.Lookup("/" + name)
-	if err == nuggdb.ErrPathNotFound || err == packet.ErrNoEnt {
-		return nil, fuse.ENOENT
-	} else if err != nil {
-		fs.logger.Error("fuse-lookup", "Lookup for "+name+" failed: ", err)
-		return nil, fuse.EIO
+	if err != nil {
+		return nil, fs.fuseErr("fuse-lookup", "Lookup for "+name, err)
 	}
 
 	meta, err := fs.provider.ReadMeta(eID)
 	if err != nil {
-		fs.logger.Error("fuse-lookup", "ReadMeta for "+name+" failed: ", err)
-		return nil, fuse.EIO
+		return nil, fs.fuseErr("fuse-lookup", "ReadMeta for "+name, err)
 	}
 
 	if meta.IsDirectory() {
-		return fs.getDir("/" + name), nil
+		return fs.getDir("/"+name, eID), nil
+	}
+	if meta.IsSymlink() {
+		return fs.getSymlink("/"+name, eID), nil
 	}
-	return fs.getFile("/" + name), nil
+	return fs.getFile("/"+name, eID), nil
 }
 
 // ReadDirAll implements fs.HandleReadDirAller for listing directories.
@@ -102,20 +200,9 @@ func (fs *FS) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	defer fs.lock.Unlock()
 	fs.logger.Info("fuse-readdirall", "Got root request")
 
-	var out []fuse.Dirent
-	entries, err := fs.provider.List("/")
-	if err == nuggdb.ErrPathNotFound {
-		return out, nil
-	} else if err != nil {
-		fs.logger.Error("fuse-readdirall", "provider.List(/) Failed: ", err)
-		return out, fuse.EIO
-	}
-	for _, entry := range entries {
-		if entry.IsDirectory() {
-			out = append(out, fuse.Dirent{Inode: uint64(fs.getInode(entry.Identifier())), Name: path.Base(entry.Identifier()), Type: fuse.DT_Dir})
-		} else {
-			out = append(out, fuse.Dirent{Inode: uint64(fs.getInode(entry.Identifier())), Name: path.Base(entry.Identifier()), Type: fuse.DT_File})
-		}
+	out, err := fs.readDir("/")
+	if err != nil {
+		return out, err
 	}
 
 	for name := range fs.overrides {
@@ -138,6 +225,20 @@ func (fs *FS) Attr(ctx context.Context, a *fuse.Attr) error {
 	fs.logger.Info("fuse-attr", "Got root request")
 	a.Inode = fs.rootInode
 	a.Mode = os.ModeDir | 0777
+
+	// The root directory is only committed once something is created in it.
+	entryID, err := fs.provider.Lookup("/")
+	if err == nuggdb.ErrPathNotFound || err == packet.ErrNoEnt {
+		return nil
+	} else if err != nil {
+		return fs.fuseErr("fuse-attr", "Lookup for /", err)
+	}
+
+	meta, err := fs.provider.ReadMeta(entryID)
+	if err != nil {
+		return fs.fuseErr("fuse-attr", "ReadMeta for /", err)
+	}
+	fillAttr(a, meta)
 	return nil
 }
 
@@ -150,8 +251,11 @@ func (fs *FS) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		return nil, nil, fuse.EPERM
 	}
 	fs.logger.Info("fuse-create", "Name: ", req.Name)
-	fs.provider.Store("/"+req.Name, []byte{})
-	f := fs.getFile("/" + req.Name)
+	eID, _, err := fs.provider.Create("/"+req.Name, requestAttributes(&req.Header, req.Mode, req.Umask))
+	if err != nil {
+		return nil, nil, fs.fuseErr("fuse-create", "provider.Create(/"+req.Name+")", err)
+	}
+	f := fs.getFile("/"+req.Name, eID)
 	return f, f, nil
 }
 
@@ -163,12 +267,58 @@ func (fs *FS) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		return nil, fuse.EPERM
 	}
 
-	_, _, err := fs.provider.Mkdir("/" + req.Name)
+	eID, _, err := fs.provider.Mkdir("/"+req.Name, requestAttributes(&req.Header, req.Mode, req.Umask))
 	if err == nil {
-		return fs.getDir("/" + req.Name), nil
+		return fs.getDir("/"+req.Name, eID), nil
+	}
+	return nil, fs.fuseErr("fuse-mkdir", "provider.Mkdir(/"+req.Name+")", err)
+}
+
+// Rename implements fs.NodeRenamer, moving an entry in the root directory.
+func (fs *FS) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	fs.logger.Info("fuse-rename", "Got root request for: ", req.OldName, " -> ", req.NewName)
+	newDirPath, ok := fs.nodePath(newDir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	return fs.rename("/"+req.OldName, path.Join(newDirPath, req.NewName))
+}
+
+// Link implements fs.NodeLinker, giving an existing file another name in the root directory.
+func (fs *FS) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	fs.logger.Info("fuse-link", "Got root request for: ", req.NewName)
+	if strings.Contains(req.NewName, "/") {
+		fs.logger.Error("fuse-link", "Cannot create node which contains slashes: ", req.NewName)
+		return nil, fuse.EPERM
 	}
-	fs.logger.Error("fuse-mkdir", "provider.Mkdir(/"+req.Name+") failed: ", err)
-	return nil, fuse.EIO
+	return fs.link(old, "/"+req.NewName)
+}
+
+// link creates newPath as another name for the file or symbolic link old.
+func (fs *FS) link(old fs.Node, newPath string) (fs.Node, error) {
+	var oldPath string
+	switch n := old.(type) {
+	case *File:
+		oldPath = n.fullPath
+	case *Symlink:
+		oldPath = n.fullPath
+	default:
+		return nil, fuse.EPERM
+	}
+	p, ok := fs.provider.(nugget.LinkDataSink)
+	if !ok {
+		fs.logger.Error("fuse-link", "Provider does not support Link, cannot create ", newPath)
+		return nil, fuse.Errno(syscall.ENOSYS)
+	}
+
+	eID, meta, err := p.Link(oldPath, newPath)
+	if err != nil {
+		return nil, fs.fuseErr("fuse-link", "provider.Link("+oldPath+", "+newPath+")", err)
+	}
+	if meta.IsSymlink() {
+		return fs.getSymlink(newPath, eID), nil
+	}
+	return fs.getFile(newPath, eID), nil
 }
 
 // Remove implements NodeRemover, which allows the removal of files.
@@ -179,10 +329,29 @@ func (fs *FS) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return fuse.EPERM
 	}
 
-	err := fs.provider.Delete("/" + req.Name)
+	return fs.remove("/"+req.Name, req.Dir)
+}
+
+// remove deletes the entry at fullPath, which must be a directory if dir is set (rmdir), and must
+// not be one otherwise (unlink).
+func (fs *FS) remove(fullPath string, dir bool) error {
+	entryID, err := fs.provider.Lookup(fullPath)
+	if err != nil {
+		return fs.fuseErr("fuse-remove", "Lookup for "+fullPath, err)
+	}
+	meta, err := fs.provider.ReadMeta(entryID)
 	if err != nil {
-		fs.logger.Error("fuse-remove", "provider.Delete(/"+req.Name+") Failed: ", err)
-		return fuse.EIO
+		return fs.fuseErr("fuse-remove", "ReadMeta for "+fullPath, err)
+	}
+	if dir && !meta.IsDirectory() {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if !dir && meta.IsDirectory() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	if err = fs.provider.Delete(fullPath); err != nil {
+		return fs.fuseErr("fuse-remove", "provider.Delete("+fullPath+")", err)
 	}
 	return nil
 }
@@ -0,0 +1,43 @@
+package nuggtofuse
+
+import (
+	"context"
+
+	"bazil.org/fuse"
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/nuggdb"
+	"github.com/twitchyliquid64/nugget/packet"
+)
+
+// statfsBlockSize is the block size statistics are reported in.
+const statfsBlockSize = 4096
+
+// Statfs implements fs.FSStatfser, reporting the capacity of the filesystem. The space used is the
+// space held by chunks, and the space available is the free space of the volume holding them, so
+// the filesystem appears as large as the chunks stored plus the room left for more. Providers which
+// cannot report statistics, including remote ends which predate Statfs, leave every field zero.
+func (fs *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	fs.logger.Info("fuse-statfs", "Got request")
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Namelen = nuggdb.MaxNameLen
+
+	p, ok := fs.provider.(nugget.StatfsDataSource)
+	if !ok {
+		return nil
+	}
+	stats, err := p.Statfs()
+	if err == packet.ErrNotSupported {
+		return nil
+	} else if err != nil {
+		return fs.fuseErr("fuse-statfs", "provider.Statfs()", err)
+	}
+
+	resp.Bfree = stats.FreeBytes / statfsBlockSize
+	resp.Bavail = resp.Bfree
+	resp.Blocks = (stats.ChunkBytes+statfsBlockSize-1)/statfsBlockSize + resp.Bfree
+	// entries are not limited, so each free block is counted as room for another
+	resp.Ffree = resp.Bfree
+	resp.Files = stats.Entries + resp.Ffree
+	return nil
+}
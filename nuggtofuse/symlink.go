@@ -0,0 +1,95 @@
+package nuggtofuse
+
+import (
+	"context"
+	"path"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/twitchyliquid64/nugget"
+)
+
+// Symlink represents is a FUSE wrapper around a symbolic link stored in the system.
+// Symlink MUST exist.
+type Symlink struct {
+	fs       *FS
+	fullPath string
+	inode    uint64
+}
+
+// Attr implements fs.Node, reporting the link with its target length as its size.
+func (l *Symlink) Attr(ctx context.Context, a *fuse.Attr) error {
+	l.fs.logger.Info("fuse-attr", "Got request for ", l.fullPath)
+	a.Inode = l.inode
+
+	entryID, err := l.fs.provider.Lookup(l.fullPath)
+	if err != nil {
+		return l.fs.fuseErr("fuse-attr", "Lookup for "+l.fullPath, err)
+	}
+
+	meta, err := l.fs.provider.ReadMeta(entryID)
+	if err != nil {
+		return l.fs.fuseErr("fuse-attr", "ReadMeta for "+l.fullPath, err)
+	}
+	fillAttr(a, meta)
+	return nil
+}
+
+// Readlink implements fs.NodeReadlinker, returning the target of the link.
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	l.fs.logger.Info("fuse-readlink", "Got request for ", l.fullPath)
+	p, ok := l.fs.provider.(nugget.SymlinkDataSink)
+	if !ok {
+		return "", fuse.Errno(syscall.ENOSYS)
+	}
+
+	target, err := p.Readlink(l.fullPath)
+	if err != nil {
+		return "", l.fs.fuseErr("fuse-readlink", "provider.Readlink("+l.fullPath+")", err)
+	}
+	return target, nil
+}
+
+// Setattr implements fs.NodeSetattrer, allowing changes to ownership and times.
+func (l *Symlink) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	l.fs.logger.Info("fuse-setattr", "Got request for ", l.fullPath, " with ", req.Valid)
+	return l.fs.setattr(l.fullPath, req)
+}
+
+// Forget implements fs.NodeForgetter, called once the kernel no longer refers to this node.
+func (l *Symlink) Forget() {
+	l.fs.forgetNode(l.fullPath, l)
+}
+
+// Symlink implements fs.NodeSymlinker, creating a symbolic link in this directory.
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	d.fs.logger.Info("fuse-symlink", "Got request for: ", path.Join(d.fullPath, req.NewName), " -> ", req.Target)
+	return d.fs.symlink(path.Join(d.fullPath, req.NewName), req)
+}
+
+// Symlink implements fs.NodeSymlinker, creating a symbolic link in the root directory.
+func (fs *FS) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	fs.logger.Info("fuse-symlink", "Got root request for: ", req.NewName, " -> ", req.Target)
+	return fs.symlink("/"+req.NewName, req)
+}
+
+// symlink creates the symbolic link described by req at fullPath.
+func (fs *FS) symlink(fullPath string, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if strings.Contains(req.NewName, "/") {
+		fs.logger.Error("fuse-symlink", "Cannot create node which contains slashes: ", req.NewName)
+		return nil, fuse.EPERM
+	}
+	p, ok := fs.provider.(nugget.SymlinkDataSink)
+	if !ok {
+		fs.logger.Error("fuse-symlink", "Provider does not support Symlink, cannot create ", fullPath)
+		return nil, fuse.Errno(syscall.ENOSYS)
+	}
+
+	eID, _, err := p.Symlink(fullPath, req.Target, nugget.NodeAttributes{UID: req.Uid, GID: req.Gid})
+	if err != nil {
+		return nil, fs.fuseErr("fuse-symlink", "provider.Symlink("+fullPath+")", err)
+	}
+	return fs.getSymlink(fullPath, eID), nil
+}
@@ -0,0 +1,136 @@
+package nuggtofuse
+
+import (
+	"context"
+
+	"bazil.org/fuse"
+	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/nuggdb"
+)
+
+// xattrErr maps an error from the extended attribute methods of a provider to its FUSE error. Names
+// which are too long are reported as ERANGE, as for setxattr(2), rather than ENAMETOOLONG.
+func (fs *FS) xattrErr(op, fullPath string, err error) error {
+	if err == nuggdb.ErrNameTooLong {
+		return fuse.ERANGE
+	}
+	return fs.fuseErr(op, "Extended attribute operation on "+fullPath, err)
+}
+
+// getxattr reads the extended attribute named by req from the entry at fullPath.
+func (fs *FS) getxattr(fullPath string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	p, ok := fs.provider.(nugget.XattrDataSink)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	value, err := p.Getxattr(fullPath, req.Name)
+	if err != nil {
+		return fs.xattrErr("fuse-getxattr", fullPath, err)
+	}
+	resp.Xattr = value
+	return nil
+}
+
+// listxattr lists the names of the extended attributes of the entry at fullPath.
+func (fs *FS) listxattr(fullPath string, resp *fuse.ListxattrResponse) error {
+	p, ok := fs.provider.(nugget.XattrDataSink)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	names, err := p.Listxattr(fullPath)
+	if err != nil {
+		return fs.xattrErr("fuse-listxattr", fullPath, err)
+	}
+	resp.Append(names...)
+	return nil
+}
+
+// setxattr applies a FUSE setxattr request to the entry at fullPath.
+func (fs *FS) setxattr(fullPath string, req *fuse.SetxattrRequest) error {
+	p, ok := fs.provider.(nugget.XattrDataSink)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	return fs.xattrErr("fuse-setxattr", fullPath, p.Setxattr(fullPath, req.Name, req.Xattr, req.Flags&(nuggdb.XattrCreate|nuggdb.XattrReplace)))
+}
+
+// removexattr removes the extended attribute named by req from the entry at fullPath.
+func (fs *FS) removexattr(fullPath string, req *fuse.RemovexattrRequest) error {
+	p, ok := fs.provider.(nugget.XattrDataSink)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	return fs.xattrErr("fuse-removexattr", fullPath, p.Removexattr(fullPath, req.Name))
+}
+
+// Getxattr implements fs.NodeGetxattrer, reading an extended attribute of the file.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	f.fs.logger.Info("fuse-getxattr", "Got request for ", f.fullPath, " (", req.Name, ")")
+	return f.fs.getxattr(f.fullPath, req, resp)
+}
+
+// Listxattr implements fs.NodeListxattrer, listing the extended attributes of the file.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	f.fs.logger.Info("fuse-listxattr", "Got request for ", f.fullPath)
+	return f.fs.listxattr(f.fullPath, resp)
+}
+
+// Setxattr implements fs.NodeSetxattrer, setting an extended attribute of the file.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	f.fs.logger.Info("fuse-setxattr", "Got request for ", f.fullPath, " (", req.Name, ")")
+	return f.fs.setxattr(f.fullPath, req)
+}
+
+// Removexattr implements fs.NodeRemovexattrer, removing an extended attribute of the file.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	f.fs.logger.Info("fuse-removexattr", "Got request for ", f.fullPath, " (", req.Name, ")")
+	return f.fs.removexattr(f.fullPath, req)
+}
+
+// Getxattr implements fs.NodeGetxattrer, reading an extended attribute of the directory.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	d.fs.logger.Info("fuse-getxattr", "Got request for ", d.fullPath, " (", req.Name, ")")
+	return d.fs.getxattr(d.fullPath, req, resp)
+}
+
+// Listxattr implements fs.NodeListxattrer, listing the extended attributes of the directory.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	d.fs.logger.Info("fuse-listxattr", "Got request for ", d.fullPath)
+	return d.fs.listxattr(d.fullPath, resp)
+}
+
+// Setxattr implements fs.NodeSetxattrer, setting an extended attribute of the directory.
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	d.fs.logger.Info("fuse-setxattr", "Got request for ", d.fullPath, " (", req.Name, ")")
+	return d.fs.setxattr(d.fullPath, req)
+}
+
+// Removexattr implements fs.NodeRemovexattrer, removing an extended attribute of the directory.
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	d.fs.logger.Info("fuse-removexattr", "Got request for ", d.fullPath, " (", req.Name, ")")
+	return d.fs.removexattr(d.fullPath, req)
+}
+
+// Getxattr implements fs.NodeGetxattrer, reading an extended attribute of the root directory.
+func (fs *FS) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	fs.logger.Info("fuse-getxattr", "Got root request (", req.Name, ")")
+	return fs.getxattr("/", req, resp)
+}
+
+// Listxattr implements fs.NodeListxattrer, listing the extended attributes of the root directory.
+func (fs *FS) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	fs.logger.Info("fuse-listxattr", "Got root request")
+	return fs.listxattr("/", resp)
+}
+
+// Setxattr implements fs.NodeSetxattrer, setting an extended attribute of the root directory.
+func (fs *FS) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	fs.logger.Info("fuse-setxattr", "Got root request (", req.Name, ")")
+	return fs.setxattr("/", req)
+}
+
+// Removexattr implements fs.NodeRemovexattrer, removing an extended attribute of the root directory.
+func (fs *FS) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	fs.logger.Info("fuse-removexattr", "Got root request (", req.Name, ")")
+	return fs.removexattr("/", req)
+}
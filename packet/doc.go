@@ -2,7 +2,6 @@ package packet
 
 import (
 	"encoding/gob"
-	"errors"
 	"io"
 	"sync"
 	"time"
@@ -41,8 +40,70 @@ const (
 	PktWriteResp
 	PktRead
 	PktReadResp
+	PktCreate
+	PktCreateResp
+	PktSetattr
+	PktSetattrResp
+	PktRename
+	PktRenameResp
+	PktListPage
+	PktListPageResp
+	PktSymlink
+	PktSymlinkResp
+	PktReadlink
+	PktReadlinkResp
+	PktLink
+	PktLinkResp
+	PktGetxattr
+	PktGetxattrResp
+	PktListxattr
+	PktListxattrResp
+	PktSetxattr
+	PktSetxattrResp
+	PktRemovexattr
+	PktRemovexattrResp
+	PktRemoveAll
+	PktRemoveAllResp
+	PktStatfs
+	PktStatfsResp
+	PktHello
+	PktHelloResp
+	PktFetchStream
+	PktFetchStreamResp
+	PktStoreStream
+	PktStoreStreamResp
+	PktStreamData
+	PktStreamAck
 )
 
+// ProtocolVersion is the version of the protocol spoken by this package, exchanged in Hello packets.
+// It changes when the meaning of existing packets changes; new packet types are instead discovered
+// from the packet types listed in the exchange.
+const ProtocolVersion = 2
+
+// FramedVersion is the first protocol version which carries packets in frames (see UseFrames). Ends
+// which agree on an earlier version keep using a single gob stream for the whole connection.
+const FramedVersion = 2
+
+// DefaultMaxMessageSize is the largest packet, in bytes, a server accepts unless configured otherwise.
+const DefaultMaxMessageSize = 32 * 1024 * 1024
+
+// LegacyPackets are the request packet types of the original protocol, which every server handles,
+// including those which predate the Hello exchange.
+var LegacyPackets = []PktType{
+	PktPing, PktLookup, PktReadMeta, PktList, PktFetch, PktReadData, PktStore, PktMkdir, PktDelete,
+	PktWrite, PktRead,
+}
+
+// MaxListPageSize is the largest number of entries returned in a single ListPageResp.
+const MaxListPageSize = 4096
+
+// StreamChunkSize is the most data carried by a single StreamData packet.
+const StreamChunkSize = 256 * 1024
+
+// StreamWindowSize is the number of bytes which may be sent on a stream before they are acknowledged.
+const StreamWindowSize = 4 * 1024 * 1024
+
 // ErrorCode represents classes of RPC failures.
 type ErrorCode byte
 
@@ -53,6 +114,18 @@ const (
 	ErrIOErr
 	ErrTimeout
 	ErrUnspec
+	ErrNoAttribute
+	ErrAttributeExists
+	ErrAttributeTooLarge
+	ErrDirNotEmpty
+	ErrExists
+	ErrNotDir
+	ErrIsDir
+	ErrNoSpace
+	ErrPermission
+	ErrNameTooLong
+	ErrInvalid
+	ErrUnsupported
 )
 
 // PingPong represents a ping/pong packet on the wire
@@ -99,6 +172,24 @@ type ListResp struct {
 	Entries   []nuggdb.DirEntry
 }
 
+// ListPageReq represents a paged List RPC on the wire. Cursor is empty for the first page,
+// and is otherwise the NextCursor of the previous page.
+type ListPageReq struct {
+	ID     uint64
+	Path   string
+	Cursor string
+	Limit  int
+}
+
+// ListPageResp represents the response to a paged List RPC on the wire. NextCursor is
+// empty once the listing is complete.
+type ListPageResp struct {
+	ID         uint64
+	ErrorCode  ErrorCode
+	Entries    []nuggdb.DirEntry
+	NextCursor string
+}
+
 // FetchReq represents a Fetch RPC on the wire
 type FetchReq struct {
 	ID        uint64
@@ -147,6 +238,7 @@ type StoreResp struct {
 type MkdirReq struct {
 	ID   uint64
 	Path string
+	Attr nugget.NodeAttributes
 }
 
 // MkdirResp represents the response to a Mkdir RPC on the wire
@@ -201,6 +293,245 @@ type ReadResp struct {
 	Data      []byte
 }
 
+// CreateReq represents a Create RPC on the wire
+type CreateReq struct {
+	ID   uint64
+	Path string
+	Attr nugget.NodeAttributes
+}
+
+// CreateResp represents the response to a Create RPC on the wire
+type CreateResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	EntryID   nugget.EntryID
+	Meta      nuggdb.EntryMetadata
+}
+
+// SetattrReq represents a Setattr RPC on the wire
+type SetattrReq struct {
+	ID      uint64
+	Path    string
+	Changes nugget.AttrChanges
+}
+
+// SetattrResp represents the response to a Setattr RPC on the wire
+type SetattrResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	EntryID   nugget.EntryID
+	Meta      nuggdb.EntryMetadata
+}
+
+// RenameReq represents a Rename RPC on the wire
+type RenameReq struct {
+	ID      uint64
+	OldPath string
+	NewPath string
+}
+
+// RenameResp represents the response to a Rename RPC on the wire
+type RenameResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+}
+
+// SymlinkReq represents a Symlink RPC on the wire
+type SymlinkReq struct {
+	ID     uint64
+	Path   string
+	Target string
+	Attr   nugget.NodeAttributes
+}
+
+// SymlinkResp represents the response to a Symlink RPC on the wire
+type SymlinkResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	EntryID   nugget.EntryID
+	Meta      nuggdb.EntryMetadata
+}
+
+// ReadlinkReq represents a Readlink RPC on the wire
+type ReadlinkReq struct {
+	ID   uint64
+	Path string
+}
+
+// ReadlinkResp represents the response to a Readlink RPC on the wire
+type ReadlinkResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	Target    string
+}
+
+// LinkReq represents a Link RPC on the wire
+type LinkReq struct {
+	ID      uint64
+	OldPath string
+	NewPath string
+}
+
+// LinkResp represents the response to a Link RPC on the wire
+type LinkResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	EntryID   nugget.EntryID
+	Meta      nuggdb.EntryMetadata
+}
+
+// GetxattrReq represents a Getxattr RPC on the wire
+type GetxattrReq struct {
+	ID   uint64
+	Path string
+	Name string
+}
+
+// GetxattrResp represents the response to a Getxattr RPC on the wire
+type GetxattrResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	Value     []byte
+}
+
+// ListxattrReq represents a Listxattr RPC on the wire
+type ListxattrReq struct {
+	ID   uint64
+	Path string
+}
+
+// ListxattrResp represents the response to a Listxattr RPC on the wire
+type ListxattrResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	Names     []string
+}
+
+// SetxattrReq represents a Setxattr RPC on the wire
+type SetxattrReq struct {
+	ID    uint64
+	Path  string
+	Name  string
+	Value []byte
+	Flags uint32
+}
+
+// SetxattrResp represents the response to a Setxattr RPC on the wire
+type SetxattrResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+}
+
+// RemovexattrReq represents a Removexattr RPC on the wire
+type RemovexattrReq struct {
+	ID   uint64
+	Path string
+	Name string
+}
+
+// RemovexattrResp represents the response to a Removexattr RPC on the wire
+type RemovexattrResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+}
+
+// RemoveAllReq represents a RemoveAll RPC on the wire
+type RemoveAllReq struct {
+	ID   uint64
+	Path string
+}
+
+// RemoveAllResp represents the response to a RemoveAll RPC on the wire
+type RemoveAllResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+}
+
+// StatfsReq represents a Statfs RPC on the wire
+type StatfsReq struct {
+	ID uint64
+}
+
+// StatfsResp represents the response to a Statfs RPC on the wire
+type StatfsResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	Stats     nugget.FSStats
+}
+
+// Hello opens a connection, describing the protocol spoken by the client. Packets lists the request
+// packet types the client may send.
+type Hello struct {
+	Version uint32
+	Packets []PktType
+}
+
+// HelloResp answers a Hello, describing the protocol spoken by the server. Version is the highest
+// version both ends speak, and Packets lists the request packet types the server handles. Packets
+// larger than MaxMessageSize bytes, and pages of more than MaxListPageSize entries, are refused.
+type HelloResp struct {
+	Version         uint32
+	Packets         []PktType
+	MaxMessageSize  uint64
+	MaxListPageSize int
+}
+
+// FetchStreamReq opens a stream of the data of the file at Path, starting at Offset and holding at most
+// Size bytes, or the rest of the file if Size is negative. Streams are only available over frames.
+type FetchStreamReq struct {
+	ID     uint64
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+// FetchStreamResp answers a FetchStreamReq with the metadata of the file. Unless ErrorCode is set, it is
+// followed by StreamData packets with the same ID, each acknowledged with a StreamAck once consumed.
+type FetchStreamResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	EntryID   nugget.EntryID
+	Meta      nuggdb.EntryMetadata
+}
+
+// StoreStreamReq opens a stream of data to write to the file at Path from Offset. If Truncate is set the
+// file is first created or emptied, as by Store. The request is followed by StreamData packets with the
+// same ID, which the server acknowledges with StreamAck packets as they are written.
+type StoreStreamReq struct {
+	ID       uint64
+	Path     string
+	Offset   int64
+	Truncate bool
+}
+
+// StoreStreamResp answers a StoreStreamReq once the last StreamData packet has been written, or as soon
+// as writing fails, in which case the rest of the stream is dropped.
+type StoreStreamResp struct {
+	ID        uint64
+	ErrorCode ErrorCode
+	Written   int64
+	EntryID   nugget.EntryID
+	Meta      nuggdb.EntryMetadata
+}
+
+// StreamData carries the next part of a stream. Seq counts the packets of the stream from zero, and EOF
+// is set on the last. A packet with ErrorCode set ends the stream with that error.
+type StreamData struct {
+	ID        uint64
+	Seq       uint64
+	Data      []byte
+	EOF       bool
+	ErrorCode ErrorCode
+}
+
+// StreamAck allows the sender of a stream to send Bytes more bytes, as data it sent has been consumed.
+// Cancel ends the stream early.
+type StreamAck struct {
+	ID     uint64
+	Bytes  uint32
+	Cancel bool
+}
+
 // Transiever takes a network bytestream and interprets it into packet structures.
 type Transiever struct {
 	packetDecoder *gob.Decoder
@@ -210,24 +541,12 @@ type Transiever struct {
 	writer io.Writer
 
 	sendLock sync.Mutex
-}
 
-// ErrNoEnt indicates that component requested did not exist.
-var ErrNoEnt = errors.New("No entity")
-
-// ErrorCodeToErr maps error codes returned via RPC to actual error types.
-func ErrorCodeToErr(code ErrorCode) error {
-	switch code {
-	case ErrNoError:
-		return nil
-	case ErrNoEntity:
-		return ErrNoEnt
-	case ErrIOErr:
-		return errors.New("IO Error")
-	case ErrTimeout:
-		return errors.New("Timeout")
-	case ErrUnspec:
-		return errors.New("Unspecified")
-	}
-	return errors.New("Unknown Error")
+	// framed is set once both ends have agreed to carry packets in frames. The header and payload of
+	// the frame last read by Decode are held until the next call to Decode.
+	framed       bool
+	maxFrameSize uint32
+	frame        frameHeader
+	payload      []byte
+	frameErr     error
 }
@@ -0,0 +1,100 @@
+package packet
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/twitchyliquid64/nugget/nuggdb"
+)
+
+// ErrNoEnt indicates that component requested did not exist.
+var ErrNoEnt = errors.New("No entity")
+
+// ErrNotSupported is returned for an operation the remote end does not support.
+var ErrNotSupported = errors.New("Operation not supported by the remote end")
+
+var (
+	errIOErr   = errors.New("IO Error")
+	errTimeout = errors.New("Timeout")
+	errUnspec  = errors.New("Unspecified")
+)
+
+// errorTable is the single mapping between the errors of a provider, the ErrorCode they are sent
+// as, and the errno reported for them by a FUSE mount. err is the error a code decodes to; the
+// errors in also are sent as the same code. Errors which do not appear are sent as ErrUnspec and
+// reported as EIO.
+var errorTable = []struct {
+	code  ErrorCode
+	err   error
+	also  []error
+	errno syscall.Errno
+}{
+	{ErrNoEntity, ErrNoEnt, []error{nuggdb.ErrPathNotFound, nuggdb.ErrMetaNotFound, nuggdb.ErrChunkNotFound}, syscall.ENOENT},
+	{ErrIOErr, errIOErr, nil, syscall.EIO},
+	{ErrTimeout, errTimeout, nil, syscall.ETIMEDOUT},
+	{ErrUnspec, errUnspec, nil, syscall.EIO},
+	{ErrNoAttribute, nuggdb.ErrXattrNotFound, nil, syscall.ENODATA},
+	{ErrAttributeExists, nuggdb.ErrXattrExists, nil, syscall.EEXIST},
+	{ErrAttributeTooLarge, nuggdb.ErrXattrTooLarge, nil, syscall.E2BIG},
+	{ErrDirNotEmpty, nuggdb.ErrNotEmpty, nil, syscall.ENOTEMPTY},
+	{ErrExists, nuggdb.ErrPathExists, nil, syscall.EEXIST},
+	{ErrNotDir, nuggdb.ErrNotDir, nil, syscall.ENOTDIR},
+	{ErrIsDir, nuggdb.ErrIsDir, nil, syscall.EISDIR},
+	{ErrNoSpace, nuggdb.ErrNoSpace, nil, syscall.ENOSPC},
+	{ErrPermission, nuggdb.ErrPermission, []error{nuggdb.ErrLinkDirectory, os.ErrPermission}, syscall.EPERM},
+	{ErrNameTooLong, nuggdb.ErrNameTooLong, nil, syscall.ENAMETOOLONG},
+	{ErrInvalid, nuggdb.ErrInvalid, []error{nuggdb.ErrNotSymlink, nuggdb.ErrInvalidLinkTarget, nuggdb.ErrInvalidCursor}, syscall.EINVAL},
+	{ErrUnsupported, ErrNotSupported, nil, syscall.ENOTSUP},
+}
+
+// ErrorCodeToErr maps error codes returned via RPC to actual error types. Codes for provider errors
+// map to the error of the provider, so callers can compare against the same errors whether the
+// provider is local or remote.
+func ErrorCodeToErr(code ErrorCode) error {
+	if code == ErrNoError {
+		return nil
+	}
+	for _, e := range errorTable {
+		if e.code == code {
+			return e.err
+		}
+	}
+	return errors.New("Unknown Error")
+}
+
+// ErrToErrorCode maps an error returned by a provider to the ErrorCode it is sent as.
+func ErrToErrorCode(err error) ErrorCode {
+	if err == nil {
+		return ErrNoError
+	}
+	for _, e := range errorTable {
+		if err == e.err {
+			return e.code
+		}
+		for _, also := range e.also {
+			if err == also {
+				return e.code
+			}
+		}
+	}
+	if os.IsPermission(err) {
+		return ErrPermission
+	}
+	return ErrUnspec
+}
+
+// Errno maps an error returned by a provider, local or remote, to the errno reported by a FUSE mount.
+// EIO is returned for errors without a mapping, and 0 for a nil error.
+func Errno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	code := ErrToErrorCode(err)
+	for _, e := range errorTable {
+		if e.code == code {
+			return e.errno
+		}
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,56 @@
+package packet
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/twitchyliquid64/nugget/nuggdb"
+)
+
+func TestErrorCodesRoundTrip(t *testing.T) {
+	for _, e := range errorTable {
+		if code := ErrToErrorCode(ErrorCodeToErr(e.code)); code != e.code {
+			t.Errorf("Expected code %d to survive a round trip, got %d", e.code, code)
+		}
+	}
+	if ErrorCodeToErr(ErrNoError) != nil || ErrToErrorCode(nil) != ErrNoError {
+		t.Error("Expected ErrNoError to map to a nil error")
+	}
+}
+
+func TestErrorsMapToErrno(t *testing.T) {
+	tcs := []struct {
+		err   error
+		code  ErrorCode
+		errno syscall.Errno
+	}{
+		{nuggdb.ErrPathNotFound, ErrNoEntity, syscall.ENOENT},
+		{ErrNoEnt, ErrNoEntity, syscall.ENOENT},
+		{nuggdb.ErrPathExists, ErrExists, syscall.EEXIST},
+		{nuggdb.ErrNotDir, ErrNotDir, syscall.ENOTDIR},
+		{nuggdb.ErrIsDir, ErrIsDir, syscall.EISDIR},
+		{nuggdb.ErrNotEmpty, ErrDirNotEmpty, syscall.ENOTEMPTY},
+		{nuggdb.ErrNoSpace, ErrNoSpace, syscall.ENOSPC},
+		{nuggdb.ErrLinkDirectory, ErrPermission, syscall.EPERM},
+		{&os.PathError{Op: "open", Path: "/x", Err: syscall.EACCES}, ErrPermission, syscall.EPERM},
+		{nuggdb.ErrNameTooLong, ErrNameTooLong, syscall.ENAMETOOLONG},
+		{nuggdb.ErrNotSymlink, ErrInvalid, syscall.EINVAL},
+		{nuggdb.ErrXattrNotFound, ErrNoAttribute, syscall.ENODATA},
+		{ErrNotSupported, ErrUnsupported, syscall.ENOTSUP},
+		{errors.New("something else"), ErrUnspec, syscall.EIO},
+	}
+	for _, tc := range tcs {
+		if code := ErrToErrorCode(tc.err); code != tc.code {
+			t.Errorf("%v: expected code %d, got %d", tc.err, tc.code, code)
+		}
+		if errno := Errno(tc.err); errno != tc.errno {
+			t.Errorf("%v: expected %v, got %v", tc.err, tc.errno, errno)
+		}
+		// the error decoded by a client maps to the same errno
+		if errno := Errno(ErrorCodeToErr(tc.code)); errno != tc.errno {
+			t.Errorf("%v: expected %v once decoded, got %v", tc.err, tc.errno, errno)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+)
+
+// frameHeaderSize is the size of the header starting every frame: the packet type, an error code, the
+// request ID and the length of the payload which follows, in that order and big endian.
+const frameHeaderSize = 1 + 1 + 8 + 4
+
+var (
+	// ErrNotFramed is returned when a frame is written on a connection which does not use frames.
+	ErrNotFramed = errors.New("Connection does not carry packets in frames")
+	// ErrFrameTooLarge is returned for a frame whose payload exceeds the size accepted by the Transiever.
+	// The payload is skipped, so the frames after it can still be decoded.
+	ErrFrameTooLarge = errors.New("Frame exceeds the maximum message size")
+)
+
+// frameHeader describes a single frame.
+type frameHeader struct {
+	Type      PktType
+	ErrorCode ErrorCode
+	ID        uint64
+	Length    uint32
+}
+
+// FrameError is returned when the payload of a request frame cannot be decoded. Only the request the frame
+// belongs to is affected: the frames after it can still be decoded.
+type FrameError struct {
+	Type PktType
+	ID   uint64
+	Err  error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("Frame of type %d for request %d: %v", e.Type, e.ID, e.Err)
+}
+
+// UseFrames switches the Transiever from a single gob stream to carrying every packet in its own frame.
+// A frame has a fixed header (see frameHeaderSize) followed by a payload gob encoded on its own, so
+// frames of unknown types, and frames which cannot be decoded, are skipped without desynchronizing the
+// connection. Frames with payloads over maxFrameSize bytes are skipped unread; zero means no limit.
+//
+// Both ends must switch at the same point in the stream, with no packets in flight: after a Hello
+// exchange agreeing on FramedVersion or later.
+func (t *Transiever) UseFrames(maxFrameSize uint64) {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+
+	if maxFrameSize == 0 || maxFrameSize > math.MaxUint32 {
+		maxFrameSize = math.MaxUint32
+	}
+	t.framed = true
+	t.maxFrameSize = uint32(maxFrameSize)
+}
+
+// Framed returns true if packets are carried in frames.
+func (t *Transiever) Framed() bool {
+	return t.framed
+}
+
+// RequestID returns the request ID carried in the header of the frame last read by Decode, or zero if
+// packets are not carried in frames.
+func (t *Transiever) RequestID() uint64 {
+	return t.frame.ID
+}
+
+// WriteErrorResp writes a frame of the given response type which carries only the request ID and an error
+// code, answering a request which could not be decoded or is not understood. The receiver decodes it as a
+// response of that type with only ID and ErrorCode set.
+func (t *Transiever) WriteErrorResp(pktType PktType, id uint64, code ErrorCode) error {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+
+	if !t.framed {
+		return ErrNotFramed
+	}
+	return t.writeFrame(frameHeader{Type: pktType, ErrorCode: code, ID: id}, nil)
+}
+
+// send writes a packet of the given type. t.sendLock must not be held.
+func (t *Transiever) send(pktType PktType, v interface{}) error {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+
+	if !t.framed {
+		err := t.packetEncoder.Encode(pktType)
+		if err != nil {
+			return err
+		}
+		return t.packetEncoder.Encode(v)
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(v); err != nil {
+		return err
+	}
+	if uint64(payload.Len()) > math.MaxUint32 {
+		return ErrFrameTooLarge
+	}
+	return t.writeFrame(frameHeader{Type: pktType, ID: requestID(v), Length: uint32(payload.Len())}, payload.Bytes())
+}
+
+// writeFrame writes a frame in a single call, so frames are not interleaved. t.sendLock must be held.
+func (t *Transiever) writeFrame(hdr frameHeader, payload []byte) error {
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = byte(hdr.Type)
+	buf[1] = byte(hdr.ErrorCode)
+	binary.BigEndian.PutUint64(buf[2:10], hdr.ID)
+	binary.BigEndian.PutUint32(buf[10:14], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	_, err := t.writer.Write(buf)
+	return err
+}
+
+// decodeFrame reads the next frame, holding its header and payload until the next call. Errors are only
+// returned if the connection can no longer be read.
+func (t *Transiever) decodeFrame() (PktType, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(t.reader, hdr[:]); err != nil {
+		return PktUnknown, err
+	}
+	t.frame = frameHeader{
+		Type:      PktType(hdr[0]),
+		ErrorCode: ErrorCode(hdr[1]),
+		ID:        binary.BigEndian.Uint64(hdr[2:10]),
+		Length:    binary.BigEndian.Uint32(hdr[10:14]),
+	}
+	t.payload, t.frameErr = nil, nil
+
+	if t.frame.Length > t.maxFrameSize {
+		if _, err := io.CopyN(ioutil.Discard, t.reader, int64(t.frame.Length)); err != nil {
+			return PktUnknown, err
+		}
+		t.frameErr = ErrFrameTooLarge
+		return t.frame.Type, nil
+	}
+	t.payload = make([]byte, t.frame.Length)
+	if _, err := io.ReadFull(t.reader, t.payload); err != nil {
+		return PktUnknown, err
+	}
+	return t.frame.Type, nil
+}
+
+// receive decodes the packet following the last type read by Decode into v.
+//
+// When packets are carried in frames, a response which cannot be decoded fails only its own request: v is
+// returned with its ID and an ErrorCode of ErrIOErr (or ErrInvalid for an oversized frame), as if the
+// remote end had reported the error. A request which cannot be decoded returns a *FrameError.
+func (t *Transiever) receive(v interface{}) error {
+	if !t.framed {
+		return t.packetDecoder.Decode(v)
+	}
+
+	err := t.frameErr
+	if err == nil && t.frame.ErrorCode != ErrNoError && len(t.payload) == 0 {
+		if setError(v, t.frame.ID, t.frame.ErrorCode) {
+			return nil
+		}
+	}
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(t.payload)).Decode(v)
+	}
+	if err == nil {
+		return nil
+	}
+
+	code := ErrIOErr
+	if err == ErrFrameTooLarge {
+		code = ErrInvalid
+	}
+	if setError(v, t.frame.ID, code) {
+		return nil
+	}
+	return &FrameError{Type: t.frame.Type, ID: t.frame.ID, Err: err}
+}
+
+// requestID returns the ID field of the packet v points to, or zero if it has none.
+func requestID(v interface{}) uint64 {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return 0
+	}
+	if id := rv.FieldByName("ID"); id.IsValid() && id.Kind() == reflect.Uint64 {
+		return id.Uint()
+	}
+	return 0
+}
+
+// setError resets the response v points to, leaving only its ID and ErrorCode set. It returns false if v
+// is not a response.
+func setError(v interface{}, id uint64, code ErrorCode) bool {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	rv = rv.Elem()
+	idField, codeField := rv.FieldByName("ID"), rv.FieldByName("ErrorCode")
+	if !idField.IsValid() || idField.Kind() != reflect.Uint64 || !codeField.IsValid() || codeField.Type() != reflect.TypeOf(code) {
+		return false
+	}
+	rv.Set(reflect.Zero(rv.Type()))
+	idField.SetUint(id)
+	codeField.Set(reflect.ValueOf(code))
+	return true
+}
@@ -0,0 +1,118 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransieverSwitchesToFramesAfterHello(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	transiever.WriteHello(&Hello{Version: ProtocolVersion})
+	transiever.UseFrames(0)
+	if err := transiever.WriteLookupReq(&LookupReq{ID: 7, Path: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := MakeTransiever(&dataChannel, &dataChannel)
+	pktType, err := reader.Decode()
+	if err != nil || pktType != PktHello {
+		t.Fatal("Expected PktHello packet type, got", pktType, err)
+	}
+	var hello Hello
+	if err = reader.GetHello(&hello); err != nil || hello.Version != ProtocolVersion {
+		t.Fatal("Incorrect packet value", hello, err)
+	}
+	reader.UseFrames(DefaultMaxMessageSize)
+	if !reader.Framed() {
+		t.Error("Expected the transiever to be framed")
+	}
+
+	pktType, err = reader.Decode()
+	if err != nil || pktType != PktLookup {
+		t.Fatal("Expected PktLookup packet type, got", pktType, err)
+	}
+	if reader.RequestID() != 7 {
+		t.Error("Expected request ID 7 in the frame header, got", reader.RequestID())
+	}
+	var out LookupReq
+	if err = reader.GetLookupReq(&out); err != nil || out.ID != 7 || out.Path != "/a" {
+		t.Error("Incorrect packet value", out, err)
+	}
+}
+
+func TestTransieverSkipsBadFrames(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+	transiever.UseFrames(64)
+
+	transiever.writeFrame(frameHeader{Type: PktType(250), ID: 1}, []byte("from the future"))
+	transiever.writeFrame(frameHeader{Type: PktLookup, ID: 2}, []byte("not gob"))
+	transiever.writeFrame(frameHeader{Type: PktLookupResp, ID: 3}, []byte("not gob"))
+	transiever.writeFrame(frameHeader{Type: PktReadResp, ID: 4}, make([]byte, 65))
+	transiever.WriteLookupReq(&LookupReq{ID: 5, Path: "/b"})
+
+	pktType, err := transiever.Decode()
+	if err != nil || pktType != PktType(250) {
+		t.Fatal("Expected the unknown packet type, got", pktType, err)
+	}
+	if err = transiever.Discard(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = transiever.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var req LookupReq
+	err = transiever.GetLookupReq(&req)
+	if frameErr, ok := err.(*FrameError); !ok || frameErr.ID != 2 || frameErr.Type != PktLookup {
+		t.Error("Expected a FrameError for request 2, got", err)
+	}
+
+	if _, err = transiever.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var resp LookupResp
+	if err = transiever.GetLookupResp(&resp); err != nil || resp.ID != 3 || resp.ErrorCode != ErrIOErr {
+		t.Error("Expected request 3 to fail with ErrIOErr, got", resp, err)
+	}
+
+	if _, err = transiever.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var readResp ReadResp
+	if err = transiever.GetReadResp(&readResp); err != nil || readResp.ID != 4 || readResp.ErrorCode != ErrInvalid {
+		t.Error("Expected oversized request 4 to fail with ErrInvalid, got", readResp.ID, readResp.ErrorCode, err)
+	}
+
+	pktType, err = transiever.Decode()
+	if err != nil || pktType != PktLookup {
+		t.Fatal("Expected PktLookup packet type, got", pktType, err)
+	}
+	if err = transiever.GetLookupReq(&req); err != nil || req.ID != 5 || req.Path != "/b" {
+		t.Error("Incorrect packet value", req, err)
+	}
+}
+
+func TestTransieverWritesErrorResp(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	if err := transiever.WriteErrorResp(PktStatfsResp, 9, ErrUnsupported); err != ErrNotFramed {
+		t.Error("Expected ErrNotFramed, got", err)
+	}
+	transiever.UseFrames(0)
+	if err := transiever.WriteErrorResp(PktStatfsResp, 9, ErrUnsupported); err != nil {
+		t.Fatal(err)
+	}
+
+	pktType, err := transiever.Decode()
+	if err != nil || pktType != PktStatfsResp {
+		t.Fatal("Expected PktStatfsResp packet type, got", pktType, err)
+	}
+	var out StatfsResp
+	if err = transiever.GetStatfsResp(&out); err != nil || out.ID != 9 || out.ErrorCode != ErrUnsupported {
+		t.Error("Incorrect packet value", out, err)
+	}
+}
@@ -0,0 +1,192 @@
+package packet
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStreamClosed is returned when sending on a stream which has ended or been cancelled.
+	ErrStreamClosed = errors.New("Stream closed")
+	// ErrStreamStalled is returned if the remote end of a stream stops sending data or acknowledgements.
+	ErrStreamStalled = errors.New("Stream stalled")
+	// ErrStreamSequence is returned for a StreamData packet which does not follow the last one received.
+	ErrStreamSequence = errors.New("StreamData packet out of sequence")
+	// ErrStreamOverrun is returned when more data arrives on a stream than was acknowledged.
+	ErrStreamOverrun = errors.New("Stream data exceeds the window")
+)
+
+// Window tracks how many bytes the sending end of a stream may send before it must wait for the
+// receiving end to acknowledge them.
+type Window struct {
+	lock    sync.Mutex
+	credit  int64
+	closed  bool
+	changed chan struct{} // closed and replaced whenever credit is granted or the window is closed
+}
+
+// NewWindow returns a Window allowing size bytes to be sent before any are acknowledged.
+func NewWindow(size int64) *Window {
+	return &Window{credit: size, changed: make(chan struct{})}
+}
+
+// Take waits until n bytes may be sent, and deducts them from the window. It gives up once the window
+// is closed, or if nothing is acknowledged for timeout (zero waits forever).
+func (w *Window) Take(n int64, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		w.lock.Lock()
+		if w.closed {
+			w.lock.Unlock()
+			return ErrStreamClosed
+		}
+		if w.credit >= n {
+			w.credit -= n
+			w.lock.Unlock()
+			return nil
+		}
+		changed := w.changed
+		w.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+			return ErrStreamStalled
+		}
+	}
+}
+
+// Grant allows n more bytes to be sent, as data sent earlier has been acknowledged.
+func (w *Window) Grant(n int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.credit += n
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// Close stops the stream, failing any waiting or later calls to Take.
+func (w *Window) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.changed)
+	}
+}
+
+// Changed returns a channel which is closed when credit is next granted, or the window is closed.
+func (w *Window) Changed() <-chan struct{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.changed
+}
+
+// StreamBuffer holds the data received on a stream until it is consumed. It holds at most StreamWindowSize
+// bytes, as the sender waits for the data to be acknowledged once consumed.
+type StreamBuffer struct {
+	lock    sync.Mutex
+	chunks  [][]byte
+	size    int64
+	next    uint64        // sequence number of the next StreamData packet
+	err     error         // returned once the chunks are consumed: io.EOF after the last packet
+	arrived chan struct{} // signalled when chunks are added or the stream ends
+}
+
+// NewStreamBuffer returns an empty StreamBuffer.
+func NewStreamBuffer() *StreamBuffer {
+	return &StreamBuffer{arrived: make(chan struct{}, 1)}
+}
+
+// Put adds the data of a StreamData packet to the buffer. Packets which are out of sequence, or overrun
+// the window, end the stream with an error, which is also returned. Packets received after the stream
+// has ended return ErrStreamClosed.
+func (b *StreamBuffer) Put(d *StreamData) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	defer b.signal()
+
+	switch {
+	case b.err != nil:
+		return ErrStreamClosed
+	case d.ErrorCode != ErrNoError:
+		b.err = ErrorCodeToErr(d.ErrorCode)
+		return nil
+	case d.Seq != b.next:
+		b.err = ErrStreamSequence
+		return b.err
+	case b.size+int64(len(d.Data)) > StreamWindowSize:
+		b.err = ErrStreamOverrun
+		return b.err
+	}
+
+	b.next++
+	if len(d.Data) > 0 {
+		b.chunks = append(b.chunks, d.Data)
+		b.size += int64(len(d.Data))
+	}
+	if d.EOF {
+		b.err = io.EOF
+	}
+	return nil
+}
+
+// Close ends the stream with err, unless it has already ended. Data already buffered can still be consumed.
+func (b *StreamBuffer) Close(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err == nil {
+		b.err = err
+		b.signal()
+	}
+}
+
+// Next returns the next chunk of data received, waiting up to timeout (zero waits forever) for it to arrive.
+// Once the stream has ended and its data has been consumed, the error ending the stream is returned, which
+// is io.EOF if all of the data was received.
+func (b *StreamBuffer) Next(timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		b.lock.Lock()
+		if len(b.chunks) > 0 {
+			chunk := b.chunks[0]
+			b.chunks = b.chunks[1:]
+			b.size -= int64(len(chunk))
+			b.lock.Unlock()
+			return chunk, nil
+		}
+		if b.err != nil {
+			b.lock.Unlock()
+			return nil, b.err
+		}
+		b.lock.Unlock()
+
+		select {
+		case <-b.arrived:
+		case <-expired:
+			return nil, ErrStreamStalled
+		}
+	}
+}
+
+// signal wakes a waiting call to Next. b.lock must be held.
+func (b *StreamBuffer) signal() {
+	select {
+	case b.arrived <- struct{}{}:
+	default:
+	}
+}
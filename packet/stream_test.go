@@ -0,0 +1,71 @@
+package packet
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	w := NewWindow(10)
+	if err := w.Take(8, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Take(4, time.Millisecond*10); err != ErrStreamStalled {
+		t.Error("Expected ErrStreamStalled, got", err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		w.Grant(2)
+	}()
+	if err := w.Take(4, time.Second); err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		w.Close()
+	}()
+	if err := w.Take(1, 0); err != ErrStreamClosed {
+		t.Error("Expected ErrStreamClosed, got", err)
+	}
+}
+
+func TestStreamBuffer(t *testing.T) {
+	b := NewStreamBuffer()
+	if _, err := b.Next(time.Millisecond); err != ErrStreamStalled {
+		t.Error("Expected ErrStreamStalled, got", err)
+	}
+
+	b.Put(&StreamData{Seq: 0, Data: []byte("ab")})
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		b.Put(&StreamData{Seq: 1, Data: []byte("cd"), EOF: true})
+	}()
+	for _, expected := range []string{"ab", "cd"} {
+		if chunk, err := b.Next(time.Second); err != nil || string(chunk) != expected {
+			t.Errorf("Expected %q, got %q (%v)", expected, chunk, err)
+		}
+	}
+	if _, err := b.Next(time.Second); err != io.EOF {
+		t.Error("Expected io.EOF, got", err)
+	}
+	if err := b.Put(&StreamData{Seq: 2}); err != ErrStreamClosed {
+		t.Error("Expected ErrStreamClosed, got", err)
+	}
+
+	b = NewStreamBuffer()
+	if err := b.Put(&StreamData{Seq: 1}); err != ErrStreamSequence {
+		t.Error("Expected ErrStreamSequence, got", err)
+	}
+	b = NewStreamBuffer()
+	if err := b.Put(&StreamData{Data: make([]byte, StreamWindowSize+1)}); err != ErrStreamOverrun {
+		t.Error("Expected ErrStreamOverrun, got", err)
+	}
+	b = NewStreamBuffer()
+	b.Put(&StreamData{ErrorCode: ErrNoSpace})
+	if _, err := b.Next(time.Second); err != ErrorCodeToErr(ErrNoSpace) {
+		t.Error("Expected the error of the stream, got", err)
+	}
+}
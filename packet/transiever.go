@@ -1,12 +1,20 @@
 package packet
 
 import (
+	"bufio"
 	"encoding/gob"
 	"io"
+	"reflect"
 )
 
 // MakeTransiever returns an initialized Transiever object to be used for packet generation / decoding.
+// Packets are written as a single gob stream until UseFrames is called.
 func MakeTransiever(reader io.Reader, writer io.Writer) *Transiever {
+	// gob does not read ahead of the current packet if given an io.ByteReader, so the stream can
+	// switch to frames without losing buffered data.
+	if _, ok := reader.(io.ByteReader); !ok {
+		reader = bufio.NewReader(reader)
+	}
 	ret := &Transiever{
 		reader: reader,
 		writer: writer,
@@ -19,6 +27,9 @@ func MakeTransiever(reader io.Reader, writer io.Writer) *Transiever {
 // Decode reads the type prefix of the next packet, leaving the actual packet in the buffer.
 // Future invocations (based on the type) can get the packet-specific data using GetPing() etc.
 func (t *Transiever) Decode() (PktType, error) {
+	if t.framed {
+		return t.decodeFrame()
+	}
 	var pktType PktType
 	err := t.packetDecoder.Decode(&pktType)
 	if err != nil {
@@ -27,347 +38,542 @@ func (t *Transiever) Decode() (PktType, error) {
 	return pktType, nil
 }
 
+// Discard reads and drops the packet following a type prefix which is not understood, so the packets
+// after it can still be decoded.
+func (t *Transiever) Discard() error {
+	if t.framed {
+		return nil // Decode already read the whole frame
+	}
+	return t.packetDecoder.DecodeValue(reflect.Value{})
+}
+
 // GetPing decodes a ping/pong packet from the network.
 func (t *Transiever) GetPing(ping *PingPong) error {
-	return t.packetDecoder.Decode(ping)
+	return t.receive(ping)
 }
 
 // WritePing writes a ping packet to the remote end.
 func (t *Transiever) WritePing(ping *PingPong) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktPing)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(ping)
+	return t.send(PktPing, ping)
 }
 
 // WritePong writes a ping packet to the remote end.
 func (t *Transiever) WritePong(ping *PingPong) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktPong)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(ping)
+	return t.send(PktPong, ping)
 }
 
 // WriteLookupReq writes a Lookup RPC packet to the remote end.
 func (t *Transiever) WriteLookupReq(l *LookupReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktLookup)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktLookup, l)
 }
 
 // GetLookupReq decodes a LookupReq packet from the network.
 func (t *Transiever) GetLookupReq(l *LookupReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 // WriteLookupResp writes the response to a Lookup RPC packet to the remote end.
 func (t *Transiever) WriteLookupResp(l *LookupResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktLookupResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktLookupResp, l)
 }
 
 // GetLookupResp decodes a LookupReq packet from the network.
 func (t *Transiever) GetLookupResp(l *LookupResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 // WriteReadMetaReq writes a ReadMeta RPC packet to the remote end.
 func (t *Transiever) WriteReadMetaReq(l *ReadMetaReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktReadMeta)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktReadMeta, l)
 }
 
 // GetReadMetaReq decodes a ReadMetaReq packet from the network.
 func (t *Transiever) GetReadMetaReq(l *ReadMetaReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 // WriteReadMetaResp writes a ReadMetaResp RPC packet to the remote end.
 func (t *Transiever) WriteReadMetaResp(l *ReadMetaResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktReadMetaResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktReadMetaResp, l)
 }
 
 // GetReadMetaResp decodes a ReadMetaResp packet from the network.
 func (t *Transiever) GetReadMetaResp(l *ReadMetaResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 // WriteListReq writes a List RPC packet to the remote end.
 func (t *Transiever) WriteListReq(l *ListReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktList)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktList, l)
 }
 
 // GetListReq decodes a ListReq packet from the network.
 func (t *Transiever) GetListReq(l *ListReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 // WriteListResp writes a ListResp RPC packet to the remote end.
 func (t *Transiever) WriteListResp(l *ListResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktListResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktListResp, l)
 }
 
 // GetListResp decodes a ListResp packet from the network.
 func (t *Transiever) GetListResp(l *ListResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
+}
+
+// WriteListPageReq writes a paged List RPC packet to the remote end.
+func (t *Transiever) WriteListPageReq(l *ListPageReq) error {
+	return t.send(PktListPage, l)
+}
+
+// GetListPageReq decodes a ListPageReq packet from the network.
+func (t *Transiever) GetListPageReq(l *ListPageReq) error {
+	return t.receive(l)
+}
+
+// WriteListPageResp writes a ListPageResp RPC packet to the remote end.
+func (t *Transiever) WriteListPageResp(l *ListPageResp) error {
+	return t.send(PktListPageResp, l)
+}
+
+// GetListPageResp decodes a ListPageResp packet from the network.
+func (t *Transiever) GetListPageResp(l *ListPageResp) error {
+	return t.receive(l)
 }
 
 // WriteFetchReq writes a Fetch RPC packet to the remote end.
 func (t *Transiever) WriteFetchReq(l *FetchReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktFetch)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktFetch, l)
 }
 
 // GetFetchReq decodes a FetchReq packet from the network.
 func (t *Transiever) GetFetchReq(l *FetchReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 // WriteFetchResp writes a FetchResp RPC packet to the remote end.
 func (t *Transiever) WriteFetchResp(l *FetchResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktFetchResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktFetchResp, l)
 }
 
 // GetFetchResp decodes a FetchResp packet from the network.
 func (t *Transiever) GetFetchResp(l *FetchResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteReadDataReq(l *ReadDataReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktReadData)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktReadData, l)
 }
 
 func (t *Transiever) GetReadDataReq(l *ReadDataReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteReadDataResp(l *ReadDataResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktReadDataResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktReadDataResp, l)
 }
 
 func (t *Transiever) GetReadDataResp(l *ReadDataResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteStoreReq(l *StoreReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktStore)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktStore, l)
 }
 
 func (t *Transiever) GetStoreReq(l *StoreReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteStoreResp(l *StoreResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktStoreResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktStoreResp, l)
 }
 
 func (t *Transiever) GetStoreResp(l *StoreResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteMkdirReq(l *MkdirReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktMkdir)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktMkdir, l)
 }
 
 func (t *Transiever) GetMkdirReq(l *MkdirReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteMkdirResp(l *MkdirResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktMkdirResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktMkdirResp, l)
 }
 
 func (t *Transiever) GetMkdirResp(l *MkdirResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteDeleteReq(l *DeleteReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktDelete)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktDelete, l)
 }
 
 func (t *Transiever) GetDeleteReq(l *DeleteReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteDeleteResp(l *DeleteResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktDeleteResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktDeleteResp, l)
 }
 
 func (t *Transiever) GetDeleteResp(l *DeleteResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteWriteReq(l *WriteReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktWrite)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktWrite, l)
 }
 
 func (t *Transiever) GetWriteReq(l *WriteReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteWriteResp(l *WriteResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktWriteResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktWriteResp, l)
 }
 
 func (t *Transiever) GetWriteResp(l *WriteResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteReadReq(l *ReadReq) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktRead)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktRead, l)
 }
 
 func (t *Transiever) GetReadReq(l *ReadReq) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
 }
 
 func (t *Transiever) WriteReadResp(l *ReadResp) error {
-	t.sendLock.Lock()
-	defer t.sendLock.Unlock()
-
-	err := t.packetEncoder.Encode(PktReadResp)
-	if err != nil {
-		return err
-	}
-	return t.packetEncoder.Encode(l)
+	return t.send(PktReadResp, l)
 }
 
 func (t *Transiever) GetReadResp(l *ReadResp) error {
-	return t.packetDecoder.Decode(l)
+	return t.receive(l)
+}
+
+// WriteCreateReq writes a Create RPC packet to the remote end.
+func (t *Transiever) WriteCreateReq(l *CreateReq) error {
+	return t.send(PktCreate, l)
+}
+
+// GetCreateReq decodes a CreateReq packet from the network.
+func (t *Transiever) GetCreateReq(l *CreateReq) error {
+	return t.receive(l)
+}
+
+// WriteCreateResp writes a CreateResp RPC packet to the remote end.
+func (t *Transiever) WriteCreateResp(l *CreateResp) error {
+	return t.send(PktCreateResp, l)
+}
+
+// GetCreateResp decodes a CreateResp packet from the network.
+func (t *Transiever) GetCreateResp(l *CreateResp) error {
+	return t.receive(l)
+}
+
+// WriteSetattrReq writes a Setattr RPC packet to the remote end.
+func (t *Transiever) WriteSetattrReq(l *SetattrReq) error {
+	return t.send(PktSetattr, l)
+}
+
+// GetSetattrReq decodes a SetattrReq packet from the network.
+func (t *Transiever) GetSetattrReq(l *SetattrReq) error {
+	return t.receive(l)
+}
+
+// WriteSetattrResp writes a SetattrResp RPC packet to the remote end.
+func (t *Transiever) WriteSetattrResp(l *SetattrResp) error {
+	return t.send(PktSetattrResp, l)
+}
+
+// GetSetattrResp decodes a SetattrResp packet from the network.
+func (t *Transiever) GetSetattrResp(l *SetattrResp) error {
+	return t.receive(l)
+}
+
+// WriteRenameReq writes a Rename RPC packet to the remote end.
+func (t *Transiever) WriteRenameReq(l *RenameReq) error {
+	return t.send(PktRename, l)
+}
+
+// GetRenameReq decodes a RenameReq packet from the network.
+func (t *Transiever) GetRenameReq(l *RenameReq) error {
+	return t.receive(l)
+}
+
+// WriteRenameResp writes a RenameResp RPC packet to the remote end.
+func (t *Transiever) WriteRenameResp(l *RenameResp) error {
+	return t.send(PktRenameResp, l)
+}
+
+// GetRenameResp decodes a RenameResp packet from the network.
+func (t *Transiever) GetRenameResp(l *RenameResp) error {
+	return t.receive(l)
+}
+
+// WriteSymlinkReq writes a Symlink RPC packet to the remote end.
+func (t *Transiever) WriteSymlinkReq(l *SymlinkReq) error {
+	return t.send(PktSymlink, l)
+}
+
+// GetSymlinkReq decodes a SymlinkReq packet from the network.
+func (t *Transiever) GetSymlinkReq(l *SymlinkReq) error {
+	return t.receive(l)
+}
+
+// WriteSymlinkResp writes a SymlinkResp RPC packet to the remote end.
+func (t *Transiever) WriteSymlinkResp(l *SymlinkResp) error {
+	return t.send(PktSymlinkResp, l)
+}
+
+// GetSymlinkResp decodes a SymlinkResp packet from the network.
+func (t *Transiever) GetSymlinkResp(l *SymlinkResp) error {
+	return t.receive(l)
+}
+
+// WriteReadlinkReq writes a Readlink RPC packet to the remote end.
+func (t *Transiever) WriteReadlinkReq(l *ReadlinkReq) error {
+	return t.send(PktReadlink, l)
+}
+
+// GetReadlinkReq decodes a ReadlinkReq packet from the network.
+func (t *Transiever) GetReadlinkReq(l *ReadlinkReq) error {
+	return t.receive(l)
+}
+
+// WriteReadlinkResp writes a ReadlinkResp RPC packet to the remote end.
+func (t *Transiever) WriteReadlinkResp(l *ReadlinkResp) error {
+	return t.send(PktReadlinkResp, l)
+}
+
+// GetReadlinkResp decodes a ReadlinkResp packet from the network.
+func (t *Transiever) GetReadlinkResp(l *ReadlinkResp) error {
+	return t.receive(l)
+}
+
+// WriteLinkReq writes a Link RPC packet to the remote end.
+func (t *Transiever) WriteLinkReq(l *LinkReq) error {
+	return t.send(PktLink, l)
+}
+
+// GetLinkReq decodes a LinkReq packet from the network.
+func (t *Transiever) GetLinkReq(l *LinkReq) error {
+	return t.receive(l)
+}
+
+// WriteLinkResp writes a LinkResp RPC packet to the remote end.
+func (t *Transiever) WriteLinkResp(l *LinkResp) error {
+	return t.send(PktLinkResp, l)
+}
+
+// GetLinkResp decodes a LinkResp packet from the network.
+func (t *Transiever) GetLinkResp(l *LinkResp) error {
+	return t.receive(l)
+}
+
+// WriteGetxattrReq writes a Getxattr RPC packet to the remote end.
+func (t *Transiever) WriteGetxattrReq(l *GetxattrReq) error {
+	return t.send(PktGetxattr, l)
+}
+
+// GetGetxattrReq decodes a GetxattrReq packet from the network.
+func (t *Transiever) GetGetxattrReq(l *GetxattrReq) error {
+	return t.receive(l)
+}
+
+// WriteGetxattrResp writes a GetxattrResp RPC packet to the remote end.
+func (t *Transiever) WriteGetxattrResp(l *GetxattrResp) error {
+	return t.send(PktGetxattrResp, l)
+}
+
+// GetGetxattrResp decodes a GetxattrResp packet from the network.
+func (t *Transiever) GetGetxattrResp(l *GetxattrResp) error {
+	return t.receive(l)
+}
+
+// WriteListxattrReq writes a Listxattr RPC packet to the remote end.
+func (t *Transiever) WriteListxattrReq(l *ListxattrReq) error {
+	return t.send(PktListxattr, l)
+}
+
+// GetListxattrReq decodes a ListxattrReq packet from the network.
+func (t *Transiever) GetListxattrReq(l *ListxattrReq) error {
+	return t.receive(l)
+}
+
+// WriteListxattrResp writes a ListxattrResp RPC packet to the remote end.
+func (t *Transiever) WriteListxattrResp(l *ListxattrResp) error {
+	return t.send(PktListxattrResp, l)
+}
+
+// GetListxattrResp decodes a ListxattrResp packet from the network.
+func (t *Transiever) GetListxattrResp(l *ListxattrResp) error {
+	return t.receive(l)
+}
+
+// WriteSetxattrReq writes a Setxattr RPC packet to the remote end.
+func (t *Transiever) WriteSetxattrReq(l *SetxattrReq) error {
+	return t.send(PktSetxattr, l)
+}
+
+// GetSetxattrReq decodes a SetxattrReq packet from the network.
+func (t *Transiever) GetSetxattrReq(l *SetxattrReq) error {
+	return t.receive(l)
+}
+
+// WriteSetxattrResp writes a SetxattrResp RPC packet to the remote end.
+func (t *Transiever) WriteSetxattrResp(l *SetxattrResp) error {
+	return t.send(PktSetxattrResp, l)
+}
+
+// GetSetxattrResp decodes a SetxattrResp packet from the network.
+func (t *Transiever) GetSetxattrResp(l *SetxattrResp) error {
+	return t.receive(l)
+}
+
+// WriteRemovexattrReq writes a Removexattr RPC packet to the remote end.
+func (t *Transiever) WriteRemovexattrReq(l *RemovexattrReq) error {
+	return t.send(PktRemovexattr, l)
+}
+
+// GetRemovexattrReq decodes a RemovexattrReq packet from the network.
+func (t *Transiever) GetRemovexattrReq(l *RemovexattrReq) error {
+	return t.receive(l)
+}
+
+// WriteRemovexattrResp writes a RemovexattrResp RPC packet to the remote end.
+func (t *Transiever) WriteRemovexattrResp(l *RemovexattrResp) error {
+	return t.send(PktRemovexattrResp, l)
+}
+
+// GetRemovexattrResp decodes a RemovexattrResp packet from the network.
+func (t *Transiever) GetRemovexattrResp(l *RemovexattrResp) error {
+	return t.receive(l)
+}
+
+// WriteRemoveAllReq writes a RemoveAll RPC packet to the remote end.
+func (t *Transiever) WriteRemoveAllReq(l *RemoveAllReq) error {
+	return t.send(PktRemoveAll, l)
+}
+
+// GetRemoveAllReq decodes a RemoveAllReq packet from the network.
+func (t *Transiever) GetRemoveAllReq(l *RemoveAllReq) error {
+	return t.receive(l)
+}
+
+// WriteRemoveAllResp writes a RemoveAllResp RPC packet to the remote end.
+func (t *Transiever) WriteRemoveAllResp(l *RemoveAllResp) error {
+	return t.send(PktRemoveAllResp, l)
+}
+
+// GetRemoveAllResp decodes a RemoveAllResp packet from the network.
+func (t *Transiever) GetRemoveAllResp(l *RemoveAllResp) error {
+	return t.receive(l)
+}
+
+// WriteStatfsReq writes a Statfs RPC packet to the remote end.
+func (t *Transiever) WriteStatfsReq(l *StatfsReq) error {
+	return t.send(PktStatfs, l)
+}
+
+// GetStatfsReq decodes a StatfsReq packet from the network.
+func (t *Transiever) GetStatfsReq(l *StatfsReq) error {
+	return t.receive(l)
+}
+
+// WriteStatfsResp writes a StatfsResp RPC packet to the remote end.
+func (t *Transiever) WriteStatfsResp(l *StatfsResp) error {
+	return t.send(PktStatfsResp, l)
+}
+
+// GetStatfsResp decodes a StatfsResp packet from the network.
+func (t *Transiever) GetStatfsResp(l *StatfsResp) error {
+	return t.receive(l)
+}
+
+// WriteHello writes a Hello packet to the remote end.
+func (t *Transiever) WriteHello(h *Hello) error {
+	return t.send(PktHello, h)
+}
+
+// GetHello decodes a Hello packet from the network.
+func (t *Transiever) GetHello(h *Hello) error {
+	return t.receive(h)
+}
+
+// WriteHelloResp writes the response to a Hello packet to the remote end.
+func (t *Transiever) WriteHelloResp(h *HelloResp) error {
+	return t.send(PktHelloResp, h)
+}
+
+// GetHelloResp decodes a HelloResp packet from the network.
+func (t *Transiever) GetHelloResp(h *HelloResp) error {
+	return t.receive(h)
+}
+
+// WriteFetchStreamReq writes a FetchStream RPC packet to the remote end.
+func (t *Transiever) WriteFetchStreamReq(l *FetchStreamReq) error {
+	return t.send(PktFetchStream, l)
+}
+
+// GetFetchStreamReq decodes a FetchStreamReq packet from the network.
+func (t *Transiever) GetFetchStreamReq(l *FetchStreamReq) error {
+	return t.receive(l)
+}
+
+// WriteFetchStreamResp writes a FetchStreamResp RPC packet to the remote end.
+func (t *Transiever) WriteFetchStreamResp(l *FetchStreamResp) error {
+	return t.send(PktFetchStreamResp, l)
+}
+
+// GetFetchStreamResp decodes a FetchStreamResp packet from the network.
+func (t *Transiever) GetFetchStreamResp(l *FetchStreamResp) error {
+	return t.receive(l)
+}
+
+// WriteStoreStreamReq writes a StoreStream RPC packet to the remote end.
+func (t *Transiever) WriteStoreStreamReq(l *StoreStreamReq) error {
+	return t.send(PktStoreStream, l)
+}
+
+// GetStoreStreamReq decodes a StoreStreamReq packet from the network.
+func (t *Transiever) GetStoreStreamReq(l *StoreStreamReq) error {
+	return t.receive(l)
+}
+
+// WriteStoreStreamResp writes a StoreStreamResp RPC packet to the remote end.
+func (t *Transiever) WriteStoreStreamResp(l *StoreStreamResp) error {
+	return t.send(PktStoreStreamResp, l)
+}
+
+// GetStoreStreamResp decodes a StoreStreamResp packet from the network.
+func (t *Transiever) GetStoreStreamResp(l *StoreStreamResp) error {
+	return t.receive(l)
+}
+
+// WriteStreamData writes a StreamData packet to the remote end.
+func (t *Transiever) WriteStreamData(d *StreamData) error {
+	return t.send(PktStreamData, d)
+}
+
+// GetStreamData decodes a StreamData packet from the network.
+func (t *Transiever) GetStreamData(d *StreamData) error {
+	return t.receive(d)
+}
+
+// WriteStreamAck writes a StreamAck packet to the remote end.
+func (t *Transiever) WriteStreamAck(a *StreamAck) error {
+	return t.send(PktStreamAck, a)
+}
+
+// GetStreamAck decodes a StreamAck packet from the network.
+func (t *Transiever) GetStreamAck(a *StreamAck) error {
+	return t.receive(a)
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/twitchyliquid64/nugget"
+	"github.com/twitchyliquid64/nugget/nuggdb"
 )
 
 func TestTransieverEncodesDecodesPingCorrectly(t *testing.T) {
@@ -288,6 +289,76 @@ func TestTransieverEncodesDecodesListRPCResponseCorrectly(t *testing.T) {
 	}
 }
 
+func TestTransieverEncodesDecodesListPageRPCCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteListPageReq(&ListPageReq{ID: 455243, Path: "/cat", Cursor: "6b6974", Limit: 50})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if dataChannel.Len() <= 0 {
+		t.Error("Expected data to be written")
+	}
+
+	var out ListPageReq
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktListPage {
+		t.Error("Expected PktListPage packet type")
+	}
+
+	err = transiever.GetListPageReq(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Path != "/cat" || out.Cursor != "6b6974" || out.Limit != 50 {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesListPageRPCResponseCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteListPageResp(&ListPageResp{ID: 455243, Entries: []nuggdb.DirEntry{{Name: "/cat/kitten"}}, NextCursor: "6b6974"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if dataChannel.Len() <= 0 {
+		t.Error("Expected data to be written")
+	}
+
+	var out ListPageResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktListPageResp {
+		t.Error("Expected PktListPageResp packet type")
+	}
+
+	err = transiever.GetListPageResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || len(out.Entries) != 1 || out.Entries[0].Name != "/cat/kitten" || out.NextCursor != "6b6974" {
+		t.Error("Incorrect packet value")
+	}
+}
+
 func TestTransieverEncodesDecodesFetchRPCCorrectly(t *testing.T) {
 	var dataChannel bytes.Buffer
 	transiever := MakeTransiever(&dataChannel, &dataChannel)
@@ -357,3 +428,453 @@ func TestTransieverEncodesDecodesFetchRPCResponseCorrectly(t *testing.T) {
 		t.Error("Incorrect packet value")
 	}
 }
+
+func TestTransieverEncodesDecodesCreateRPCCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteCreateReq(&CreateReq{ID: 455243, Path: "/new", Attr: nugget.NodeAttributes{Mode: 0640, UID: 1000, GID: 100}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if dataChannel.Len() <= 0 {
+		t.Error("Expected data to be written")
+	}
+
+	var out CreateReq
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktCreate {
+		t.Error("Expected PktCreate packet type")
+	}
+
+	err = transiever.GetCreateReq(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Path != "/new" || out.Attr.Mode != 0640 || out.Attr.UID != 1000 || out.Attr.GID != 100 {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesReadMetaRPCResponseAttributesCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	mtime := time.Date(2016, 2, 2, 4, 1, 0, 0, time.UTC)
+	err := transiever.WriteReadMetaResp(&ReadMetaResp{ID: 455243, Meta: nuggdb.EntryMetadata{Mode: 0600, UID: 1000, GID: 50, Mtime: mtime}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out ReadMetaResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktReadMetaResp {
+		t.Error("Expected PktReadMetaResp packet type")
+	}
+
+	err = transiever.GetReadMetaResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.Meta.Mode != 0600 || out.Meta.UID != 1000 || out.Meta.GID != 50 || !out.Meta.Mtime.Equal(mtime) {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesSetattrRPCCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteSetattrReq(&SetattrReq{ID: 455243, Path: "/trunc", Changes: nugget.AttrChanges{Valid: nugget.AttrSize | nugget.AttrMode, Size: 42, Mode: 0600}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if dataChannel.Len() <= 0 {
+		t.Error("Expected data to be written")
+	}
+
+	var out SetattrReq
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktSetattr {
+		t.Error("Expected PktSetattr packet type")
+	}
+
+	err = transiever.GetSetattrReq(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Path != "/trunc" || out.Changes.Valid != nugget.AttrSize|nugget.AttrMode || out.Changes.Size != 42 || out.Changes.Mode != 0600 {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesRenameRPCCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteRenameReq(&RenameReq{ID: 455243, OldPath: "/a", NewPath: "/b/c"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if dataChannel.Len() <= 0 {
+		t.Error("Expected data to be written")
+	}
+
+	var out RenameReq
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktRename {
+		t.Error("Expected PktRename packet type")
+	}
+
+	err = transiever.GetRenameReq(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.OldPath != "/a" || out.NewPath != "/b/c" {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesSymlinkRPCCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteSymlinkReq(&SymlinkReq{ID: 455243, Path: "/cat", Target: "../dog", Attr: nugget.NodeAttributes{UID: 1000}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out SymlinkReq
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktSymlink {
+		t.Error("Expected PktSymlink packet type")
+	}
+
+	err = transiever.GetSymlinkReq(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Path != "/cat" || out.Target != "../dog" || out.Attr.UID != 1000 {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesReadlinkRPCResponseCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteReadlinkResp(&ReadlinkResp{ID: 455243, Target: "../dog"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out ReadlinkResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktReadlinkResp {
+		t.Error("Expected PktReadlinkResp packet type")
+	}
+
+	err = transiever.GetReadlinkResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Target != "../dog" {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesLinkRPCResponseCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteLinkResp(&LinkResp{ID: 455243, EntryID: nugget.EntryID{4}, Meta: nuggdb.EntryMetadata{Nlink: 2}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out LinkResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktLinkResp {
+		t.Error("Expected PktLinkResp packet type")
+	}
+
+	err = transiever.GetLinkResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.EntryID != (nugget.EntryID{4}) || out.Meta.Nlink != 2 {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesSetxattrRPCCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteSetxattrReq(&SetxattrReq{ID: 455243, Path: "/cat", Name: "user.kind", Value: []byte("tabby"), Flags: 1})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out SetxattrReq
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktSetxattr {
+		t.Error("Expected PktSetxattr packet type")
+	}
+
+	err = transiever.GetSetxattrReq(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Path != "/cat" || out.Name != "user.kind" || string(out.Value) != "tabby" || out.Flags != 1 {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesListxattrRPCResponseCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteListxattrResp(&ListxattrResp{ID: 455243, ErrorCode: ErrNoAttribute, Names: []string{"user.a", "user.b"}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out ListxattrResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktListxattrResp {
+		t.Error("Expected PktListxattrResp packet type")
+	}
+
+	err = transiever.GetListxattrResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || len(out.Names) != 2 || out.Names[1] != "user.b" || ErrorCodeToErr(out.ErrorCode) != nuggdb.ErrXattrNotFound {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesRemoveAllRPCResponseCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteRemoveAllResp(&RemoveAllResp{ID: 455243, ErrorCode: ErrDirNotEmpty})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out RemoveAllResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktRemoveAllResp {
+		t.Error("Expected PktRemoveAllResp packet type")
+	}
+
+	err = transiever.GetRemoveAllResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || ErrorCodeToErr(out.ErrorCode) != nuggdb.ErrNotEmpty {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesStatfsRPCResponseCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteStatfsResp(&StatfsResp{ID: 455243, Stats: nugget.FSStats{TotalBytes: 1000, FreeBytes: 400, Entries: 7, ChunkBytes: 321}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var out StatfsResp
+	pktType, err := transiever.Decode()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if pktType != PktStatfsResp {
+		t.Error("Expected PktStatfsResp packet type")
+	}
+
+	err = transiever.GetStatfsResp(&out)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if out.ID != 455243 || out.Stats != (nugget.FSStats{TotalBytes: 1000, FreeBytes: 400, Entries: 7, ChunkBytes: 321}) {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverEncodesDecodesHelloCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	err := transiever.WriteHello(&Hello{Version: ProtocolVersion, Packets: LegacyPackets})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = transiever.WriteHelloResp(&HelloResp{Version: ProtocolVersion, Packets: []PktType{PktPing, PktStatfs}, MaxMessageSize: DefaultMaxMessageSize, MaxListPageSize: MaxListPageSize})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var hello Hello
+	pktType, err := transiever.Decode()
+	if err != nil || pktType != PktHello {
+		t.Fatal("Expected PktHello packet type, got", pktType, err)
+	}
+	if err = transiever.GetHello(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != ProtocolVersion || len(hello.Packets) != len(LegacyPackets) {
+		t.Error("Incorrect packet value")
+	}
+
+	var helloResp HelloResp
+	pktType, err = transiever.Decode()
+	if err != nil || pktType != PktHelloResp {
+		t.Fatal("Expected PktHelloResp packet type, got", pktType, err)
+	}
+	if err = transiever.GetHelloResp(&helloResp); err != nil {
+		t.Fatal(err)
+	}
+	if helloResp.Version != ProtocolVersion || len(helloResp.Packets) != 2 || helloResp.Packets[1] != PktStatfs ||
+		helloResp.MaxMessageSize != DefaultMaxMessageSize || helloResp.MaxListPageSize != MaxListPageSize {
+		t.Error("Incorrect packet value")
+	}
+}
+
+func TestTransieverDiscardsUnknownPackets(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+
+	transiever.WriteStatfsReq(&StatfsReq{ID: 1})
+	transiever.WriteLookupReq(&LookupReq{ID: 2, Path: "/a"})
+
+	if _, err := transiever.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if err := transiever.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	pktType, err := transiever.Decode()
+	if err != nil || pktType != PktLookup {
+		t.Fatal("Expected PktLookup packet type, got", pktType, err)
+	}
+	var out LookupReq
+	if err = transiever.GetLookupReq(&out); err != nil || out.ID != 2 || out.Path != "/a" {
+		t.Error("Incorrect packet value", out, err)
+	}
+}
+
+func TestTransieverEncodesDecodesStreamPacketsCorrectly(t *testing.T) {
+	var dataChannel bytes.Buffer
+	transiever := MakeTransiever(&dataChannel, &dataChannel)
+	transiever.UseFrames(0)
+
+	transiever.WriteStoreStreamReq(&StoreStreamReq{ID: 3, Path: "/a", Offset: 10, Truncate: true})
+	transiever.WriteStreamData(&StreamData{ID: 3, Seq: 1, Data: []byte("abc"), EOF: true})
+	transiever.WriteStreamAck(&StreamAck{ID: 3, Bytes: 3})
+
+	var req StoreStreamReq
+	if pktType, err := transiever.Decode(); err != nil || pktType != PktStoreStream {
+		t.Fatal("Expected PktStoreStream packet type, got", pktType, err)
+	}
+	if err := transiever.GetStoreStreamReq(&req); err != nil || req.ID != 3 || req.Path != "/a" || req.Offset != 10 || !req.Truncate {
+		t.Error("Incorrect packet value", req, err)
+	}
+	var data StreamData
+	if pktType, err := transiever.Decode(); err != nil || pktType != PktStreamData {
+		t.Fatal("Expected PktStreamData packet type, got", pktType, err)
+	}
+	if err := transiever.GetStreamData(&data); err != nil || data.Seq != 1 || string(data.Data) != "abc" || !data.EOF {
+		t.Error("Incorrect packet value", data, err)
+	}
+	var ack StreamAck
+	if pktType, err := transiever.Decode(); err != nil || pktType != PktStreamAck {
+		t.Fatal("Expected PktStreamAck packet type, got", pktType, err)
+	}
+	if err := transiever.GetStreamAck(&ack); err != nil || ack.ID != 3 || ack.Bytes != 3 || ack.Cancel {
+		t.Error("Incorrect packet value", ack, err)
+	}
+}
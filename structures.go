@@ -1,5 +1,11 @@
 package nugget
 
+import (
+	"io"
+	"os"
+	"time"
+)
+
 // Remote supports the representation of remote filesystems, and implements data exchange
 
 // ChunkID uniquely represents a data chunk
@@ -14,6 +20,95 @@ type OptimisedDataSourceSink interface {
 	Read(fPath string, offset int64, size int64) ([]byte, error)
 }
 
+// SetattrDataSink implements optional methods for changing the attributes of existing files/directories.
+type SetattrDataSink interface {
+	Setattr(fPath string, changes AttrChanges) (EntryID, NodeMetadata, error)
+}
+
+// SymlinkDataSink implements optional methods for creating and reading symbolic links.
+type SymlinkDataSink interface {
+	Symlink(path, target string, attr NodeAttributes) (EntryID, NodeMetadata, error)
+	Readlink(path string) (string, error)
+}
+
+// StreamDataSink implements optional methods for storing files too large to hold in memory. StoreFrom
+// replaces the contents of the file at path with the data read from r, switching to the new contents only
+// once all of it has been read, so a failure part way leaves the file as it was.
+type StreamDataSink interface {
+	StoreFrom(path string, r io.Reader) (EntryID, NodeMetadata, error)
+}
+
+// StreamDataSource implements optional methods for reading files too large to hold in memory. FetchReader
+// returns a reader for at most size bytes of the file at path from offset, or the rest of the file if size
+// is negative, which must be closed once done with.
+type StreamDataSource interface {
+	FetchReader(path string, offset, size int64) (io.ReadCloser, error)
+}
+
+// LinkDataSink implements optional methods for giving an existing file another name.
+type LinkDataSink interface {
+	Link(oldPath, newPath string) (EntryID, NodeMetadata, error)
+}
+
+// RemoveAllDataSink implements optional methods for deleting a directory and everything beneath it.
+type RemoveAllDataSink interface {
+	RemoveAll(path string) error
+}
+
+// StatfsDataSource implements optional methods for reporting the capacity and usage of a filesystem.
+type StatfsDataSource interface {
+	Statfs() (FSStats, error)
+}
+
+// XattrDataSink implements optional methods for reading and writing the extended attributes of
+// existing files/directories.
+type XattrDataSink interface {
+	Getxattr(path, name string) ([]byte, error)
+	Listxattr(path string) ([]string, error)
+	Setxattr(path, name string, value []byte, flags uint32) error
+	Removexattr(path, name string) error
+}
+
+// ClientDataSourceSink implements optional methods for attributing changes to the client making them.
+// ForClient returns a view of the provider which creates entries on behalf of client, so they count
+// against the quota of that client.
+type ClientDataSourceSink interface {
+	ForClient(client string) DataSourceSink
+}
+
+// PagedDataSource implements optional methods for listing large directories a page at a time.
+// ListPage returns up to limit entries following the position described by cursor, along with
+// the cursor for the next page. An empty cursor starts at the beginning of the directory, and an
+// empty next cursor is returned once the listing is complete.
+type PagedDataSource interface {
+	ListPage(path string, cursor string, limit int) ([]DirEntry, string, error)
+}
+
+// AttrChangeMask selects which fields of an AttrChanges should be applied.
+type AttrChangeMask uint32
+
+// Attribute change flags
+const (
+	AttrMode AttrChangeMask = 1 << iota
+	AttrUID
+	AttrGID
+	AttrSize
+	AttrAtime
+	AttrMtime
+)
+
+// AttrChanges represents a set of changes to the attributes of a file/directory.
+// Only the fields selected by Valid are applied.
+type AttrChanges struct {
+	Valid AttrChangeMask
+	Mode  os.FileMode //permission bits only
+	UID   uint32
+	GID   uint32
+	Size  uint64
+	Atime time.Time
+	Mtime time.Time
+}
+
 // DataSource represents entities who can be queried about filesystem objects.
 type DataSource interface {
 	Lookup(path string) (EntryID, error)
@@ -26,8 +121,10 @@ type DataSource interface {
 // DataSink represents entities who can accept data writes.
 type DataSink interface {
 	Store(path string, data []byte) (EntryID, NodeMetadata, error)
-	Mkdir(path string) (EntryID, NodeMetadata, error)
+	Create(path string, attr NodeAttributes) (EntryID, NodeMetadata, error)
+	Mkdir(path string, attr NodeAttributes) (EntryID, NodeMetadata, error)
 	Delete(path string) error
+	Rename(oldPath, newPath string) error
 	Close() error
 }
 
@@ -42,9 +139,25 @@ type DataSourceSink interface {
 type NodeMetadata interface {
 	ID() EntryID
 	IsDirectory() bool
+	IsSymlink() bool
 	LocalName() string //No path information
+	GetNlink() uint32
 	GetSize() uint64
 	GetDataLocality() LocalityInfo //represents where the data is actually stored
+	GetMode() os.FileMode          //permission bits only
+	GetUID() uint32
+	GetGID() uint32
+	GetAtime() time.Time
+	GetMtime() time.Time
+	GetCtime() time.Time
+	GetCrtime() time.Time
+}
+
+// NodeAttributes represents the ownership and permissions given to a new file/directory.
+type NodeAttributes struct {
+	Mode os.FileMode //permission bits only
+	UID  uint32
+	GID  uint32
 }
 
 // LocalityInfo represents information about the concrete location of data.
@@ -58,4 +171,14 @@ type LocalityInfo interface {
 type DirEntry interface {
 	Identifier() string
 	IsDirectory() bool
+	IsSymlink() bool
+	ID() EntryID // the zero EntryID if not known
+}
+
+// FSStats describes the capacity and usage of the storage behind a provider.
+type FSStats struct {
+	TotalBytes uint64 // size of the volume holding the data
+	FreeBytes  uint64 // bytes available on that volume
+	Entries    uint64 // number of files, directories and links stored
+	ChunkBytes uint64 // bytes held by stored chunks
 }